@@ -0,0 +1,839 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cniplugin is the "Multi-plugin" of the multus binary. The delegate
+// concept refered from CNI project. It reads other plugin netconf, and then
+// invoke them, e.g. flannel or sriov plugin.
+package cniplugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containernetworking/cni/libcni"
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/containernetworking/cni/pkg/skel"
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	cniversion "github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/ns"
+	k8s "github.com/intel/multus-cni/k8sclient"
+	"github.com/intel/multus-cni/logging"
+	"github.com/intel/multus-cni/sandbox"
+	"github.com/intel/multus-cni/types"
+	"github.com/vishvananda/netlink"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+var defaultReadinessBackoff = wait.Backoff{
+	Steps:    4,
+	Duration: 250 * time.Millisecond,
+	Factor:   4.0,
+	Jitter:   0.1,
+}
+
+var defaultCNIVer = "0.3.1"
+
+func saveScratchNetConf(containerID, dataDir string, netconf []byte) error {
+	logging.Debugf("saveScratchNetConf: %s, %s, %s", containerID, dataDir, string(netconf))
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return logging.Errorf("failed to create the multus data directory(%q): %v", dataDir, err)
+	}
+
+	path := filepath.Join(dataDir, containerID)
+
+	err := ioutil.WriteFile(path, netconf, 0600)
+	if err != nil {
+		return logging.Errorf("failed to write container data in the path(%q): %v", path, err)
+	}
+
+	return err
+}
+
+func consumeScratchNetConf(containerID, dataDir string) ([]byte, string, error) {
+	logging.Debugf("consumeScratchNetConf: %s, %s", containerID, dataDir)
+	path := filepath.Join(dataDir, containerID)
+
+	b, err := ioutil.ReadFile(path)
+	return b, path, err
+}
+
+func getIfname(delegate *types.DelegateNetConf, argif string, idx int) string {
+	logging.Debugf("getIfname: %v, %s, %d", delegate, argif, idx)
+	if delegate.IfnameRequest != "" {
+		return delegate.IfnameRequest
+	}
+	if delegate.MasterPlugin {
+		// master plugin always uses the CNI-provided interface name
+		return argif
+	}
+
+	// Otherwise construct a unique interface name from the delegate's
+	// position in the delegate list
+	return fmt.Sprintf("eth%d", idx)
+}
+
+func getIfnameHw(delegate *types.DelegateNetConf, argif string, idx int) string {
+	logging.Debugf("getIfnameHw: %v, %s, %d", delegate, argif, idx)
+	if delegate.MasterPlugin || (idx == 0) {
+		// master plugin always uses the CNI-provided interface name
+		return "net0"
+	}
+
+	// Otherwise construct a unique interface name from the delegate's
+	// position in the delegate list
+	return fmt.Sprintf("eth%d", idx-1)
+}
+
+func saveDelegates(containerID, dataDir string, delegates []*types.DelegateNetConf) error {
+	logging.Debugf("saveDelegates: %s, %s, %v", containerID, dataDir, delegates)
+	delegatesBytes, err := json.Marshal(delegates)
+	if err != nil {
+		return logging.Errorf("error serializing delegate netconf: %v", err)
+	}
+
+	if err = saveScratchNetConf(containerID, dataDir, delegatesBytes); err != nil {
+		return logging.Errorf("error in saving the delegates : %v", err)
+	}
+
+	return err
+}
+
+func deleteDelegates(containerID, dataDir string) error {
+	logging.Debugf("deleteDelegates: %s, %s", containerID, dataDir)
+
+	path := filepath.Join(dataDir, containerID)
+	if err := os.Remove(path); err != nil {
+		return logging.Errorf("error in deleting the delegates : %v", err)
+	}
+
+	return nil
+}
+
+func validateIfName(nsname string, ifname string) error {
+	logging.Debugf("validateIfName: %s, %s", nsname, ifname)
+	podNs, err := ns.GetNS(nsname)
+	if err != nil {
+		// the delegate reports the netns which does not exist
+		if _, ok := err.(ns.NSPathNotExistErr); ok {
+			logging.Debugf("validateIfName: netns %s does not exist, skip it", nsname)
+			return nil
+		}
+		return logging.Errorf("no netns: %v", err)
+	}
+	defer podNs.Close()
+
+	err = podNs.Do(func(_ ns.NetNS) error {
+		_, err := netlink.LinkByName(ifname)
+		if err != nil {
+			if err.Error() == "Link not found" {
+				return nil
+			}
+			return err
+		}
+		return logging.Errorf("ifname %s is already exist", ifname)
+	})
+
+	return err
+}
+
+func conflistAdd(rt *libcni.RuntimeConf, rawnetconflist []byte, cniPath, binDir string, exec invoke.Exec) (cnitypes.Result, error) {
+	logging.Debugf("conflistAdd: %v, %s, %s, %s", rt, string(rawnetconflist), cniPath, binDir)
+	// In part, adapted from K8s pkg/kubelet/dockershim/network/cni/cni.go
+	binDirs := filepath.SplitList(cniPath)
+	binDirs = append(binDirs, binDir)
+	cniNet := libcni.NewCNIConfig(binDirs, exec)
+
+	confList, err := libcni.ConfListFromBytes(rawnetconflist)
+	if err != nil {
+		return nil, logging.Errorf("error in converting the raw bytes to conflist: %v", err)
+	}
+
+	result, err := cniNet.AddNetworkList(context.Background(), confList, rt)
+	if err != nil {
+		return nil, logging.Errorf("error in getting result from AddNetworkList: %v", err)
+	}
+
+	return result, nil
+}
+
+func conflistDel(rt *libcni.RuntimeConf, rawnetconflist []byte, cniPath, binDir string, exec invoke.Exec) error {
+	logging.Debugf("conflistDel: %v, %s, %s, %s", rt, string(rawnetconflist), cniPath, binDir)
+	// In part, adapted from K8s pkg/kubelet/dockershim/network/cni/cni.go
+	binDirs := filepath.SplitList(cniPath)
+	binDirs = append(binDirs, binDir)
+	cniNet := libcni.NewCNIConfig(binDirs, exec)
+
+	confList, err := libcni.ConfListFromBytes(rawnetconflist)
+	if err != nil {
+		return logging.Errorf("error in converting the raw bytes to conflist: %v", err)
+	}
+
+	if confList.CNIVersion == "" {
+		confList.CNIVersion = defaultCNIVer
+	}
+
+	err = cniNet.DelNetworkList(context.Background(), confList, rt)
+	if err != nil {
+		return logging.Errorf("error in getting result from DelNetworkList: %v", err)
+	}
+
+	return err
+}
+
+func conflistCheck(rt *libcni.RuntimeConf, rawnetconflist []byte, cniPath, binDir string, exec invoke.Exec) error {
+	logging.Debugf("conflistCheck: %v, %s, %s, %s", rt, string(rawnetconflist), cniPath, binDir)
+	binDirs := filepath.SplitList(cniPath)
+	binDirs = append(binDirs, binDir)
+	cniNet := libcni.NewCNIConfig(binDirs, exec)
+
+	confList, err := libcni.ConfListFromBytes(rawnetconflist)
+	if err != nil {
+		return logging.Errorf("error in converting the raw bytes to conflist: %v", err)
+	}
+
+	if confList.CNIVersion == "" {
+		confList.CNIVersion = defaultCNIVer
+	}
+	if !supportsCheck(confList.CNIVersion) {
+		logging.Verbosef("Check: %s has version %q without CHECK, skip it", confList.Name, confList.CNIVersion)
+		return nil
+	}
+
+	// the plugins get the result cached by libcni on ADD as prevResult
+	err = cniNet.CheckNetworkList(context.Background(), confList, rt)
+	if err != nil {
+		return logging.Errorf("error in getting result from CheckNetworkList: %v", err)
+	}
+
+	return nil
+}
+
+// supportsCheck tells whether the CNI version has the CHECK command, added in
+// 0.4.0
+func supportsCheck(cniVersion string) bool {
+	gtet, err := cniversion.GreaterThanOrEqualTo(cniVersion, "0.4.0")
+	return err == nil && gtet
+}
+
+// pluginArgs returns the environment of the plugin of a delegate for the CNI
+// command, taken from rt and not from this process, so the interface name and
+// the args of one delegate are never seen by another one
+func pluginArgs(command string, rt *libcni.RuntimeConf, cniPath string) *invoke.Args {
+	return &invoke.Args{
+		Command:     command,
+		ContainerID: rt.ContainerID,
+		NetNS:       rt.NetNS,
+		PluginArgs:  rt.Args,
+		IfName:      rt.IfName,
+		Path:        cniPath,
+	}
+}
+
+func findPlugin(exec invoke.Exec, plugin, cniPath string) (string, error) {
+	paths := filepath.SplitList(cniPath)
+	if exec == nil {
+		return invoke.FindInPath(plugin, paths)
+	}
+	return exec.FindInPath(plugin, paths)
+}
+
+// validateRequests checks the MAC and IP requested for delegate
+func validateRequests(delegate *types.DelegateNetConf) error {
+	if err := types.CheckRequests(delegate.MacRequest, delegate.IPRequest); err != nil {
+		return logging.Errorf("%v", err)
+	}
+	return nil
+}
+
+func delegateAdd(exec invoke.Exec, ifName string, delegate *types.DelegateNetConf, rt *libcni.RuntimeConf, cniPath, binDir string) (cnitypes.Result, error) {
+	logging.Debugf("delegateAdd: %v, %s, %v, %v, %s, %s", exec, ifName, delegate, rt, cniPath, binDir)
+	if err := validateIfName(rt.NetNS, ifName); err != nil {
+		return nil, logging.Errorf("cannot set %q ifname to %q: %v", delegate.Conf.Type, ifName, err)
+	}
+
+	if err := validateRequests(delegate); err != nil {
+		return nil, err
+	}
+
+	var result cnitypes.Result
+	var err error
+	if delegate.ConfListPlugin {
+		result, err = conflistAdd(rt, delegate.Bytes, cniPath, binDir, exec)
+		if err != nil {
+			return nil, logging.Errorf("Multus: error in invoke Conflist add - %q: %v", delegate.ConfList.Name, err)
+		}
+	} else {
+		var pluginPath string
+		pluginPath, err = findPlugin(exec, delegate.Conf.Type, cniPath)
+		if err == nil {
+			result, err = invoke.ExecPluginWithResult(context.Background(), pluginPath, delegate.Bytes, pluginArgs("ADD", rt, cniPath), exec)
+		}
+		if err != nil {
+			return nil, logging.Errorf("Multus: error in invoke Delegate add - %q: %v", delegate.Conf.Type, err)
+		}
+	}
+
+	if logging.GetLoggingLevel() >= logging.VerboseLevel {
+		data, _ := json.Marshal(result)
+		var confName string
+		if delegate.ConfListPlugin {
+			confName = delegate.ConfList.Name
+		} else {
+			confName = delegate.Conf.Name
+		}
+
+		logging.Verbosef("Add: %s:%s:%s:%s %s", rt.Args[1][1], rt.Args[2][1], confName, rt.IfName, string(data))
+	}
+
+	return result, nil
+}
+
+func delegateDel(exec invoke.Exec, ifName string, delegateConf *types.DelegateNetConf, rt *libcni.RuntimeConf, cniPath, binDir string) error {
+	logging.Debugf("delegateDel: %v, %s, %v, %v, %s, %s", exec, ifName, delegateConf, rt, cniPath, binDir)
+	if logging.GetLoggingLevel() >= logging.VerboseLevel {
+		var confName string
+		if delegateConf.ConfListPlugin {
+			confName = delegateConf.ConfList.Name
+		} else {
+			confName = delegateConf.Conf.Name
+		}
+		logging.Verbosef("Del: %s:%s:%s:%s %s", rt.Args[1][1], rt.Args[2][1], confName, rt.IfName, string(delegateConf.Bytes))
+	}
+
+	var err error
+	if delegateConf.ConfListPlugin {
+		err = conflistDel(rt, delegateConf.Bytes, cniPath, binDir, exec)
+		if err != nil {
+			return logging.Errorf("Multus: error in invoke Conflist Del - %q: %v", delegateConf.ConfList.Name, err)
+		}
+	} else {
+		var pluginPath string
+		pluginPath, err = findPlugin(exec, delegateConf.Conf.Type, cniPath)
+		if err == nil {
+			err = invoke.ExecPluginWithoutResult(context.Background(), pluginPath, delegateConf.Bytes, pluginArgs("DEL", rt, cniPath), exec)
+		}
+		if err != nil {
+			return logging.Errorf("Multus: error in invoke Delegate del - %q: %v", delegateConf.Conf.Type, err)
+		}
+	}
+
+	return err
+}
+
+func delegateCheck(exec invoke.Exec, ifName string, delegateConf *types.DelegateNetConf, rt *libcni.RuntimeConf, cniPath, binDir string) error {
+	logging.Debugf("delegateCheck: %v, %s, %v, %v, %s, %s", exec, ifName, delegateConf, rt, cniPath, binDir)
+	if delegateConf.ConfListPlugin {
+		if err := conflistCheck(rt, delegateConf.Bytes, cniPath, binDir, exec); err != nil {
+			return logging.Errorf("Multus: error in invoke Conflist Check - %q: %v", delegateConf.ConfList.Name, err)
+		}
+		return nil
+	}
+
+	if !supportsCheck(delegateConf.Conf.CNIVersion) {
+		logging.Verbosef("Check: %s has version %q without CHECK, skip it", delegateConf.Conf.Name, delegateConf.Conf.CNIVersion)
+		return nil
+	}
+	if len(delegateConf.Result) == 0 {
+		// added by a version which did not cache the results
+		logging.Verbosef("Check: %s has no result cached on ADD, skip it", delegateConf.Conf.Name)
+		return nil
+	}
+
+	// the plugin gets its result on ADD as prevResult, as libcni does
+	err := func() error {
+		result, err := types.LoadDelegateResult(delegateConf)
+		if err != nil {
+			return err
+		}
+		prevResult, err := result.GetAsVersion(delegateConf.Conf.CNIVersion)
+		if err != nil {
+			return err
+		}
+		conf, err := libcni.ConfFromBytes(delegateConf.Bytes)
+		if err != nil {
+			return err
+		}
+		conf, err = libcni.InjectConf(conf, map[string]interface{}{"prevResult": prevResult})
+		if err != nil {
+			return err
+		}
+		pluginPath, err := findPlugin(exec, delegateConf.Conf.Type, cniPath)
+		if err != nil {
+			return err
+		}
+		return invoke.ExecPluginWithoutResult(context.Background(), pluginPath, conf.Bytes, pluginArgs("CHECK", rt, cniPath), exec)
+	}()
+	if err != nil {
+		return logging.Errorf("Multus: error in invoke Delegate check - %q: %v", delegateConf.Conf.Type, err)
+	}
+	return nil
+}
+
+func delPlugins(exec invoke.Exec, args *skel.CmdArgs, k8sArgs *types.K8sArgs, delegates []*types.DelegateNetConf, lastIdx int, rc *types.RuntimeConfig, binDir string) error {
+	logging.Debugf("delPlugins: %v, %v, %v, %v, %d, %v, %s", exec, args, k8sArgs, delegates, lastIdx, rc, binDir)
+
+	var errorstrings []string
+	for idx := lastIdx; idx >= 0; idx-- {
+		ifName := getIfname(delegates[idx], args.IfName, idx)
+		rt := types.CreateCNIRuntimeConf(args, k8sArgs, ifName, rc, delegates[idx])
+		// Attempt to delete all but do not error out, instead, collect all errors.
+		if err := delegateDel(exec, ifName, delegates[idx], rt, args.Path, binDir); err != nil {
+			errorstrings = append(errorstrings, err.Error())
+		}
+	}
+
+	// Check if we had any errors, and send them all back.
+	if len(errorstrings) > 0 {
+		return fmt.Errorf(strings.Join(errorstrings, " / "))
+	}
+
+	return nil
+}
+
+// addDelegates adds the master plugin, then the other delegates in parallel,
+// at most n.MaxParallelDelegates at a time. The results are in the order of
+// the delegates. If a delegate fails, no other one is started and all the
+// delegates started are deleted.
+func addDelegates(exec invoke.Exec, args *skel.CmdArgs, k8sArgs *types.K8sArgs, n *types.NetConf) ([]cnitypes.Result, error) {
+	ifNames := map[string]int{}
+	for idx, delegate := range n.Delegates {
+		ifName := getIfname(delegate, args.IfName, idx)
+		if prev, ok := ifNames[ifName]; ok {
+			return nil, logging.Errorf("Multus: delegates %d and %d have the same interface name %q", prev, idx, ifName)
+		}
+		ifNames[ifName] = idx
+	}
+
+	results := make([]cnitypes.Result, len(n.Delegates))
+	errs := make([]error, len(n.Delegates))
+	add := func(idx int) {
+		delegate := n.Delegates[idx]
+		ifName := getIfname(delegate, args.IfName, idx)
+		rt := types.CreateCNIRuntimeConf(args, k8sArgs, ifName, n.RuntimeConfig, delegate)
+		results[idx], errs[idx] = delegateAdd(exec, ifName, delegate, rt, args.Path, n.BinDir)
+	}
+
+	// the master plugin sets up the pod network the others may rely on
+	first := 0
+	if len(n.Delegates) > 0 && n.Delegates[0].MasterPlugin {
+		add(0)
+		first = 1
+	}
+	lastIdx := first - 1
+	if lastIdx < 0 || errs[lastIdx] == nil {
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		failed := false
+		slots := make(chan struct{}, n.MaxParallelDelegates)
+		for idx := first; idx < len(n.Delegates); idx++ {
+			slots <- struct{}{}
+			mu.Lock()
+			stop := failed
+			mu.Unlock()
+			if stop {
+				<-slots
+				break
+			}
+			lastIdx = idx
+			wg.Add(1)
+			go func(idx int) {
+				defer wg.Done()
+				add(idx)
+				if errs[idx] != nil {
+					mu.Lock()
+					failed = true
+					mu.Unlock()
+				}
+				<-slots
+			}(idx)
+		}
+		wg.Wait()
+	}
+
+	for idx := 0; idx <= lastIdx; idx++ {
+		if errs[idx] == nil {
+			continue
+		}
+		// If the add failed, tear down all networks we already added
+		netName := n.Delegates[idx].Conf.Name
+		if netName == "" {
+			netName = n.Delegates[idx].ConfList.Name
+		}
+		// Ignore errors; DEL must be idempotent anyway
+		_ = delPlugins(exec, args, k8sArgs, n.Delegates, lastIdx, n.RuntimeConfig, n.BinDir)
+		return nil, logging.Errorf("Multus: Err adding pod to network %q: %v", netName, errs[idx])
+	}
+	return results, nil
+}
+
+// saveSandbox caches the delegates, and the sandbox of the pod for the
+// hot-plug agent of multus-daemon to change its networks
+func saveSandbox(args *skel.CmdArgs, k8sArgs *types.K8sArgs, n *types.NetConf) error {
+	lk, err := sandbox.Lock(n.CNIDir)
+	if err != nil {
+		return logging.Errorf("Multus: Err in locking the sandboxes: %v", err)
+	}
+	defer lk.Close()
+
+	if err := saveDelegates(args.ContainerID, n.CNIDir, n.Delegates); err != nil {
+		return logging.Errorf("Multus: Err in saving the delegates: %v", err)
+	}
+	if k8sArgs.K8S_POD_NAME == "" {
+		return nil
+	}
+	err = sandbox.Save(n.CNIDir, string(k8sArgs.K8S_POD_NAMESPACE), string(k8sArgs.K8S_POD_NAME), &sandbox.Sandbox{
+		ContainerID: args.ContainerID,
+		NetNS:       args.Netns,
+		IfName:      args.IfName,
+		Args:        args.Args,
+		NetConf:     args.StdinData,
+	})
+	if err != nil {
+		return logging.Errorf("Multus: Err in saving the sandbox: %v", err)
+	}
+	return nil
+}
+
+// CmdAdd adds the delegates of the pod and returns the result of the master
+// plugin. exec and kubeClient are nil but in tests and multus-daemon.
+func CmdAdd(args *skel.CmdArgs, exec invoke.Exec, kubeClient k8s.KubeClient) (cnitypes.Result, error) {
+	n, err := types.LoadNetConf(args.StdinData)
+	logging.Debugf("CmdAdd: %v, %v, %v", args, exec, kubeClient)
+	if err != nil {
+		return nil, logging.Errorf("err in loading netconf: %v", err)
+	}
+
+	k8sArgs, err := k8s.GetK8sArgs(args)
+	if err != nil {
+		return nil, logging.Errorf("Multus: Err in getting k8s args: %v", err)
+	}
+
+	wait.ExponentialBackoff(defaultReadinessBackoff, func() (bool, error) {
+		_, err := os.Stat(n.ReadinessIndicatorFile)
+		switch {
+		case err == nil:
+			return true, nil
+		default:
+			return false, nil
+		}
+	})
+
+	if n.ClusterNetwork != "" {
+		err = k8s.GetDefaultNetworks(k8sArgs, n, kubeClient)
+		if err != nil {
+			return nil, logging.Errorf("Multus: Failed to get clusterNetwork/defaultNetworks: %v", err)
+		}
+		// First delegate is always the master plugin
+		n.Delegates[0].MasterPlugin = true
+	}
+
+	_, kc, err := k8s.TryLoadPodDelegates(k8sArgs, n, kubeClient)
+	if err != nil {
+		return nil, logging.Errorf("Multus: Err in loading K8s Delegates k8s args: %v", err)
+	}
+
+	// cache the multus config
+	if err := saveDelegates(args.ContainerID, n.CNIDir, n.Delegates); err != nil {
+		return nil, logging.Errorf("Multus: Err in saving the delegates: %v", err)
+	}
+
+	results, err := addDelegates(exec, args, k8sArgs, n)
+	if err != nil {
+		return nil, err
+	}
+
+	// cache the results too, they are the prevResult of the delegates on CHECK
+	for idx, delegate := range n.Delegates {
+		if delegate.Result, err = json.Marshal(results[idx]); err != nil {
+			return nil, logging.Errorf("Multus: Err in serializing the result of %q: %v", delegate.Conf.Name, err)
+		}
+	}
+	if err := saveSandbox(args, k8sArgs, n); err != nil {
+		return nil, err
+	}
+
+	var result cnitypes.Result
+	var netStatus []*types.NetworkStatus
+	for idx, delegate := range n.Delegates {
+		tmpResult := results[idx]
+
+		// Master plugin result is always used if present
+		if delegate.MasterPlugin || result == nil {
+			result = tmpResult
+		}
+
+		//create the network status, only in case Multus as kubeconfig
+		if n.Kubeconfig != "" && kc != nil {
+			if !types.CheckSystemNamespaces(kc.Podnamespace, n.SystemNamespaces) {
+				delegateNetStatus, err := types.LoadDelegateNetworkStatus(tmpResult, delegate)
+				if err != nil {
+					return nil, logging.Errorf("Multus: Err in setting network status: %v", err)
+				}
+
+				netStatus = append(netStatus, delegateNetStatus)
+			}
+		}
+	}
+
+	//set the network status annotation in apiserver, only in case Multus as kubeconfig
+	if n.Kubeconfig != "" && kc != nil {
+		if !types.CheckSystemNamespaces(kc.Podnamespace, n.SystemNamespaces) {
+			err = k8s.SetNetworkStatus(kubeClient, k8sArgs, netStatus, n)
+			if err != nil {
+				return nil, logging.Errorf("Multus: Err set the networks status: %v", err)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// loadDelegates loads the delegates cached on ADD into in
+func loadDelegates(netconfBytes []byte, in *types.NetConf) error {
+	delegates, err := types.LoadCachedDelegates(netconfBytes)
+	if err != nil {
+		return logging.Errorf("Multus: %v", err)
+	}
+	in.Delegates = delegates
+	return nil
+}
+
+// checkNetworkStatus checks the network status of the pod annotation is the
+// one of the results of the delegates
+func checkNetworkStatus(kubeClient k8s.KubeClient, k8sArgs *types.K8sArgs, in *types.NetConf) error {
+	annotStatus, err := k8s.GetNetworkStatus(kubeClient, k8sArgs, in)
+	if err != nil {
+		return err
+	}
+	if annotStatus == nil {
+		return nil
+	}
+
+	var netStatus []*types.NetworkStatus
+	for _, delegate := range in.Delegates {
+		if len(delegate.Result) == 0 {
+			logging.Verbosef("Check: %s has no result cached on ADD, skip the network status", delegate.Conf.Name)
+			return nil
+		}
+		result, err := types.LoadDelegateResult(delegate)
+		if err != nil {
+			return logging.Errorf("Multus: Err in loading the result of %q: %v", delegate.Conf.Name, err)
+		}
+		delegateNetStatus, err := types.LoadDelegateNetworkStatus(result, delegate)
+		if err != nil {
+			return logging.Errorf("Multus: Err in setting network status: %v", err)
+		}
+		netStatus = append(netStatus, delegateNetStatus)
+	}
+
+	if len(annotStatus) != len(netStatus) {
+		return logging.Errorf("Multus: the pod annotation has the status of %d networks, the delegates report %d", len(annotStatus), len(netStatus))
+	}
+	var errorstrings []string
+	for idx := range netStatus {
+		status := *netStatus[idx]
+		if legacyNetworkStatus(annotStatus[idx]) {
+			status.Gateway, status.Routes, status.FixedIP, status.VNI, status.DeviceID = nil, nil, false, 0, ""
+		}
+		annot, _ := json.Marshal(annotStatus[idx])
+		reported, _ := json.Marshal(&status)
+		if string(annot) != string(reported) {
+			errorstrings = append(errorstrings, fmt.Sprintf("network %q has status %s in the pod annotation, the delegate reports %s",
+				netStatus[idx].Name, annot, reported))
+		}
+	}
+	if len(errorstrings) > 0 {
+		return logging.Errorf("Multus: %s", strings.Join(errorstrings, " / "))
+	}
+	return nil
+}
+
+// legacyNetworkStatus tells whether s may have been written before the
+// gateway, routes, fixed ip, VNI and device ID were added to the status, they
+// are not compared then
+func legacyNetworkStatus(s *types.NetworkStatus) bool {
+	return len(s.Gateway) == 0 && len(s.Routes) == 0 && !s.FixedIP && s.VNI == 0 && s.DeviceID == ""
+}
+
+// CmdCheck checks every delegate cached on ADD, and the network status of the
+// pod annotation. The errors of all the networks are returned together.
+func CmdCheck(args *skel.CmdArgs, exec invoke.Exec, kubeClient k8s.KubeClient) error {
+	logging.Debugf("CmdCheck: %v, %v, %v", args, exec, kubeClient)
+	in, err := types.LoadNetConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	k8sArgs, err := k8s.GetK8sArgs(args)
+	if err != nil {
+		return logging.Errorf("Multus: Err in getting k8s args: %v", err)
+	}
+
+	netconfBytes, _, err := consumeScratchNetConf(args.ContainerID, in.CNIDir)
+	if err != nil {
+		return logging.Errorf("Multus: Err in reading the delegates: %v", err)
+	}
+	if err := loadDelegates(netconfBytes, in); err != nil {
+		return err
+	}
+
+	// set CNIVersion in delegate CNI config if there is no CNIVersion and multus conf have CNIVersion.
+	for _, v := range in.Delegates {
+		if v.ConfListPlugin == true && v.ConfList.CNIVersion == "" && in.CNIVersion != "" {
+			v.ConfList.CNIVersion = in.CNIVersion
+			v.Bytes, err = json.Marshal(v.ConfList)
+		}
+	}
+
+	var errorstrings []string
+	for idx, delegate := range in.Delegates {
+		ifName := getIfname(delegate, args.IfName, idx)
+		rt := types.CreateCNIRuntimeConf(args, k8sArgs, ifName, in.RuntimeConfig, delegate)
+		// Check all the delegates, and collect the errors of each network
+		if err := delegateCheck(exec, ifName, delegate, rt, args.Path, in.BinDir); err != nil {
+			netName := delegate.Conf.Name
+			if netName == "" {
+				netName = delegate.ConfList.Name
+			}
+			errorstrings = append(errorstrings, fmt.Sprintf("network %q: %v", netName, err))
+		}
+	}
+
+	// check the network status annotation in apiserver, only in case Multus as kubeconfig
+	if in.Kubeconfig != "" && !types.CheckSystemNamespaces(string(k8sArgs.K8S_POD_NAMESPACE), in.SystemNamespaces) {
+		if err := checkNetworkStatus(kubeClient, k8sArgs, in); err != nil {
+			errorstrings = append(errorstrings, err.Error())
+		}
+	}
+
+	if len(errorstrings) > 0 {
+		return fmt.Errorf("%s", strings.Join(errorstrings, " / "))
+	}
+
+	return nil
+}
+
+// CmdDel deletes the delegates added on ADD
+func CmdDel(args *skel.CmdArgs, exec invoke.Exec, kubeClient k8s.KubeClient) error {
+	logging.Debugf("CmdDel: %v, %v, %v", args, exec, kubeClient)
+	in, err := types.LoadNetConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	netnsfound := true
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		// if NetNs is passed down by the Cloud Orchestration Engine, or if it called multiple times
+		// so don't return an error if the device is already removed.
+		// https://github.com/kubernetes/kubernetes/issues/43014#issuecomment-287164444
+		_, ok := err.(ns.NSPathNotExistErr)
+		if ok {
+			netnsfound = false
+			logging.Debugf("CmdDel: WARNING netns may not exist, netns: %s, err: %s", args.Netns, err)
+		} else {
+			return fmt.Errorf("failed to open netns %q: %v", netns, err)
+		}
+	}
+
+	if netns != nil {
+		defer netns.Close()
+	}
+
+	k8sArgs, err := k8s.GetK8sArgs(args)
+	if err != nil {
+		return logging.Errorf("Multus: Err in getting k8s args: %v", err)
+	}
+
+	// Read the cache to get delegates json for the pod, the hot-plug agent
+	// of multus-daemon does not change it once it is read
+	lk, lkErr := sandbox.Lock(in.CNIDir)
+	if lkErr != nil {
+		logging.Errorf("Multus: Err in locking the sandboxes: %v, but continue to delete", lkErr)
+	}
+	netconfBytes, path, err := consumeScratchNetConf(args.ContainerID, in.CNIDir)
+	if err == nil {
+		os.Remove(path)
+	}
+	if k8sArgs.K8S_POD_NAME != "" {
+		if err := sandbox.Remove(in.CNIDir, string(k8sArgs.K8S_POD_NAMESPACE), string(k8sArgs.K8S_POD_NAME), args.ContainerID); err != nil {
+			logging.Errorf("Multus: Err in removing the sandbox: %v", err)
+		}
+	}
+	if lk != nil {
+		lk.Close()
+	}
+	if err != nil {
+		// Fetch delegates again if cache is not exist
+		if os.IsNotExist(err) {
+			if in.ClusterNetwork != "" {
+				err = k8s.GetDefaultNetworks(k8sArgs, in, kubeClient)
+				if err != nil {
+					return logging.Errorf("Multus: Failed to get clusterNetwork/defaultNetworks: %v", err)
+				}
+				// First delegate is always the master plugin
+				in.Delegates[0].MasterPlugin = true
+			}
+
+			// Get pod annotation and so on
+			_, _, err := k8s.TryLoadPodDelegates(k8sArgs, in, kubeClient)
+			if err != nil {
+				if len(in.Delegates) == 0 {
+					// No delegate available so send error
+					return logging.Errorf("Multus: failed to get delegates: %v", err)
+				}
+				// Get clusterNetwork before, so continue to delete
+				logging.Errorf("Multus: failed to get delegates: %v, but continue to delete clusterNetwork", err)
+			}
+		} else {
+			return logging.Errorf("Multus: Err in reading the delegates: %v", err)
+		}
+	} else {
+		if err := loadDelegates(netconfBytes, in); err != nil {
+			return err
+		}
+	}
+
+	// set CNIVersion in delegate CNI config if there is no CNIVersion and multus conf have CNIVersion.
+	for _, v := range in.Delegates {
+		if v.ConfListPlugin == true && v.ConfList.CNIVersion == "" && in.CNIVersion != "" {
+			v.ConfList.CNIVersion = in.CNIVersion
+			v.Bytes, err = json.Marshal(v.ConfList)
+		}
+	}
+
+	// unset the network status annotation in apiserver, only in case Multus as kubeconfig
+	if in.Kubeconfig != "" {
+		if netnsfound {
+			if !types.CheckSystemNamespaces(string(k8sArgs.K8S_POD_NAMESPACE), in.SystemNamespaces) {
+				err := k8s.SetNetworkStatus(kubeClient, k8sArgs, nil, in)
+				if err != nil {
+					// error happen but continue to delete
+					logging.Errorf("Multus: Err unset the networks status: %v", err)
+				}
+			}
+		} else {
+			logging.Debugf("WARNING: Unset SetNetworkStatus skipped due to netns not found.")
+		}
+	}
+
+	return delPlugins(exec, args, k8sArgs, in.Delegates, len(in.Delegates)-1, in.RuntimeConfig, in.BinDir)
+}
@@ -13,7 +13,7 @@
 // limitations under the License.
 //
 
-package main
+package cniplugin
 
 import (
 	"context"
@@ -24,11 +24,14 @@ import (
 	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	cnitypes "github.com/containernetworking/cni/pkg/types"
 	types020 "github.com/containernetworking/cni/pkg/types/020"
+	"github.com/containernetworking/cni/pkg/types/current"
 	cniversion "github.com/containernetworking/cni/pkg/version"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/containernetworking/plugins/pkg/testutils"
@@ -52,17 +55,26 @@ type fakePlugin struct {
 	expectedIfname string
 	result         cnitypes.Result
 	err            error
+	// gate is called before the plugin returns
+	gate func()
+	// checkErr is returned on CHECK, prevResult is the one given on CHECK
+	checkErr   error
+	prevResult string
 }
 
 type fakeExec struct {
 	cniversion.PluginDecoder
 
-	addIndex int
-	delIndex int
-	plugins  []*fakePlugin
+	mu         sync.Mutex
+	addIndex   int
+	delIndex   int
+	checkIndex int
+	added      map[int]bool
+	checked    map[int]bool
+	plugins    []*fakePlugin
 }
 
-func (f *fakeExec) addPlugin(expectedEnv []string, expectedIfname, expectedConf string, result *types020.Result, err error) {
+func (f *fakeExec) addPlugin(expectedEnv []string, expectedIfname, expectedConf string, result cnitypes.Result, err error) {
 	f.plugins = append(f.plugins, &fakePlugin{
 		expectedEnv:    expectedEnv,
 		expectedConf:   expectedConf,
@@ -87,12 +99,11 @@ func matchArray(a1, a2 []string) {
 	}
 }
 
-// When faking plugin execution the ExecPlugin() call environ is not populated
-// (while it would be for real exec). Filter the environment variables for
+// Filter the environment variables the plugin is called with for
 // CNI-specific ones that testcases will care about.
-func gatherCNIEnv() []string {
+func gatherCNIEnv(environ []string) []string {
 	filtered := make([]string, 0)
-	for _, env := range os.Environ() {
+	for _, env := range environ {
 		if strings.HasPrefix(env, "CNI_") {
 			filtered = append(filtered, env)
 		}
@@ -100,14 +111,56 @@ func gatherCNIEnv() []string {
 	return filtered
 }
 
+func getEnv(environ []string, key string) string {
+	for _, env := range environ {
+		if strings.HasPrefix(env, key+"=") {
+			return strings.TrimPrefix(env, key+"=")
+		}
+	}
+	return ""
+}
+
+// next returns the first plugin not done yet, with the interface name ifName
+// if any, the delegates after the master plugin are added in parallel
+func (f *fakeExec) next(done map[int]bool, ifName string) int {
+	index := -1
+	for i, plugin := range f.plugins {
+		if done[i] {
+			continue
+		}
+		if plugin.expectedIfname == ifName {
+			index = i
+			break
+		}
+		if index < 0 {
+			index = i
+		}
+	}
+	Expect(index).To(BeNumerically(">=", 0))
+	done[index] = true
+	return index
+}
+
 func (f *fakeExec) ExecPlugin(ctx context.Context, pluginPath string, stdinData []byte, environ []string) ([]byte, error) {
-	cmd := os.Getenv("CNI_COMMAND")
+	// delegates are added from other goroutines
+	defer GinkgoRecover()
+
+	cmd := getEnv(environ, "CNI_COMMAND")
 	var index int
+	f.mu.Lock()
 	switch cmd {
 	case "ADD":
-		Expect(len(f.plugins)).To(BeNumerically(">", f.addIndex))
-		index = f.addIndex
+		if f.added == nil {
+			f.added = map[int]bool{}
+		}
+		index = f.next(f.added, getEnv(environ, "CNI_IFNAME"))
 		f.addIndex++
+	case "CHECK":
+		if f.checked == nil {
+			f.checked = map[int]bool{}
+		}
+		index = f.next(f.checked, getEnv(environ, "CNI_IFNAME"))
+		f.checkIndex++
 	case "DEL":
 		Expect(len(f.plugins)).To(BeNumerically(">", f.delIndex))
 		index = len(f.plugins) - f.delIndex - 1
@@ -116,24 +169,44 @@ func (f *fakeExec) ExecPlugin(ctx context.Context, pluginPath string, stdinData
 		// Should never be reached
 		Expect(false).To(BeTrue())
 	}
+	f.mu.Unlock()
 	plugin := f.plugins[index]
 
 	GinkgoT().Logf("[%s %d] exec plugin %q found %+v\n", cmd, index, pluginPath, plugin)
 
+	// libcni gives prevResult on DEL too from 0.4.0
+	conf := map[string]interface{}{}
+	if err := json.Unmarshal(stdinData, &conf); err == nil && conf["prevResult"] != nil {
+		if cmd == "CHECK" {
+			prevResult, err := json.Marshal(conf["prevResult"])
+			Expect(err).NotTo(HaveOccurred())
+			plugin.prevResult = string(prevResult)
+		}
+		delete(conf, "prevResult")
+		stdinData, err = json.Marshal(conf)
+		Expect(err).NotTo(HaveOccurred())
+	}
 	if plugin.expectedConf != "" {
 		Expect(string(stdinData)).To(MatchJSON(plugin.expectedConf))
 	}
 	if plugin.expectedIfname != "" {
-		Expect(os.Getenv("CNI_IFNAME")).To(Equal(plugin.expectedIfname))
+		Expect(getEnv(environ, "CNI_IFNAME")).To(Equal(plugin.expectedIfname))
 	}
 
 	if len(plugin.expectedEnv) > 0 {
-		cniEnv := gatherCNIEnv()
+		cniEnv := gatherCNIEnv(environ)
 		for _, expectedCniEnvVar := range plugin.expectedEnv {
 			Expect(cniEnv).Should(ContainElement(expectedCniEnvVar))
 		}
 	}
 
+	if plugin.gate != nil {
+		plugin.gate()
+	}
+
+	if cmd == "CHECK" {
+		return nil, plugin.checkErr
+	}
 	if plugin.err != nil {
 		return nil, plugin.err
 	}
@@ -157,8 +230,6 @@ var _ = Describe("multus operations", func() {
 		var err error
 		testNS, err = testutils.NewNS()
 		Expect(err).NotTo(HaveOccurred())
-		os.Setenv("CNI_NETNS", testNS.Path())
-		os.Setenv("CNI_PATH", "/some/path")
 
 		tmpDir, err = ioutil.TempDir("", "multus_tmp")
 		Expect(err).NotTo(HaveOccurred())
@@ -166,7 +237,6 @@ var _ = Describe("multus operations", func() {
 
 	AfterEach(func() {
 		Expect(testNS.Close()).To(Succeed())
-		os.Unsetenv("CNI_PATH")
 		os.Unsetenv("CNI_ARGS")
 		err := os.RemoveAll(tmpDir)
 		Expect(err).NotTo(HaveOccurred())
@@ -175,6 +245,7 @@ var _ = Describe("multus operations", func() {
 	It("executes delegates", func() {
 		args := &skel.CmdArgs{
 			ContainerID: "123456789",
+			Path:        "/some/path",
 			Netns:       testNS.Path(),
 			IfName:      "eth0",
 			StdinData: []byte(`{
@@ -229,7 +300,7 @@ var _ = Describe("multus operations", func() {
 
 		os.Setenv("CNI_COMMAND", "ADD")
 		os.Setenv("CNI_IFNAME", "eth0")
-		result, err := cmdAdd(args, fExec, nil)
+		result, err := CmdAdd(args, fExec, nil)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(fExec.addIndex).To(Equal(len(fExec.plugins)))
 		r := result.(*types020.Result)
@@ -238,7 +309,7 @@ var _ = Describe("multus operations", func() {
 
 		os.Setenv("CNI_COMMAND", "DEL")
 		os.Setenv("CNI_IFNAME", "eth0")
-		err = cmdDel(args, fExec, nil)
+		err = CmdDel(args, fExec, nil)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(fExec.delIndex).To(Equal(len(fExec.plugins)))
 
@@ -252,6 +323,7 @@ var _ = Describe("multus operations", func() {
 	It("executes delegates given faulty namespace", func() {
 		args := &skel.CmdArgs{
 			ContainerID: "123456789",
+			Path:        "/some/path",
 			Netns:       "fsdadfad",
 			IfName:      "eth0",
 			StdinData: []byte(`{
@@ -305,7 +377,7 @@ var _ = Describe("multus operations", func() {
 
 		os.Setenv("CNI_COMMAND", "ADD")
 		os.Setenv("CNI_IFNAME", "eth0")
-		result, err := cmdAdd(args, fExec, nil)
+		result, err := CmdAdd(args, fExec, nil)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(fExec.addIndex).To(Equal(len(fExec.plugins)))
 		r := result.(*types020.Result)
@@ -314,7 +386,7 @@ var _ = Describe("multus operations", func() {
 
 		os.Setenv("CNI_COMMAND", "DEL")
 		os.Setenv("CNI_IFNAME", "eth0")
-		err = cmdDel(args, fExec, nil)
+		err = CmdDel(args, fExec, nil)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(fExec.delIndex).To(Equal(len(fExec.plugins)))
 
@@ -325,9 +397,10 @@ var _ = Describe("multus operations", func() {
 		}
 	})
 
-	It("returns the previous result using cmdGet", func() {
+	It("checks the delegates using CmdCheck", func() {
 		args := &skel.CmdArgs{
 			ContainerID: "123456789",
+			Path:        "/some/path",
 			Netns:       testNS.Path(),
 			IfName:      "eth0",
 			StdinData: []byte(`{
@@ -382,19 +455,19 @@ var _ = Describe("multus operations", func() {
 
 		os.Setenv("CNI_COMMAND", "ADD")
 		os.Setenv("CNI_IFNAME", "eth0")
-		result, err := cmdAdd(args, fExec, nil)
+		result, err := CmdAdd(args, fExec, nil)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(fExec.addIndex).To(Equal(len(fExec.plugins)))
 		r := result.(*types020.Result)
 		// plugin 1 is the masterplugin
 		Expect(reflect.DeepEqual(r, expectedResult1)).To(BeTrue())
 
-		result, err = cmdGet(args, fExec, nil)
+		err = CmdCheck(args, fExec, nil)
 		Expect(err).NotTo(HaveOccurred())
 
 		os.Setenv("CNI_COMMAND", "DEL")
 		os.Setenv("CNI_IFNAME", "eth0")
-		err = cmdDel(args, fExec, nil)
+		err = CmdDel(args, fExec, nil)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(fExec.delIndex).To(Equal(len(fExec.plugins)))
 
@@ -408,6 +481,7 @@ var _ = Describe("multus operations", func() {
 	It("executes delegates given faulty namespace", func() {
 		args := &skel.CmdArgs{
 			ContainerID: "123456789",
+			Path:        "/some/path",
 			Netns:       "fsdadfad",
 			IfName:      "eth0",
 			StdinData: []byte(`{
@@ -461,7 +535,7 @@ var _ = Describe("multus operations", func() {
 
 		os.Setenv("CNI_COMMAND", "ADD")
 		os.Setenv("CNI_IFNAME", "eth0")
-		result, err := cmdAdd(args, fExec, nil)
+		result, err := CmdAdd(args, fExec, nil)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(fExec.addIndex).To(Equal(len(fExec.plugins)))
 		r := result.(*types020.Result)
@@ -470,7 +544,7 @@ var _ = Describe("multus operations", func() {
 
 		os.Setenv("CNI_COMMAND", "DEL")
 		os.Setenv("CNI_IFNAME", "eth0")
-		err = cmdDel(args, fExec, nil)
+		err = CmdDel(args, fExec, nil)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(fExec.delIndex).To(Equal(len(fExec.plugins)))
 
@@ -481,9 +555,10 @@ var _ = Describe("multus operations", func() {
 		}
 	})
 
-	It("returns the previous result using cmdGet", func() {
+	It("checks the delegates using CmdCheck", func() {
 		args := &skel.CmdArgs{
 			ContainerID: "123456789",
+			Path:        "/some/path",
 			Netns:       testNS.Path(),
 			IfName:      "eth0",
 			StdinData: []byte(`{
@@ -538,19 +613,19 @@ var _ = Describe("multus operations", func() {
 
 		os.Setenv("CNI_COMMAND", "ADD")
 		os.Setenv("CNI_IFNAME", "eth0")
-		result, err := cmdAdd(args, fExec, nil)
+		result, err := CmdAdd(args, fExec, nil)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(fExec.addIndex).To(Equal(len(fExec.plugins)))
 		r := result.(*types020.Result)
 		// plugin 1 is the masterplugin
 		Expect(reflect.DeepEqual(r, expectedResult1)).To(BeTrue())
 
-		result, err = cmdGet(args, fExec, nil)
+		err = CmdCheck(args, fExec, nil)
 		Expect(err).NotTo(HaveOccurred())
 
 		os.Setenv("CNI_COMMAND", "DEL")
 		os.Setenv("CNI_IFNAME", "eth0")
-		err = cmdDel(args, fExec, nil)
+		err = CmdDel(args, fExec, nil)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(fExec.delIndex).To(Equal(len(fExec.plugins)))
 
@@ -564,6 +639,7 @@ var _ = Describe("multus operations", func() {
 	It("executes delegates given faulty namespace", func() {
 		args := &skel.CmdArgs{
 			ContainerID: "123456789",
+			Path:        "/some/path",
 			Netns:       "fsdadfad",
 			IfName:      "eth0",
 			StdinData: []byte(`{
@@ -618,7 +694,7 @@ var _ = Describe("multus operations", func() {
 
 		os.Setenv("CNI_COMMAND", "ADD")
 		os.Setenv("CNI_IFNAME", "eth0")
-		result, err := cmdAdd(args, fExec, nil)
+		result, err := CmdAdd(args, fExec, nil)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(fExec.addIndex).To(Equal(len(fExec.plugins)))
 		r := result.(*types020.Result)
@@ -627,7 +703,7 @@ var _ = Describe("multus operations", func() {
 
 		os.Setenv("CNI_COMMAND", "DEL")
 		os.Setenv("CNI_IFNAME", "eth0")
-		err = cmdDel(args, fExec, nil)
+		err = CmdDel(args, fExec, nil)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(fExec.delIndex).To(Equal(len(fExec.plugins)))
 
@@ -638,9 +714,10 @@ var _ = Describe("multus operations", func() {
 		}
 	})
 
-	It("returns the previous result using cmdGet", func() {
+	It("checks the delegates using CmdCheck", func() {
 		args := &skel.CmdArgs{
 			ContainerID: "123456789",
+			Path:        "/some/path",
 			Netns:       testNS.Path(),
 			IfName:      "eth0",
 			StdinData: []byte(`{
@@ -695,19 +772,19 @@ var _ = Describe("multus operations", func() {
 
 		os.Setenv("CNI_COMMAND", "ADD")
 		os.Setenv("CNI_IFNAME", "eth0")
-		result, err := cmdAdd(args, fExec, nil)
+		result, err := CmdAdd(args, fExec, nil)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(fExec.addIndex).To(Equal(len(fExec.plugins)))
 		r := result.(*types020.Result)
 		// plugin 1 is the masterplugin
 		Expect(reflect.DeepEqual(r, expectedResult1)).To(BeTrue())
 
-		result, err = cmdGet(args, fExec, nil)
+		err = CmdCheck(args, fExec, nil)
 		Expect(err).NotTo(HaveOccurred())
 
 		os.Setenv("CNI_COMMAND", "DEL")
 		os.Setenv("CNI_IFNAME", "eth0")
-		err = cmdDel(args, fExec, nil)
+		err = CmdDel(args, fExec, nil)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(fExec.delIndex).To(Equal(len(fExec.plugins)))
 
@@ -721,6 +798,7 @@ var _ = Describe("multus operations", func() {
 	It("executes delegates given faulty namespace", func() {
 		args := &skel.CmdArgs{
 			ContainerID: "123456789",
+			Path:        "/some/path",
 			Netns:       "fsdadfad",
 			IfName:      "eth0",
 			StdinData: []byte(`{
@@ -774,7 +852,7 @@ var _ = Describe("multus operations", func() {
 
 		os.Setenv("CNI_COMMAND", "ADD")
 		os.Setenv("CNI_IFNAME", "eth0")
-		result, err := cmdAdd(args, fExec, nil)
+		result, err := CmdAdd(args, fExec, nil)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(fExec.addIndex).To(Equal(len(fExec.plugins)))
 		r := result.(*types020.Result)
@@ -783,7 +861,7 @@ var _ = Describe("multus operations", func() {
 
 		os.Setenv("CNI_COMMAND", "DEL")
 		os.Setenv("CNI_IFNAME", "eth0")
-		err = cmdDel(args, fExec, nil)
+		err = CmdDel(args, fExec, nil)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(fExec.delIndex).To(Equal(len(fExec.plugins)))
 
@@ -794,9 +872,10 @@ var _ = Describe("multus operations", func() {
 		}
 	})
 
-	It("returns the previous result using cmdGet", func() {
+	It("checks the delegates using CmdCheck", func() {
 		args := &skel.CmdArgs{
 			ContainerID: "123456789",
+			Path:        "/some/path",
 			Netns:       testNS.Path(),
 			IfName:      "eth0",
 			StdinData: []byte(`{
@@ -851,19 +930,19 @@ var _ = Describe("multus operations", func() {
 
 		os.Setenv("CNI_COMMAND", "ADD")
 		os.Setenv("CNI_IFNAME", "eth0")
-		result, err := cmdAdd(args, fExec, nil)
+		result, err := CmdAdd(args, fExec, nil)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(fExec.addIndex).To(Equal(len(fExec.plugins)))
 		r := result.(*types020.Result)
 		// plugin 1 is the masterplugin
 		Expect(reflect.DeepEqual(r, expectedResult1)).To(BeTrue())
 
-		result, err = cmdGet(args, fExec, nil)
+		err = CmdCheck(args, fExec, nil)
 		Expect(err).NotTo(HaveOccurred())
 
 		os.Setenv("CNI_COMMAND", "DEL")
 		os.Setenv("CNI_IFNAME", "eth0")
-		err = cmdDel(args, fExec, nil)
+		err = CmdDel(args, fExec, nil)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(fExec.delIndex).To(Equal(len(fExec.plugins)))
 
@@ -877,6 +956,7 @@ var _ = Describe("multus operations", func() {
 	It("executes delegates given faulty namespace", func() {
 		args := &skel.CmdArgs{
 			ContainerID: "123456789",
+			Path:        "/some/path",
 			Netns:       "fsdadfad",
 			IfName:      "eth0",
 			StdinData: []byte(`{
@@ -930,7 +1010,7 @@ var _ = Describe("multus operations", func() {
 
 		os.Setenv("CNI_COMMAND", "ADD")
 		os.Setenv("CNI_IFNAME", "eth0")
-		result, err := cmdAdd(args, fExec, nil)
+		result, err := CmdAdd(args, fExec, nil)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(fExec.addIndex).To(Equal(len(fExec.plugins)))
 		r := result.(*types020.Result)
@@ -939,7 +1019,7 @@ var _ = Describe("multus operations", func() {
 
 		os.Setenv("CNI_COMMAND", "DEL")
 		os.Setenv("CNI_IFNAME", "eth0")
-		err = cmdDel(args, fExec, nil)
+		err = CmdDel(args, fExec, nil)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(fExec.delIndex).To(Equal(len(fExec.plugins)))
 
@@ -950,9 +1030,10 @@ var _ = Describe("multus operations", func() {
 		}
 	})
 
-	It("returns the previous result using cmdGet", func() {
+	It("checks the delegates using CmdCheck", func() {
 		args := &skel.CmdArgs{
 			ContainerID: "123456789",
+			Path:        "/some/path",
 			Netns:       testNS.Path(),
 			IfName:      "eth0",
 			StdinData: []byte(`{
@@ -1005,19 +1086,19 @@ var _ = Describe("multus operations", func() {
 
 		os.Setenv("CNI_COMMAND", "ADD")
 		os.Setenv("CNI_IFNAME", "eth0")
-		result, err := cmdAdd(args, fExec, nil)
+		result, err := CmdAdd(args, fExec, nil)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(fExec.addIndex).To(Equal(len(fExec.plugins)))
 		r := result.(*types020.Result)
 		// plugin 1 is the masterplugin
 		Expect(reflect.DeepEqual(r, expectedResult1)).To(BeTrue())
 
-		result, err = cmdGet(args, fExec, nil)
+		err = CmdCheck(args, fExec, nil)
 		Expect(err).NotTo(HaveOccurred())
 
 		os.Setenv("CNI_COMMAND", "DEL")
 		os.Setenv("CNI_IFNAME", "eth0")
-		err = cmdDel(args, fExec, nil)
+		err = CmdDel(args, fExec, nil)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(fExec.delIndex).To(Equal(len(fExec.plugins)))
 
@@ -1028,9 +1109,10 @@ var _ = Describe("multus operations", func() {
 		}
 	})
 
-	It("fails to load NetConf with bad json in cmdAdd/Del", func() {
+	It("fails to load NetConf with bad json in CmdAdd/Del", func() {
 		args := &skel.CmdArgs{
 			ContainerID: "123456789",
+			Path:        "/some/path",
 			Netns:       testNS.Path(),
 			IfName:      "eth0",
 			StdinData: []byte(`{
@@ -1084,10 +1166,10 @@ var _ = Describe("multus operations", func() {
 
 		os.Setenv("CNI_COMMAND", "ADD")
 		os.Setenv("CNI_IFNAME", "eth0")
-		_, err := cmdAdd(args, fExec, nil)
+		_, err := CmdAdd(args, fExec, nil)
 		Expect(err).To(HaveOccurred())
 
-		err = cmdDel(args, fExec, nil)
+		err = CmdDel(args, fExec, nil)
 		Expect(err).To(HaveOccurred())
 	})
 
@@ -1124,6 +1206,7 @@ var _ = Describe("multus operations", func() {
 	}`
 		args := &skel.CmdArgs{
 			ContainerID: "123456789",
+			Path:        "/some/path",
 			Netns:       testNS.Path(),
 			IfName:      "eth0",
 			StdinData: []byte(fmt.Sprintf(`{
@@ -1154,7 +1237,7 @@ var _ = Describe("multus operations", func() {
 
 		os.Setenv("CNI_COMMAND", "ADD")
 		os.Setenv("CNI_IFNAME", "eth0")
-		_, err = cmdAdd(args, fExec, nil)
+		_, err = CmdAdd(args, fExec, nil)
 		Expect(fExec.addIndex).To(Equal(2))
 		Expect(fExec.delIndex).To(Equal(2))
 		Expect(err).To(MatchError("Multus: Err adding pod to network \"other1\": Multus: error in invoke Delegate add - \"other-plugin\": expected plugin failure"))
@@ -1178,10 +1261,11 @@ var _ = Describe("multus operations", func() {
 		    "cniVersion": "0.2.0",
 		    "type": "other-plugin"
 		}`
-		// took out the name in expectedConf2, expecting a new value to be filled in by cmdAdd
+		// took out the name in expectedConf2, expecting a new value to be filled in by CmdAdd
 
 		args := &skel.CmdArgs{
 			ContainerID: "123456789",
+			Path:        "/some/path",
 			Netns:       testNS.Path(),
 			IfName:      "eth0",
 			StdinData: []byte(fmt.Sprintf(`{
@@ -1212,7 +1296,7 @@ var _ = Describe("multus operations", func() {
 
 		os.Setenv("CNI_COMMAND", "ADD")
 		os.Setenv("CNI_IFNAME", "eth0")
-		_, err = cmdAdd(args, fExec, nil)
+		_, err = CmdAdd(args, fExec, nil)
 		Expect(fExec.addIndex).To(Equal(2))
 		Expect(fExec.delIndex).To(Equal(2))
 		Expect(err).To(HaveOccurred())
@@ -1225,6 +1309,110 @@ var _ = Describe("multus operations", func() {
 
 	})
 
+	It("executes the delegates after the master plugin in parallel", func() {
+		confs := []string{}
+		for _, name := range []string{"weave1", "other1", "other2", "other3"} {
+			confs = append(confs, fmt.Sprintf(`{
+	    "name": "%s",
+	    "cniVersion": "0.2.0",
+	    "type": "%s-plugin"
+	}`, name, name))
+		}
+		args := &skel.CmdArgs{
+			ContainerID: "123456789",
+			Path:        "/some/path",
+			Netns:       testNS.Path(),
+			IfName:      "eth0",
+			StdinData: []byte(fmt.Sprintf(`{
+	    "name": "node-cni-network",
+	    "type": "multus",
+	    "delegates": [%s]
+	}`, strings.Join(confs, ","))),
+		}
+
+		// every delegate after the master plugin waits for the others
+		var entered sync.WaitGroup
+		entered.Add(len(confs) - 1)
+		gate := func() {
+			entered.Done()
+			done := make(chan struct{})
+			go func() {
+				entered.Wait()
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(10 * time.Second):
+				Fail("the delegates were not added in parallel")
+			}
+		}
+
+		fExec := &fakeExec{}
+		for idx, conf := range confs {
+			fExec.addPlugin(nil, fmt.Sprintf("eth%d", idx), conf, &types020.Result{
+				CNIVersion: "0.2.0",
+				IP4: &types020.IPConfig{
+					IP: *testhelpers.EnsureCIDR(fmt.Sprintf("1.1.1.%d/24", idx+2)),
+				},
+			}, nil)
+			if idx > 0 {
+				fExec.plugins[idx].gate = gate
+			}
+		}
+
+		os.Setenv("CNI_COMMAND", "ADD")
+		os.Setenv("CNI_IFNAME", "eth0")
+		result, err := CmdAdd(args, fExec, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fExec.addIndex).To(Equal(len(confs)))
+		r := result.(*types020.Result)
+		// plugin 1 is the masterplugin
+		Expect(r.IP4.IP.String()).To(Equal("1.1.1.2/24"))
+	})
+
+	It("fails before any delegate given the same interface name twice", func() {
+		fakePod := testhelpers.NewFakePod("testpod", `[{"name":"net1","interface":"net1"},{"name":"net2","interface":"net1"}]`, "")
+		net1 := `{
+		"name": "net1",
+		"type": "mynet",
+		"cniVersion": "0.2.0"
+	}`
+		net2 := `{
+		"name": "net2",
+		"type": "mynet2",
+		"cniVersion": "0.2.0"
+	}`
+		args := &skel.CmdArgs{
+			ContainerID: "123456789",
+			Path:        "/some/path",
+			Netns:       testNS.Path(),
+			IfName:      "eth0",
+			Args:        fmt.Sprintf("K8S_POD_NAME=%s;K8S_POD_NAMESPACE=%s", fakePod.ObjectMeta.Name, fakePod.ObjectMeta.Namespace),
+			StdinData: []byte(`{
+	    "name": "node-cni-network",
+	    "type": "multus",
+	    "kubeconfig": "/etc/kubernetes/node-kubeconfig.yaml",
+	    "delegates": [{
+	        "name": "weave1",
+	        "cniVersion": "0.2.0",
+	        "type": "weave-net"
+	    }]
+	}`),
+		}
+
+		fKubeClient := testhelpers.NewFakeKubeClient()
+		fKubeClient.AddPod(fakePod)
+		fKubeClient.AddNetConfig(fakePod.ObjectMeta.Namespace, "net1", net1)
+		fKubeClient.AddNetConfig(fakePod.ObjectMeta.Namespace, "net2", net2)
+
+		fExec := &fakeExec{}
+		os.Setenv("CNI_COMMAND", "ADD")
+		os.Setenv("CNI_IFNAME", "eth0")
+		_, err := CmdAdd(args, fExec, fKubeClient)
+		Expect(err).To(MatchError(`Multus: delegates 1 and 2 have the same interface name "net1"`))
+		Expect(fExec.addIndex).To(Equal(0))
+	})
+
 	It("executes delegates with interface name and MAC and IP addr", func() {
 		podNet := `[{"name":"net1",
 				 "interface": "test1",
@@ -1246,6 +1434,7 @@ var _ = Describe("multus operations", func() {
 	}`
 		args := &skel.CmdArgs{
 			ContainerID: "123456789",
+			Path:        "/some/path",
 			Netns:       testNS.Path(),
 			IfName:      "eth0",
 			Args:        fmt.Sprintf("K8S_POD_NAME=%s;K8S_POD_NAMESPACE=%s", fakePod.ObjectMeta.Name, fakePod.ObjectMeta.Namespace),
@@ -1274,13 +1463,13 @@ var _ = Describe("multus operations", func() {
 	    "type": "weave-net"
 	}`
 		fExec.addPlugin(nil, "eth0", expectedConf1, expectedResult1, nil)
-		fExec.addPlugin([]string{"CNI_ARGS=IgnoreUnknown=true;IP=1.2.3.4/24"}, "test1", net1, &types020.Result{
+		fExec.addPlugin([]string{"CNI_ARGS=IgnoreUnknown=1;K8S_POD_NAMESPACE=test;K8S_POD_NAME=testpod;K8S_POD_INFRA_CONTAINER_ID=;IP=1.2.3.4/24"}, "test1", net1, &types020.Result{
 			CNIVersion: "0.2.0",
 			IP4: &types020.IPConfig{
 				IP: *testhelpers.EnsureCIDR("1.1.1.3/24"),
 			},
 		}, nil)
-		fExec.addPlugin([]string{"CNI_ARGS=IgnoreUnknown=true;MAC=c2:11:22:33:44:66;IP=10.0.0.1"}, "eth2", net2, &types020.Result{
+		fExec.addPlugin([]string{"CNI_ARGS=IgnoreUnknown=1;K8S_POD_NAMESPACE=test;K8S_POD_NAME=testpod;K8S_POD_INFRA_CONTAINER_ID=;MAC=c2:11:22:33:44:66;IP=10.0.0.1"}, "eth2", net2, &types020.Result{
 			CNIVersion: "0.2.0",
 			IP4: &types020.IPConfig{
 				IP: *testhelpers.EnsureCIDR("1.1.1.4/24"),
@@ -1294,7 +1483,7 @@ var _ = Describe("multus operations", func() {
 
 		os.Setenv("CNI_COMMAND", "ADD")
 		os.Setenv("CNI_IFNAME", "eth0")
-		result, err := cmdAdd(args, fExec, fKubeClient)
+		result, err := CmdAdd(args, fExec, fKubeClient)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(fExec.addIndex).To(Equal(len(fExec.plugins)))
 		Expect(fKubeClient.PodCount).To(Equal(2))
@@ -1304,6 +1493,390 @@ var _ = Describe("multus operations", func() {
 		Expect(reflect.DeepEqual(r, expectedResult1)).To(BeTrue())
 	})
 
+	It("checks every delegate with its result on ADD as prevResult", func() {
+		args := &skel.CmdArgs{
+			ContainerID: "123456789",
+			Path:        "/some/path",
+			Netns:       testNS.Path(),
+			IfName:      "eth0",
+			StdinData: []byte(fmt.Sprintf(`{
+	    "name": "node-cni-network",
+	    "type": "multus",
+	    "cniVersion": "0.4.0",
+	    "cniDir": "%s",
+	    "delegates": [{
+	        "name": "weave1",
+	        "cniVersion": "0.4.0",
+	        "type": "weave-net"
+	    },{
+	        "name": "other1",
+	        "cniVersion": "0.4.0",
+	        "plugins": [{
+	            "type": "other-plugin"
+	        }]
+	    },{
+	        "name": "old1",
+	        "cniVersion": "0.3.1",
+	        "type": "old-plugin"
+	    }]
+	}`, tmpDir)),
+		}
+
+		results := []*current.Result{}
+		for _, ip := range []string{"1.1.1.2/24", "1.1.1.3/24", "1.1.1.4/24"} {
+			results = append(results, &current.Result{
+				CNIVersion: "0.4.0",
+				IPs: []*current.IPConfig{{
+					Version: "4",
+					Address: *testhelpers.EnsureCIDR(ip),
+				}},
+			})
+		}
+		results[2].CNIVersion = "0.3.1"
+		fExec := &fakeExec{}
+		fExec.addPlugin([]string{"CNI_IFNAME=eth0"}, "eth0", `{
+	    "name": "weave1",
+	    "cniVersion": "0.4.0",
+	    "type": "weave-net"
+	}`, results[0], nil)
+		fExec.addPlugin([]string{"CNI_IFNAME=eth1"}, "eth1", `{
+	    "name": "other1",
+	    "cniVersion": "0.4.0",
+	    "type": "other-plugin"
+	}`, results[1], nil)
+		fExec.addPlugin([]string{"CNI_IFNAME=eth2"}, "eth2", "", results[2], nil)
+
+		os.Setenv("CNI_COMMAND", "ADD")
+		os.Setenv("CNI_IFNAME", "eth0")
+		_, err := CmdAdd(args, fExec, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fExec.addIndex).To(Equal(len(fExec.plugins)))
+
+		os.Setenv("CNI_COMMAND", "CHECK")
+		err = CmdCheck(args, fExec, nil)
+		Expect(err).NotTo(HaveOccurred())
+		// the 0.3.1 delegate has no CHECK
+		Expect(fExec.checkIndex).To(Equal(2))
+		for idx := 0; idx < 2; idx++ {
+			expected, err := json.Marshal(results[idx])
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fExec.plugins[idx].prevResult).To(MatchJSON(expected))
+		}
+
+		os.Setenv("CNI_COMMAND", "DEL")
+		err = CmdDel(args, fExec, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fExec.delIndex).To(Equal(len(fExec.plugins)))
+	})
+
+	It("returns the check errors of all the networks", func() {
+		args := &skel.CmdArgs{
+			ContainerID: "123456789",
+			Path:        "/some/path",
+			Netns:       testNS.Path(),
+			IfName:      "eth0",
+			StdinData: []byte(fmt.Sprintf(`{
+	    "name": "node-cni-network",
+	    "type": "multus",
+	    "cniVersion": "0.4.0",
+	    "cniDir": "%s",
+	    "delegates": [{
+	        "name": "weave1",
+	        "cniVersion": "0.4.0",
+	        "type": "weave-net"
+	    },{
+	        "name": "other1",
+	        "cniVersion": "0.4.0",
+	        "type": "other-plugin"
+	    },{
+	        "name": "other2",
+	        "cniVersion": "0.4.0",
+	        "type": "other-plugin"
+	    }]
+	}`, tmpDir)),
+		}
+
+		fExec := &fakeExec{}
+		for idx, ip := range []string{"1.1.1.2/24", "1.1.1.3/24", "1.1.1.4/24"} {
+			fExec.addPlugin(nil, fmt.Sprintf("eth%d", idx), "", &current.Result{
+				CNIVersion: "0.4.0",
+				IPs: []*current.IPConfig{{
+					Version: "4",
+					Address: *testhelpers.EnsureCIDR(ip),
+				}},
+			}, nil)
+		}
+		fExec.plugins[0].checkErr = fmt.Errorf("no route")
+		fExec.plugins[2].checkErr = fmt.Errorf("no address")
+
+		os.Setenv("CNI_COMMAND", "ADD")
+		os.Setenv("CNI_IFNAME", "eth0")
+		_, err := CmdAdd(args, fExec, nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		os.Setenv("CNI_COMMAND", "CHECK")
+		err = CmdCheck(args, fExec, nil)
+		Expect(err).To(HaveOccurred())
+		Expect(fExec.checkIndex).To(Equal(len(fExec.plugins)))
+		Expect(err.Error()).To(ContainSubstring(`network "weave1"`))
+		Expect(err.Error()).To(ContainSubstring("no route"))
+		Expect(err.Error()).NotTo(ContainSubstring(`network "other1"`))
+		Expect(err.Error()).To(ContainSubstring(`network "other2"`))
+		Expect(err.Error()).To(ContainSubstring("no address"))
+	})
+
+	It("fails the check if the network status of the pod is not the one of the delegates", func() {
+		fakePod := testhelpers.NewFakePod("testpod", "net1", "")
+		net1 := `{
+		"name": "net1",
+		"type": "mynet",
+		"cniVersion": "0.4.0"
+	}`
+		args := &skel.CmdArgs{
+			ContainerID: "123456789",
+			Path:        "/some/path",
+			Netns:       testNS.Path(),
+			IfName:      "eth0",
+			Args:        fmt.Sprintf("K8S_POD_NAME=%s;K8S_POD_NAMESPACE=%s", fakePod.ObjectMeta.Name, fakePod.ObjectMeta.Namespace),
+			StdinData: []byte(fmt.Sprintf(`{
+	    "name": "node-cni-network",
+	    "type": "multus",
+	    "cniVersion": "0.4.0",
+	    "cniDir": "%s",
+	    "kubeconfig": "/etc/kubernetes/node-kubeconfig.yaml",
+	    "delegates": [{
+	        "name": "weave1",
+	        "cniVersion": "0.4.0",
+	        "type": "weave-net"
+	    }]
+	}`, tmpDir)),
+		}
+
+		fExec := &fakeExec{}
+		for idx, ip := range []string{"1.1.1.2/24", "1.1.1.3/24"} {
+			fExec.addPlugin(nil, fmt.Sprintf("eth%d", idx), "", &current.Result{
+				CNIVersion: "0.4.0",
+				IPs: []*current.IPConfig{{
+					Version: "4",
+					Address: *testhelpers.EnsureCIDR(ip),
+				}},
+			}, nil)
+		}
+
+		fKubeClient := testhelpers.NewFakeKubeClient()
+		fKubeClient.AddPod(fakePod)
+		fKubeClient.AddNetConfig(fakePod.ObjectMeta.Namespace, "net1", net1)
+
+		os.Setenv("CNI_COMMAND", "ADD")
+		os.Setenv("CNI_IFNAME", "eth0")
+		_, err := CmdAdd(args, fExec, fKubeClient)
+		Expect(err).NotTo(HaveOccurred())
+
+		os.Setenv("CNI_COMMAND", "CHECK")
+		err = CmdCheck(args, fExec, fKubeClient)
+		Expect(err).NotTo(HaveOccurred())
+
+		// the address of net1 is changed in the annotation
+		pod, err := fKubeClient.GetPod(fakePod.ObjectMeta.Namespace, fakePod.ObjectMeta.Name)
+		Expect(err).NotTo(HaveOccurred())
+		netStatus := []*types.NetworkStatus{}
+		Expect(json.Unmarshal([]byte(pod.Annotations[k8sclient.NetworkAttachmentStatus]), &netStatus)).To(Succeed())
+		Expect(netStatus).To(HaveLen(2))
+		netStatus[1].IPs = []string{"1.1.1.9"}
+		annot, err := json.Marshal(netStatus)
+		Expect(err).NotTo(HaveOccurred())
+		pod.Annotations[k8sclient.NetworkAttachmentStatus] = string(annot)
+
+		fExec.checked = nil
+		err = CmdCheck(args, fExec, fKubeClient)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring(`network "net1" has status`))
+		Expect(err.Error()).NotTo(ContainSubstring(`network "weave1" has status`))
+	})
+
+	It("checks the pods added before the results were cached", func() {
+		fakePod := testhelpers.NewFakePod("testpod", "net1", "")
+		net1 := `{
+		"name": "net1",
+		"type": "mynet",
+		"cniVersion": "0.4.0"
+	}`
+		args := &skel.CmdArgs{
+			ContainerID: "123456789",
+			Path:        "/some/path",
+			Netns:       testNS.Path(),
+			IfName:      "eth0",
+			Args:        fmt.Sprintf("K8S_POD_NAME=%s;K8S_POD_NAMESPACE=%s", fakePod.ObjectMeta.Name, fakePod.ObjectMeta.Namespace),
+			StdinData: []byte(fmt.Sprintf(`{
+	    "name": "node-cni-network",
+	    "type": "multus",
+	    "cniVersion": "0.4.0",
+	    "cniDir": "%s",
+	    "kubeconfig": "/etc/kubernetes/node-kubeconfig.yaml",
+	    "delegates": [{
+	        "name": "weave1",
+	        "cniVersion": "0.4.0",
+	        "type": "weave-net"
+	    }]
+	}`, tmpDir)),
+		}
+
+		fExec := &fakeExec{}
+		for idx, ip := range []string{"1.1.1.2/24", "1.1.1.3/24"} {
+			fExec.addPlugin(nil, fmt.Sprintf("eth%d", idx), "", &current.Result{
+				CNIVersion: "0.4.0",
+				IPs: []*current.IPConfig{{
+					Version: "4",
+					Address: *testhelpers.EnsureCIDR(ip),
+					Gateway: testhelpers.EnsureCIDR("1.1.1.1/24").IP,
+				}},
+			}, nil)
+		}
+
+		fKubeClient := testhelpers.NewFakeKubeClient()
+		fKubeClient.AddPod(fakePod)
+		fKubeClient.AddNetConfig(fakePod.ObjectMeta.Namespace, "net1", net1)
+
+		os.Setenv("CNI_COMMAND", "ADD")
+		os.Setenv("CNI_IFNAME", "eth0")
+		_, err := CmdAdd(args, fExec, fKubeClient)
+		Expect(err).NotTo(HaveOccurred())
+
+		// the annotation has no gateway as before the upgrade
+		pod, err := fKubeClient.GetPod(fakePod.ObjectMeta.Namespace, fakePod.ObjectMeta.Name)
+		Expect(err).NotTo(HaveOccurred())
+		netStatus := []*types.NetworkStatus{}
+		Expect(json.Unmarshal([]byte(pod.Annotations[k8sclient.NetworkAttachmentStatus]), &netStatus)).To(Succeed())
+		Expect(netStatus).To(HaveLen(2))
+		for _, s := range netStatus {
+			Expect(s.Gateway).To(Equal([]string{"1.1.1.1"}))
+			s.Gateway = nil
+		}
+		annot, err := json.Marshal(netStatus)
+		Expect(err).NotTo(HaveOccurred())
+		pod.Annotations[k8sclient.NetworkAttachmentStatus] = string(annot)
+
+		os.Setenv("CNI_COMMAND", "CHECK")
+		err = CmdCheck(args, fExec, fKubeClient)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fExec.checkIndex).To(Equal(len(fExec.plugins)))
+
+		// the cache has no result either
+		cachePath := filepath.Join(tmpDir, args.ContainerID)
+		data, err := ioutil.ReadFile(cachePath)
+		Expect(err).NotTo(HaveOccurred())
+		delegates := []map[string]interface{}{}
+		Expect(json.Unmarshal(data, &delegates)).To(Succeed())
+		Expect(delegates).To(HaveLen(2))
+		for _, d := range delegates {
+			Expect(d).To(HaveKey("result"))
+			delete(d, "result")
+		}
+		data, err = json.Marshal(delegates)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ioutil.WriteFile(cachePath, data, 0600)).To(Succeed())
+
+		fExec.checkIndex = 0
+		err = CmdCheck(args, fExec, fKubeClient)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fExec.checkIndex).To(Equal(0))
+
+		os.Setenv("CNI_COMMAND", "DEL")
+		err = CmdDel(args, fExec, fKubeClient)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("keeps the MAC and IP requested for a delegate out of the others", func() {
+		podNet := `[{"name":"net1",
+			 "mac": "c2:11:22:33:44:66",
+			 "ips": "10.0.0.1"},
+			{"name":"net2"},
+			{"name":"net3",
+			 "interface": "test3",
+			 "ips": "10.0.0.3/24"}
+	]`
+		fakePod := testhelpers.NewFakePod("testpod", podNet, "")
+		nets := []string{}
+		for _, name := range []string{"net1", "net2", "net3"} {
+			nets = append(nets, fmt.Sprintf(`{
+		"name": "%s",
+		"type": "my%s",
+		"cniVersion": "0.2.0"
+	}`, name, name))
+		}
+		args := &skel.CmdArgs{
+			ContainerID: "123456789",
+			Path:        "/some/path",
+			Netns:       testNS.Path(),
+			IfName:      "eth0",
+			Args:        fmt.Sprintf("K8S_POD_NAME=%s;K8S_POD_NAMESPACE=%s", fakePod.ObjectMeta.Name, fakePod.ObjectMeta.Namespace),
+			StdinData: []byte(fmt.Sprintf(`{
+	    "name": "node-cni-network",
+	    "type": "multus",
+	    "kubeconfig": "/etc/kubernetes/node-kubeconfig.yaml",
+	    "cniDir": "%s",
+	    "delegates": [{
+	        "name": "weave1",
+	        "cniVersion": "0.2.0",
+	        "type": "weave-net"
+	    }]
+	}`, tmpDir)),
+		}
+
+		podArgs := "CNI_ARGS=IgnoreUnknown=1;K8S_POD_NAMESPACE=test;K8S_POD_NAME=testpod;K8S_POD_INFRA_CONTAINER_ID="
+		fExec := &fakeExec{}
+		fExec.addPlugin([]string{podArgs, "CNI_IFNAME=eth0"}, "eth0", `{
+	    "name": "weave1",
+	    "cniVersion": "0.2.0",
+	    "type": "weave-net"
+	}`, &types020.Result{
+			CNIVersion: "0.2.0",
+			IP4: &types020.IPConfig{
+				IP: *testhelpers.EnsureCIDR("1.1.1.2/24"),
+			},
+		}, nil)
+		fExec.addPlugin([]string{podArgs + ";MAC=c2:11:22:33:44:66;IP=10.0.0.1", "CNI_IFNAME=eth1"}, "eth1", nets[0], &types020.Result{
+			CNIVersion: "0.2.0",
+			IP4: &types020.IPConfig{
+				IP: *testhelpers.EnsureCIDR("10.0.0.1/24"),
+			},
+		}, nil)
+		fExec.addPlugin([]string{podArgs, "CNI_IFNAME=eth2"}, "eth2", nets[1], &types020.Result{
+			CNIVersion: "0.2.0",
+			IP4: &types020.IPConfig{
+				IP: *testhelpers.EnsureCIDR("1.1.1.4/24"),
+			},
+		}, nil)
+		fExec.addPlugin([]string{podArgs + ";IP=10.0.0.3/24", "CNI_IFNAME=test3"}, "test3", nets[2], &types020.Result{
+			CNIVersion: "0.2.0",
+			IP4: &types020.IPConfig{
+				IP: *testhelpers.EnsureCIDR("10.0.0.3/24"),
+			},
+		}, nil)
+
+		fKubeClient := testhelpers.NewFakeKubeClient()
+		fKubeClient.AddPod(fakePod)
+		for idx, name := range []string{"net1", "net2", "net3"} {
+			fKubeClient.AddNetConfig(fakePod.ObjectMeta.Namespace, name, nets[idx])
+		}
+
+		os.Setenv("CNI_COMMAND", "ADD")
+		os.Setenv("CNI_IFNAME", "eth0")
+		_, err := CmdAdd(args, fExec, fKubeClient)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fExec.addIndex).To(Equal(len(fExec.plugins)))
+
+		// the same args are given back on DEL, from the cached delegates
+		os.Setenv("CNI_COMMAND", "DEL")
+		err = CmdDel(args, fExec, fKubeClient)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fExec.delIndex).To(Equal(len(fExec.plugins)))
+
+		// the environment of multus is left alone
+		Expect(os.Getenv("CNI_IFNAME")).To(Equal("eth0"))
+		Expect(os.Getenv("CNI_ARGS")).To(Equal(""))
+	})
+
 	It("executes delegates and kubernetes networks", func() {
 		fakePod := testhelpers.NewFakePod("testpod", "net1,net2", "")
 		net1 := `{
@@ -1323,6 +1896,7 @@ var _ = Describe("multus operations", func() {
 	}`
 		args := &skel.CmdArgs{
 			ContainerID: "123456789",
+			Path:        "/some/path",
 			Netns:       testNS.Path(),
 			IfName:      "eth0",
 			Args:        fmt.Sprintf("K8S_POD_NAME=%s;K8S_POD_NAMESPACE=%s", fakePod.ObjectMeta.Name, fakePod.ObjectMeta.Namespace),
@@ -1373,7 +1947,7 @@ var _ = Describe("multus operations", func() {
 
 		os.Setenv("CNI_COMMAND", "ADD")
 		os.Setenv("CNI_IFNAME", "eth0")
-		result, err := cmdAdd(args, fExec, fKubeClient)
+		result, err := CmdAdd(args, fExec, fKubeClient)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(fExec.addIndex).To(Equal(len(fExec.plugins)))
 		Expect(fKubeClient.PodCount).To(Equal(2))
@@ -1392,6 +1966,7 @@ var _ = Describe("multus operations", func() {
 	}`
 		args := &skel.CmdArgs{
 			ContainerID: "123456789",
+			Path:        "/some/path",
 			Netns:       testNS.Path(),
 			IfName:      "eth0",
 			Args:        fmt.Sprintf("K8S_POD_NAME=%s;K8S_POD_NAMESPACE=%s", fakePod.ObjectMeta.Name, fakePod.ObjectMeta.Namespace),
@@ -1433,7 +2008,7 @@ var _ = Describe("multus operations", func() {
 
 		os.Setenv("CNI_COMMAND", "ADD")
 		os.Setenv("CNI_IFNAME", "eth0")
-		result, err := cmdAdd(args, fExec, fKubeClient)
+		result, err := CmdAdd(args, fExec, fKubeClient)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(fExec.addIndex).To(Equal(len(fExec.plugins)))
 		Expect(fKubeClient.PodCount).To(Equal(2))
@@ -1446,7 +2021,7 @@ var _ = Describe("multus operations", func() {
 		os.Setenv("CNI_IFNAME", "eth0")
 		// set fKubeClient to nil to emulate no pod info
 		fKubeClient.DeletePod(fakePod)
-		err = cmdDel(args, fExec, fKubeClient)
+		err = CmdDel(args, fExec, fKubeClient)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(fExec.delIndex).To(Equal(len(fExec.plugins)))
 	})
@@ -1460,6 +2035,7 @@ var _ = Describe("multus operations", func() {
 	}`
 		args := &skel.CmdArgs{
 			ContainerID: "123456789",
+			Path:        "/some/path",
 			Netns:       testNS.Path(),
 			IfName:      "eth0",
 			Args:        fmt.Sprintf("K8S_POD_NAME=%s;K8S_POD_NAMESPACE=%s", fakePod.ObjectMeta.Name, fakePod.ObjectMeta.Namespace),
@@ -1501,7 +2077,7 @@ var _ = Describe("multus operations", func() {
 
 		os.Setenv("CNI_COMMAND", "ADD")
 		os.Setenv("CNI_IFNAME", "eth0")
-		result, err := cmdAdd(args, fExec, fKubeClient)
+		result, err := CmdAdd(args, fExec, fKubeClient)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(fExec.addIndex).To(Equal(len(fExec.plugins)))
 		Expect(fKubeClient.PodCount).To(Equal(2))
@@ -1514,7 +2090,7 @@ var _ = Describe("multus operations", func() {
 		os.Setenv("CNI_IFNAME", "eth0")
 		// set fKubeClient to nil to emulate no pod info
 		fKubeClient.DeletePod(fakePod)
-		err = cmdDel(args, fExec, fKubeClient)
+		err = CmdDel(args, fExec, fKubeClient)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(fExec.delIndex).To(Equal(len(fExec.plugins)))
 	})
@@ -1528,6 +2104,7 @@ var _ = Describe("multus operations", func() {
 	}`
 		args := &skel.CmdArgs{
 			ContainerID: "123456789",
+			Path:        "/some/path",
 			Netns:       testNS.Path(),
 			IfName:      "eth0",
 			Args:        fmt.Sprintf("K8S_POD_NAME=%s;K8S_POD_NAMESPACE=%s", fakePod.ObjectMeta.Name, fakePod.ObjectMeta.Namespace),
@@ -1569,7 +2146,7 @@ var _ = Describe("multus operations", func() {
 
 		os.Setenv("CNI_COMMAND", "ADD")
 		os.Setenv("CNI_IFNAME", "eth0")
-		result, err := cmdAdd(args, fExec, fKubeClient)
+		result, err := CmdAdd(args, fExec, fKubeClient)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(fExec.addIndex).To(Equal(len(fExec.plugins)))
 		Expect(fKubeClient.PodCount).To(Equal(2))
@@ -1582,7 +2159,7 @@ var _ = Describe("multus operations", func() {
 		os.Setenv("CNI_IFNAME", "eth0")
 		// set fKubeClient to nil to emulate no pod info
 		fKubeClient.DeletePod(fakePod)
-		err = cmdDel(args, fExec, fKubeClient)
+		err = CmdDel(args, fExec, fKubeClient)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(fExec.delIndex).To(Equal(len(fExec.plugins)))
 	})
@@ -1590,6 +2167,7 @@ var _ = Describe("multus operations", func() {
 	It("ensure delegates get portmap runtime config", func() {
 		args := &skel.CmdArgs{
 			ContainerID: "123456789",
+			Path:        "/some/path",
 			Netns:       testNS.Path(),
 			IfName:      "eth0",
 			StdinData: []byte(`{
@@ -1628,7 +2206,7 @@ var _ = Describe("multus operations", func() {
 		fExec.addPlugin(nil, "eth0", expectedConf1, nil, nil)
 		os.Setenv("CNI_COMMAND", "ADD")
 		os.Setenv("CNI_IFNAME", "eth0")
-		_, err := cmdAdd(args, fExec, nil)
+		_, err := CmdAdd(args, fExec, nil)
 		Expect(err).NotTo(HaveOccurred())
 	})
 
@@ -1647,6 +2225,7 @@ var _ = Describe("multus operations", func() {
 		}
 		args := &skel.CmdArgs{
 			ContainerID: "123456789",
+			Path:        "/some/path",
 			Netns:       testNS.Path(),
 			IfName:      "eth0",
 			Args:        fmt.Sprintf("K8S_POD_NAME=%s;K8S_POD_NAMESPACE=%s", fakePod.ObjectMeta.Name, fakePod.ObjectMeta.Namespace),
@@ -1669,7 +2248,7 @@ var _ = Describe("multus operations", func() {
 
 		os.Setenv("CNI_COMMAND", "ADD")
 		os.Setenv("CNI_IFNAME", "eth0")
-		result, err := cmdAdd(args, fExec, fKubeClient)
+		result, err := CmdAdd(args, fExec, fKubeClient)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(fExec.addIndex).To(Equal(len(fExec.plugins)))
 		Expect(fKubeClient.PodCount).To(Equal(2))
@@ -1679,7 +2258,7 @@ var _ = Describe("multus operations", func() {
 
 		os.Setenv("CNI_COMMAND", "DEL")
 		os.Setenv("CNI_IFNAME", "eth0")
-		err = cmdDel(args, fExec, fKubeClient)
+		err = CmdDel(args, fExec, fKubeClient)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(fExec.delIndex).To(Equal(len(fExec.plugins)))
 	})
@@ -1697,6 +2276,7 @@ var _ = Describe("multus operations", func() {
 	}`
 		args := &skel.CmdArgs{
 			ContainerID: "123456789",
+			Path:        "/some/path",
 			Netns:       testNS.Path(),
 			IfName:      "eth0",
 			Args:        fmt.Sprintf("K8S_POD_NAME=%s;K8S_POD_NAMESPACE=%s", fakePod.ObjectMeta.Name, fakePod.ObjectMeta.Namespace),
@@ -1738,7 +2318,7 @@ var _ = Describe("multus operations", func() {
 		fKubeClient.AddNetConfig(fakePod.ObjectMeta.Namespace, "net1", net1)
 		os.Setenv("CNI_COMMAND", "ADD")
 		os.Setenv("CNI_IFNAME", "eth0")
-		result, err := cmdAdd(args, fExec, fKubeClient)
+		result, err := CmdAdd(args, fExec, fKubeClient)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(fExec.addIndex).To(Equal(len(fExec.plugins)))
 		Expect(fKubeClient.PodCount).To(Equal(2))
@@ -1755,7 +2335,7 @@ var _ = Describe("multus operations", func() {
 		By("Delete and check net count is not incremented")
 		os.Setenv("CNI_COMMAND", "DEL")
 		os.Setenv("CNI_IFNAME", "eth0")
-		err = cmdDel(args, fExec, fKubeClient)
+		err = CmdDel(args, fExec, fKubeClient)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(fExec.delIndex).To(Equal(len(fExec.plugins)))
 		Expect(fKubeClient.PodCount).To(Equal(3))
@@ -1775,6 +2355,7 @@ var _ = Describe("multus operations", func() {
 	}`
 		args := &skel.CmdArgs{
 			ContainerID: "123456789",
+			Path:        "/some/path",
 			Netns:       testNS.Path(),
 			IfName:      "eth0",
 			Args:        fmt.Sprintf("K8S_POD_NAME=%s;K8S_POD_NAMESPACE=%s", fakePod.ObjectMeta.Name, fakePod.ObjectMeta.Namespace),
@@ -1816,7 +2397,7 @@ var _ = Describe("multus operations", func() {
 		fKubeClient.AddNetConfig(fakePod.ObjectMeta.Namespace, "net1", net1)
 		os.Setenv("CNI_COMMAND", "ADD")
 		os.Setenv("CNI_IFNAME", "eth0")
-		result, err := cmdAdd(args, fExec, fKubeClient)
+		result, err := CmdAdd(args, fExec, fKubeClient)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(fExec.addIndex).To(Equal(len(fExec.plugins)))
 		Expect(fKubeClient.PodCount).To(Equal(2))
@@ -1836,7 +2417,7 @@ var _ = Describe("multus operations", func() {
 		By("Delete and check pod/net count is incremented")
 		os.Setenv("CNI_COMMAND", "DEL")
 		os.Setenv("CNI_IFNAME", "eth0")
-		err = cmdDel(args, fExec, fKubeClient)
+		err = CmdDel(args, fExec, fKubeClient)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(fExec.delIndex).To(Equal(len(fExec.plugins)))
 		Expect(fKubeClient.PodCount).To(Equal(4))
@@ -1846,6 +2427,7 @@ var _ = Describe("multus operations", func() {
 	It("fails to execute confListDel given no 'plugins' key", func() {
 		args := &skel.CmdArgs{
 			ContainerID: "123456789",
+			Path:        "/some/path",
 			Netns:       testNS.Path(),
 			IfName:      "eth0",
 			StdinData: []byte(`{
@@ -1904,15 +2486,16 @@ var _ = Describe("multus operations", func() {
 		rawnetconflist := []byte(`{"cniVersion":"0.2.0","name":"weave1","type":"weave-net"}`)
 		k8sargs, err := k8sclient.GetK8sArgs(args)
 		n, err := types.LoadNetConf(args.StdinData)
-		rt := types.CreateCNIRuntimeConf(args, k8sargs, args.IfName, n.RuntimeConfig)
+		rt := types.CreateCNIRuntimeConf(args, k8sargs, args.IfName, n.RuntimeConfig, nil)
 
-		err = conflistDel(rt, rawnetconflist, binDir, fExec)
+		err = conflistDel(rt, rawnetconflist, args.Path, binDir, fExec)
 		Expect(err).To(HaveOccurred())
 	})
 
 	It("executes confListDel without error", func() {
 		args := &skel.CmdArgs{
 			ContainerID: "123456789",
+			Path:        "/some/path",
 			Netns:       testNS.Path(),
 			IfName:      "eth0",
 			StdinData: []byte(`{
@@ -1956,7 +2539,7 @@ var _ = Describe("multus operations", func() {
 		os.Setenv("CNI_COMMAND", "ADD")
 		os.Setenv("CNI_IFNAME", "eth0")
 
-		err := cmdDel(args, fExec, nil)
+		err := CmdDel(args, fExec, nil)
 		Expect(err).NotTo(HaveOccurred())
 	})
 })
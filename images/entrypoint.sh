@@ -25,6 +25,7 @@ MULTUS_AUTOCONF_DIR="/host/etc/cni/net.d"
 MULTUS_BIN_FILE="/usr/src/multus-cni/bin/multus"
 MULTUS_KUBECONFIG_FILE_HOST="/etc/cni/net.d/multus.d/multus.kubeconfig"
 MULTUS_NAMESPACE_ISOLATION=false
+MULTUS_MAX_PARALLEL_DELEGATES="" #"4"
 MULTUS_LOG_LEVEL="" #"error"
 MULTUS_LOG_FILE="" #"/tmp/multus.log"
 OVERRIDE_NETWORK_NAME=false
@@ -39,6 +40,16 @@ MULTUS_ANNOTATION="mynetworks"
 EXTEND_FUNCTION=true
 DAEMON_BIN_FILE="/usr/src/multus-cni/bin/multus-daemon"
 MULTUS_TICKER_TIME="21600"
+MULTUS_METRICS_ADDR=":9610"
+MULTUS_IPAM_CHECK_MODE="repair"
+MULTUS_CONTAINER_RUNTIME="docker"
+MULTUS_RUNTIME_ENDPOINT=""
+MULTUS_POD_GC_MODE="report"
+MULTUS_POD_GC_GRACE_PERIOD="300"
+MULTUS_HOT_PLUG_MODE="off"
+MULTUS_SERVER_MODE="off"
+MULTUS_SERVER_SOCKET="/run/multus/multus.sock"
+MULTUS_NAD_CACHE_TTL="30"
 DAEMON_NET_DATA_DIR="/var/lib/cni/networks"
 ETCD_CONF_FILE="/tmp/etcd-conf/etcd.conf"
 ETCD_FILE_HOST_DIR="/host/etc/cni/net.d/multus.d/etcd"
@@ -68,6 +79,7 @@ function usage() {
   echo -e "\t--multus-bin-file=$MULTUS_BIN_FILE"
   echo -e "\t--multus-kubeconfig-file-host=$MULTUS_KUBECONFIG_FILE_HOST"
   echo -e "\t--namespace-isolation=$MULTUS_NAMESPACE_ISOLATION"
+  echo -e "\t--multus-max-parallel-delegates=$MULTUS_MAX_PARALLEL_DELEGATES (empty by default for 4, 1 adds the delegates one by one, used only with --multus-conf-file=auto)"
   echo -e "\t--multus-autoconfig-dir=$MULTUS_AUTOCONF_DIR (used only with --multus-conf-file=auto)"
   echo -e "\t--multus-log-level=$MULTUS_LOG_LEVEL (empty by default, used only with --multus-conf-file=auto)"
   echo -e "\t--multus-log-file=$MULTUS_LOG_FILE (empty by default, used only with --multus-conf-file=auto)"
@@ -78,6 +90,16 @@ function usage() {
   # multus-ipam Configuration
   echo -e "\t--extend-function=$EXTEND_FUNCTION (enable extend function)"
   echo -e "\t--multus-ticker-time=$MULTUS_TICKER_TIME"
+  echo -e "\t--multus-metrics-addr=$MULTUS_METRICS_ADDR"
+  echo -e "\t--multus-ipam-check-mode=$MULTUS_IPAM_CHECK_MODE (report or repair)"
+  echo -e "\t--multus-container-runtime=$MULTUS_CONTAINER_RUNTIME (docker, containerd, crio or cri)"
+  echo -e "\t--multus-runtime-endpoint=$MULTUS_RUNTIME_ENDPOINT (socket of the container runtime, as mounted in the pod)"
+  echo -e "\t--multus-pod-gc-mode=$MULTUS_POD_GC_MODE (off, report or release the ips of deleted pods)"
+  echo -e "\t--multus-pod-gc-grace-period=$MULTUS_POD_GC_GRACE_PERIOD (seconds)"
+  echo -e "\t--multus-hot-plug-mode=$MULTUS_HOT_PLUG_MODE (off or on, to add and delete the networks changed in the annotation of running pods)"
+  echo -e "\t--multus-server-mode=$MULTUS_SERVER_MODE (off or on, to run the commands of the multus binary in multus-daemon)"
+  echo -e "\t--multus-server-socket=$MULTUS_SERVER_SOCKET (socket of the server, as mounted in the pod)"
+  echo -e "\t--multus-nad-cache-ttl=$MULTUS_NAD_CACHE_TTL (seconds the server uses the network attachment definitions read)"
 }
 
 function log() {
@@ -122,6 +144,9 @@ while [ "$1" != "" ]; do
   --namespace-isolation)
     MULTUS_NAMESPACE_ISOLATION=$VALUE
     ;;
+  --multus-max-parallel-delegates)
+    MULTUS_MAX_PARALLEL_DELEGATES=$VALUE
+    ;;
   --multus-log-level)
     MULTUS_LOG_LEVEL=$VALUE
     ;;
@@ -149,6 +174,36 @@ while [ "$1" != "" ]; do
   --multus-ticker-time)
     MULTUS_TICKER_TIME=$VALUE
     ;;
+  --multus-metrics-addr)
+    MULTUS_METRICS_ADDR=$VALUE
+    ;;
+  --multus-ipam-check-mode)
+    MULTUS_IPAM_CHECK_MODE=$VALUE
+    ;;
+  --multus-container-runtime)
+    MULTUS_CONTAINER_RUNTIME=$VALUE
+    ;;
+  --multus-runtime-endpoint)
+    MULTUS_RUNTIME_ENDPOINT=$VALUE
+    ;;
+  --multus-pod-gc-mode)
+    MULTUS_POD_GC_MODE=$VALUE
+    ;;
+  --multus-pod-gc-grace-period)
+    MULTUS_POD_GC_GRACE_PERIOD=$VALUE
+    ;;
+  --multus-hot-plug-mode)
+    MULTUS_HOT_PLUG_MODE=$VALUE
+    ;;
+  --multus-server-mode)
+    MULTUS_SERVER_MODE=$VALUE
+    ;;
+  --multus-server-socket)
+    MULTUS_SERVER_SOCKET=$VALUE
+    ;;
+  --multus-nad-cache-ttl)
+    MULTUS_NAD_CACHE_TTL=$VALUE
+    ;;
   --multus-crd-plural)
     MULTUS_CRD_PLURAL=$VALUE
     ;;
@@ -291,7 +346,7 @@ function checkDaemon(){
     if [ ! -z "${MULTUS_LOG_FILE// /}" ]; then
         MULTUS_DAEMON_LOG_FILE="$(dirname ${MULTUS_LOG_FILE})/multus-daemon.log"
     fi
-    ETCD_CFG_DIR=${ETCD_FILE_HOST_DIR} TICKER_TIME=${MULTUS_TICKER_TIME} DOCKER_HOST="unix:///host/var/run/docker.sock" LOG_FILE=${MULTUS_DAEMON_LOG_FILE} LOG_LEVEL=${MULTUS_LOG_LEVEL} ${DAEMON_BIN_FILE} &
+    ETCD_CFG_DIR=${ETCD_FILE_HOST_DIR} TICKER_TIME=${MULTUS_TICKER_TIME} METRICS_ADDR=${MULTUS_METRICS_ADDR} IPAM_CHECK_MODE=${MULTUS_IPAM_CHECK_MODE} CONTAINER_RUNTIME=${MULTUS_CONTAINER_RUNTIME} RUNTIME_ENDPOINT=${MULTUS_RUNTIME_ENDPOINT} POD_GC_MODE=${MULTUS_POD_GC_MODE} POD_GC_GRACE_PERIOD=${MULTUS_POD_GC_GRACE_PERIOD} HOT_PLUG_MODE=${MULTUS_HOT_PLUG_MODE} SERVER_MODE=${MULTUS_SERVER_MODE} SERVER_SOCKET=${MULTUS_SERVER_SOCKET} NAD_CACHE_TTL=${MULTUS_NAD_CACHE_TTL} CNI_BIN_DIR=${CNI_BIN_DIR} DOCKER_HOST="unix:///host/var/run/docker.sock" LOG_FILE=${MULTUS_DAEMON_LOG_FILE} LOG_LEVEL=${MULTUS_LOG_LEVEL} ${DAEMON_BIN_FILE} &
   fi
 }
 
@@ -333,6 +388,11 @@ function generateMultusConf() {
           ISOLATION_STRING="\"namespaceIsolation\": true,"
         fi
 
+        MAX_PARALLEL_DELEGATES_STRING=""
+        if [ ! -z "${MULTUS_MAX_PARALLEL_DELEGATES// /}" ]; then
+          MAX_PARALLEL_DELEGATES_STRING="\"maxParallelDelegates\": $MULTUS_MAX_PARALLEL_DELEGATES,"
+        fi
+
         LOG_LEVEL_STRING=""
         if [ ! -z "${MULTUS_LOG_LEVEL// /}" ]; then
           case "$MULTUS_LOG_LEVEL" in
@@ -390,6 +450,7 @@ function generateMultusConf() {
           "name": "$MASTER_PLUGIN_NET_NAME",
           "type": "multus",
           $ISOLATION_STRING
+          $MAX_PARALLEL_DELEGATES_STRING
           $LOG_LEVEL_STRING
           $LOG_FILE_STRING
           $MULTUS_CRD_PLURAL_STRING
@@ -8,6 +8,13 @@ set -e
 MULTUS_KUBECONFIG_FILE_HOST="host/etc/cni/net.d/multus.d/multus.kubeconfig"
 ETCD_FILE_HOST_DIR="/host/etc/cni/net.d/multus.d/etcd"
 MULTUS_TICKER_TIME="21600"
+MULTUS_UTILISATION_CHECK_TIME="300"
+MULTUS_UTILISATION_THRESHOLDS="80,90,100"
+MULTUS_WEBHOOK_MODE="off"
+MULTUS_WEBHOOK_ADDR=":8443"
+MULTUS_WEBHOOK_CERT_FILE=""
+MULTUS_WEBHOOK_KEY_FILE=""
+MULTUS_WEBHOOK_NAMESPACE_ISOLATION="off"
 MULTUS_LOG_LEVEL="error"
 MULTUS_LOG_FILE="/var/log/multus-controller.log"
 
@@ -17,6 +24,13 @@ function usage() {
   echo -e "\t--multus-kubeconfig-file-host=$MULTUS_KUBECONFIG_FILE_HOST"
   echo -e "\t--etcd-file-host-dir=$ETCD_FILE_HOST_DIR"
   echo -e "\t--multus-ticker-time=$MULTUS_TICKER_TIME"
+  echo -e "\t--multus-utilisation-check-time=$MULTUS_UTILISATION_CHECK_TIME (seconds between ip pool utilisation checks)"
+  echo -e "\t--multus-utilisation-thresholds=$MULTUS_UTILISATION_THRESHOLDS (percents an event is emitted on the net-attach-def at)"
+  echo -e "\t--multus-webhook-mode=$MULTUS_WEBHOOK_MODE (on/off, validate the net-attach-defs in an admission webhook)"
+  echo -e "\t--multus-webhook-addr=$MULTUS_WEBHOOK_ADDR (address the webhook listens on)"
+  echo -e "\t--multus-webhook-cert-file=$MULTUS_WEBHOOK_CERT_FILE (certificate of the webhook, required with --multus-webhook-mode=on)"
+  echo -e "\t--multus-webhook-key-file=$MULTUS_WEBHOOK_KEY_FILE (key of the webhook, required with --multus-webhook-mode=on)"
+  echo -e "\t--multus-webhook-namespace-isolation=$MULTUS_WEBHOOK_NAMESPACE_ISOLATION (on/off, on if the multus daemonset runs with --namespace-isolation=true)"
   echo -e "\t--multus-log-level=$MULTUS_LOG_LEVEL (empty by default, used only with --multus-conf-file=auto)"
   echo -e "\t--multus-log-file=$MULTUS_LOG_FILE (empty by default, used only with --multus-conf-file=auto)"
 }
@@ -57,6 +71,27 @@ while [ "$1" != "" ]; do
   --multus-ticker-time)
     MULTUS_TICKER_TIME=$VALUE
     ;;
+  --multus-utilisation-check-time)
+    MULTUS_UTILISATION_CHECK_TIME=$VALUE
+    ;;
+  --multus-utilisation-thresholds)
+    MULTUS_UTILISATION_THRESHOLDS=$VALUE
+    ;;
+  --multus-webhook-mode)
+    MULTUS_WEBHOOK_MODE=$VALUE
+    ;;
+  --multus-webhook-addr)
+    MULTUS_WEBHOOK_ADDR=$VALUE
+    ;;
+  --multus-webhook-cert-file)
+    MULTUS_WEBHOOK_CERT_FILE=$VALUE
+    ;;
+  --multus-webhook-key-file)
+    MULTUS_WEBHOOK_KEY_FILE=$VALUE
+    ;;
+  --multus-webhook-namespace-isolation)
+    MULTUS_WEBHOOK_NAMESPACE_ISOLATION=$VALUE
+    ;;
   *)
     warn "unknown parameter \"$PARAM\""
     ;;
@@ -64,4 +99,4 @@ while [ "$1" != "" ]; do
   shift
 done
 
-KUBE_CONFIG=${MULTUS_KUBECONFIG_FILE_HOST} ETCD_CFG_DIR=${ETCD_FILE_HOST_DIR} TICKER_TIME=${MULTUS_TICKER_TIME} LOG_LEVEL=${MULTUS_LOG_LEVEL} LOG_FILE=${MULTUS_LOG_FILE} /multus-controller
\ No newline at end of file
+KUBE_CONFIG=${MULTUS_KUBECONFIG_FILE_HOST} ETCD_CFG_DIR=${ETCD_FILE_HOST_DIR} TICKER_TIME=${MULTUS_TICKER_TIME} UTILISATION_CHECK_TIME=${MULTUS_UTILISATION_CHECK_TIME} UTILISATION_THRESHOLDS=${MULTUS_UTILISATION_THRESHOLDS} WEBHOOK_MODE=${MULTUS_WEBHOOK_MODE} WEBHOOK_ADDR=${MULTUS_WEBHOOK_ADDR} WEBHOOK_CERT_FILE=${MULTUS_WEBHOOK_CERT_FILE} WEBHOOK_KEY_FILE=${MULTUS_WEBHOOK_KEY_FILE} WEBHOOK_NAMESPACE_ISOLATION=${MULTUS_WEBHOOK_NAMESPACE_ISOLATION} LOG_LEVEL=${MULTUS_LOG_LEVEL} LOG_FILE=${MULTUS_LOG_FILE} /multus-controller
\ No newline at end of file
@@ -0,0 +1,168 @@
+// Copyright (c) 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8sclient
+
+import (
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/intel/multus-cni/logging"
+)
+
+// DefaultRawCacheTTL is how long the network attachment definitions read
+// by a cached KubeClient are used before they are read again
+const DefaultRawCacheTTL = 30 * time.Second
+
+type rawEntry struct {
+	data    []byte
+	expires time.Time
+}
+
+// cachedKubeClient serves the pods of the node from an informer and the
+// network attachment definitions from a cache of ttl, what it does not have
+// is read from live
+type cachedKubeClient struct {
+	live KubeClient
+	ttl  time.Duration
+	now  func() time.Time
+
+	pods cache.Store
+
+	mu  sync.Mutex
+	raw map[string]*rawEntry
+	// written are the pods updated through the client, they are read from
+	// live until the informer has the version of the api server
+	written map[string]bool
+}
+
+// cachedKubeClient implements KubeClient
+var _ KubeClient = &cachedKubeClient{}
+
+func newCachedKubeClient(live KubeClient, ttl time.Duration) *cachedKubeClient {
+	return &cachedKubeClient{
+		live:    live,
+		ttl:     ttl,
+		now:     time.Now,
+		pods:    cache.NewStore(cache.MetaNamespaceKeyFunc),
+		raw:     map[string]*rawEntry{},
+		written: map[string]bool{},
+	}
+}
+
+// NewCachedKubeClient returns a KubeClient of client for long running
+// processes, which watches the pods of node until stopCh is closed and keeps
+// the network attachment definitions read for ttl
+func NewCachedKubeClient(client kubernetes.Interface, node string, ttl time.Duration, stopCh <-chan struct{}) KubeClient {
+	c := newCachedKubeClient(NewKubeClient(client), ttl)
+	selector := fields.OneTermEqualSelector("spec.nodeName", node).String()
+	var controller cache.Controller
+	c.pods, controller = cache.NewInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				options.FieldSelector = selector
+				return client.CoreV1().Pods("").List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				options.FieldSelector = selector
+				return client.CoreV1().Pods("").Watch(options)
+			},
+		},
+		&v1.Pod{},
+		0,
+		cache.ResourceEventHandlerFuncs{
+			DeleteFunc: func(obj interface{}) {
+				key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+				if err != nil {
+					return
+				}
+				c.mu.Lock()
+				delete(c.written, key)
+				c.mu.Unlock()
+			},
+		},
+	)
+	go controller.Run(stopCh)
+	return c
+}
+
+// GetRawWithPath returns the data of path read less than ttl ago, or reads it
+func (c *cachedKubeClient) GetRawWithPath(path string) ([]byte, error) {
+	c.mu.Lock()
+	e, ok := c.raw[path]
+	if ok && c.now().Before(e.expires) {
+		c.mu.Unlock()
+		return e.data, nil
+	}
+	c.mu.Unlock()
+
+	data, err := c.live.GetRawWithPath(path)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	// the expired entries are dropped as the definitions are deleted
+	for p, e := range c.raw {
+		if !c.now().Before(e.expires) {
+			delete(c.raw, p)
+		}
+	}
+	c.raw[path] = &rawEntry{data: data, expires: c.now().Add(c.ttl)}
+	c.mu.Unlock()
+	return data, nil
+}
+
+// GetPod returns a copy of the pod of the informer, or reads the pods it
+// does not have and those it has not seen updated yet
+func (c *cachedKubeClient) GetPod(namespace, name string) (*v1.Pod, error) {
+	key := namespace + "/" + name
+	obj, exists, err := c.pods.GetByKey(key)
+	if err != nil || !exists {
+		logging.Debugf("GetPod: %s is not cached, read it", key)
+		return c.live.GetPod(namespace, name)
+	}
+	cached := obj.(*v1.Pod)
+
+	c.mu.Lock()
+	written := c.written[key]
+	c.mu.Unlock()
+	if !written {
+		return cached.DeepCopy(), nil
+	}
+
+	pod, err := c.live.GetPod(namespace, name)
+	if err == nil && pod.ResourceVersion == cached.ResourceVersion {
+		c.mu.Lock()
+		delete(c.written, key)
+		c.mu.Unlock()
+	}
+	return pod, err
+}
+
+// UpdatePodStatus updates pod, the pod is read from live until the informer
+// is up to date
+func (c *cachedKubeClient) UpdatePodStatus(pod *v1.Pod) (*v1.Pod, error) {
+	c.mu.Lock()
+	c.written[pod.Namespace+"/"+pod.Name] = true
+	c.mu.Unlock()
+	return c.live.UpdatePodStatus(pod)
+}
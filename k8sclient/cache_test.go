@@ -0,0 +1,113 @@
+// Copyright (c) 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8sclient
+
+import (
+	"time"
+
+	testhelpers "github.com/intel/multus-cni/testing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("cached k8sclient", func() {
+	It("keeps the network attachment definitions for ttl", func() {
+		fKubeClient := testhelpers.NewFakeKubeClient()
+		fKubeClient.AddNetConfig("kube-system", "net1", `{"name": "net1", "type": "mynet"}`)
+		now := time.Now()
+		c := newCachedKubeClient(fKubeClient, time.Minute)
+		c.now = func() time.Time { return now }
+
+		path := "/apis/k8s.cni.cncf.io/v1/namespaces/kube-system/" + CRDPlural + "/net1"
+		data, err := c.GetRawWithPath(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(ContainSubstring("mynet"))
+
+		fKubeClient.AddNetConfig("kube-system", "net1", `{"name": "net1", "type": "othernet"}`)
+		data, err = c.GetRawWithPath(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(ContainSubstring("mynet"))
+
+		now = now.Add(time.Minute)
+		data, err = c.GetRawWithPath(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(ContainSubstring("othernet"))
+
+		// the misses are not cached
+		_, err = c.GetRawWithPath("/apis/k8s.cni.cncf.io/v1/namespaces/kube-system/" + CRDPlural + "/net2")
+		Expect(err).To(HaveOccurred())
+		fKubeClient.AddNetConfig("kube-system", "net2", `{"name": "net2", "type": "mynet"}`)
+		_, err = c.GetRawWithPath("/apis/k8s.cni.cncf.io/v1/namespaces/kube-system/" + CRDPlural + "/net2")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("serves the pods of the informer", func() {
+		fKubeClient := testhelpers.NewFakeKubeClient()
+		pod := testhelpers.NewFakePod("testpod", "net1", "")
+		pod.ResourceVersion = "1"
+		fKubeClient.AddPod(pod)
+		c := newCachedKubeClient(fKubeClient, time.Minute)
+		Expect(c.pods.Add(pod.DeepCopy())).To(Succeed())
+
+		got, err := c.GetPod("test", "testpod")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got.Annotations[NetworkAttachmentAnnot]).To(Equal("net1"))
+		Expect(fKubeClient.PodCount).To(Equal(0))
+
+		// the pods of the informer are not changed by the callers
+		got.Annotations[NetworkAttachmentStatus] = "[]"
+		got, err = c.GetPod("test", "testpod")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got.Annotations).NotTo(HaveKey(NetworkAttachmentStatus))
+
+		// a miss is read from the api server
+		other := testhelpers.NewFakePod("otherpod", "", "")
+		fKubeClient.AddPod(other)
+		got, err = c.GetPod("test", "otherpod")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got.Name).To(Equal("otherpod"))
+		Expect(fKubeClient.PodCount).To(Equal(1))
+	})
+
+	It("reads the pods updated until the informer has them", func() {
+		fKubeClient := testhelpers.NewFakeKubeClient()
+		pod := testhelpers.NewFakePod("testpod", "net1", "")
+		pod.ResourceVersion = "1"
+		fKubeClient.AddPod(pod)
+		c := newCachedKubeClient(fKubeClient, time.Minute)
+		Expect(c.pods.Add(pod.DeepCopy())).To(Succeed())
+
+		updated := pod.DeepCopy()
+		updated.ResourceVersion = "2"
+		updated.Annotations[NetworkAttachmentStatus] = "[]"
+		_, err := c.UpdatePodStatus(updated)
+		Expect(err).NotTo(HaveOccurred())
+
+		got, err := c.GetPod("test", "testpod")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got.Annotations[NetworkAttachmentStatus]).To(Equal("[]"))
+		Expect(fKubeClient.PodCount).To(Equal(1))
+
+		// once the informer has the update, the pod is served from it again
+		Expect(c.pods.Update(updated.DeepCopy())).To(Succeed())
+		_, err = c.GetPod("test", "testpod")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fKubeClient.PodCount).To(Equal(2))
+		got, err = c.GetPod("test", "testpod")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got.Annotations[NetworkAttachmentStatus]).To(Equal("[]"))
+		Expect(fKubeClient.PodCount).To(Equal(2))
+	})
+})
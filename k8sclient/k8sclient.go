@@ -17,8 +17,10 @@ package k8sclient
 import (
 	"encoding/json"
 	"fmt"
+	netutils "net"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
 
 	v1 "k8s.io/api/core/v1"
@@ -43,9 +45,15 @@ var (
 	NetworkAttachmentAnnot  = "k8s.v1.cni.cncf.io/" + annotation
 	DefaultNetAnnot         = NetworkAttachmentAnnot + "-default"
 	NetworkAttachmentStatus = NetworkAttachmentAnnot + "-status"
-	ExtEnvAnnot             = "k8s.v1.cni.cncf.io/extEnv"
+	// ExtEnvAnnot is deprecated, set fixedIP and ipCount in the elements of
+	// NetworkAttachmentAnnot instead
+	ExtEnvAnnot = "k8s.v1.cni.cncf.io/extEnv"
 )
 
+// maxIPCount is the most addresses a network attachment may request from a
+// range set
+const maxIPCount = 64
+
 func init() {
 	logging.Verbosef("CRD:%s\nANNOT:%s\nRESOURE_NAME_ANNOT:%s\nNET_ATTACH_ANNOT:%s\nDEF_NET_ANNOT:%s\nNET_ATTACH_STATUS:%s\n",
 		CRDPlural, annotation, ResourceNameAnnot,
@@ -88,6 +96,11 @@ func (d *defaultKubeClient) Client() *kubernetes.Interface {
 	return &d.client
 }
 
+// NewKubeClient returns the KubeClient of client
+func NewKubeClient(client kubernetes.Interface) KubeClient {
+	return &defaultKubeClient{client: client}
+}
+
 func setKubeClientInfo(c *ClientInfo, client KubeClient, k8sArgs *types.K8sArgs) {
 	logging.Debugf("setKubeClientInfo: %v, %v, %v", c, client, k8sArgs)
 	c.Client = client
@@ -140,6 +153,36 @@ func SetNetworkStatus(client KubeClient, k8sArgs *types.K8sArgs, netStatus []*ty
 	return nil
 }
 
+// GetNetworkStatus returns the network status of the Pod annotation, nil if
+// there is no kube client
+func GetNetworkStatus(client KubeClient, k8sArgs *types.K8sArgs, conf *types.NetConf) ([]*types.NetworkStatus, error) {
+	logging.Debugf("GetNetworkStatus: %v, %v, %v", client, k8sArgs, conf)
+
+	client, err := GetK8sClient(conf.Kubeconfig, client)
+	if err != nil {
+		return nil, logging.Errorf("GetNetworkStatus: %v", err)
+	}
+	if client == nil {
+		logging.Debugf("GetNetworkStatus: kube client info is not defined, skip network status check")
+		return nil, nil
+	}
+
+	podName := string(k8sArgs.K8S_POD_NAME)
+	podNamespace := string(k8sArgs.K8S_POD_NAMESPACE)
+	pod, err := client.GetPod(podNamespace, podName)
+	if err != nil {
+		return nil, logging.Errorf("GetNetworkStatus: failed to query the pod %v in out of cluster comm: %v", podName, err)
+	}
+
+	netStatus := []*types.NetworkStatus{}
+	if annot := pod.Annotations[NetworkAttachmentStatus]; annot != "" {
+		if err := json.Unmarshal([]byte(annot), &netStatus); err != nil {
+			return nil, logging.Errorf("GetNetworkStatus: failed to parse the network status of pod %v: %v", podName, err)
+		}
+	}
+	return netStatus, nil
+}
+
 func setPodNetworkAnnotation(client KubeClient, namespace string, pod *v1.Pod, networkstatus string) (*v1.Pod, error) {
 	logging.Debugf("setPodNetworkAnnotation: %v, %s, %v, %s", client, namespace, pod, networkstatus)
 	//if pod annotations is empty, make sure it allocatable
@@ -249,11 +292,94 @@ func parsePodNetworkAnnotation(podNetworks, defaultNamespace string) ([]*types.N
 		if net.ObsolatedInterfaceRequest != "" && net.InterfaceRequest == "" {
 			net.InterfaceRequest = net.ObsolatedInterfaceRequest
 		}
+		if err := validateIPAMRequest(net); err != nil {
+			return nil, logging.Errorf("parsePodNetworkAnnotation: %v", err)
+		}
 	}
 
 	return networks, nil
 }
 
+// validateIPAMRequest checks the fixedIP, ipCount and ipPool of net, before
+// any delegate is called
+func validateIPAMRequest(net *types.NetworkSelectionElement) error {
+	if net.IPCount < 0 || net.IPCount > maxIPCount {
+		return fmt.Errorf("ipCount %d of network %q must be between 1 and %d", net.IPCount, net.Name, maxIPCount)
+	}
+	if net.IPPool != "" {
+		if _, _, err := netutils.ParseCIDR(net.IPPool); err != nil {
+			return fmt.Errorf("ipPool %q of network %q is not a subnet: %v", net.IPPool, net.Name, err)
+		}
+		if net.FixedIP {
+			return fmt.Errorf("ipPool and fixedIP of network %q can not be both set, fixed ips come from the fixRange", net.Name)
+		}
+	}
+	if net.FixedIP && net.IPRequest != "" {
+		return fmt.Errorf("ips and fixedIP of network %q can not be both set", net.Name)
+	}
+	return nil
+}
+
+// applyExtEnv sets the fixedIP and ipCount of networks from the deprecated
+// ExtEnvAnnot, "Fix=<net>,<net>;Num=<net>:<count>,<net>:<count>". The elements
+// of the networks annotation which set them take precedence.
+func applyExtEnv(networks []*types.NetworkSelectionElement, extEnv string) error {
+	logging.Verbosef("annotation %v is deprecated, set fixedIP and ipCount in %v", ExtEnvAnnot, NetworkAttachmentAnnot)
+	byName := func(name string) []*types.NetworkSelectionElement {
+		found := []*types.NetworkSelectionElement{}
+		for _, net := range networks {
+			if strings.ToLower(net.Name) == strings.ToLower(strings.TrimSpace(name)) {
+				found = append(found, net)
+			}
+		}
+		return found
+	}
+
+	for _, kv := range strings.Split(extEnv, ";") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		pair := strings.SplitN(kv, "=", 2)
+		if len(pair) != 2 {
+			return fmt.Errorf("invalid %v item %q, must be KEY=VALUE", ExtEnvAnnot, kv)
+		}
+		switch pair[0] {
+		case "Fix":
+			for _, name := range strings.Split(pair[1], ",") {
+				for _, net := range byName(name) {
+					net.FixedIP = true
+				}
+			}
+		case "Num":
+			for _, item := range strings.Split(pair[1], ",") {
+				v := strings.Split(item, ":")
+				if len(v) != 2 {
+					return fmt.Errorf("invalid %v Num item %q, must be <network>:<count>", ExtEnvAnnot, item)
+				}
+				n, err := strconv.Atoi(v[1])
+				if err != nil || n < 1 {
+					return fmt.Errorf("invalid %v address count %q of network %q", ExtEnvAnnot, v[1], v[0])
+				}
+				for _, net := range byName(v[0]) {
+					if net.IPCount == 0 {
+						net.IPCount = n
+					}
+				}
+			}
+		default:
+			logging.Errorf("ignore unknown key %q of %v", pair[0], ExtEnvAnnot)
+		}
+	}
+
+	for _, net := range networks {
+		if err := validateIPAMRequest(net); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func getCNIConfigFromFile(name string, confdir string) ([]byte, error) {
 	logging.Debugf("getCNIConfigFromFile: %s, %s", name, confdir)
 
@@ -355,12 +481,16 @@ func cniConfigFromNetworkResource(customResource *types.NetworkAttachmentDefinit
 	return config, nil
 }
 
+// networkResourcePath returns the path of the network attachment definition
+// net selects
+func networkResourcePath(net *types.NetworkSelectionElement) string {
+	return fmt.Sprintf("/apis/k8s.cni.cncf.io/v1/namespaces/%s/"+CRDPlural+"/%s", net.Namespace, net.Name)
+}
+
 func getKubernetesDelegate(client KubeClient, net *types.NetworkSelectionElement, confdir string, pod *v1.Pod, resourceMap map[string]*types.ResourceInfo) (*types.DelegateNetConf, map[string]*types.ResourceInfo, error) {
 
 	logging.Debugf("getKubernetesDelegate: %v, %v, %s", client, net, confdir)
-	rawPath := fmt.Sprintf("/apis/k8s.cni.cncf.io/v1/namespaces/%s/"+CRDPlural+"/%s", net.Namespace, net.Name)
-
-	netData, err := client.GetRawWithPath(rawPath)
+	netData, err := client.GetRawWithPath(networkResourcePath(net))
 	if err != nil {
 		return nil, resourceMap, logging.Errorf("getKubernetesDelegate: failed to get network resource, refer Multus README.md for the usage guide: %v", err)
 	}
@@ -434,22 +564,22 @@ func GetK8sArgs(args *skel.CmdArgs) (*types.K8sArgs, error) {
 
 // TryLoadPodDelegates attempts to load Kubernetes-defined delegates and add them to the Multus config.
 // Returns the number of Kubernetes-defined delegates added or an error.
-func TryLoadPodDelegates(k8sArgs *types.K8sArgs, conf *types.NetConf, kubeClient KubeClient) (int, *ClientInfo, string, error) {
+func TryLoadPodDelegates(k8sArgs *types.K8sArgs, conf *types.NetConf, kubeClient KubeClient) (int, *ClientInfo, error) {
 	var err error
 	clientInfo := &ClientInfo{}
 
 	logging.Debugf("TryLoadPodDelegates: %v, %v, %v", k8sArgs, conf, kubeClient)
 	kubeClient, err = GetK8sClient(conf.Kubeconfig, kubeClient)
 	if err != nil {
-		return 0, nil, "", err
+		return 0, nil, err
 	}
 
 	if kubeClient == nil {
 		if len(conf.Delegates) == 0 {
 			// No available kube client and no delegates, we can't do anything
-			return 0, nil, "", logging.Errorf("must have either Kubernetes config or delegates, refer Multus README.md for the usage guide")
+			return 0, nil, logging.Errorf("must have either Kubernetes config or delegates, refer Multus README.md for the usage guide")
 		}
-		return 0, nil, "", nil
+		return 0, nil, nil
 	}
 
 	setKubeClientInfo(clientInfo, kubeClient, k8sArgs)
@@ -457,12 +587,12 @@ func TryLoadPodDelegates(k8sArgs *types.K8sArgs, conf *types.NetConf, kubeClient
 	pod, err := kubeClient.GetPod(string(k8sArgs.K8S_POD_NAMESPACE), string(k8sArgs.K8S_POD_NAME))
 	if err != nil {
 		logging.Debugf("tryLoadK8sDelegates: Err in loading K8s cluster default network from pod annotation: %v, use cached delegates", err)
-		return 0, nil, "", nil
+		return 0, nil, nil
 	}
 
 	delegate, err := tryLoadK8sPodDefaultNetwork(kubeClient, pod, conf)
 	if err != nil {
-		return 0, nil, "", logging.Errorf("tryLoadK8sDelegates: Err in loading K8s cluster default network from pod annotation: %v", err)
+		return 0, nil, logging.Errorf("tryLoadK8sDelegates: Err in loading K8s cluster default network from pod annotation: %v", err)
 	}
 	if delegate != nil {
 		logging.Debugf("tryLoadK8sDelegates: Overwrite the cluster default network with %v from pod annotations", delegate)
@@ -471,28 +601,25 @@ func TryLoadPodDelegates(k8sArgs *types.K8sArgs, conf *types.NetConf, kubeClient
 	}
 
 	networks, err := GetPodNetwork(pod)
-	logging.Debugf("annotations:%v", pod.Annotations)
 	if networks != nil {
-		extEnv, ok := pod.Annotations[ExtEnvAnnot]
-		logging.Debugf("extEnv:%v,ok:%v", extEnv, ok)
-		if !ok {
-			extEnv = ""
-		}
 		delegates, err := GetNetworkDelegates(kubeClient, pod, networks, conf.ConfDir, conf.NamespaceIsolation)
 		if err != nil {
 			if _, ok := err.(*NoK8sNetworkError); ok {
-				return 0, clientInfo, extEnv, nil
+				return 0, clientInfo, nil
 			}
-			return 0, nil, extEnv, logging.Errorf("Multus: Err in getting k8s network from pod: %v", err)
+			return 0, nil, logging.Errorf("Multus: Err in getting k8s network from pod: %v", err)
 		}
 
 		if err = conf.AddDelegates(delegates); err != nil {
-			return 0, nil, extEnv, err
+			return 0, nil, err
 		}
 
-		return len(delegates), clientInfo, extEnv, nil
+		return len(delegates), clientInfo, nil
+	}
+	if _, ok := err.(*NoK8sNetworkError); err != nil && !ok {
+		return 0, nil, logging.Errorf("Multus: Err in getting k8s network from pod: %v", err)
 	}
-	return 0, clientInfo, "", nil
+	return 0, clientInfo, nil
 }
 
 // GetK8sClient gets client info from kubeconfig
@@ -553,9 +680,23 @@ func GetPodNetwork(pod *v1.Pod) ([]*types.NetworkSelectionElement, error) {
 	if err != nil {
 		return nil, err
 	}
+	if extEnv := pod.Annotations[ExtEnvAnnot]; extEnv != "" {
+		if err := applyExtEnv(networks, extEnv); err != nil {
+			return nil, logging.Errorf("GetPodNetwork: %v", err)
+		}
+	}
 	return networks, nil
 }
 
+// checkNamespaceIsolation returns an error if net is out of podNamespace, the
+// pods may only attach the networks of their namespace with NamespaceIsolation
+func checkNamespaceIsolation(podNamespace string, net *types.NetworkSelectionElement) error {
+	if podNamespace != net.Namespace {
+		return fmt.Errorf("namespace isolation violation: podnamespace: %v / target namespace: %v", podNamespace, net.Namespace)
+	}
+	return nil
+}
+
 // GetNetworkDelegates returns delegatenetconf from net-attach-def annotation in pod
 func GetNetworkDelegates(k8sclient KubeClient, pod *v1.Pod, networks []*types.NetworkSelectionElement, confdir string, confnamespaceIsolation bool) ([]*types.DelegateNetConf, error) {
 	logging.Debugf("GetNetworkDelegates: %v, %v, %v, %v, %v", k8sclient, pod, networks, confdir, confnamespaceIsolation)
@@ -572,8 +713,8 @@ func GetNetworkDelegates(k8sclient KubeClient, pod *v1.Pod, networks []*types.Ne
 		// The pods namespace (stored as defaultNamespace, does not equal the annotation's target namespace in net.Namespace)
 		// In the case that this is a mismatch when namespaceisolation is enabled, this should be an error.
 		if confnamespaceIsolation {
-			if defaultNamespace != net.Namespace {
-				return nil, logging.Errorf("GetPodNetwork: namespace isolation violation: podnamespace: %v / target namespace: %v", defaultNamespace, net.Namespace)
+			if err := checkNamespaceIsolation(defaultNamespace, net); err != nil {
+				return nil, logging.Errorf("GetPodNetwork: %v", err)
 			}
 		}
 
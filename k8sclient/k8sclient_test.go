@@ -16,6 +16,7 @@
 package k8sclient
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -203,6 +204,97 @@ var _ = Describe("k8sclient operations", func() {
 		Expect(err).To(MatchError("parsePodNetworkAnnotation: failed to parse pod Network Attachment Selection Annotation JSON format: invalid character 'a' looking for beginning of value"))
 	})
 
+	It("passes fixedIP, ipCount and ipPool to the ipam of the delegates", func() {
+		fakePod := testutils.NewFakePod("testpod", `[
+{"name":"net1", "fixedIP": true},
+{"name":"net2", "ipCount": 2, "ipPool": "10.1.2.0/24"}
+]`, "")
+
+		fKubeClient := testutils.NewFakeKubeClient()
+		fKubeClient.AddPod(fakePod)
+		fKubeClient.AddNetConfig(fakePod.ObjectMeta.Namespace, "net1", `{
+	"name": "net1",
+	"type": "mynet",
+	"cniVersion": "0.3.1",
+	"ipam": {"type": "multus-ipam"}
+}`)
+		fKubeClient.AddNetConfig(fakePod.ObjectMeta.Namespace, "net2", `{
+	"name": "net2",
+	"cniVersion": "0.3.1",
+	"plugins": [
+		{"type": "mynet2", "ipam": {"type": "multus-ipam"}},
+		{"type": "tuning"}
+	]
+}`)
+
+		kubeClient, err := GetK8sClient("", fKubeClient)
+		Expect(err).NotTo(HaveOccurred())
+		networks, err := GetPodNetwork(fakePod)
+		Expect(err).NotTo(HaveOccurred())
+		delegates, err := GetNetworkDelegates(kubeClient, fakePod, networks, tmpDir, false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(len(delegates)).To(Equal(2))
+
+		type cniArgs struct {
+			Args struct {
+				CNI map[string]interface{} `json:"cni"`
+			} `json:"args"`
+		}
+		conf := &cniArgs{}
+		Expect(json.Unmarshal(delegates[0].Bytes, conf)).To(Succeed())
+		Expect(conf.Args.CNI).To(Equal(map[string]interface{}{"fixedIP": true}))
+		Expect(delegates[0].FixedIP).To(BeTrue())
+
+		confList := &struct {
+			Plugins []*cniArgs `json:"plugins"`
+		}{}
+		Expect(json.Unmarshal(delegates[1].Bytes, confList)).To(Succeed())
+		Expect(confList.Plugins[0].Args.CNI).To(Equal(map[string]interface{}{"ipCount": float64(2), "ipPool": "10.1.2.0/24"}))
+		Expect(confList.Plugins[1].Args.CNI).To(BeNil())
+		Expect(delegates[1].IPCount).To(Equal(2))
+	})
+
+	It("translates the deprecated extEnv annotation", func() {
+		fakePod := testutils.NewFakePod("testpod", "net1,net2", "")
+		fakePod.Annotations[ExtEnvAnnot] = "Fix=net1;Num=net1:2,NET2:3"
+
+		networks, err := GetPodNetwork(fakePod)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(len(networks)).To(Equal(2))
+		Expect(networks[0].FixedIP).To(BeTrue())
+		Expect(networks[0].IPCount).To(Equal(2))
+		Expect(networks[1].FixedIP).To(BeFalse())
+		Expect(networks[1].IPCount).To(Equal(3))
+
+		// the networks annotation takes precedence
+		fakePod.Annotations[NetworkAttachmentAnnot] = `[{"name":"net1","ipCount":4}]`
+		networks, err = GetPodNetwork(fakePod)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(networks[0].IPCount).To(Equal(4))
+
+		fakePod.Annotations[ExtEnvAnnot] = "Num=net1:x"
+		_, err = GetPodNetwork(fakePod)
+		Expect(err).To(MatchError(`GetPodNetwork: invalid k8s.v1.cni.cncf.io/extEnv address count "x" of network "net1"`))
+	})
+
+	It("rejects invalid ipam requests", func() {
+		fakePod := testutils.NewFakePod("testpod", `[{"name":"net1","ipCount":-1}]`, "")
+		_, err := GetPodNetwork(fakePod)
+		Expect(err).To(MatchError(`parsePodNetworkAnnotation: ipCount -1 of network "net1" must be between 1 and 64`))
+
+		fakePod.Annotations[NetworkAttachmentAnnot] = `[{"name":"net1","ipPool":"10.1.2.0"}]`
+		_, err = GetPodNetwork(fakePod)
+		Expect(err).To(MatchError(`parsePodNetworkAnnotation: ipPool "10.1.2.0" of network "net1" is not a subnet: invalid CIDR address: 10.1.2.0`))
+
+		fakePod.Annotations[NetworkAttachmentAnnot] = `[{"name":"net1","fixedIP":true,"ipPool":"10.1.2.0/24"}]`
+		_, err = GetPodNetwork(fakePod)
+		Expect(err).To(MatchError(`parsePodNetworkAnnotation: ipPool and fixedIP of network "net1" can not be both set, fixed ips come from the fixRange`))
+
+		fakePod.Annotations[NetworkAttachmentAnnot] = `[{"name":"net1","fixedIP":true,"ips":"10.1.2.3"}]`
+		_, err = GetPodNetwork(fakePod)
+		Expect(err).To(MatchError(`parsePodNetworkAnnotation: ips and fixedIP of network "net1" can not be both set`))
+	})
+
 	It("retrieves delegates from kubernetes using on-disk config files", func() {
 		fakePod := testutils.NewFakePod("testpod", "net1,net2", "")
 		args := &skel.CmdArgs{
@@ -525,7 +617,7 @@ var _ = Describe("k8sclient operations", func() {
 		Expect(netConf.Delegates[0].Conf.Name).To(Equal("net2"))
 		Expect(netConf.Delegates[0].Conf.Type).To(Equal("mynet2"))
 
-		numK8sDelegates, _, _, err := TryLoadPodDelegates(k8sArgs, netConf, kubeClient)
+		numK8sDelegates, _, err := TryLoadPodDelegates(k8sArgs, netConf, kubeClient)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(numK8sDelegates).To(Equal(0))
 		Expect(netConf.Delegates[0].Conf.Name).To(Equal("net1"))
@@ -562,7 +654,7 @@ var _ = Describe("k8sclient operations", func() {
 		Expect(err).To(HaveOccurred())
 
 		netConf.ConfDir = "badfilepath"
-		_, _, _, err = TryLoadPodDelegates(k8sArgs, netConf, kubeClient)
+		_, _, err = TryLoadPodDelegates(k8sArgs, netConf, kubeClient)
 		Expect(err).To(HaveOccurred())
 	})
 
@@ -595,7 +687,7 @@ var _ = Describe("k8sclient operations", func() {
 		k8sArgs, err := GetK8sArgs(args)
 		Expect(err).NotTo(HaveOccurred())
 
-		numK8sDelegates, _, _, err := TryLoadPodDelegates(k8sArgs, netConf, kubeClient)
+		numK8sDelegates, _, err := TryLoadPodDelegates(k8sArgs, netConf, kubeClient)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(numK8sDelegates).To(Equal(0))
 		Expect(netConf.Delegates[0].Conf.Name).To(Equal("net1"))
@@ -630,7 +722,7 @@ var _ = Describe("k8sclient operations", func() {
 		k8sArgs, err := GetK8sArgs(args)
 		Expect(err).NotTo(HaveOccurred())
 
-		_, _, _, err = TryLoadPodDelegates(k8sArgs, netConf, nil)
+		_, _, err = TryLoadPodDelegates(k8sArgs, netConf, nil)
 		Expect(err).To(HaveOccurred())
 	})
 
@@ -662,12 +754,12 @@ var _ = Describe("k8sclient operations", func() {
 		k8sArgs, err := GetK8sArgs(args)
 		Expect(err).NotTo(HaveOccurred())
 
-		_, _, _, err = TryLoadPodDelegates(k8sArgs, netConf, nil)
+		_, _, err = TryLoadPodDelegates(k8sArgs, netConf, nil)
 		Expect(err).NotTo(HaveOccurred())
 
 		// additionally, we expect the test to fail with no delegates, as at least one is always required.
 		netConf.Delegates = nil
-		_, _, _, err = TryLoadPodDelegates(k8sArgs, netConf, nil)
+		_, _, err = TryLoadPodDelegates(k8sArgs, netConf, nil)
 		Expect(err).To(HaveOccurred())
 	})
 
@@ -722,7 +814,7 @@ users:
 		k8sArgs, err := GetK8sArgs(args)
 		Expect(err).NotTo(HaveOccurred())
 
-		_, _, _, err = TryLoadPodDelegates(k8sArgs, netConf, nil)
+		_, _, err = TryLoadPodDelegates(k8sArgs, netConf, nil)
 		Expect(err).NotTo(HaveOccurred())
 	})
 
@@ -1019,6 +1111,43 @@ users:
 			Expect(err).NotTo(HaveOccurred())
 		})
 
+		It("Gets the network status set before", func() {
+			conf := `{
+			"name": "node-cni-network",
+			"type": "multus",
+			"kubeconfig": "/etc/kubernetes/node-kubeconfig.yaml",
+			"delegates": [{
+				"type": "weave-net"
+			}]
+		}`
+			netConf, err := types.LoadNetConf([]byte(conf))
+			Expect(err).NotTo(HaveOccurred())
+
+			fakePod := testutils.NewFakePod("testpod", "", "")
+			args := &skel.CmdArgs{
+				Args: fmt.Sprintf("K8S_POD_NAME=%s;K8S_POD_NAMESPACE=%s", fakePod.ObjectMeta.Name, fakePod.ObjectMeta.Namespace),
+			}
+			fKubeClient := testutils.NewFakeKubeClient()
+			fKubeClient.AddPod(fakePod)
+			k8sArgs, err := GetK8sArgs(args)
+			Expect(err).NotTo(HaveOccurred())
+
+			netstatus, err := GetNetworkStatus(fKubeClient, k8sArgs, netConf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netstatus).To(BeEmpty())
+
+			expected := []*types.NetworkStatus{
+				{Name: "weave1", Interface: "eth0", IPs: []string{"1.1.1.2"}, Default: true},
+				{Name: "net1", Interface: "net1", IPs: []string{"1.1.1.3"}, Mac: "c2:11:22:33:44:66"},
+			}
+			err = SetNetworkStatus(fKubeClient, k8sArgs, expected, netConf)
+			Expect(err).NotTo(HaveOccurred())
+
+			netstatus, err = GetNetworkStatus(fKubeClient, k8sArgs, netConf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netstatus).To(Equal(expected))
+		})
+
 		It("Sets network status with kubeclient built from kubeconfig and attempts to connect", func() {
 			kubeletconf, err := os.Create("/etc/kubernetes/kubelet.conf")
 			kubeletconfDef := `apiVersion: v1
@@ -0,0 +1,57 @@
+// Copyright (c) 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8sclient
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+
+	"github.com/intel/multus-cni/types"
+)
+
+// ValidatePodNetworks checks the networks annotation of pod as CNI ADD reads
+// it, without calling any plugin: the annotation parses, the network
+// attachment definitions exist and are in the namespace of the pod with
+// namespaceIsolation, and the ips and mac requested parse. A pod without the
+// annotation is valid.
+func ValidatePodNetworks(client KubeClient, pod *v1.Pod, namespaceIsolation bool) error {
+	networks, err := GetPodNetwork(pod)
+	if err != nil {
+		if _, ok := err.(*NoK8sNetworkError); ok {
+			return nil
+		}
+		return fmt.Errorf("invalid %v annotation: %v", NetworkAttachmentAnnot, err)
+	}
+
+	for _, net := range networks {
+		if namespaceIsolation {
+			if err := checkNamespaceIsolation(pod.Namespace, net); err != nil {
+				return fmt.Errorf("network %q: %v", net.Name, err)
+			}
+		}
+		if err := types.CheckRequests(net.MacRequest, net.IPRequest); err != nil {
+			return fmt.Errorf("network %q: %v", net.Name, err)
+		}
+		if _, err := client.GetRawWithPath(networkResourcePath(net)); err != nil {
+			if apierrors.IsNotFound(err) {
+				return fmt.Errorf("network %q: network attachment definition %s/%s does not exist", net.Name, net.Namespace, net.Name)
+			}
+			return fmt.Errorf("network %q: failed to get network attachment definition %s/%s: %v", net.Name, net.Namespace, net.Name, err)
+		}
+	}
+	return nil
+}
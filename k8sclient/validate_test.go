@@ -0,0 +1,63 @@
+// Copyright (c) 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8sclient
+
+import (
+	testhelpers "github.com/intel/multus-cni/testing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("pod networks validation", func() {
+	var fKubeClient *testhelpers.FakeKubeClient
+
+	BeforeEach(func() {
+		fKubeClient = testhelpers.NewFakeKubeClient()
+		fKubeClient.AddNetConfig("test", "net1", `{"name": "net1", "type": "mynet"}`)
+		fKubeClient.AddNetConfig("kube-system", "net2", `{"name": "net2", "type": "mynet"}`)
+	})
+
+	It("admits the valid annotations", func() {
+		Expect(ValidatePodNetworks(fKubeClient, testhelpers.NewFakePod("testpod", "", ""), true)).To(Succeed())
+		Expect(ValidatePodNetworks(fKubeClient, testhelpers.NewFakePod("testpod", "net1@eth1, kube-system/net2", ""), false)).To(Succeed())
+		pod := testhelpers.NewFakePod("testpod", `[{"name": "net1", "ips": "10.1.0.5/24", "mac": "c2:11:22:33:44:55"}]`, "")
+		Expect(ValidatePodNetworks(fKubeClient, pod, true)).To(Succeed())
+	})
+
+	It("rejects the malformed annotations", func() {
+		err := ValidatePodNetworks(fKubeClient, testhelpers.NewFakePod("testpod", "net1@eth1@eth2", ""), false)
+		Expect(err).To(MatchError("invalid " + NetworkAttachmentAnnot + " annotation: parsePodNetworkAnnotation: Invalid network object (failed at '@')"))
+
+		err = ValidatePodNetworks(fKubeClient, testhelpers.NewFakePod("testpod", `[{"name": "net1"`, ""), false)
+		Expect(err.Error()).To(HavePrefix("invalid " + NetworkAttachmentAnnot + " annotation: parsePodNetworkAnnotation: failed to parse pod Network Attachment Selection Annotation JSON format"))
+
+		err = ValidatePodNetworks(fKubeClient, testhelpers.NewFakePod("testpod", `[{"name": "net1", "ipCount": -1}]`, ""), false)
+		Expect(err).To(MatchError("invalid " + NetworkAttachmentAnnot + ` annotation: parsePodNetworkAnnotation: ipCount -1 of network "net1" must be between 1 and 64`))
+	})
+
+	It("rejects the networks which can not be attached", func() {
+		err := ValidatePodNetworks(fKubeClient, testhelpers.NewFakePod("testpod", "net1,net3", ""), false)
+		Expect(err).To(MatchError(`network "net3": failed to get network attachment definition test/net3: resource not found`))
+
+		err = ValidatePodNetworks(fKubeClient, testhelpers.NewFakePod("testpod", "kube-system/net2", ""), true)
+		Expect(err).To(MatchError(`network "net2": namespace isolation violation: podnamespace: test / target namespace: kube-system`))
+
+		err = ValidatePodNetworks(fKubeClient, testhelpers.NewFakePod("testpod", `[{"name": "net1", "mac": "c2:11:22"}]`, ""), false)
+		Expect(err).To(MatchError(`network "net1": failed to parse mac address "c2:11:22"`))
+
+		err = ValidatePodNetworks(fKubeClient, testhelpers.NewFakePod("testpod", `[{"name": "net1", "ips": "10.1.0.300"}]`, ""), false)
+		Expect(err).To(MatchError(`network "net1": failed to parse IP address "10.1.0.300"`))
+	})
+})
@@ -39,6 +39,7 @@ const (
 var loggingStderr bool
 var loggingFp *os.File
 var loggingLevel Level
+var loggingKept bool
 
 const defaultTimestampFormat = time.RFC3339
 
@@ -120,8 +121,17 @@ func getLoggingLevel(levelStr string) Level {
 	return UnknownLevel
 }
 
+// KeepSettings makes the next SetLogLevel and SetLogFile do nothing, for the
+// processes running the commands of several multus configs, as multus-daemon
+func KeepSettings() {
+	loggingKept = true
+}
+
 // SetLogLevel sets logging level
 func SetLogLevel(levelStr string) {
+	if loggingKept {
+		return
+	}
 	level := getLoggingLevel(levelStr)
 	if level < MaxLevel {
 		loggingLevel = level
@@ -135,7 +145,7 @@ func SetLogStderr(enable bool) {
 
 // SetLogFile sets logging file
 func SetLogFile(filename string) {
-	if filename == "" {
+	if filename == "" || loggingKept {
 		return
 	}
 
@@ -68,6 +68,17 @@ var _ = Describe("logging operations", func() {
 		Expect(loggingLevel).To(Equal(currentLevel))
 	})
 
+	It("Check the settings kept", func() {
+		SetLogLevel("error")
+		KeepSettings()
+		defer func() { loggingKept = false }()
+		SetLogLevel("debug")
+		Expect(loggingLevel).To(Equal(ErrorLevel))
+		currentFp := loggingFp
+		SetLogFile("/tmp/multus-kept.log")
+		Expect(loggingFp).To(Equal(currentFp))
+	})
+
 	It("Check log to stderr setter with invalid level", func() {
 		currentVal := loggingStderr
 		SetLogStderr(!currentVal)
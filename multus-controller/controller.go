@@ -37,6 +37,7 @@ import (
 	"github.com/coreos/etcd/clientv3"
 	"github.com/intel/multus-cni/etcdv3"
 	"github.com/intel/multus-cni/logging"
+	"github.com/intel/multus-cni/multus-ipam/backend/allocator"
 	"github.com/intel/multus-cni/multus-ipam/backend/etcdv3cli"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
@@ -56,6 +57,7 @@ type KubeManager struct {
 	wg             sync.WaitGroup
 	fullCheck      bool
 	waitDelFixIPs  map[string]time.Time
+	utilLevels     map[string]int // thresholds reached by the net-attach-defs
 }
 
 func init() {
@@ -133,6 +135,7 @@ func NewKubeManager(ctx context.Context, wg sync.WaitGroup) (*KubeManager, error
 	km.ctx = ctx
 	km.wg = wg
 	km.waitDelFixIPs = make(map[string]time.Time)
+	km.utilLevels = make(map[string]int)
 	return &km, nil
 }
 
@@ -204,6 +207,16 @@ func main() {
 			km.PeriodChkFixIP()
 			wg.Done()
 		}()
+		wg.Add(1)
+		go func() {
+			km.PeriodChkUtilisation()
+			wg.Done()
+		}()
+		wg.Add(1)
+		go func() {
+			km.RunWebhook()
+			wg.Done()
+		}()
 	} else {
 		logging.Errorf("create kube manager failed, %v", err)
 	}
@@ -294,8 +307,10 @@ func (km *KubeManager) CheckFixIP() error {
 	}
 
 	if len(delList) > 0 {
-		logging.Debugf("Going to del %v", delList)
-		etcdv3.TransDelKeys(em.Cli, delList)
+		logging.Debugf("Going to release %v", delList)
+		if err := etcdv3cli.IPAMReleaseFixIPs(em, delList); err != nil {
+			return err
+		}
 	}
-	return nil
+	return etcdv3cli.IPAMPurgeQuarantine(em, allocator.MaxQuarantine)
 }
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/intel/multus-cni/etcdv3"
+	"github.com/intel/multus-cni/k8sclient"
+	"github.com/intel/multus-cni/logging"
+	"github.com/intel/multus-cni/multus-ipam/backend/allocator"
+	"github.com/intel/multus-cni/multus-ipam/backend/etcdv3cli"
+	"github.com/intel/multus-cni/types"
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var (
+	defaultThresholds       = []int{80, 90, 100}
+	defaultUtilisationTime  = time.Duration(5+rand.Intn(2)) * time.Minute
+	ipamStatusSuffix        = "-ipam-status"
+	ipamStatusLabel         = "k8s.cni.cncf.io/ipam-status"
+	nadAPIVersion           = "k8s.cni.cncf.io/v1"
+	nadKind                 = "NetworkAttachmentDefinition"
+	reasonUtilisationHigh   = "IPPoolUtilisationHigh"
+	reasonUtilisationNormal = "IPPoolUtilisationNormal"
+)
+
+// networkUsage is the cluster wide address usage of a network
+type networkUsage struct {
+	Network  string
+	Capacity uint64 // addresses of the ranges and the fixRange
+	Leased   uint64 // addresses of the blocks leased to the nodes
+	Fixed    uint64 // fixed ips bound
+}
+
+func (u *networkUsage) Used() uint64 {
+	return u.Leased + u.Fixed
+}
+
+func (u *networkUsage) Free() uint64 {
+	if u.Used() > u.Capacity {
+		return 0
+	}
+	return u.Capacity - u.Used()
+}
+
+// Known tells whether the utilisation of the network is known, the capacity
+// of the ipv6 ranges is not counted
+func (u *networkUsage) Known() bool {
+	return u.Capacity > 0
+}
+
+// Percent returns the utilisation of the network, 0 if it is not known
+func (u *networkUsage) Percent() int {
+	if !u.Known() {
+		return 0
+	}
+	return int(u.Used() * 100 / u.Capacity)
+}
+
+// PercentString returns the utilisation of the network for the status config
+// map, "unknown" if it is not known
+func (u *networkUsage) PercentString() string {
+	if !u.Known() {
+		return "unknown"
+	}
+	return strconv.Itoa(u.Percent()) + "%"
+}
+
+// parseThresholds parses a comma separated list of percents, e.g. "80,90,100"
+func parseThresholds(s string) ([]int, error) {
+	thresholds := []int{}
+	for _, f := range strings.Split(s, ",") {
+		t, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || t <= 0 || t > 100 {
+			return nil, fmt.Errorf("invalid threshold %q", f)
+		}
+		thresholds = append(thresholds, t)
+	}
+	sort.Ints(thresholds)
+	return thresholds, nil
+}
+
+// thresholdLevel returns how many of thresholds percent has reached
+func thresholdLevel(percent int, thresholds []int) int {
+	level := 0
+	for _, t := range thresholds {
+		if percent >= t {
+			level++
+		}
+	}
+	return level
+}
+
+// ipamCapacity returns the addresses a multus-ipam network may hand out, the
+// addresses of the ranges and the fixRange overlapping are counted once
+func ipamCapacity(conf *allocator.IPAMConfig) uint64 {
+	type bounds struct{ start, end uint32 }
+	all := []bounds{}
+	add := func(r *allocator.Range) {
+		// the blocks are leased from ipv4 ranges only
+		if start, end, ok := allocator.LeaseBounds(r); ok {
+			all = append(all, bounds{start, end})
+		}
+	}
+	for _, rs := range conf.Ranges {
+		for i := range rs {
+			add(&rs[i])
+		}
+	}
+	if conf.FixRange != nil {
+		add(conf.FixRange)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].start < all[j].start })
+
+	capacity := uint64(0)
+	var last *bounds
+	for i := range all {
+		b := &all[i]
+		if last != nil && b.start <= last.end {
+			if b.end > last.end {
+				capacity += uint64(b.end - last.end)
+				last.end = b.end
+			}
+			continue
+		}
+		capacity += uint64(b.end-b.start) + 1
+		last = b
+	}
+	return capacity
+}
+
+// nadPlugins returns the plugins of the config or config list of a
+// net-attach-def, with the name and cniVersion of the list and without the
+// log settings, which are kept off the controller
+func nadPlugins(config string) ([]map[string]interface{}, error) {
+	top := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(config), &top); err != nil {
+		return nil, err
+	}
+	plugins := []map[string]interface{}{top}
+	if list, ok := top["plugins"].([]interface{}); ok {
+		plugins = []map[string]interface{}{}
+		for _, p := range list {
+			if m, ok := p.(map[string]interface{}); ok {
+				m["name"], m["cniVersion"] = top["name"], top["cniVersion"]
+				plugins = append(plugins, m)
+			}
+		}
+	}
+	for _, p := range plugins {
+		delete(p, "logFile")
+		delete(p, "logLevel")
+	}
+	return plugins, nil
+}
+
+// usesIPAM tells whether plugin p allocates its addresses with multus-ipam
+func usesIPAM(p map[string]interface{}) bool {
+	ipam, ok := p["ipam"].(map[string]interface{})
+	return ok && ipam["type"] == "multus-ipam"
+}
+
+// nadIPAMConfig returns the multus-ipam config of the config or config list of
+// a net-attach-def, nil if it does not use multus-ipam
+func nadIPAMConfig(config string) (*allocator.Net, error) {
+	plugins, err := nadPlugins(config)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range plugins {
+		if !usesIPAM(p) {
+			continue
+		}
+		data, err := json.Marshal(p)
+		if err != nil {
+			return nil, err
+		}
+		n, _, err := allocator.LoadIPAMConfig(data, "")
+		return n, err
+	}
+	return nil, nil
+}
+
+func (km *KubeManager) listNADs() ([]types.NetworkAttachmentDefinition, error) {
+	data, err := km.client.ExtensionsV1beta1().RESTClient().Get().AbsPath("/apis/" + nadAPIVersion + "/" + k8sclient.CRDPlural).DoRaw()
+	if err != nil {
+		return nil, err
+	}
+	list := struct {
+		Items []types.NetworkAttachmentDefinition `json:"items"`
+	}{}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func (km *KubeManager) PeriodChkUtilisation() {
+	tickerTime := defaultUtilisationTime
+	tmp := os.Getenv("UTILISATION_CHECK_TIME")
+	if tmp != "" {
+		t, err := strconv.Atoi(tmp)
+		if err == nil && t > 0 {
+			tickerTime = time.Duration(t) * time.Second
+		}
+	}
+	thresholds := defaultThresholds
+	if tmp := os.Getenv("UTILISATION_THRESHOLDS"); tmp != "" {
+		t, err := parseThresholds(tmp)
+		if err != nil {
+			logging.Errorf("parse UTILISATION_THRESHOLDS failed, %v, use %v", err, defaultThresholds)
+		} else {
+			thresholds = t
+		}
+	}
+	km.CheckUtilisation(thresholds)
+	ticker := time.NewTicker(tickerTime)
+	for {
+		select {
+		case <-km.ctx.Done():
+			logging.Verbosef("ctx stop utilisation check")
+			return
+		case <-ticker.C:
+			km.CheckUtilisation(thresholds)
+		}
+	}
+}
+
+// CheckUtilisation computes the utilisation of every multus-ipam network,
+// records it in the status config map of its net-attach-defs and emits an
+// event on them when it crosses one of thresholds
+func (km *KubeManager) CheckUtilisation(thresholds []int) error {
+	nads, err := km.listNADs()
+	if err != nil {
+		return logging.Errorf("list net-attach-defs failed, %v", err)
+	}
+	em, err := etcdv3.New()
+	if err != nil {
+		return logging.Errorf("Create etcd client failed, %v", err)
+	}
+	defer em.Close()
+
+	seen := map[string]bool{}
+	for i := range nads {
+		nad := &nads[i]
+		n, err := nadIPAMConfig(nad.Spec.Config)
+		if err != nil {
+			logging.Errorf("parse config of %v/%v failed, %v", nad.Metadata.Namespace, nad.Metadata.Name, err)
+			continue
+		}
+		if n == nil {
+			continue
+		}
+		leased, fixed, err := etcdv3cli.IPAMGetUsage(em, n.Name)
+		if err != nil {
+			continue
+		}
+		u := &networkUsage{Network: n.Name, Capacity: ipamCapacity(n.IPAM), Leased: leased, Fixed: uint64(fixed)}
+		if err := km.updateIPAMStatus(nad, u); err != nil {
+			logging.Errorf("update ipam status of %v/%v failed, %v", nad.Metadata.Namespace, nad.Metadata.Name, err)
+		}
+
+		key := nad.Metadata.Namespace + "/" + nad.Metadata.Name
+		if !u.Known() {
+			// no event is emitted on the networks without capacity
+			continue
+		}
+		seen[key] = true
+		level := thresholdLevel(u.Percent(), thresholds)
+		last := km.utilLevels[key]
+		km.utilLevels[key] = level
+		switch {
+		case level > last:
+			msg := fmt.Sprintf("network %v is %d%% used (threshold %d%%), %d of %d addresses left",
+				u.Network, u.Percent(), thresholds[level-1], u.Free(), u.Capacity)
+			km.emitNADEvent(nad, apiv1.EventTypeWarning, reasonUtilisationHigh, msg)
+		case level == 0 && last > 0:
+			msg := fmt.Sprintf("network %v is %d%% used, %d of %d addresses left",
+				u.Network, u.Percent(), u.Free(), u.Capacity)
+			km.emitNADEvent(nad, apiv1.EventTypeNormal, reasonUtilisationNormal, msg)
+		}
+	}
+	for key := range km.utilLevels {
+		if !seen[key] {
+			delete(km.utilLevels, key)
+		}
+	}
+	return nil
+}
+
+func nadOwnerReference(nad *types.NetworkAttachmentDefinition) metav1.OwnerReference {
+	return metav1.OwnerReference{
+		APIVersion: nadAPIVersion,
+		Kind:       nadKind,
+		Name:       nad.Metadata.Name,
+		UID:        nad.Metadata.UID,
+	}
+}
+
+// updateIPAMStatus records u in the "<nad>-ipam-status" config map, which is
+// deleted along with the net-attach-def
+func (km *KubeManager) updateIPAMStatus(nad *types.NetworkAttachmentDefinition, u *networkUsage) error {
+	cms := km.client.CoreV1().ConfigMaps(nad.Metadata.Namespace)
+	data := map[string]string{
+		"network":     u.Network,
+		"capacity":    strconv.FormatUint(u.Capacity, 10),
+		"leased":      strconv.FormatUint(u.Leased, 10),
+		"fixed":       strconv.FormatUint(u.Fixed, 10),
+		"free":        strconv.FormatUint(u.Free(), 10),
+		"utilisation": u.PercentString(),
+		"updated":     time.Now().UTC().Format(time.RFC3339),
+	}
+	name := nad.Metadata.Name + ipamStatusSuffix
+	cm, err := cms.Get(name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		cm = &apiv1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            name,
+				Namespace:       nad.Metadata.Namespace,
+				Labels:          map[string]string{ipamStatusLabel: "true"},
+				OwnerReferences: []metav1.OwnerReference{nadOwnerReference(nad)},
+			},
+			Data: data,
+		}
+		_, err = cms.Create(cm)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	cm.Data = data
+	_, err = cms.Update(cm)
+	return err
+}
+
+func (km *KubeManager) emitNADEvent(nad *types.NetworkAttachmentDefinition, eventType, reason, message string) {
+	logging.Verbosef("%v/%v: %v", nad.Metadata.Namespace, nad.Metadata.Name, message)
+	now := metav1.Now()
+	ev := &apiv1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: nad.Metadata.Name + ".",
+			Namespace:    nad.Metadata.Namespace,
+		},
+		InvolvedObject: apiv1.ObjectReference{
+			APIVersion: nadAPIVersion,
+			Kind:       nadKind,
+			Namespace:  nad.Metadata.Namespace,
+			Name:       nad.Metadata.Name,
+			UID:        nad.Metadata.UID,
+		},
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		Source:         apiv1.EventSource{Component: "multus-controller"},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	if _, err := km.client.CoreV1().Events(nad.Metadata.Namespace).Create(ev); err != nil {
+		logging.Errorf("create event on %v/%v failed, %v", nad.Metadata.Namespace, nad.Metadata.Name, err)
+	}
+}
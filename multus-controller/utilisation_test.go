@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Utilisation", func() {
+	It("parses the thresholds", func() {
+		thresholds, err := parseThresholds("90, 80,100")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(thresholds).To(Equal([]int{80, 90, 100}))
+		_, err = parseThresholds("80,120")
+		Expect(err).To(HaveOccurred())
+
+		Expect(thresholdLevel(79, thresholds)).To(Equal(0))
+		Expect(thresholdLevel(85, thresholds)).To(Equal(1))
+		Expect(thresholdLevel(100, thresholds)).To(Equal(3))
+	})
+
+	It("computes the usage of a network", func() {
+		u := &networkUsage{Capacity: 200, Leased: 160, Fixed: 10}
+		Expect(u.Percent()).To(Equal(85))
+		Expect(u.PercentString()).To(Equal("85%"))
+		Expect(u.Free()).To(Equal(uint64(30)))
+		u.Leased = 256
+		Expect(u.Free()).To(BeZero())
+
+		// the ipv6 ranges are not counted
+		u = &networkUsage{Leased: 16}
+		Expect(u.Known()).To(BeFalse())
+		Expect(u.Percent()).To(BeZero())
+		Expect(u.PercentString()).To(Equal("unknown"))
+	})
+
+	It("loads the capacity of a config list", func() {
+		config := `{
+			"cniVersion": "0.3.1",
+			"name": "testnet",
+			"plugins": [{
+				"type": "multus-vxlan",
+				"logFile": "/tmp/multus-vxlan.log",
+				"ipam": {
+					"type": "multus-ipam",
+					"ranges": [[{"subnet": "10.1.0.0/24", "rangeStart": "10.1.0.16", "rangeEnd": "10.1.0.79"}]],
+					"fixRange": {"subnet": "10.2.0.0/28"}
+				}
+			}, {
+				"type": "portmap"
+			}]
+		}`
+		n, err := nadIPAMConfig(config)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n.Name).To(Equal("testnet"))
+		// .2 to .14 of the fixRange
+		Expect(ipamCapacity(n.IPAM)).To(Equal(uint64(64 + 13)))
+
+		// the fixRange overlapping the ranges is counted once, from .2 on
+		n.IPAM.FixRange.Subnet = n.IPAM.Ranges[0][0].Subnet
+		n.IPAM.FixRange.RangeStart = net.ParseIP("10.1.0.64").To4()
+		n.IPAM.FixRange.RangeEnd = net.ParseIP("10.1.0.99").To4()
+		n.IPAM.Ranges[0][0].RangeStart = net.ParseIP("10.1.0.0").To4()
+		Expect(ipamCapacity(n.IPAM)).To(Equal(uint64(98)))
+
+		n, err = nadIPAMConfig(`{"cniVersion": "0.3.1", "name": "other", "type": "macvlan", "ipam": {"type": "host-local"}}`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n).To(BeNil())
+	})
+})
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+
+	"github.com/intel/multus-cni/etcdv3"
+	"github.com/intel/multus-cni/k8sclient"
+	"github.com/intel/multus-cni/logging"
+	"github.com/intel/multus-cni/multus-ipam/backend/allocator"
+	"github.com/intel/multus-cni/multus-ipam/backend/etcdv3cli"
+	vxconfig "github.com/intel/multus-cni/multus-vxlan/config"
+	"github.com/intel/multus-cni/types"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	webhookNADPath     = "/validate-nad"
+	webhookPodPath     = "/validate-pod"
+	defaultWebhookAddr = ":8443"
+)
+
+// webhook rejects the net-attach-defs multus-vxlan and multus-ipam would
+// fail on when a pod is attached, and the changes which leave the blocks
+// leased or the fixed ips bound out of the ranges. It rejects the pods whose
+// networks annotation CNI ADD would fail on as well.
+type webhook struct {
+	// usage returns the blocks leased and the fixed ips bound of network
+	usage func(network string) ([]etcdv3cli.Lease, []etcdv3cli.FixBinding, error)
+	// kubeClient reads the net-attach-defs of the pods
+	kubeClient k8sclient.KubeClient
+	// namespaceIsolation is the NamespaceIsolation of the multus config of
+	// the nodes
+	namespaceIsolation bool
+}
+
+func etcdUsage(network string) ([]etcdv3cli.Lease, []etcdv3cli.FixBinding, error) {
+	em, err := etcdv3.New()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer em.Close()
+	leases, err := etcdv3cli.IPAMListLeases(em, network)
+	if err != nil {
+		return nil, nil, err
+	}
+	fixed, err := etcdv3cli.IPAMListFixBindings(em, network)
+	if err != nil {
+		return nil, nil, err
+	}
+	return leases, fixed, nil
+}
+
+// pluginLabel names plugin i of plugins in the messages of the webhook
+func pluginLabel(plugins []map[string]interface{}, i int) string {
+	if len(plugins) == 1 {
+		return fmt.Sprintf("%v", plugins[i]["type"])
+	}
+	return fmt.Sprintf("plugins[%d] (%v)", i, plugins[i]["type"])
+}
+
+// validateNADConfig checks the multus-vxlan and multus-ipam plugins of the
+// config of a net-attach-def and returns its multus-ipam networks
+func validateNADConfig(config string) ([]*allocator.Net, error) {
+	if config == "" {
+		// the config is read from the cni directory of the node
+		return nil, nil
+	}
+	plugins, err := nadPlugins(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config, %v", err)
+	}
+	nets := []*allocator.Net{}
+	for i, p := range plugins {
+		data, err := json.Marshal(p)
+		if err != nil {
+			return nil, err
+		}
+		if p["type"] == "multus-vxlan" {
+			n, _, err := vxconfig.Load(data)
+			if err == nil {
+				err = n.Validate()
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%v: %v", pluginLabel(plugins, i), err)
+			}
+		}
+		if usesIPAM(p) {
+			n, _, err := allocator.LoadIPAMConfig(data, "")
+			if err == nil {
+				err = n.IPAM.Validate()
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%v: ipam: %v", pluginLabel(plugins, i), err)
+			}
+			nets = append(nets, n)
+		}
+	}
+	return nets, nil
+}
+
+// nadIPAMNets returns the multus-ipam networks of config which load, the
+// others have not leased anything
+func nadIPAMNets(config string) []*allocator.Net {
+	nets := []*allocator.Net{}
+	plugins, err := nadPlugins(config)
+	if err != nil {
+		return nets
+	}
+	for _, p := range plugins {
+		if !usesIPAM(p) {
+			continue
+		}
+		data, err := json.Marshal(p)
+		if err != nil {
+			continue
+		}
+		if n, _, err := allocator.LoadIPAMConfig(data, ""); err == nil {
+			nets = append(nets, n)
+		}
+	}
+	return nets
+}
+
+func inRanges(sets []allocator.RangeSet, block *allocator.SimpleRange) bool {
+	for _, rs := range sets {
+		for i := range rs {
+			if rs[i].Contains(block.RangeStart) && rs[i].Contains(block.RangeEnd) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkUsage returns an error if a block leased or a fixed ip bound of the
+// multus-ipam networks of old is out of the networks of new
+func (w *webhook) checkUsage(old, new []*allocator.Net) error {
+	for _, o := range old {
+		var n *allocator.Net
+		for _, c := range new {
+			if c.Name == o.Name {
+				n = c
+				break
+			}
+		}
+		if n != nil && reflect.DeepEqual(o.IPAM.Ranges, n.IPAM.Ranges) && reflect.DeepEqual(o.IPAM.FixRange, n.IPAM.FixRange) {
+			continue
+		}
+		leases, fixed, err := w.usage(o.Name)
+		if err != nil {
+			return fmt.Errorf("read the leases of network %v failed, %v", o.Name, err)
+		}
+		if n == nil {
+			if len(leases) > 0 || len(fixed) > 0 {
+				return fmt.Errorf("network %v has %d blocks leased and %d fixed ips bound, it can not be removed or renamed", o.Name, len(leases), len(fixed))
+			}
+			continue
+		}
+		for _, l := range leases {
+			if !inRanges(n.IPAM.Ranges, &l.Range) {
+				return fmt.Errorf("block %v-%v of network %v is leased to node %v, it is out of the new ranges",
+					l.Range.RangeStart, l.Range.RangeEnd, o.Name, l.Node)
+			}
+		}
+		for _, b := range fixed {
+			if n.IPAM.FixRange == nil || !n.IPAM.FixRange.Contains(b.IP) {
+				return fmt.Errorf("fixed ip %v of network %v is bound to pod %v/%v, it is out of the new fixRange",
+					b.IP, o.Name, b.Namespace, b.Pod)
+			}
+		}
+	}
+	return nil
+}
+
+// validateNAD checks the net-attach-def created or updated by req
+func (w *webhook) validateNAD(req *admissionv1beta1.AdmissionRequest) error {
+	nad := &types.NetworkAttachmentDefinition{}
+	if err := json.Unmarshal(req.Object.Raw, nad); err != nil {
+		return fmt.Errorf("invalid net-attach-def, %v", err)
+	}
+	nets, err := validateNADConfig(nad.Spec.Config)
+	if err != nil {
+		return err
+	}
+	if req.Operation != admissionv1beta1.Update {
+		return nil
+	}
+	old := &types.NetworkAttachmentDefinition{}
+	if err := json.Unmarshal(req.OldObject.Raw, old); err != nil {
+		return fmt.Errorf("invalid net-attach-def, %v", err)
+	}
+	return w.checkUsage(nadIPAMNets(old.Spec.Config), nets)
+}
+
+// validatePod checks the networks annotation of the pod created by req, or
+// updated with another networks annotation
+func (w *webhook) validatePod(req *admissionv1beta1.AdmissionRequest) error {
+	pod := &apiv1.Pod{}
+	if err := json.Unmarshal(req.Object.Raw, pod); err != nil {
+		return fmt.Errorf("invalid pod, %v", err)
+	}
+	// the namespace of a pod is not set before it is created
+	if pod.Namespace == "" {
+		pod.Namespace = req.Namespace
+	}
+	if req.Operation == admissionv1beta1.Update {
+		old := &apiv1.Pod{}
+		if err := json.Unmarshal(req.OldObject.Raw, old); err != nil {
+			return fmt.Errorf("invalid pod, %v", err)
+		}
+		if old.Annotations[k8sclient.NetworkAttachmentAnnot] == pod.Annotations[k8sclient.NetworkAttachmentAnnot] {
+			return nil
+		}
+	}
+	return k8sclient.ValidatePodNetworks(w.kubeClient, pod, w.namespaceIsolation)
+}
+
+// admit answers the admission reviews posted with validate, the object is
+// denied with the error of validate
+func admit(validate func(*admissionv1beta1.AdmissionRequest) error) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		review := &admissionv1beta1.AdmissionReview{}
+		if err := json.NewDecoder(req.Body).Decode(review); err != nil || review.Request == nil {
+			http.Error(rw, "invalid admission review", http.StatusBadRequest)
+			return
+		}
+		r := review.Request
+		resp := &admissionv1beta1.AdmissionResponse{UID: r.UID, Allowed: true}
+		if err := validate(r); err != nil {
+			logging.Verbosef("webhook: %v of %v %v/%v denied, %v", r.Operation, r.Kind.Kind, r.Namespace, r.Name, err)
+			resp.Allowed = false
+			resp.Result = &metav1.Status{
+				Status:  metav1.StatusFailure,
+				Message: err.Error(),
+				Reason:  metav1.StatusReasonInvalid,
+				Code:    http.StatusUnprocessableEntity,
+			}
+		}
+		review.Request = nil
+		review.Response = resp
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(review)
+	})
+}
+
+// RunWebhook serves the validating admission webhook on WEBHOOK_ADDR with
+// WEBHOOK_CERT_FILE and WEBHOOK_KEY_FILE if WEBHOOK_MODE is "on". The pods
+// may only attach the networks of their namespace if
+// WEBHOOK_NAMESPACE_ISOLATION is "on", as in the multus config of the nodes.
+func (km *KubeManager) RunWebhook() {
+	mode := os.Getenv("WEBHOOK_MODE")
+	if mode == "" || mode == "off" {
+		return
+	}
+	if mode != "on" {
+		logging.Errorf("webhook is disabled, invalid WEBHOOK_MODE %q", mode)
+		return
+	}
+	certFile, keyFile := os.Getenv("WEBHOOK_CERT_FILE"), os.Getenv("WEBHOOK_KEY_FILE")
+	if certFile == "" || keyFile == "" {
+		logging.Errorf("webhook is disabled, WEBHOOK_CERT_FILE and WEBHOOK_KEY_FILE are required")
+		return
+	}
+	addr := os.Getenv("WEBHOOK_ADDR")
+	if addr == "" {
+		addr = defaultWebhookAddr
+	}
+
+	isolation := os.Getenv("WEBHOOK_NAMESPACE_ISOLATION")
+	if isolation != "" && isolation != "on" && isolation != "off" {
+		logging.Errorf("invalid WEBHOOK_NAMESPACE_ISOLATION %q, use off", isolation)
+	}
+
+	w := &webhook{
+		usage:              etcdUsage,
+		kubeClient:         k8sclient.NewKubeClient(km.client),
+		namespaceIsolation: isolation == "on",
+	}
+	mux := http.NewServeMux()
+	mux.Handle(webhookNADPath, admit(w.validateNAD))
+	mux.Handle(webhookPodPath, admit(w.validatePod))
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-km.ctx.Done()
+		srv.Close()
+	}()
+	logging.Verbosef("webhook listens on %v", addr)
+	if err := srv.ListenAndServeTLS(certFile, keyFile); err != nil && err != http.ErrServerClosed {
+		logging.Errorf("serve webhook on %v failed, %v", addr, err)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/intel/multus-cni/k8sclient"
+	"github.com/intel/multus-cni/multus-ipam/backend/allocator"
+	"github.com/intel/multus-cni/multus-ipam/backend/etcdv3cli"
+	testhelpers "github.com/intel/multus-cni/testing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const webhookConfig = `{
+	"cniVersion": "0.3.1",
+	"name": "testnet",
+	"plugins": [{
+		"type": "multus-vxlan",
+		"master": "eth1",
+		"vxlan": {"vxlanId": 201},
+		"ipam": {
+			"type": "multus-ipam",
+			"ranges": [[{"subnet": "10.1.0.0/24", "rangeStart": "10.1.0.16", "rangeEnd": "10.1.0.127"}]],
+			"fixRange": {"subnet": "10.1.0.0/24", "rangeStart": "10.1.0.128"}
+		}
+	}, {
+		"type": "portmap"
+	}]
+}`
+
+func nadObject(config string) runtime.RawExtension {
+	data, err := json.Marshal(map[string]interface{}{
+		"apiVersion": "k8s.cni.cncf.io/v1",
+		"kind":       "NetworkAttachmentDefinition",
+		"metadata":   map[string]interface{}{"name": "testnet", "namespace": "test"},
+		"spec":       map[string]interface{}{"config": config},
+	})
+	Expect(err).NotTo(HaveOccurred())
+	return runtime.RawExtension{Raw: data}
+}
+
+// podObject returns a pod before it is created, without namespace
+func podObject(networks string) runtime.RawExtension {
+	data, err := json.Marshal(&apiv1.Pod{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "testpod",
+			Annotations: map[string]string{k8sclient.NetworkAttachmentAnnot: networks},
+		},
+	})
+	Expect(err).NotTo(HaveOccurred())
+	return runtime.RawExtension{Raw: data}
+}
+
+// review posts req to h and returns the response
+func review(h http.Handler, req *admissionv1beta1.AdmissionRequest) *admissionv1beta1.AdmissionResponse {
+	req.UID = "1234"
+	data, err := json.Marshal(&admissionv1beta1.AdmissionReview{Request: req})
+	Expect(err).NotTo(HaveOccurred())
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, webhookNADPath, bytes.NewReader(data)))
+	Expect(rec.Code).To(Equal(http.StatusOK))
+	r := &admissionv1beta1.AdmissionReview{}
+	Expect(json.Unmarshal(rec.Body.Bytes(), r)).To(Succeed())
+	Expect(r.Response.UID).To(BeEquivalentTo("1234"))
+	return r.Response
+}
+
+func denied(resp *admissionv1beta1.AdmissionResponse) string {
+	Expect(resp.Allowed).To(BeFalse())
+	return resp.Result.Message
+}
+
+var _ = Describe("Webhook", func() {
+	var (
+		w       *webhook
+		leases  []etcdv3cli.Lease
+		fixed   []etcdv3cli.FixBinding
+		network string
+	)
+
+	BeforeEach(func() {
+		leases = []etcdv3cli.Lease{{
+			Network: "testnet",
+			Node:    "node1",
+			Range:   allocator.SimpleRange{RangeStart: net.ParseIP("10.1.0.96").To4(), RangeEnd: net.ParseIP("10.1.0.111").To4()},
+		}}
+		fixed = []etcdv3cli.FixBinding{{Network: "testnet", IP: net.ParseIP("10.1.0.130").To4(), Namespace: "test", Pod: "testpod"}}
+		network = ""
+		w = &webhook{usage: func(n string) ([]etcdv3cli.Lease, []etcdv3cli.FixBinding, error) {
+			network = n
+			return leases, fixed, nil
+		}}
+	})
+
+	create := func(config string) *admissionv1beta1.AdmissionResponse {
+		return review(admit(w.validateNAD), &admissionv1beta1.AdmissionRequest{
+			Operation: admissionv1beta1.Create,
+			Object:    nadObject(config),
+		})
+	}
+
+	update := func(config string) *admissionv1beta1.AdmissionResponse {
+		return review(admit(w.validateNAD), &admissionv1beta1.AdmissionRequest{
+			Operation: admissionv1beta1.Update,
+			Object:    nadObject(config),
+			OldObject: nadObject(webhookConfig),
+		})
+	}
+
+	It("admits the valid net-attach-defs", func() {
+		Expect(create(webhookConfig).Allowed).To(BeTrue())
+		Expect(create("").Allowed).To(BeTrue())
+		Expect(create(`{"cniVersion": "0.3.1", "name": "other", "type": "macvlan", "ipam": {"type": "host-local"}}`).Allowed).To(BeTrue())
+		// the leases are not read on creation
+		Expect(network).To(BeEmpty())
+	})
+
+	It("rejects the invalid configs", func() {
+		Expect(denied(create(`{"name": "testnet",`))).To(HavePrefix("invalid config, "))
+		Expect(denied(create(strings.Replace(webhookConfig, `"vxlan": {"vxlanId": 201},`, "", 1)))).To(
+			Equal("plugins[0] (multus-vxlan): vxlan.vxlanId is missing"))
+		Expect(denied(create(strings.Replace(webhookConfig, `"rangeStart": "10.1.0.128"`, `"rangeStart": "10.1.0.100"`, 1)))).To(
+			Equal("plugins[0] (multus-vxlan): ipam: fixRange 10.1.0.100-10.1.0.254 overlaps with range 10.1.0.16-10.1.0.127 of range set 0"))
+		Expect(denied(create(strings.Replace(webhookConfig, `"fixRange"`, `"applyUnit": 7, "fixRange"`, 1)))).To(
+			ContainSubstring("applyUnit 7 is too large for range 10.1.0.16-10.1.0.127"))
+		Expect(denied(create(strings.Replace(webhookConfig, "10.1.0.0/24", "10.1.0.0/33", 1)))).To(
+			HavePrefix("plugins[0] (multus-vxlan): ipam: "))
+	})
+
+	It("rejects the changes which break the leases", func() {
+		// the ranges are not changed
+		Expect(update(strings.Replace(webhookConfig, `"vxlanId": 201`, `"vxlanId": 202`, 1)).Allowed).To(BeTrue())
+		Expect(network).To(BeEmpty())
+
+		// the leased block is kept
+		Expect(update(strings.Replace(webhookConfig, `"rangeEnd": "10.1.0.127"`, `"rangeEnd": "10.1.0.111"`, 1)).Allowed).To(BeTrue())
+		Expect(network).To(Equal("testnet"))
+
+		Expect(denied(update(strings.Replace(webhookConfig, `"rangeEnd": "10.1.0.127"`, `"rangeEnd": "10.1.0.100"`, 1)))).To(
+			Equal("block 10.1.0.96-10.1.0.111 of network testnet is leased to node node1, it is out of the new ranges"))
+		Expect(denied(update(strings.Replace(webhookConfig, `"rangeStart": "10.1.0.128"`, `"rangeStart": "10.1.0.192"`, 1)))).To(
+			Equal("fixed ip 10.1.0.130 of network testnet is bound to pod test/testpod, it is out of the new fixRange"))
+		Expect(denied(update(strings.Replace(webhookConfig, `"name": "testnet"`, `"name": "othernet"`, 1)))).To(
+			Equal("network testnet has 1 blocks leased and 1 fixed ips bound, it can not be removed or renamed"))
+
+		leases, fixed = nil, nil
+		Expect(update(strings.Replace(webhookConfig, `"name": "testnet"`, `"name": "othernet"`, 1)).Allowed).To(BeTrue())
+
+		w.usage = func(string) ([]etcdv3cli.Lease, []etcdv3cli.FixBinding, error) {
+			return nil, nil, fmt.Errorf("etcd is down")
+		}
+		Expect(denied(update(strings.Replace(webhookConfig, `"rangeEnd": "10.1.0.127"`, `"rangeEnd": "10.1.0.100"`, 1)))).To(
+			Equal("read the leases of network testnet failed, etcd is down"))
+	})
+
+	It("rejects the pods whose networks can not be attached", func() {
+		fKubeClient := testhelpers.NewFakeKubeClient()
+		fKubeClient.AddNetConfig("test", "net1", `{"name": "net1", "type": "mynet"}`)
+		fKubeClient.AddNetConfig("kube-system", "net2", `{"name": "net2", "type": "mynet"}`)
+		w.kubeClient = fKubeClient
+		w.namespaceIsolation = true
+
+		create := func(networks string) *admissionv1beta1.AdmissionResponse {
+			return review(admit(w.validatePod), &admissionv1beta1.AdmissionRequest{
+				Operation: admissionv1beta1.Create,
+				Namespace: "test",
+				Object:    podObject(networks),
+			})
+		}
+		Expect(create("net1@eth1").Allowed).To(BeTrue())
+		Expect(denied(create("kube-system/net2"))).To(
+			Equal(`network "net2": namespace isolation violation: podnamespace: test / target namespace: kube-system`))
+		Expect(denied(create(`[{"name": "net1", "mac": "c2:11"}]`))).To(
+			Equal(`network "net1": failed to parse mac address "c2:11"`))
+
+		update := func(oldNetworks, networks string) *admissionv1beta1.AdmissionResponse {
+			return review(admit(w.validatePod), &admissionv1beta1.AdmissionRequest{
+				Operation: admissionv1beta1.Update,
+				Namespace: "test",
+				Object:    podObject(networks),
+				OldObject: podObject(oldNetworks),
+			})
+		}
+		// the annotation is not changed
+		Expect(update("net3", "net3").Allowed).To(BeTrue())
+		Expect(denied(update("net1", "net1,net3"))).To(
+			Equal(`network "net3": failed to get network attachment definition test/net3: resource not found`))
+	})
+})
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/intel/multus-cni/logging"
+	vxEtcd "github.com/intel/multus-cni/multus-vxlan/backend/etcdv3cli"
+	"golang.org/x/net/context"
+)
+
+var (
+	ebtablesCmd = "ebtables"
+	// chains per hook, ebtables does not allow -i in OUTPUT nor -o in INPUT
+	gwArpChains = map[string]string{
+		"INPUT":   "MULVX-GW-IN",
+		"FORWARD": "MULVX-GW-FWD",
+		"OUTPUT":  "MULVX-GW-OUT",
+	}
+	// gwArpWatchInterval is the period the gateways recorded by multus-vxlan
+	// are read at, the ARP of a new distributed gateway crosses the overlay
+	// for that long at most
+	gwArpWatchInterval = 2 * time.Second
+)
+
+// gwArpSuppressor keeps ARP for distributed gateways inside the node, every
+// node answers for the gateway itself, so the request and the replies of
+// other nodes must not cross the vxlan overlay
+type gwArpSuppressor struct {
+	mu      sync.Mutex
+	applied []string
+}
+
+// gwArpRules generates the ebtables rules for every hook chain
+func gwArpRules(gws map[string][]net.IP) map[string][][]string {
+	rules := map[string][][]string{}
+	vxlans := []string{}
+	for vx := range gws {
+		vxlans = append(vxlans, vx)
+	}
+	sort.Strings(vxlans)
+	for _, vx := range vxlans {
+		for _, gw := range gws[vx] {
+			if gw.To4() == nil {
+				continue
+			}
+			for _, m := range []string{"--arp-ip-src", "--arp-ip-dst"} {
+				in := []string{"-p", "ARP", "-i", vx, m, gw.String(), "-j", "DROP"}
+				out := []string{"-p", "ARP", "-o", vx, m, gw.String(), "-j", "DROP"}
+				rules["INPUT"] = append(rules["INPUT"], in)
+				rules["FORWARD"] = append(rules["FORWARD"], in, out)
+				rules["OUTPUT"] = append(rules["OUTPUT"], out)
+			}
+		}
+	}
+	return rules
+}
+
+func flattenRules(rules map[string][][]string) []string {
+	flat := []string{}
+	for _, hook := range []string{"INPUT", "FORWARD", "OUTPUT"} {
+		for _, r := range rules[hook] {
+			flat = append(flat, hook+" "+strings.Join(r, " "))
+		}
+	}
+	return flat
+}
+
+func ebtables(args ...string) (string, error) {
+	out, err := exec.Command(ebtablesCmd, append([]string{"-t", "filter"}, args...)...).CombinedOutput()
+	return string(out), err
+}
+
+// Sync applies the ARP suppression rules of the gateways recorded by multus-vxlan
+func (s *gwArpSuppressor) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	gws := vxEtcd.LoadGateways()
+	rules := gwArpRules(gws)
+	flat := flattenRules(rules)
+	if len(flat) == 0 && len(s.applied) == 0 {
+		return nil
+	}
+	if strings.Join(flat, "\n") == strings.Join(s.applied, "\n") {
+		return nil
+	}
+
+	logging.Verbosef("going to suppress gateway arp for %v", gws)
+	for hook, chain := range gwArpChains {
+		// the chain may exist already
+		ebtables("-N", chain)
+		out, err := ebtables("-L", hook)
+		if err != nil {
+			return logging.Errorf("list ebtables chain %v failed, %v, %s", hook, err, out)
+		}
+		if !strings.Contains(out, "-j "+chain) {
+			if out, err := ebtables("-A", hook, "-p", "ARP", "-j", chain); err != nil {
+				return logging.Errorf("jump from %v to %v failed, %v, %s", hook, chain, err, out)
+			}
+		}
+		if out, err := ebtables("-F", chain); err != nil {
+			return logging.Errorf("flush ebtables chain %v failed, %v, %s", chain, err, out)
+		}
+		for _, r := range rules[hook] {
+			if out, err := ebtables(append([]string{"-A", chain}, r...)...); err != nil {
+				return logging.Errorf("add ebtables rule %v to %v failed, %v, %s", r, chain, err, out)
+			}
+		}
+	}
+	s.applied = flat
+	return nil
+}
+
+// watchGateways syncs the ARP suppression every gwArpWatchInterval until ctx
+// is done, so that the gateways multus-vxlan records on ADD are suppressed
+// without waiting for the ticker. ebtables is only run when they changed.
+func (d *multusd) watchGateways(ctx context.Context) {
+	ticker := time.NewTicker(gwArpWatchInterval)
+	defer ticker.Stop()
+	lastErr := ""
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := d.gwArp.Sync()
+			if err == nil {
+				lastErr = ""
+				continue
+			}
+			// the same failure is logged once
+			if err.Error() != lastErr {
+				logging.Errorf("sync gateway arp failed, %v", err)
+				lastErr = err.Error()
+			}
+		}
+	}
+}
@@ -27,10 +27,12 @@ import (
 	"github.com/archichris/netools/dev"
 	"github.com/coreos/etcd/clientv3"
 	"github.com/intel/multus-cni/etcdv3"
+	k8s "github.com/intel/multus-cni/k8sclient"
 	"github.com/intel/multus-cni/logging"
-	ipamDocker "github.com/intel/multus-cni/multus-ipam/backend/dockercli"
 	ipamEtcd "github.com/intel/multus-cni/multus-ipam/backend/etcdv3cli"
+	"github.com/intel/multus-cni/multus-ipam/backend/runtimecli"
 	vxEtcd "github.com/intel/multus-cni/multus-vxlan/backend/etcdv3cli"
+	"github.com/intel/multus-cni/server"
 	"github.com/vishvananda/netlink"
 	"golang.org/x/net/context"
 )
@@ -38,6 +40,9 @@ import (
 var (
 	defaultWaitTime   = 5 * time.Second
 	defaultTickerTime = time.Duration(5+rand.Intn(2)) * time.Minute
+	// IPAM_CHECK_MODE "report" only logs and exports what the ipam check
+	// finds, "repair" also fixes it
+	defaultIPAMCheckMode = "repair"
 	// ipamEtcdCheckTicker  = 1
 	// ipamLocalCheckTicker = 10
 	// vxEtcdCheckTicker    = 1
@@ -64,22 +69,31 @@ func init() {
 	//debug
 	// logging.SetLogFile("/host/var/log/multus-daemon.log")
 	// logging.SetLogLevel("debug")
+
+	// the multus configs loaded by hot-plug and the server do not change
+	// the log of the daemon
+	logging.KeepSettings()
 }
 
 type multusd struct {
-	ctx    context.Context
-	wg     *sync.WaitGroup
-	mux    sync.Mutex
-	buf    map[string]string
-	keyDir string
+	ctx     context.Context
+	wg      *sync.WaitGroup
+	mux     sync.Mutex
+	buf     map[string]string
+	keyDir  string
+	gwArp   gwArpSuppressor
+	metrics *daemonMetrics
+	orphans *runtimecli.Checker
+	podGC   *podGC
 }
 
 func newMultusd(ctx context.Context, wg *sync.WaitGroup, keyDir string) *multusd {
 	return &multusd{
-		ctx:    ctx,
-		wg:     wg,
-		keyDir: keyDir,
-		buf:    make(map[string]string),
+		ctx:     ctx,
+		wg:      wg,
+		keyDir:  keyDir,
+		buf:     make(map[string]string),
+		metrics: newDaemonMetrics(),
 	}
 }
 
@@ -93,9 +107,31 @@ func (d *multusd) Run() {
 		logging.Verbosef("Watching exited")
 		d.wg.Done()
 	}()
+	d.wg.Add(1)
+	go func() {
+		d.metrics.serveMetrics(d.ctx)
+		d.wg.Done()
+	}()
+	d.wg.Add(1)
+	go func() {
+		d.runHotplug()
+		d.wg.Done()
+	}()
+	d.wg.Add(1)
+	go func() {
+		d.runServer()
+		d.wg.Done()
+	}()
+	d.wg.Add(1)
+	go func() {
+		d.watchGateways(d.ctx)
+		d.wg.Done()
+	}()
 
 	//todo prevent out of ord between history record and watching
-	ipamEtcd.IPAMCheckEtcd()
+	d.metrics.timed("check_etcd", d.checkIPAM)
+	d.metrics.timed("sync_gateway_arp", d.syncGatewayArp)
+	d.metrics.collectEtcd()
 	tickerTime := defaultTickerTime
 	tmp := os.Getenv("TICKER_TIME")
 	if tmp != "" {
@@ -113,10 +149,143 @@ func (d *multusd) Run() {
 			return
 		case <-ticker.C:
 			// logging.Debugf("ticker run")
-			ipamEtcd.IPAMCheckEtcd()
-			ipamDocker.IPAMCheckLocalIPs("")
-			vxEtcd.CacheToEtcd()
+			d.metrics.timed("check_etcd", d.checkIPAM)
+			d.metrics.timed("check_local_ips", d.checkLocalIPs)
+			d.metrics.timed("pod_gc", d.checkPods)
+			d.metrics.timed("cache_to_etcd", func() { vxEtcd.CacheToEtcd() })
+			d.metrics.timed("sync_gateway_arp", d.syncGatewayArp)
+			d.metrics.collectEtcd()
+		}
+	}
+}
+
+// runHotplug watches the networks of the pods of this node if HOT_PLUG_MODE
+// is "on", see hotplug
+func (d *multusd) runHotplug() {
+	h, err := newHotplugFromEnv()
+	if err != nil {
+		logging.Errorf("hot-plug is disabled, %v", err)
+		return
+	}
+	if h == nil {
+		return
+	}
+	h.Run(d.ctx)
+}
+
+// runServer runs the CNI commands of the multus binary on SERVER_SOCKET if
+// SERVER_MODE is "on", see package server. The network attachment
+// definitions are read again after NAD_CACHE_TTL seconds.
+func (d *multusd) runServer() {
+	mode := os.Getenv("SERVER_MODE")
+	if mode == "" || mode == "off" {
+		return
+	}
+	if mode != "on" {
+		logging.Errorf("server is disabled, invalid SERVER_MODE %q", mode)
+		return
+	}
+	socketPath := os.Getenv("SERVER_SOCKET")
+	if socketPath == "" {
+		socketPath = server.DefaultSocketPath
+	}
+	client, err := kubeClientFromEnv()
+	if err != nil {
+		logging.Errorf("server is disabled, %v", err)
+		return
+	}
+	// the pods of the node and the network attachment definitions are
+	// cached, see k8s.NewCachedKubeClient
+	ttl := k8s.DefaultRawCacheTTL
+	if v := os.Getenv("NAD_CACHE_TTL"); v != "" {
+		t, err := strconv.Atoi(v)
+		if err != nil || t < 0 {
+			logging.Errorf("invalid NAD_CACHE_TTL %q, use %v", v, ttl)
+		} else {
+			ttl = time.Duration(t) * time.Second
+		}
+	}
+	kubeClient := k8s.NewCachedKubeClient(client, nodeNameFromEnv(), ttl, d.ctx.Done())
+	if err := server.NewServer(kubeClient).Serve(d.ctx, socketPath); err != nil {
+		logging.Errorf("server exited, %v", err)
+	}
+}
+
+// checkIPAM compares the blocks cached on this node with etcd, logs and
+// exports the differences and repairs them unless IPAM_CHECK_MODE is "report"
+func (d *multusd) checkIPAM() {
+	mode := os.Getenv("IPAM_CHECK_MODE")
+	if mode == "" {
+		mode = defaultIPAMCheckMode
+	}
+	em, err := etcdv3.New()
+	if err != nil {
+		logging.Errorf("Create etcd client failed, %v", err)
+		return
+	}
+	defer em.Close()
+
+	diffs, err := ipamEtcd.IPAMDiffEtcd(em, "")
+	if err != nil {
+		logging.Errorf("ipam check failed, %v", err)
+		return
+	}
+	d.metrics.setReconcileDiff(diffs)
+	for _, diff := range diffs {
+		if !diff.Empty() {
+			logging.Verbosef("ipam check (%s), %v", mode, diff)
+		}
+	}
+	if mode == "report" {
+		return
+	}
+	if err := ipamEtcd.IPAMRepairEtcd(em, diffs); err != nil {
+		logging.Errorf("ipam repair failed, %v", err)
+	}
+}
+
+// checkLocalIPs releases the ips reserved for the sandboxes the container
+// runtime no longer has, see runtimecli.Checker
+func (d *multusd) checkLocalIPs() {
+	if d.orphans == nil {
+		c, err := runtimecli.NewCheckerFromEnv(os.Getenv("NET_DATA_DIR"))
+		if err != nil {
+			logging.Errorf("create orphan ip checker failed, %v", err)
+			return
+		}
+		d.orphans = c
+	}
+	released, err := d.orphans.Check()
+	if err != nil {
+		return
+	}
+	if len(released) > 0 {
+		logging.Verbosef("released %d orphan ips of %v", len(released), d.orphans.Runtime.Name())
+	}
+}
+
+// checkPods releases the ips of the pods the api server no longer has on this
+// node, see podGC
+func (d *multusd) checkPods() {
+	if d.podGC == nil {
+		g, err := newPodGCFromEnv()
+		if err != nil {
+			logging.Errorf("create pod gc failed, %v", err)
+			return
+		}
+		if g == nil {
+			return
 		}
+		d.podGC = g
+	}
+	d.podGC.Check()
+}
+
+// syncGatewayArp applies the ARP suppression of the distributed gateways,
+// see gwArpSuppressor
+func (d *multusd) syncGatewayArp() {
+	if err := d.gwArp.Sync(); err != nil {
+		logging.Errorf("sync gateway arp failed, %v", err)
 	}
 }
 
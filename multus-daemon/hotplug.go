@@ -0,0 +1,395 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/containernetworking/cni/libcni"
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/containernetworking/cni/pkg/skel"
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	k8s "github.com/intel/multus-cni/k8sclient"
+	"github.com/intel/multus-cni/logging"
+	"github.com/intel/multus-cni/sandbox"
+	"github.com/intel/multus-cni/types"
+	"golang.org/x/net/context"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	defaultMultusDataDir = "/var/lib/cni/multus"
+	// hotplugResyncPeriod is the period the pods are synced again at, the
+	// delegates which failed are added or deleted again then
+	hotplugResyncPeriod = 5 * time.Minute
+)
+
+// hotplug adds and deletes the delegates of the running pods of this node
+// so that they are the networks of their annotation. The delegates are run in
+// the sandbox multus recorded on ADD, and the delegates it cached are
+// updated, so multus deletes them with the sandbox.
+type hotplug struct {
+	client     kubernetes.Interface
+	kubeClient k8s.KubeClient
+	node       string
+	dataDir    string
+	binDir     string
+	exec       invoke.Exec
+}
+
+// newHotplugFromEnv returns the hot-plug agent configured by HOT_PLUG_MODE
+// ("off" or "on"), MULTUS_DATA_DIR, CNI_BIN_DIR and NODE_NAME, nil if it is
+// off
+func newHotplugFromEnv() (*hotplug, error) {
+	mode := os.Getenv("HOT_PLUG_MODE")
+	if mode == "" || mode == "off" {
+		return nil, nil
+	}
+	if mode != "on" {
+		return nil, fmt.Errorf("invalid HOT_PLUG_MODE %q", mode)
+	}
+	h := &hotplug{
+		node:    nodeNameFromEnv(),
+		dataDir: os.Getenv("MULTUS_DATA_DIR"),
+		binDir:  os.Getenv("CNI_BIN_DIR"),
+	}
+	if h.dataDir == "" {
+		h.dataDir = defaultMultusDataDir
+	}
+	var err error
+	h.client, err = kubeClientFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	h.kubeClient = k8s.NewKubeClient(h.client)
+	return h, nil
+}
+
+// Run watches the pods of the node until ctx is done. Every pod is synced
+// when it is listed, changed, and every hotplugResyncPeriod, so the changes
+// made while the daemon was down are applied too.
+func (h *hotplug) Run(ctx context.Context) {
+	selector := fields.OneTermEqualSelector("spec.nodeName", h.node).String()
+	_, controller := cache.NewInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				options.FieldSelector = selector
+				return h.client.CoreV1().Pods("").List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				options.FieldSelector = selector
+				return h.client.CoreV1().Pods("").Watch(options)
+			},
+		},
+		&v1.Pod{},
+		hotplugResyncPeriod,
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				if pod, ok := obj.(*v1.Pod); ok {
+					h.sync(pod)
+				}
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				if pod, ok := newObj.(*v1.Pod); ok {
+					h.sync(pod)
+				}
+			},
+		},
+	)
+	logging.Verbosef("hot-plug watches the pods of %v", h.node)
+	controller.Run(ctx.Done())
+}
+
+// podNetworks returns the networks annotation of pod, nil if there is none
+func podNetworks(pod *v1.Pod) ([]*types.NetworkSelectionElement, error) {
+	networks, err := k8s.GetPodNetwork(pod)
+	if _, ok := err.(*k8s.NoK8sNetworkError); ok {
+		return nil, nil
+	}
+	return networks, err
+}
+
+// diffNetworks returns the networks of to which are not in from, and those of
+// from which are not in to
+func diffNetworks(from, to []*types.NetworkSelectionElement) ([]*types.NetworkSelectionElement, []*types.NetworkSelectionElement) {
+	kept := make([]bool, len(from))
+	added := []*types.NetworkSelectionElement{}
+	for _, n := range to {
+		found := false
+		for i, o := range from {
+			if !kept[i] && reflect.DeepEqual(n, o) {
+				kept[i] = true
+				found = true
+				break
+			}
+		}
+		if !found {
+			added = append(added, n)
+		}
+	}
+	removed := []*types.NetworkSelectionElement{}
+	for i, o := range from {
+		if !kept[i] {
+			removed = append(removed, o)
+		}
+	}
+	return added, removed
+}
+
+// attachedNetworks returns the networks of the annotation the delegates were
+// added for, the default networks are not
+func attachedNetworks(delegates []*types.DelegateNetConf) []*types.NetworkSelectionElement {
+	networks := []*types.NetworkSelectionElement{}
+	for _, d := range delegates {
+		if d.Network != nil && !d.MasterPlugin {
+			networks = append(networks, d.Network)
+		}
+	}
+	return networks
+}
+
+// findDelegate returns the index of the delegate of net, -1 if there is none
+func findDelegate(delegates []*types.DelegateNetConf, net *types.NetworkSelectionElement) int {
+	for idx, d := range delegates {
+		if d.Network != nil && !d.MasterPlugin && reflect.DeepEqual(d.Network, net) {
+			return idx
+		}
+	}
+	return -1
+}
+
+// pinIfNames sets the interface name of every delegate, multus names them by
+// their position otherwise, which changes when a delegate is deleted
+func pinIfNames(delegates []*types.DelegateNetConf, argIf string) {
+	for idx, d := range delegates {
+		if d.IfnameRequest != "" {
+			continue
+		}
+		// as getIfname of multus
+		if idx == 0 {
+			d.IfnameRequest = argIf
+		} else {
+			d.IfnameRequest = fmt.Sprintf("eth%d", idx)
+		}
+	}
+}
+
+// freeIfName returns the first interface name of multus no delegate has
+func freeIfName(delegates []*types.DelegateNetConf) string {
+	used := map[string]bool{}
+	for _, d := range delegates {
+		used[d.IfnameRequest] = true
+	}
+	for idx := 1; ; idx++ {
+		if name := fmt.Sprintf("eth%d", idx); !used[name] {
+			return name
+		}
+	}
+}
+
+func (h *hotplug) cniConfig(conf *types.NetConf) *libcni.CNIConfig {
+	binDir := h.binDir
+	if binDir == "" {
+		binDir = conf.BinDir
+	}
+	return libcni.NewCNIConfig(filepath.SplitList(binDir), h.exec)
+}
+
+func (h *hotplug) add(conf *types.NetConf, rt *libcni.RuntimeConf, delegate *types.DelegateNetConf) (cnitypes.Result, error) {
+	cniNet := h.cniConfig(conf)
+	if delegate.ConfListPlugin {
+		confList, err := libcni.ConfListFromBytes(delegate.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if confList.CNIVersion == "" {
+			confList.CNIVersion = conf.CNIVersion
+		}
+		return cniNet.AddNetworkList(context.Background(), confList, rt)
+	}
+	netConf, err := libcni.ConfFromBytes(delegate.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return cniNet.AddNetwork(context.Background(), netConf, rt)
+}
+
+func (h *hotplug) del(conf *types.NetConf, rt *libcni.RuntimeConf, delegate *types.DelegateNetConf) error {
+	cniNet := h.cniConfig(conf)
+	if delegate.ConfListPlugin {
+		confList, err := libcni.ConfListFromBytes(delegate.Bytes)
+		if err != nil {
+			return err
+		}
+		if confList.CNIVersion == "" {
+			confList.CNIVersion = conf.CNIVersion
+		}
+		return cniNet.DelNetworkList(context.Background(), confList, rt)
+	}
+	netConf, err := libcni.ConfFromBytes(delegate.Bytes)
+	if err != nil {
+		return err
+	}
+	return cniNet.DelNetwork(context.Background(), netConf, rt)
+}
+
+// sync adds the delegates of the networks of the annotation of pod which are
+// not cached, and deletes the cached ones of the networks no longer there,
+// then updates the network status
+func (h *hotplug) sync(pod *v1.Pod) {
+	key := podKey(pod.Namespace, pod.Name)
+	if pod.Spec.HostNetwork || pod.DeletionTimestamp != nil {
+		// multus deletes the delegates with the sandbox
+		return
+	}
+	networks, err := podNetworks(pod)
+	if err != nil {
+		logging.Errorf("hot-plug: invalid networks of pod %v, %v", key, err)
+		return
+	}
+
+	lk, err := sandbox.Lock(h.dataDir)
+	if err != nil {
+		logging.Errorf("hot-plug: lock the sandboxes failed, %v", err)
+		return
+	}
+	defer lk.Close()
+
+	sb, err := sandbox.Load(h.dataDir, pod.Namespace, pod.Name)
+	if err != nil {
+		logging.Errorf("hot-plug: load the sandbox of pod %v failed, %v", key, err)
+		return
+	}
+	if sb == nil {
+		logging.Debugf("hot-plug: pod %v has no sandbox on this node, skip it", key)
+		return
+	}
+	conf, err := types.LoadNetConf(sb.NetConf)
+	if err != nil {
+		logging.Errorf("hot-plug: load the netconf of pod %v failed, %v", key, err)
+		return
+	}
+	// the delegates cached by saveDelegates of multus
+	path := filepath.Join(h.dataDir, sb.ContainerID)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		logging.Errorf("hot-plug: read the delegates of pod %v failed, %v", key, err)
+		return
+	}
+	delegates, err := types.LoadCachedDelegates(data)
+	if err != nil {
+		logging.Errorf("hot-plug: load the delegates of pod %v failed, %v", key, err)
+		return
+	}
+
+	added, removed := diffNetworks(attachedNetworks(delegates), networks)
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+
+	args := &skel.CmdArgs{
+		ContainerID: sb.ContainerID,
+		Netns:       sb.NetNS,
+		IfName:      sb.IfName,
+		Args:        sb.Args,
+	}
+	k8sArgs, err := k8s.GetK8sArgs(args)
+	if err != nil {
+		logging.Errorf("hot-plug: invalid args of pod %v, %v", key, err)
+		return
+	}
+	pinIfNames(delegates, sb.IfName)
+
+	for _, net := range removed {
+		idx := findDelegate(delegates, net)
+		if idx < 0 {
+			logging.Verbosef("hot-plug: network %v of pod %v is not attached, skip it", net.Name, key)
+			continue
+		}
+		d := delegates[idx]
+		rt := types.CreateCNIRuntimeConf(args, k8sArgs, d.IfnameRequest, conf.RuntimeConfig, d)
+		if err := h.del(conf, rt, d); err != nil {
+			// it stays cached, the next sync deletes it again
+			logging.Errorf("hot-plug: delete network %v of pod %v failed, %v", net.Name, key, err)
+			continue
+		}
+		delegates = append(delegates[:idx], delegates[idx+1:]...)
+		logging.Verbosef("hot-plug: deleted network %v of pod %v, %v", net.Name, key, rt.IfName)
+	}
+
+	if len(added) > 0 {
+		newDelegates, err := k8s.GetNetworkDelegates(h.kubeClient, pod, added, conf.ConfDir, conf.NamespaceIsolation)
+		if err != nil {
+			logging.Errorf("hot-plug: get the delegates of pod %v failed, %v", key, err)
+			newDelegates = nil
+		}
+		for _, d := range newDelegates {
+			if d.IfnameRequest == "" {
+				d.IfnameRequest = freeIfName(delegates)
+			} else if ifNameUsed(delegates, d.IfnameRequest) {
+				logging.Errorf("hot-plug: interface %v of pod %v is used, skip network %v", d.IfnameRequest, key, d.Network.Name)
+				continue
+			}
+			rt := types.CreateCNIRuntimeConf(args, k8sArgs, d.IfnameRequest, conf.RuntimeConfig, d)
+			result, err := h.add(conf, rt, d)
+			if err != nil {
+				logging.Errorf("hot-plug: add network %v to pod %v failed, %v", d.Network.Name, key, err)
+				continue
+			}
+			if d.Result, err = json.Marshal(result); err != nil {
+				logging.Errorf("hot-plug: serialize the result of network %v failed, %v", d.Network.Name, err)
+			}
+			delegates = append(delegates, d)
+			logging.Verbosef("hot-plug: added network %v to pod %v, %v", d.Network.Name, key, rt.IfName)
+		}
+	}
+
+	data, err = json.Marshal(delegates)
+	if err == nil {
+		err = ioutil.WriteFile(path, data, 0600)
+	}
+	if err != nil {
+		logging.Errorf("hot-plug: save the delegates of pod %v failed, %v", key, err)
+	}
+
+	// set the network status annotation in apiserver, only in case Multus as kubeconfig
+	if conf.Kubeconfig == "" || types.CheckSystemNamespaces(pod.Namespace, conf.SystemNamespaces) {
+		return
+	}
+	var netStatus []*types.NetworkStatus
+	for _, d := range delegates {
+		result, err := types.LoadDelegateResult(d)
+		if err != nil {
+			logging.Errorf("hot-plug: load the result of %q of pod %v failed, %v, skip the network status", d.Conf.Name, key, err)
+			return
+		}
+		delegateNetStatus, err := types.LoadDelegateNetworkStatus(result, d)
+		if err != nil {
+			logging.Errorf("hot-plug: network status of %q of pod %v failed, %v", d.Conf.Name, key, err)
+			return
+		}
+		netStatus = append(netStatus, delegateNetStatus)
+	}
+	if err := k8s.SetNetworkStatus(h.kubeClient, k8sArgs, netStatus, conf); err != nil {
+		logging.Errorf("hot-plug: set the network status of pod %v failed, %v", key, err)
+	}
+}
+
+func ifNameUsed(delegates []*types.DelegateNetConf, ifName string) bool {
+	for _, d := range delegates {
+		if d.IfnameRequest == ifName {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/containernetworking/cni/pkg/version"
+	k8s "github.com/intel/multus-cni/k8sclient"
+	"github.com/intel/multus-cni/sandbox"
+	testhelpers "github.com/intel/multus-cni/testing"
+	"github.com/intel/multus-cni/types"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+// hotplugExec records the delegates run as "COMMAND ifname network"
+type hotplugExec struct {
+	version.PluginDecoder
+
+	calls []string
+	// fail are the calls which fail
+	fail map[string]bool
+}
+
+func (e *hotplugExec) ExecPlugin(ctx context.Context, pluginPath string, stdinData []byte, environ []string) ([]byte, error) {
+	conf := struct {
+		Name string `json:"name"`
+	}{}
+	Expect(json.Unmarshal(stdinData, &conf)).To(Succeed())
+	call := fmt.Sprintf("%s %s %s", getEnv(environ, "CNI_COMMAND"), getEnv(environ, "CNI_IFNAME"), conf.Name)
+	e.calls = append(e.calls, call)
+	if e.fail[call] {
+		return nil, fmt.Errorf("%s failed", call)
+	}
+	if getEnv(environ, "CNI_COMMAND") != "ADD" {
+		return nil, nil
+	}
+	return []byte(fmt.Sprintf(`{
+	    "cniVersion": "0.3.1",
+	    "interfaces": [{"name": %q, "sandbox": %q}],
+	    "ips": [{"version": "4", "address": "10.1.0.5/24", "interface": 0}]
+	}`, getEnv(environ, "CNI_IFNAME"), getEnv(environ, "CNI_NETNS"))), nil
+}
+
+func (e *hotplugExec) FindInPath(plugin string, paths []string) (string, error) {
+	return filepath.Join("/opt/cni/bin", plugin), nil
+}
+
+func getEnv(environ []string, key string) string {
+	for _, env := range environ {
+		if len(env) > len(key) && env[:len(key)+1] == key+"=" {
+			return env[len(key)+1:]
+		}
+	}
+	return ""
+}
+
+func selection(name string) *types.NetworkSelectionElement {
+	return &types.NetworkSelectionElement{Name: name, Namespace: "test"}
+}
+
+var _ = Describe("Hotplug", func() {
+	It("diffs the networks of the annotation", func() {
+		a, b, c := selection("a"), selection("b"), selection("c")
+		added, removed := diffNetworks(
+			[]*types.NetworkSelectionElement{a, b, selection("b")},
+			[]*types.NetworkSelectionElement{selection("b"), c, selection("a")})
+		Expect(added).To(Equal([]*types.NetworkSelectionElement{c}))
+		Expect(removed).To(Equal([]*types.NetworkSelectionElement{b}))
+
+		fixed := selection("a")
+		fixed.IPRequest = "10.1.0.5/24"
+		added, removed = diffNetworks([]*types.NetworkSelectionElement{a}, []*types.NetworkSelectionElement{fixed})
+		Expect(added).To(Equal([]*types.NetworkSelectionElement{fixed}))
+		Expect(removed).To(Equal([]*types.NetworkSelectionElement{a}))
+	})
+
+	It("diffs the networks of the annotation from the delegates", func() {
+		net1, net2 := selection("net1"), selection("net2")
+		delegates := []*types.DelegateNetConf{
+			{MasterPlugin: true, Network: selection("default")},
+			{Network: net1},
+			{},
+		}
+		Expect(attachedNetworks(delegates)).To(Equal([]*types.NetworkSelectionElement{net1}))
+		Expect(findDelegate(delegates, selection("default"))).To(Equal(-1))
+
+		added, removed := diffNetworks(attachedNetworks(delegates), []*types.NetworkSelectionElement{net2})
+		Expect(added).To(Equal([]*types.NetworkSelectionElement{net2}))
+		Expect(removed).To(Equal([]*types.NetworkSelectionElement{net1}))
+	})
+
+	It("keeps the interface names of the delegates attached", func() {
+		delegates := []*types.DelegateNetConf{{}, {}, {IfnameRequest: "net1"}, {}}
+		pinIfNames(delegates, "eth0")
+		Expect(delegates[0].IfnameRequest).To(Equal("eth0"))
+		Expect(delegates[1].IfnameRequest).To(Equal("eth1"))
+		Expect(delegates[2].IfnameRequest).To(Equal("net1"))
+		Expect(delegates[3].IfnameRequest).To(Equal("eth3"))
+
+		delegates = append(delegates[:1], delegates[2:]...)
+		Expect(freeIfName(delegates)).To(Equal("eth1"))
+		Expect(ifNameUsed(delegates, "net1")).To(BeTrue())
+	})
+
+	Context("on a pod of the node", func() {
+		var (
+			dataDir     string
+			exec        *hotplugExec
+			fKubeClient *testhelpers.FakeKubeClient
+			h           *hotplug
+		)
+
+		BeforeEach(func() {
+			var err error
+			dataDir, err = ioutil.TempDir("", "multus_hotplug")
+			Expect(err).NotTo(HaveOccurred())
+
+			netConf := fmt.Sprintf(`{
+	    "name": "node-cni-network",
+	    "type": "multus",
+	    "kubeconfig": "/etc/kubernetes/node-kubeconfig.yaml",
+	    "cniDir": %q,
+	    "delegates": [{
+	        "name": "weave1",
+	        "cniVersion": "0.3.1",
+	        "type": "weave-net"
+	    }]
+	}`, dataDir)
+			master, err := types.LoadDelegateNetConf([]byte(`{"name": "weave1", "cniVersion": "0.3.1", "type": "weave-net"}`), nil, "")
+			Expect(err).NotTo(HaveOccurred())
+			master.MasterPlugin = true
+			net1, err := types.LoadDelegateNetConf([]byte(`{"name": "net1", "cniVersion": "0.3.1", "type": "mynet"}`), selection("net1"), "")
+			Expect(err).NotTo(HaveOccurred())
+			net2, err := types.LoadDelegateNetConf([]byte(`{"name": "net2", "cniVersion": "0.3.1", "type": "mynet2"}`), selection("net2"), "")
+			Expect(err).NotTo(HaveOccurred())
+			result := []byte(`{"cniVersion": "0.3.1", "ips": [{"version": "4", "address": "10.0.0.5/24"}]}`)
+			for _, d := range []*types.DelegateNetConf{master, net1, net2} {
+				d.Result = result
+			}
+			data, err := json.Marshal([]*types.DelegateNetConf{master, net1, net2})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ioutil.WriteFile(filepath.Join(dataDir, "123456789"), data, 0600)).To(Succeed())
+			Expect(sandbox.Save(dataDir, "test", "testpod", &sandbox.Sandbox{
+				ContainerID: "123456789",
+				NetNS:       "/var/run/netns/test",
+				IfName:      "eth0",
+				Args:        "K8S_POD_NAMESPACE=test;K8S_POD_NAME=testpod",
+				NetConf:     json.RawMessage(netConf),
+			})).To(Succeed())
+
+			fKubeClient = testhelpers.NewFakeKubeClient()
+			fKubeClient.AddNetConfig("test", "net3", `{"name": "net3", "cniVersion": "0.3.1", "type": "mynet3"}`)
+			exec = &hotplugExec{}
+			h = &hotplug{kubeClient: fKubeClient, dataDir: dataDir, binDir: "/opt/cni/bin", exec: exec}
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dataDir)
+		})
+
+		It("adds and deletes only the networks changed", func() {
+			pod := testhelpers.NewFakePod("testpod", "net2,net3", "")
+			fKubeClient.AddPod(pod)
+
+			h.sync(pod)
+			Expect(exec.calls).To(Equal([]string{"DEL eth1 net1", "ADD eth1 net3"}))
+
+			data, err := ioutil.ReadFile(filepath.Join(dataDir, "123456789"))
+			Expect(err).NotTo(HaveOccurred())
+			delegates, err := types.LoadCachedDelegates(data)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(delegates).To(HaveLen(3))
+			Expect(delegates[1].Conf.Name).To(Equal("net2"))
+			Expect(delegates[1].IfnameRequest).To(Equal("eth2"))
+			Expect(delegates[2].Conf.Name).To(Equal("net3"))
+			Expect(delegates[2].IfnameRequest).To(Equal("eth1"))
+
+			status, err := k8s.GetNetworkStatus(fKubeClient, &types.K8sArgs{K8S_POD_NAMESPACE: "test", K8S_POD_NAME: "testpod"}, &types.NetConf{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(status).To(HaveLen(3))
+			Expect(status[2].Name).To(Equal("net3"))
+			Expect(status[2].Interface).To(Equal("eth1"))
+			Expect(status[2].IPs).To(Equal([]string{"10.1.0.5"}))
+		})
+
+		It("retries the delegates which failed on the next sync", func() {
+			pod := testhelpers.NewFakePod("testpod", "net2,net3", "")
+			fKubeClient.AddPod(pod)
+			exec.fail = map[string]bool{"DEL eth1 net1": true, "ADD eth3 net3": true}
+
+			h.sync(pod)
+			Expect(exec.calls).To(Equal([]string{"DEL eth1 net1", "ADD eth3 net3"}))
+
+			exec.calls, exec.fail = nil, nil
+			h.sync(pod)
+			Expect(exec.calls).To(Equal([]string{"DEL eth1 net1", "ADD eth1 net3"}))
+
+			// the delegates are the networks of the annotation
+			exec.calls = nil
+			h.sync(pod)
+			Expect(exec.calls).To(BeEmpty())
+		})
+
+		It("does nothing for the pods without sandbox on the node", func() {
+			pod := testhelpers.NewFakePod("otherpod", "net3", "")
+			fKubeClient.AddPod(pod)
+
+			h.sync(pod)
+			Expect(exec.calls).To(BeEmpty())
+		})
+	})
+})
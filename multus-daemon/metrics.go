@@ -0,0 +1,171 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/intel/multus-cni/etcdv3"
+	"github.com/intel/multus-cni/logging"
+	"github.com/intel/multus-cni/multus-ipam/backend/disk"
+	ipamEtcd "github.com/intel/multus-cni/multus-ipam/backend/etcdv3cli"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/net/context"
+)
+
+var (
+	defaultMetricsAddr = ":9610"
+	durationBuckets    = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+)
+
+// localCollector reads the metrics of the node on every scrape, the stores
+// are read from a disk.View so a scrape never takes their lock
+type localCollector struct {
+	leasedBlocks  *prometheus.Desc
+	allocatedIPs  *prometheus.Desc
+	freeIPs       *prometheus.Desc
+	applyFailures *prometheus.Desc
+	fdbEntries    *prometheus.Desc
+}
+
+func newLocalCollector() *localCollector {
+	return &localCollector{
+		leasedBlocks:  prometheus.NewDesc("multus_ipam_leased_blocks", "Address blocks leased to this node.", []string{"network"}, nil),
+		allocatedIPs:  prometheus.NewDesc("multus_ipam_allocated_ips", "Addresses allocated on this node.", []string{"network"}, nil),
+		freeIPs:       prometheus.NewDesc("multus_ipam_free_ips", "Free addresses in the blocks leased to this node.", []string{"network"}, nil),
+		applyFailures: prometheus.NewDesc("multus_ipam_lease_apply_failures_total", "Failed attempts of this node to lease a block from etcd.", []string{"network"}, nil),
+		fdbEntries:    prometheus.NewDesc("multus_vxlan_fdb_entries", "FDB entries of the vxlan devices on this node.", []string{"device"}, nil),
+	}
+}
+
+func (c *localCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{c.leasedBlocks, c.allocatedIPs, c.freeIPs, c.applyFailures, c.fdbEntries} {
+		ch <- d
+	}
+}
+
+func (c *localCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, network := range disk.GetAllNet("") {
+		u, err := disk.LoadUsage(network, "")
+		if err != nil {
+			logging.Errorf("load usage of %v failed, %v", network, err)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.leasedBlocks, prometheus.GaugeValue, float64(u.Blocks), network)
+		ch <- prometheus.MustNewConstMetric(c.allocatedIPs, prometheus.GaugeValue, float64(u.Allocated), network)
+		ch <- prometheus.MustNewConstMetric(c.freeIPs, prometheus.GaugeValue, float64(u.Free()), network)
+		ch <- prometheus.MustNewConstMetric(c.applyFailures, prometheus.CounterValue, float64(u.ApplyFailures), network)
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		logging.Errorf("list links failed, %v", err)
+		return
+	}
+	for _, l := range links {
+		if _, ok := l.(*netlink.Vxlan); !ok {
+			continue
+		}
+		neighs, err := netlink.NeighList(l.Attrs().Index, syscall.AF_BRIDGE)
+		if err != nil {
+			logging.Errorf("list fdb of %v failed, %v", l.Attrs().Name, err)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.fdbEntries, prometheus.GaugeValue, float64(len(neighs)), l.Attrs().Name)
+	}
+}
+
+// daemonMetrics are the metrics served by multusd on /metrics
+type daemonMetrics struct {
+	registry          *prometheus.Registry
+	fixedIPs          *prometheus.GaugeVec
+	etcdDuration      *prometheus.HistogramVec
+	reconcileDuration *prometheus.HistogramVec
+	reconcileDiff     *prometheus.GaugeVec
+}
+
+func newDaemonMetrics() *daemonMetrics {
+	m := &daemonMetrics{
+		registry: prometheus.NewRegistry(),
+		fixedIPs: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "multus_ipam_fixed_ips",
+			Help: "Fixed addresses bound in the cluster.",
+		}, []string{"network"}),
+		etcdDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "multus_etcd_request_duration_seconds",
+			Help:    "Duration of the etcd requests of multusd.",
+			Buckets: durationBuckets,
+		}, []string{"op"}),
+		reconcileDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "multus_reconcile_duration_seconds",
+			Help:    "Duration of the periodic reconcile tasks.",
+			Buckets: durationBuckets,
+		}, []string{"task"}),
+		reconcileDiff: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "multus_ipam_reconcile_diff",
+			Help: "Differences between the cache of this node and etcd found by the last check.",
+		}, []string{"network", "kind"}),
+	}
+	m.registry.MustRegister(newLocalCollector(), m.fixedIPs, m.etcdDuration, m.reconcileDuration, m.reconcileDiff)
+	return m
+}
+
+// timed runs task and records how long it took
+func (m *daemonMetrics) timed(task string, f func()) {
+	start := time.Now()
+	f()
+	m.reconcileDuration.WithLabelValues(task).Observe(time.Since(start).Seconds())
+}
+
+// setReconcileDiff exports the differences found by the last ipam check
+func (m *daemonMetrics) setReconcileDiff(diffs []*ipamEtcd.NetDiff) {
+	m.reconcileDiff.Reset()
+	for _, d := range diffs {
+		m.reconcileDiff.WithLabelValues(d.Network, "local_only").Set(float64(len(d.LocalOnly)))
+		m.reconcileDiff.WithLabelValues(d.Network, "etcd_only").Set(float64(len(d.EtcdOnly)))
+		m.reconcileDiff.WithLabelValues(d.Network, "conflict").Set(float64(len(d.Conflicts)))
+		m.reconcileDiff.WithLabelValues(d.Network, "orphan").Set(float64(len(d.Orphans)))
+	}
+}
+
+// collectEtcd refreshes the metrics read from etcd, it is done on the ticker
+func (m *daemonMetrics) collectEtcd() {
+	em, err := etcdv3.New()
+	if err != nil {
+		logging.Errorf("Create etcd client failed, %v", err)
+		return
+	}
+	defer em.Close()
+	start := time.Now()
+	counts, err := ipamEtcd.IPAMCountFixIPs(em)
+	m.etcdDuration.WithLabelValues("count_fixed_ips").Observe(time.Since(start).Seconds())
+	if err != nil {
+		return
+	}
+	m.fixedIPs.Reset()
+	for network, n := range counts {
+		m.fixedIPs.WithLabelValues(network).Set(float64(n))
+	}
+}
+
+// serveMetrics serves /metrics on METRICS_ADDR until ctx is done
+func (m *daemonMetrics) serveMetrics(ctx context.Context) {
+	addr := os.Getenv("METRICS_ADDR")
+	if addr == "" {
+		addr = defaultMetricsAddr
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	logging.Verbosef("serving metrics on %v", addr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logging.Errorf("serve metrics on %v failed, %v", addr, err)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/intel/multus-cni/etcdv3"
+	"github.com/intel/multus-cni/logging"
+	"github.com/intel/multus-cni/multus-ipam/backend/disk"
+	ipamEtcd "github.com/intel/multus-cni/multus-ipam/backend/etcdv3cli"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	defaultPodGCMode        = "report"
+	defaultPodGCGracePeriod = 5 * time.Minute
+)
+
+// podGC releases the ips held by pods the api server no longer has on this
+// node: the ips reserved on the node for them and the fixed ips bound to
+// them. It complements the runtime check, a pod may be gone while its
+// sandbox is left behind.
+type podGC struct {
+	client      kubernetes.Interface
+	node        string
+	dataDir     string
+	gracePeriod time.Duration
+	dryRun      bool
+	missing     map[string]time.Time // orphan ips, by when they were found orphan
+	fixOnNode   map[string]bool      // fixed ips of pods seen on this node
+}
+
+// newPodGCFromEnv returns the pod gc configured by POD_GC_MODE ("off",
+// "report" or "release"), POD_GC_GRACE_PERIOD in seconds and NODE_NAME, nil
+// if it is off
+func newPodGCFromEnv() (*podGC, error) {
+	mode := os.Getenv("POD_GC_MODE")
+	if mode == "" {
+		mode = defaultPodGCMode
+	}
+	if mode == "off" {
+		return nil, nil
+	}
+	if mode != "report" && mode != "release" {
+		return nil, fmt.Errorf("invalid POD_GC_MODE %q", mode)
+	}
+	g := &podGC{
+		dataDir:     os.Getenv("NET_DATA_DIR"),
+		gracePeriod: defaultPodGCGracePeriod,
+		dryRun:      mode == "report",
+		missing:     map[string]time.Time{},
+		fixOnNode:   map[string]bool{},
+	}
+	if v := os.Getenv("POD_GC_GRACE_PERIOD"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid POD_GC_GRACE_PERIOD %q", v)
+		}
+		g.gracePeriod = time.Duration(n) * time.Second
+	}
+	g.node = nodeNameFromEnv()
+
+	var err error
+	g.client, err = kubeClientFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// nodeNameFromEnv returns NODE_NAME, the host name if it is empty
+func nodeNameFromEnv() string {
+	node := os.Getenv("NODE_NAME")
+	if node == "" {
+		node, _ = os.Hostname()
+	}
+	return node
+}
+
+// kubeClientFromEnv returns the client of KUBE_CONFIG, the in-cluster config
+// is used if it is empty
+func kubeClientFromEnv() (kubernetes.Interface, error) {
+	kubeConfig := os.Getenv("KUBE_CONFIG")
+	config, err := clientcmd.BuildConfigFromFlags("", kubeConfig)
+	if err != nil {
+		return nil, logging.Errorf("failed to get context for the kubeconfig %v, %v", kubeConfig, err)
+	}
+	config.AcceptContentTypes = "application/vnd.kubernetes.protobuf,application/json"
+	config.ContentType = "application/vnd.kubernetes.protobuf"
+	return kubernetes.NewForConfig(config)
+}
+
+func podKey(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+func fixKey(b *ipamEtcd.FixBinding) string {
+	return fmt.Sprintf("fix:%s/%v", b.Network, b.IP)
+}
+
+// plan returns the reservations and the fixed ips which have been orphan for
+// the grace period. onNode are the pods of this node, exists tells whether a
+// pod still exists on any node.
+func (g *podGC) plan(owners map[string]disk.Owner, bindings []ipamEtcd.FixBinding, onNode map[string]bool,
+	exists func(namespace, name string) (bool, error)) ([]string, []ipamEtcd.FixBinding) {
+	orphans := map[string]bool{}
+	for f, o := range owners {
+		// the pod of the ips reserved by older versions may be unknown
+		if o.Pod == "" || o.ID == disk.GatewayID {
+			continue
+		}
+		if !onNode[podKey(o.Namespace, o.Pod)] {
+			orphans[f] = true
+		}
+	}
+
+	bound := map[string]bool{}
+	for i := range bindings {
+		b := &bindings[i]
+		k := fixKey(b)
+		bound[k] = true
+		if onNode[podKey(b.Namespace, b.Pod)] {
+			g.fixOnNode[k] = true
+			continue
+		}
+		if !g.fixOnNode[k] {
+			continue
+		}
+		found, err := exists(b.Namespace, b.Pod)
+		if err != nil {
+			logging.Errorf("get pod %v failed, %v", podKey(b.Namespace, b.Pod), err)
+			// keep waiting if it was orphan already
+			if _, ok := g.missing[k]; ok {
+				orphans[k] = true
+			}
+			continue
+		}
+		if found {
+			// moved to another node
+			delete(g.fixOnNode, k)
+			continue
+		}
+		orphans[k] = true
+	}
+	for k := range g.fixOnNode {
+		if !bound[k] {
+			delete(g.fixOnNode, k)
+		}
+	}
+
+	now := time.Now()
+	for k := range g.missing {
+		if !orphans[k] {
+			delete(g.missing, k)
+		}
+	}
+	for k := range orphans {
+		if _, ok := g.missing[k]; !ok {
+			g.missing[k] = now
+		}
+	}
+
+	ips := []string{}
+	for f := range owners {
+		if t, ok := g.missing[f]; ok && now.Sub(t) >= g.gracePeriod {
+			ips = append(ips, f)
+		}
+	}
+	sort.Strings(ips)
+	fixes := []ipamEtcd.FixBinding{}
+	for _, b := range bindings {
+		if t, ok := g.missing[fixKey(&b)]; ok && now.Sub(t) >= g.gracePeriod {
+			fixes = append(fixes, b)
+		}
+	}
+	return ips, fixes
+}
+
+// Check releases, or only logs in report mode, the ips of the pods gone from
+// this node for longer than the grace period
+func (g *podGC) Check() {
+	// load the reservations first, those made after the pods are listed
+	// would look orphan
+	owners := disk.LoadAllOwners("", g.dataDir)
+
+	em, err := etcdv3.New()
+	if err != nil {
+		logging.Errorf("Create etcd client failed, %v", err)
+		return
+	}
+	defer em.Close()
+	bindings, err := ipamEtcd.IPAMListFixBindings(em, "")
+	if err != nil {
+		return
+	}
+
+	selector := fields.OneTermEqualSelector("spec.nodeName", g.node).String()
+	pods, err := g.client.CoreV1().Pods("").List(metav1.ListOptions{FieldSelector: selector})
+	if err != nil {
+		logging.Errorf("list pods of %v failed, %v", g.node, err)
+		return
+	}
+	// this daemon runs in a pod of the node, the node name is wrong if
+	// there is none
+	if len(pods.Items) == 0 {
+		logging.Errorf("no pod on node %v, check NODE_NAME, skip pod gc", g.node)
+		return
+	}
+	onNode := map[string]bool{}
+	for _, p := range pods.Items {
+		onNode[podKey(p.Namespace, p.Name)] = true
+	}
+
+	ips, fixes := g.plan(owners, bindings, onNode, func(namespace, name string) (bool, error) {
+		_, err := g.client.CoreV1().Pods(namespace).Get(name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+		return err == nil, err
+	})
+
+	for _, f := range ips {
+		o := owners[f]
+		if g.dryRun {
+			logging.Verbosef("pod gc would release %v of %v, pod %v is gone", f, o.ID, podKey(o.Namespace, o.Pod))
+			continue
+		}
+		ok, err := disk.ReleaseIfOwned(f, o.ID)
+		if err != nil {
+			logging.Errorf("release %v of %v failed, %v", f, o.ID, err)
+			continue
+		}
+		if ok {
+			logging.Verbosef("pod gc released %v of %v, pod %v is gone", f, o.ID, podKey(o.Namespace, o.Pod))
+		}
+		delete(g.missing, f)
+	}
+	for _, b := range fixes {
+		if g.dryRun {
+			logging.Verbosef("pod gc would release fixed ip %v of %v, pod %v is gone", b.IP, b.Network, podKey(b.Namespace, b.Pod))
+			continue
+		}
+		logging.Verbosef("pod gc releases fixed ip %v of %v, pod %v is gone", b.IP, b.Network, podKey(b.Namespace, b.Pod))
+		delete(g.missing, fixKey(&b))
+		delete(g.fixOnNode, fixKey(&b))
+	}
+	if !g.dryRun && len(fixes) > 0 {
+		if err := ipamEtcd.IPAMReleaseFixBindings(em, fixes); err != nil {
+			logging.Errorf("release fixed ips failed, %v", err)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/intel/multus-cni/multus-ipam/backend/disk"
+	ipamEtcd "github.com/intel/multus-cni/multus-ipam/backend/etcdv3cli"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("PodGC", func() {
+	var (
+		g      *podGC
+		owners = map[string]disk.Owner{
+			"/net/10.0.0.2": {ID: "c1", Namespace: "default", Pod: "running"},
+			"/net/10.0.0.3": {ID: "c2", Namespace: "default", Pod: "gone"},
+			"/net/10.0.0.4": {ID: "c3"},
+			"/net/10.0.0.1": {ID: disk.GatewayID},
+		}
+		bindings = []ipamEtcd.FixBinding{
+			{Network: "fixnet", IP: net.ParseIP("10.1.0.2"), Namespace: "default", Pod: "running"},
+			{Network: "fixnet", IP: net.ParseIP("10.1.0.3"), Namespace: "default", Pod: "sts-0"},
+		}
+		exists map[string]bool
+		lookup = func(namespace, name string) (bool, error) {
+			found, ok := exists[podKey(namespace, name)]
+			if !ok {
+				return false, fmt.Errorf("api server unavailable")
+			}
+			return found, nil
+		}
+	)
+
+	BeforeEach(func() {
+		g = &podGC{missing: map[string]time.Time{}, fixOnNode: map[string]bool{}}
+		exists = map[string]bool{}
+	})
+
+	It("releases the ips of the pods gone from the node", func() {
+		onNode := map[string]bool{"default/running": true, "default/sts-0": true}
+		ips, fixes := g.plan(owners, bindings, onNode, lookup)
+		Expect(ips).To(Equal([]string{"/net/10.0.0.3"}))
+		Expect(fixes).To(BeEmpty())
+
+		// sts-0 is deleted
+		delete(onNode, "default/sts-0")
+		exists["default/sts-0"] = false
+		ips, fixes = g.plan(owners, bindings, onNode, lookup)
+		Expect(ips).To(Equal([]string{"/net/10.0.0.3"}))
+		Expect(fixes).To(HaveLen(1))
+		Expect(fixes[0].IP.String()).To(Equal("10.1.0.3"))
+	})
+
+	It("leaves the fixed ips of pods moved to another node", func() {
+		onNode := map[string]bool{"default/running": true, "default/sts-0": true}
+		g.plan(owners, bindings, onNode, lookup)
+		delete(onNode, "default/sts-0")
+		exists["default/sts-0"] = true
+		_, fixes := g.plan(owners, bindings, onNode, lookup)
+		Expect(fixes).To(BeEmpty())
+		Expect(g.fixOnNode).NotTo(HaveKey("fix:fixnet/10.1.0.3"))
+
+		// fixed ips never seen on this node are not its business
+		exists["default/sts-0"] = false
+		_, fixes = g.plan(owners, bindings, onNode, lookup)
+		Expect(fixes).To(BeEmpty())
+	})
+
+	It("waits for the grace period", func() {
+		g.gracePeriod = time.Hour
+		onNode := map[string]bool{"default/running": true, "default/sts-0": true}
+		g.plan(owners, bindings, onNode, lookup)
+		delete(onNode, "default/sts-0")
+		ips, fixes := g.plan(owners, bindings, onNode, lookup)
+		Expect(ips).To(BeEmpty())
+		Expect(fixes).To(BeEmpty())
+		Expect(g.missing).To(HaveKey("/net/10.0.0.3"))
+		// the api server could not tell
+		Expect(g.missing).NotTo(HaveKey("fix:fixnet/10.1.0.3"))
+
+		// back before the grace period is over
+		onNode["default/gone"] = true
+		g.plan(owners, bindings, onNode, lookup)
+		Expect(g.missing).To(BeEmpty())
+	})
+})
@@ -81,34 +81,40 @@ func (a *IPAllocator) Get(id string, ifname string, requestedIP net.IP) (*curren
 		gw = r.Gateway
 
 	} else {
-		// try to get allocated IPs for this given id, if exists, just return error
-		// because duplicate allocation is not allowed in SPEC
-		// https://github.com/containernetworking/cni/blob/master/SPEC.md
+		// try to get allocated IPs for this given id, if exists, return it, so
+		// the runtime can retry ADD after a partial failure
 		allocatedIPs := a.store.GetByID(id, ifname)
 		for _, allocatedIP := range allocatedIPs {
 			// check whether the existing IP belong to this range set
-			if _, err := a.rangeset.RangeFor(allocatedIP); err == nil {
-				return nil, fmt.Errorf("%s has been allocated to %s, duplicate allocation is not allowed", allocatedIP.String(), id)
-			}
-		}
-
-		iter, err := a.GetIter()
-		if err != nil {
-			return nil, err
-		}
-		for {
-			reservedIP, gw = iter.Next()
-			if reservedIP == nil {
+			if r, err := a.rangeset.RangeFor(allocatedIP); err == nil {
+				if err := canonicalizeIP(&allocatedIP); err != nil {
+					return nil, err
+				}
+				reservedIP = &net.IPNet{IP: allocatedIP, Mask: r.Subnet.Mask}
+				gw = r.Gateway
 				break
 			}
+		}
 
-			reserved, err := a.store.Reserve(id, ifname, reservedIP.IP, a.rangeID)
+		if reservedIP == nil {
+			iter, err := a.GetIter()
 			if err != nil {
 				return nil, err
 			}
+			for {
+				reservedIP, gw = iter.Next()
+				if reservedIP == nil {
+					break
+				}
 
-			if reserved {
-				break
+				reserved, err := a.store.Reserve(id, ifname, reservedIP.IP, a.rangeID)
+				if err != nil {
+					return nil, err
+				}
+
+				if reserved {
+					break
+				}
 			}
 		}
 	}
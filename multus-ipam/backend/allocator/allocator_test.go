@@ -248,6 +248,17 @@ var _ = Describe("host-local ip allocator", func() {
 
 		})
 
+		It("should return the existing allocation of the same id and ifname", func() {
+			alloc := mkalloc()
+			res, err := alloc.Get("ID", "eth0", nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.Address.String()).To(Equal("192.168.1.2/29"))
+
+			again, err := alloc.Get("ID", "eth0", nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(again).To(Equal(res))
+		})
+
 		Context("when requesting a specific IP", func() {
 			It("must allocate the requested IP", func() {
 				alloc := mkalloc()
@@ -20,7 +20,9 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/archichris/netools/ipaddr"
 	"github.com/containernetworking/cni/pkg/types"
 	types020 "github.com/containernetworking/cni/pkg/types/020"
 	"github.com/intel/multus-cni/logging"
@@ -34,6 +36,9 @@ var (
 	defaultApplyUnit = uint32(4)
 )
 
+// MaxQuarantine is the longest time released addresses are remembered
+const MaxQuarantine = 24 * time.Hour
+
 type Net struct {
 	Name       string      `json:"name"`
 	Type       string      `json:"type"`
@@ -73,12 +78,46 @@ type IPAMConfig struct {
 	IPArgs     []net.IP       `json:"-"` // Requested IPs from CNI_ARGS and args
 	ApplyUnit  uint32         `json:"applyUnit,omitempty"`
 	AllocGW    bool           `json:"allocGW,omitempty"`
+	DistGW     bool           `json:"distGW,omitempty"`
+	IPCount    map[string]int `json:"ipCount,omitempty"`    // addresses per family, keyed by "ipv4" and "ipv6"
+	Quarantine int            `json:"quarantine,omitempty"` // seconds a released address is not reused
 	LogFile    string         `json:"logFile,omitempty"`
 	LogLevel   string         `json:"logLevel,omitempty"`
 	PodName    string
 	K8sNs      string
 	IsFixIP    bool
 	Num        int
+	Pool       *types.IPNet `json:"-"` // the subnet the addresses are allocated from, any if nil
+}
+
+// Count returns how many addresses are allocated from a range of the family of addr
+func (c *IPAMConfig) Count(addr net.IP) int {
+	family := "ipv6"
+	if addr.To4() != nil {
+		family = "ipv4"
+	}
+	if n, ok := c.IPCount[family]; ok {
+		return n
+	}
+	return c.Num
+}
+
+// InPool tells whether the addresses may be allocated from rs
+func (c *IPAMConfig) InPool(rs RangeSet) bool {
+	if c.Pool == nil {
+		return true
+	}
+	for _, r := range rs {
+		if (*net.IPNet)(&r.Subnet).String() == (*net.IPNet)(c.Pool).String() {
+			return true
+		}
+	}
+	return false
+}
+
+// QuarantinePeriod returns how long a released address is not handed out again
+func (c *IPAMConfig) QuarantinePeriod() time.Duration {
+	return time.Duration(c.Quarantine) * time.Second
 }
 
 type IPAMEnvArgs struct {
@@ -90,8 +129,13 @@ type IPAMEnvArgs struct {
 	Num               types.UnmarshallableString `json:"extEnvNum,omitempty"`
 }
 
+// IPAMArgs are the "cni" args multus passes from the network selection of
+// the pod, they take precedence over the Fix and Num CNI_ARGS
 type IPAMArgs struct {
-	IPs []net.IP `json:"ips"`
+	IPs     []net.IP `json:"ips"`
+	FixedIP bool     `json:"fixedIP,omitempty"`
+	IPCount int      `json:"ipCount,omitempty"`
+	IPPool  string   `json:"ipPool,omitempty"`
 }
 
 type RangeSet []Range
@@ -156,20 +200,42 @@ func LoadIPAMConfig(bytes []byte, envArgs string) (*Net, string, error) {
 		if e.Num != "" {
 			for _, t := range strings.Split(string(e.Num), ",") {
 				v := strings.Split(t, ":")
-				if strings.ToLower(v[0]) == strings.ToLower(n.Name) {
+				if strings.ToLower(v[0]) == strings.ToLower(n.Name) && len(v) > 1 {
 					n.IPAM.Num, err = strconv.Atoi(v[1])
-					if err != nil {
+					if err != nil || n.IPAM.Num < 1 {
 						n.IPAM.Num = 1
-						logging.Errorf("convert %v to int failed", v[1])
+						logging.Errorf("convert %v to address count failed", v[1])
 					}
+					// the annotation overrides the count of every family
+					n.IPAM.IPCount = nil
 					break
 				}
 			}
 		}
 	}
 
-	if n.Args != nil && n.Args.A != nil && len(n.Args.A.IPs) != 0 {
-		n.IPAM.IPArgs = append(n.IPAM.IPArgs, n.Args.A.IPs...)
+	if n.Args != nil && n.Args.A != nil {
+		a := n.Args.A
+		if len(a.IPs) != 0 {
+			n.IPAM.IPArgs = append(n.IPAM.IPArgs, a.IPs...)
+		}
+		if a.FixedIP {
+			n.IPAM.IsFixIP = true
+		}
+		if a.IPCount < 0 {
+			return nil, "", fmt.Errorf("invalid ipCount arg %d", a.IPCount)
+		}
+		if a.IPCount > 0 {
+			n.IPAM.Num = a.IPCount
+			n.IPAM.IPCount = nil
+		}
+		if a.IPPool != "" {
+			_, pool, err := net.ParseCIDR(a.IPPool)
+			if err != nil {
+				return nil, "", fmt.Errorf("invalid ipPool arg %q, %v", a.IPPool, err)
+			}
+			n.IPAM.Pool = (*types.IPNet)(pool)
+		}
 	}
 
 	for idx := range n.IPAM.IPArgs {
@@ -228,6 +294,19 @@ func LoadIPAMConfig(bytes []byte, envArgs string) (*Net, string, error) {
 		}
 	}
 
+	if n.IPAM.Pool != nil {
+		found := false
+		for _, rs := range n.IPAM.Ranges {
+			if n.IPAM.InPool(rs) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, "", fmt.Errorf("ipPool %v is not a subnet of the ranges of %v", (*net.IPNet)(n.IPAM.Pool), n.Name)
+		}
+	}
+
 	n.IPAM.Name = n.Name
 
 	if n.IPAM.FixRange != nil {
@@ -236,6 +315,10 @@ func LoadIPAMConfig(bytes []byte, envArgs string) (*Net, string, error) {
 		}
 	}
 
+	if n.IPAM.AllocGW && n.IPAM.DistGW {
+		return nil, "", fmt.Errorf("allocGW and distGW can not be set at the same time")
+	}
+
 	if n.IPAM.ApplyUnit == 0 {
 		n.IPAM.ApplyUnit = defaultApplyUnit
 	}
@@ -244,5 +327,82 @@ func LoadIPAMConfig(bytes []byte, envArgs string) (*Net, string, error) {
 		n.IPAM.Num = 1
 	}
 
+	for family, num := range n.IPAM.IPCount {
+		if family != "ipv4" && family != "ipv6" {
+			return nil, "", fmt.Errorf("invalid ipCount family %q, must be ipv4 or ipv6", family)
+		}
+		if num < 1 {
+			return nil, "", fmt.Errorf("invalid ipCount %d for %v", num, family)
+		}
+	}
+
+	if n.IPAM.Quarantine < 0 || n.IPAM.QuarantinePeriod() > MaxQuarantine {
+		return nil, "", fmt.Errorf("invalid quarantine %d, must be between 0 and %d seconds", n.IPAM.Quarantine, int(MaxQuarantine.Seconds()))
+	}
+
 	return &n, n.CNIVersion, nil
 }
+
+// Validate checks what LoadIPAMConfig lets through for the configs already
+// deployed: a fixRange overlapping the ranges, whose addresses would be
+// handed out twice, blocks of applyUnit larger than an ipv4 range, and
+// distributed gateways which are not ipv4
+func (c *IPAMConfig) Validate() error {
+	if c.ApplyUnit > 32 {
+		return fmt.Errorf("invalid applyUnit %d, must be at most 32", c.ApplyUnit)
+	}
+	for i, rs := range c.Ranges {
+		for j := range rs {
+			r := &rs[j]
+			if c.FixRange != nil && r.Overlaps(c.FixRange) {
+				return fmt.Errorf("fixRange %v overlaps with range %v of range set %d", c.FixRange, r, i)
+			}
+			if c.DistGW && r.Gateway.To4() == nil {
+				// multus-daemon suppresses the ARP of the gateway, not the
+				// neighbour discovery
+				return fmt.Errorf("distGW needs an ipv4 gateway, range %v of range set %d has gateway %v", r, i, r.Gateway)
+			}
+			if r.RangeStart.To4() == nil {
+				// the blocks are leased from ipv4 ranges only
+				continue
+			}
+			if blockSize(c.ApplyUnit) > rangeSize(r) {
+				return fmt.Errorf("applyUnit %d is too large for range %v of range set %d, a block of %d addresses does not fit in it",
+					c.ApplyUnit, r, i, blockSize(c.ApplyUnit))
+			}
+		}
+	}
+	if c.DistGW && c.FixRange != nil && c.FixRange.Gateway.To4() == nil {
+		return fmt.Errorf("distGW needs an ipv4 gateway, fixRange %v has gateway %v", c.FixRange, c.FixRange.Gateway)
+	}
+	return nil
+}
+
+// blockSize returns the addresses of a block leased with applyUnit unit
+func blockSize(unit uint32) uint64 {
+	return uint64(1) << unit
+}
+
+// LeaseBounds returns the first and the last address of the ipv4 range r
+// the blocks and the fixed ips are handed out from, which skips the network
+// address and the first address of the subnet. ok is false if there is none.
+func LeaseBounds(r *Range) (start, end uint32, ok bool) {
+	if r.RangeStart.To4() == nil {
+		return 0, 0, false
+	}
+	start = ipaddr.IP4ToUint32(r.RangeStart)
+	if first := ipaddr.IP4ToUint32(r.Subnet.IP) + 2; start < first {
+		start = first
+	}
+	end = ipaddr.IP4ToUint32(r.RangeEnd)
+	return start, end, end >= start
+}
+
+// rangeSize returns the addresses of the ipv4 range r a block is leased from
+func rangeSize(r *Range) uint64 {
+	start, end, ok := LeaseBounds(r)
+	if !ok {
+		return 0
+	}
+	return uint64(end-start) + 1
+}
@@ -16,6 +16,8 @@ package allocator
 
 import (
 	"net"
+	"strings"
+	"time"
 
 	"github.com/containernetworking/cni/pkg/types"
 	. "github.com/onsi/ginkgo"
@@ -385,4 +387,200 @@ var _ = Describe("IPAM config", func() {
 		_, _, err := LoadIPAMConfig([]byte(input), "")
 		Expect(err).NotTo(HaveOccurred())
 	})
+
+	It("Should parse distributed gateway", func() {
+		input := `{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "multus-vxlan",
+				"ipam": {
+					"type": "multus-ipam",
+					"ranges": [
+						[{"subnet": "10.1.2.0/24", "gateway": "10.1.2.254"}]
+					],
+					"distGW": true
+				}
+			}`
+		conf, _, err := LoadIPAMConfig([]byte(input), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.IPAM.DistGW).To(BeTrue())
+		Expect(conf.IPAM.Ranges[0][0].Gateway).To(Equal(net.IP{10, 1, 2, 254}))
+	})
+
+	It("Should reject allocGW together with distGW", func() {
+		input := `{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "multus-vxlan",
+				"ipam": {
+					"type": "multus-ipam",
+					"ranges": [
+						[{"subnet": "10.1.2.0/24"}]
+					],
+					"allocGW": true,
+					"distGW": true
+				}
+			}`
+		_, _, err := LoadIPAMConfig([]byte(input), "")
+		Expect(err).To(MatchError("allocGW and distGW can not be set at the same time"))
+	})
+
+	It("Should parse the address count per family", func() {
+		input := `{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "multus-vxlan",
+				"ipam": {
+					"type": "multus-ipam",
+					"ranges": [
+						[{"subnet": "10.1.2.0/24"}],
+						[{"subnet": "2001:db8:1::/64"}]
+					],
+					"ipCount": {"ipv4": 3}
+				}
+			}`
+		conf, _, err := LoadIPAMConfig([]byte(input), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.IPAM.Count(net.ParseIP("10.1.2.10"))).To(Equal(3))
+		Expect(conf.IPAM.Count(net.ParseIP("2001:db8:1::10"))).To(Equal(1))
+
+		// the annotation overrides every family
+		conf, _, err = LoadIPAMConfig([]byte(input), "Num=mynet:2")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.IPAM.Count(net.ParseIP("10.1.2.10"))).To(Equal(2))
+		Expect(conf.IPAM.Count(net.ParseIP("2001:db8:1::10"))).To(Equal(2))
+	})
+
+	It("Should parse the ipam args of the pod", func() {
+		input := `{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "multus-vxlan",
+				"ipam": {
+					"type": "multus-ipam",
+					"ranges": [
+						[{"subnet": "10.1.2.0/24"}],
+						[{"subnet": "10.1.3.0/24"}]
+					],
+					"ipCount": {"ipv4": 3}
+				},
+				"args": {
+					"cni": {"fixedIP": true, "ipCount": 2, "ipPool": "10.1.3.0/24"}
+				}
+			}`
+		conf, _, err := LoadIPAMConfig([]byte(input), "Num=mynet:4")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.IPAM.IsFixIP).To(BeTrue())
+		Expect(conf.IPAM.Count(net.ParseIP("10.1.2.10"))).To(Equal(2))
+		Expect(conf.IPAM.InPool(conf.IPAM.Ranges[0])).To(BeFalse())
+		Expect(conf.IPAM.InPool(conf.IPAM.Ranges[1])).To(BeTrue())
+	})
+
+	It("Should reject an ipPool out of the ranges", func() {
+		input := `{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "multus-vxlan",
+				"ipam": {
+					"type": "multus-ipam",
+					"ranges": [
+						[{"subnet": "10.1.2.0/24"}]
+					]
+				},
+				"args": {
+					"cni": {"ipPool": "10.1.4.0/24"}
+				}
+			}`
+		_, _, err := LoadIPAMConfig([]byte(input), "")
+		Expect(err).To(MatchError("ipPool 10.1.4.0/24 is not a subnet of the ranges of mynet"))
+	})
+
+	It("Should reject an invalid address count", func() {
+		input := `{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "multus-vxlan",
+				"ipam": {
+					"type": "multus-ipam",
+					"ranges": [
+						[{"subnet": "10.1.2.0/24"}]
+					],
+					"ipCount": {"ipv4": 0}
+				}
+			}`
+		_, _, err := LoadIPAMConfig([]byte(input), "")
+		Expect(err).To(MatchError("invalid ipCount 0 for ipv4"))
+	})
+
+	It("Should load the quarantine period", func() {
+		input := `{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "multus-vxlan",
+				"ipam": {
+					"type": "multus-ipam",
+					"ranges": [
+						[{"subnet": "10.1.2.0/24"}]
+					],
+					"quarantine": 300
+				}
+			}`
+		conf, _, err := LoadIPAMConfig([]byte(input), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.IPAM.QuarantinePeriod()).To(Equal(5 * time.Minute))
+
+		_, _, err = LoadIPAMConfig([]byte(strings.Replace(input, "300", "-1", 1)), "")
+		Expect(err).To(MatchError("invalid quarantine -1, must be between 0 and 86400 seconds"))
+	})
+
+	It("Should validate the fixRange and applyUnit", func() {
+		input := `{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "multus-vxlan",
+				"ipam": {
+					"type": "multus-ipam",
+					"ranges": [
+						[{"subnet": "10.1.2.0/24", "rangeEnd": "10.1.2.127"}]
+					],
+					"fixRange": {"subnet": "10.1.2.0/24", "rangeStart": "10.1.2.128"},
+					"applyUnit": 6
+				}
+			}`
+		conf, _, err := LoadIPAMConfig([]byte(input), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.IPAM.Validate()).To(Succeed())
+
+		// .2 to .127 are leased, there is no block of 128 addresses
+		conf, _, err = LoadIPAMConfig([]byte(strings.Replace(input, `"applyUnit": 6`, `"applyUnit": 7`, 1)), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.IPAM.Validate()).To(MatchError("applyUnit 7 is too large for range 10.1.2.1-10.1.2.127 of range set 0, a block of 128 addresses does not fit in it"))
+
+		conf, _, err = LoadIPAMConfig([]byte(strings.Replace(input, "10.1.2.128", "10.1.2.100", 1)), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.IPAM.Validate()).To(MatchError("fixRange 10.1.2.100-10.1.2.254 overlaps with range 10.1.2.1-10.1.2.127 of range set 0"))
+	})
+
+	It("Should reject the distributed gateways which are not ipv4", func() {
+		input := `{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "multus-vxlan",
+				"ipam": {
+					"type": "multus-ipam",
+					"distGW": true,
+					"ranges": [
+						[{"subnet": "10.1.2.0/24"}],
+						[{"subnet": "2001:db8:1::/64"}]
+					]
+				}
+			}`
+		conf, _, err := LoadIPAMConfig([]byte(input), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.IPAM.Validate()).To(MatchError("distGW needs an ipv4 gateway, range 2001:db8:1::1-2001:db8:1:0:ffff:ffff:ffff:ffff of range set 1 has gateway 2001:db8:1::1"))
+
+		conf, _, err = LoadIPAMConfig([]byte(strings.Replace(input, `"distGW": true,`, "", 1)), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.IPAM.Validate()).To(Succeed())
+	})
 })
@@ -15,35 +15,43 @@
 package disk
 
 import (
-	"bufio"
-	"io"
+	"fmt"
 	"io/ioutil"
 
 	// "log"
-	"fmt"
 	"net"
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend"
 	"github.com/intel/multus-cni/disk"
 	"github.com/intel/multus-cni/logging"
-	"github.com/intel/multus-cni/multus-ipam/backend/allocator"
 )
 
 const lastIPFilePrefix = "last_reserved_ip."
 const LineBreak = "\r\n"
 
+// GatewayID is the id multus-ipam reserves the gateways with, not the one of
+// a container. They are kept out of the leased blocks and are never released
+// as orphans.
+const GatewayID = "gateway"
+
 var defaultDataDir = "/var/lib/cni/mulnets"
 var cacheName = "rangeset_cache"
 
-// Store is a simple disk-backed store that creates one file per IP
-// address in a given directory. The contents of the file are the container ID.
+// Store is a disk-backed store that keeps the reservations of a network in
+// an index by ip and by container ID, see index.
 type Store struct {
 	*disk.FileLock
-	dataDir string
+	dataDir    string
+	index      *index
+	owner      owner
+	quarantine time.Duration
 }
 
 // Store implements the Store interface
@@ -62,31 +70,61 @@ func New(network, dataDir string) (*Store, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Store{lk, dir}, nil
+	s := &Store{FileLock: lk, dataDir: dir, index: newIndex(dir)}
+
+	// the index is migrated and compacted only with the lock held
+	if err := s.Lock(); err != nil {
+		lk.Close()
+		return nil, err
+	}
+	defer s.Unlock()
+	if err := s.index.load(); err != nil {
+		lk.Close()
+		return nil, logging.Errorf("load index of %v failed, %v", dir, err)
+	}
+	if err := s.index.migrate(); err != nil {
+		lk.Close()
+		return nil, logging.Errorf("migrate %v to index failed, %v", dir, err)
+	}
+	if s.index.records > maxJournalRecords {
+		if err := s.index.compact(); err != nil {
+			logging.Errorf("compact index of %v failed, %v", dir, err)
+		}
+	}
+	if err := s.rotateHistory(); err != nil {
+		logging.Errorf("rotate history of %v failed, %v", dir, err)
+	}
+	return s, nil
 }
 
-func (s *Store) Reserve(id string, ifname string, ip net.IP, rangeID string) (bool, error) {
-	fname := GetEscapedPath(s.dataDir, ip.String())
+// SetQuarantine keeps ips released by another container from being
+// reserved again for d, so peers can age out their stale arp entries
+func (s *Store) SetQuarantine(d time.Duration) {
+	s.quarantine = d
+}
 
-	f, err := os.OpenFile(fname, os.O_RDWR|os.O_EXCL|os.O_CREATE, 0644)
-	if os.IsExist(err) {
+func (s *Store) Reserve(id string, ifname string, ip net.IP, rangeID string) (bool, error) {
+	if err := s.index.load(); err != nil {
+		return false, err
+	}
+	if _, ok := s.index.entries[ip.String()]; ok {
 		return false, nil
 	}
-	if err != nil {
-		return false, err
+	if s.index.inQuarantine(ip.String(), strings.TrimSpace(id), s.quarantine) {
+		logging.Debugf("%v is in quarantine", ip)
+		return false, nil
 	}
-	if _, err := f.WriteString(strings.TrimSpace(id) + LineBreak + ifname); err != nil {
-		f.Close()
-		os.Remove(f.Name())
-		return false, err
+	rec := &journalRecord{Op: "add", IP: ip.String(), ID: strings.TrimSpace(id), IfName: ifname}
+	if rec.ID == s.owner.id {
+		rec.Parent, rec.Namespace, rec.Pod = s.owner.ifName, s.owner.namespace, s.owner.pod
 	}
-	if err := f.Close(); err != nil {
-		os.Remove(f.Name())
+	if err := s.index.append(rec); err != nil {
 		return false, err
 	}
+	s.record("reserve", rec.IP, s.index.entries[rec.IP])
 	// store the reserved ip in lastIPFile
 	ipfile := GetEscapedPath(s.dataDir, lastIPFilePrefix+rangeID)
-	err = ioutil.WriteFile(ipfile, []byte(ip.String()), 0644)
+	err := ioutil.WriteFile(ipfile, []byte(ip.String()), 0644)
 	if err != nil {
 		return false, err
 	}
@@ -104,27 +142,69 @@ func (s *Store) LastReservedIP(rangeID string) (net.IP, error) {
 }
 
 func (s *Store) Release(ip net.IP) error {
-	return os.Remove(GetEscapedPath(s.dataDir, ip.String()))
+	if err := s.index.load(); err != nil {
+		return err
+	}
+	e, ok := s.index.entries[ip.String()]
+	if !ok {
+		return nil
+	}
+	if err := s.index.append(&journalRecord{Op: "del", IP: ip.String(), Time: time.Now().Unix()}); err != nil {
+		return err
+	}
+	s.record("release", ip.String(), e)
+	return nil
 }
 
-func (s *Store) FindByKey(id string, ifname string, match string) (bool, error) {
-	found := false
+// matchKey reports whether e belongs to match, the content of an ip file
+// "<id>" or "<id>\r\n<ifname>". The sub interfaces of ifname belong to it,
+// they are recorded with ifname as parent. Those recorded before the parent
+// was are named "<ifname>.<n>".
+func (e indexEntry) matchKey(match string) bool {
+	if e.key() == match {
+		return true
+	}
+	parts := strings.SplitN(match, LineBreak, 2)
+	if len(parts) != 2 || parts[0] != e.ID || parts[1] == "" {
+		return false
+	}
+	if e.Parent != "" {
+		return e.Parent == parts[1]
+	}
+	n := strings.TrimPrefix(e.IfName, parts[1]+".")
+	if n == e.IfName || n == "" {
+		return false
+	}
+	_, err := strconv.ParseUint(n, 10, 32)
+	return err == nil
+}
 
-	err := filepath.Walk(s.dataDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil || info.IsDir() {
-			return nil
-		}
-		data, err := ioutil.ReadFile(path)
-		if err != nil {
-			return nil
-		}
-		if strings.TrimSpace(string(data)) == match {
-			found = true
+// key is the content of the ip file of the one file per ip layout
+func (e indexEntry) key() string {
+	if e.IfName == "" {
+		return e.ID
+	}
+	return e.ID + LineBreak + e.IfName
+}
+
+// findByKey returns the ips of id that match, sorted as the files were
+func (s *Store) findByKey(id string, match string) ([]string, error) {
+	if err := s.index.load(); err != nil {
+		return nil, err
+	}
+	ips := []string{}
+	for ip := range s.index.byID[strings.TrimSpace(id)] {
+		if s.index.entries[ip].matchKey(match) {
+			ips = append(ips, ip)
 		}
-		return nil
-	})
-	return found, err
+	}
+	sort.Strings(ips)
+	return ips, nil
+}
 
+func (s *Store) FindByKey(id string, ifname string, match string) (bool, error) {
+	ips, err := s.findByKey(id, match)
+	return len(ips) > 0, err
 }
 
 func (s *Store) FindByID(id string, ifname string) bool {
@@ -145,25 +225,18 @@ func (s *Store) FindByID(id string, ifname string) bool {
 }
 
 func (s *Store) ReleaseByKey(id string, ifname string, match string) (bool, error) {
-	found := false
-	err := filepath.Walk(s.dataDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil || info.IsDir() {
-			return nil
-		}
-		data, err := ioutil.ReadFile(path)
-		if err != nil {
-			return nil
-		}
-		if strings.HasPrefix(strings.TrimSpace(string(data)), match) {
-			if err := os.Remove(path); err != nil {
-				return nil
-			}
-			found = true
+	ips, err := s.findByKey(id, match)
+	if err != nil {
+		return false, err
+	}
+	for _, ip := range ips {
+		e := s.index.entries[ip]
+		if err := s.index.append(&journalRecord{Op: "del", IP: ip, Time: time.Now().Unix()}); err != nil {
+			return false, err
 		}
-		return nil
-	})
-	return found, err
-
+		s.record("release", ip, e)
+	}
+	return len(ips) > 0, nil
 }
 
 // N.B. This function eats errors to be tolerant and
@@ -189,124 +262,76 @@ func (s *Store) GetByID(id string, ifname string) []net.IP {
 	// matchOld for backwards compatibility
 	matchOld := strings.TrimSpace(id)
 
-	// walk through all ips in this network to get the ones which belong to a specific ID
-	_ = filepath.Walk(s.dataDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil || info.IsDir() {
-			return nil
-		}
-		data, err := ioutil.ReadFile(path)
+	for _, m := range []string{match, matchOld} {
+		found, err := s.findByKey(id, m)
 		if err != nil {
+			logging.Errorf("get ips of %v failed, %v", id, err)
 			return nil
 		}
-		if strings.HasPrefix(strings.TrimSpace(string(data)), match) || strings.TrimSpace(string(data)) == matchOld {
-			_, ipString := filepath.Split(path)
-			if ip := net.ParseIP(ipString); ip != nil {
-				ips = append(ips, ip)
-			}
+		for _, ip := range found {
+			ips = append(ips, net.ParseIP(ip))
 		}
-		return nil
-	})
-
+	}
 	return ips
 }
 
-func GetEscapedPath(dataDir string, fname string) string {
-	if runtime.GOOS == "windows" {
-		fname = strings.Replace(fname, ":", "_", -1)
+// GetByIfName returns the IPs reserved for id on exactly ifname, unlike
+// GetByID the sub interfaces of ifname do not match
+func (s *Store) GetByIfName(id string, ifname string) []net.IP {
+	if err := s.index.load(); err != nil {
+		logging.Errorf("get ips of %v failed, %v", id, err)
+		return nil
 	}
-	return filepath.Join(dataDir, fname)
-}
-
-func (s *Store) Dir() string {
-	return s.dataDir
+	found := []string{}
+	for ip := range s.index.byID[strings.TrimSpace(id)] {
+		if s.index.entries[ip].IfName == ifname {
+			found = append(found, ip)
+		}
+	}
+	sort.Strings(found)
+	ips := []net.IP{}
+	for _, ip := range found {
+		ips = append(ips, net.ParseIP(ip))
+	}
+	return ips
 }
 
-// LoadRangeSetFromCache is used to load IP range set "startIP:endIP" from cache file
-func (s *Store) LoadCache() ([]allocator.SimpleRange, error) {
-	s.Lock()
-	defer s.Unlock()
-	fname := GetEscapedPath(s.dataDir, cacheName)
-	result := []allocator.SimpleRange{}
-	_, err := os.Stat(fname)
-	if os.IsNotExist(err) { // file do not exist
-		return result, nil
-	}
-	f, err := os.Open(fname)
-	if os.IsExist(err) {
-		return nil, err
+// SetIfName records the reservation of ip under ifname, it keeps its id and
+// owner. The lock must be held.
+func (s *Store) SetIfName(ip net.IP, ifname string) error {
+	if err := s.index.load(); err != nil {
+		return err
 	}
-	defer f.Close()
-	buf := bufio.NewReader(f)
-	for {
-		line, err := buf.ReadString('\n')
-		if err != nil {
-			if err == io.EOF { //读取结束，会报EOF
-				return result, nil
-			}
-			return nil, err
-		}
-		line = strings.TrimRight(line, "\n\r\t ")
-		pairIP := strings.Split(line, "-")
-		// logging.Debugf("load cache %v", pairIP)
-		result = append(result, allocator.SimpleRange{RangeStart: net.ParseIP(pairIP[0]), RangeEnd: net.ParseIP(pairIP[1])})
+	e, ok := s.index.entries[ip.String()]
+	if !ok {
+		return fmt.Errorf("%v is not reserved", ip)
 	}
+	return s.index.append(&journalRecord{Op: "add", IP: ip.String(), ID: e.ID, IfName: ifname, Namespace: e.Namespace, Pod: e.Pod})
 }
 
-func (s *Store) FlashCache(srs []allocator.SimpleRange) error {
-	logging.Debugf("Going to flash cache %v", srs)
+// Reservations returns the ids of the reserved ips, by ip
+func (s *Store) Reservations() (map[string]string, error) {
 	s.Lock()
 	defer s.Unlock()
-	fname := GetEscapedPath(s.dataDir, cacheName)
-	f, err := os.OpenFile(fname, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
-	if err != nil {
-		return logging.Errorf("open file %v failed, %v", fname, err)
+	if err := s.index.load(); err != nil {
+		return nil, err
 	}
-	defer f.Close()
-	defer f.Sync()
-	for _, sr := range srs {
-		sr.Canonicalize()
-		_, err = f.WriteString(fmt.Sprintf("%s-%s\n", sr.RangeStart.String(), sr.RangeEnd.String()))
-		if err != nil {
-			return logging.Errorf("write file %s failed, %v", fname, err)
-		}
+	ids := map[string]string{}
+	for ip, e := range s.index.entries {
+		ids[ip] = e.ID
 	}
-	return nil
+	return ids, nil
 }
 
-func (s *Store) AppendCache(sr *allocator.SimpleRange) error {
-	logging.Debugf("Going to append cache %v", *sr)
-	caches, err := s.LoadCache()
-	if err != nil {
-		return err
-	}
-
-	for _, csr := range caches {
-		if csr.Overlaps(sr) {
-			return logging.Errorf("%v over laps cache %v", *sr, csr)
-		}
+func GetEscapedPath(dataDir string, fname string) string {
+	if runtime.GOOS == "windows" {
+		fname = strings.Replace(fname, ":", "_", -1)
 	}
-	caches = append(caches, *sr)
-	return s.FlashCache(caches)
+	return filepath.Join(dataDir, fname)
 }
 
-func (s *Store) DeleteCache(sr *allocator.SimpleRange) error {
-	caches, err := s.LoadCache()
-	if err != nil {
-		return err
-	}
-	for idx, cache := range caches {
-		if cache.Overlaps(sr) {
-			if idx == 0 {
-				caches = caches[1:]
-			} else if idx == len(caches)-1 {
-				caches = caches[:idx]
-			} else {
-				caches = append(caches[:idx], caches[idx+1:]...)
-			}
-			break
-		}
-	}
-	return s.FlashCache(caches)
+func (s *Store) Dir() string {
+	return s.dataDir
 }
 
 func GetAllNet(d string) []string {
@@ -350,31 +375,101 @@ func LoadAllLeases(network string, d string) map[string]string {
 	leases := map[string]string{}
 
 	for _, n := range ns {
-		dir := filepath.Join(dataDir, n)
-		files, _ := ioutil.ReadDir(dir)
-		for _, file := range files {
-			if file.IsDir() {
-				continue
-			}
-			if strings.Contains(strings.ToLower(file.Name()), "lock") {
-				continue
+		s, err := New(n, dataDir)
+		if err != nil {
+			logging.Errorf("open store of %v failed, %v", n, err)
+			continue
+		}
+		for ip, e := range s.index.entries {
+			fulPath := filepath.Join(s.dataDir, ip)
+			logging.Debugf("file:%v, id:%v", fulPath, e.ID)
+			if e.ID != "" {
+				leases[fulPath] = e.ID
 			}
-			if ip := net.ParseIP(file.Name()); ip == nil {
-				logging.Verbosef("find an unregnized file %v", file.Name())
+		}
+		s.Close()
+	}
+	return leases
+}
+
+// Owner is the container and pod an ip is reserved for
+type Owner struct {
+	ID        string
+	Namespace string
+	Pod       string
+}
+
+// LoadAllOwners returns the owners of the reserved ips by path, as
+// LoadAllLeases does. The pod of the ips reserved before it was kept in the
+// index is looked up in the history, it is empty if not found there either.
+func LoadAllOwners(network string, d string) map[string]Owner {
+	dataDir := d
+	if dataDir == "" {
+		dataDir = defaultDataDir
+	}
+	var ns []string
+	if network != "" {
+		ns = []string{network}
+	} else {
+		ns = GetAllNet(dataDir)
+	}
+
+	owners := map[string]Owner{}
+	for _, n := range ns {
+		s, err := New(n, dataDir)
+		if err != nil {
+			logging.Errorf("open store of %v failed, %v", n, err)
+			continue
+		}
+		var reserved map[string]HistoryEvent
+		for ip, e := range s.index.entries {
+			if e.ID == "" {
 				continue
 			}
-			fulPath := filepath.Join(dir, file.Name())
-			id := GetID(fulPath)
-			logging.Debugf("file:%v, id:%v", fulPath, id)
-			if id != "" {
-				leases[fulPath] = id
+			o := Owner{ID: e.ID, Namespace: e.Namespace, Pod: e.Pod}
+			if o.Pod == "" {
+				if reserved == nil {
+					reserved = lastReserves(n, dataDir)
+				}
+				if ev, ok := reserved[ip]; ok && ev.ID == e.ID {
+					o.Namespace, o.Pod = ev.Namespace, ev.Pod
+				}
 			}
+			owners[filepath.Join(s.dataDir, ip)] = o
 		}
+		s.Close()
 	}
-	return leases
+	return owners
+}
+
+// lastReserves returns the last reserve event of every ip in the history
+func lastReserves(network, dataDir string) map[string]HistoryEvent {
+	reserved := map[string]HistoryEvent{}
+	events, err := LoadHistory(network, dataDir, nil)
+	if err != nil {
+		logging.Errorf("load history of %v failed, %v", network, err)
+		return reserved
+	}
+	for _, ev := range events {
+		if ev.Op == "reserve" {
+			reserved[ev.IP] = ev
+		}
+	}
+	return reserved
 }
 
+// GetID returns the id the ip a path of LoadAllLeases is reserved for
 func GetID(file string) string {
+	x := newIndex(filepath.Dir(file))
+	if err := x.load(); err != nil {
+		logging.Errorf("load index of %v failed, %v", file, err)
+		return ""
+	}
+	if e, ok := x.entries[parseIPFileName(filepath.Base(file))]; ok {
+		return e.ID
+	}
+
+	// not migrated yet
 	data, err := ioutil.ReadFile(file)
 	if err != nil {
 		logging.Errorf("read file %v failed, %v", file, err)
@@ -382,3 +477,23 @@ func GetID(file string) string {
 	}
 	return strings.Trim(strings.Split(string(data), "\n")[0], " \r\t")
 }
+
+// ReleaseIfOwned releases the ip of a path of LoadAllLeases if it is still
+// reserved for id
+func ReleaseIfOwned(file, id string) (bool, error) {
+	dir := filepath.Dir(file)
+	s, err := New(filepath.Base(dir), filepath.Dir(dir))
+	if err != nil {
+		return false, err
+	}
+	defer s.Close()
+	s.Lock()
+	defer s.Unlock()
+	if GetID(file) != id {
+		return false, nil
+	}
+	if err := s.Release(net.ParseIP(filepath.Base(file))); err != nil {
+		return false, err
+	}
+	return true, nil
+}
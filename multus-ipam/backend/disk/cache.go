@@ -0,0 +1,261 @@
+package disk
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/intel/multus-cni/logging"
+	"github.com/intel/multus-cni/multus-ipam/backend/allocator"
+)
+
+const cacheVersion = 1
+
+// CacheEntry is a block of ips leased to this node
+type CacheEntry struct {
+	allocator.SimpleRange
+	Revision  int64     // etcd revision of the lease, 0 if unknown
+	LeaseTime time.Time // when the block was leased or first cached
+}
+
+type cacheRecord struct {
+	Start     string    `json:"start"`
+	End       string    `json:"end"`
+	Revision  int64     `json:"revision"`
+	LeaseTime time.Time `json:"leaseTime"`
+}
+
+type cacheFile struct {
+	Version  int             `json:"version"`
+	Checksum string          `json:"checksum"` // sha256 of entries
+	Entries  json.RawMessage `json:"entries"`
+}
+
+func cacheChecksum(entries []byte) string {
+	sum := sha256.Sum256(entries)
+	return hex.EncodeToString(sum[:])
+}
+
+// parseCache parses the cache file, the "startIP-endIP" lines of the
+// previous format are accepted as well
+func parseCache(data []byte) ([]CacheEntry, error) {
+	result := []CacheEntry{}
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return result, nil
+	}
+
+	if data[0] != '{' {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			pairIP := strings.Split(line, "-")
+			if len(pairIP) != 2 || net.ParseIP(pairIP[0]) == nil || net.ParseIP(pairIP[1]) == nil {
+				logging.Errorf("skip malformed cache line %q", line)
+				continue
+			}
+			result = append(result, CacheEntry{
+				SimpleRange: allocator.SimpleRange{RangeStart: net.ParseIP(pairIP[0]), RangeEnd: net.ParseIP(pairIP[1])},
+			})
+		}
+		return result, scanner.Err()
+	}
+
+	f := cacheFile{}
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	if f.Version != cacheVersion {
+		return nil, fmt.Errorf("unsupported version %d", f.Version)
+	}
+	if cacheChecksum(f.Entries) != f.Checksum {
+		return nil, fmt.Errorf("checksum mismatch")
+	}
+	records := []cacheRecord{}
+	if err := json.Unmarshal(f.Entries, &records); err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		start, end := net.ParseIP(r.Start), net.ParseIP(r.End)
+		if start == nil || end == nil {
+			return nil, fmt.Errorf("malformed entry %v-%v", r.Start, r.End)
+		}
+		result = append(result, CacheEntry{
+			SimpleRange: allocator.SimpleRange{RangeStart: start, RangeEnd: end},
+			Revision:    r.Revision,
+			LeaseTime:   r.LeaseTime,
+		})
+	}
+	return result, nil
+}
+
+// loadCache returns the cached blocks. A corrupted cache is put aside and
+// treated as empty, IPAMCheckEtcd caches the blocks leased in etcd again.
+func (s *Store) loadCache() ([]CacheEntry, error) {
+	fname := GetEscapedPath(s.dataDir, cacheName)
+	data, err := ioutil.ReadFile(fname)
+	if os.IsNotExist(err) {
+		return []CacheEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries, err := parseCache(data)
+	if err != nil {
+		logging.Errorf("cache %v is corrupted, %v", fname, err)
+		if err := os.Rename(fname, fname+".corrupted"); err != nil {
+			return nil, err
+		}
+		return []CacheEntry{}, nil
+	}
+	return entries, nil
+}
+
+func (s *Store) flashCache(entries []CacheEntry) error {
+	records := []cacheRecord{}
+	for _, e := range entries {
+		e.Canonicalize()
+		records = append(records, cacheRecord{
+			Start:     e.RangeStart.String(),
+			End:       e.RangeEnd.String(),
+			Revision:  e.Revision,
+			LeaseTime: e.LeaseTime,
+		})
+	}
+	raw, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(cacheFile{Version: cacheVersion, Checksum: cacheChecksum(raw), Entries: raw})
+	if err != nil {
+		return err
+	}
+	fname := GetEscapedPath(s.dataDir, cacheName)
+	if err := writeFileSync(fname, data); err != nil {
+		return logging.Errorf("write file %s failed, %v", fname, err)
+	}
+	return nil
+}
+
+// LoadCacheEntries returns the blocks leased to this node
+func (s *Store) LoadCacheEntries() ([]CacheEntry, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.loadCache()
+}
+
+// LoadCache is used to load the IP range set leased to this node from cache file
+func (s *Store) LoadCache() ([]allocator.SimpleRange, error) {
+	entries, err := s.LoadCacheEntries()
+	if err != nil {
+		return nil, err
+	}
+	result := []allocator.SimpleRange{}
+	for _, e := range entries {
+		result = append(result, e.SimpleRange)
+	}
+	return result, nil
+}
+
+// FlashCacheEntries replaces the cached blocks with entries
+func (s *Store) FlashCacheEntries(entries []CacheEntry) error {
+	logging.Debugf("Going to flash cache %v", entries)
+	s.Lock()
+	defer s.Unlock()
+	return s.flashCache(entries)
+}
+
+// FlashCache replaces the cached blocks with srs, the revision and lease time
+// of the blocks cached already are kept
+func (s *Store) FlashCache(srs []allocator.SimpleRange) error {
+	logging.Debugf("Going to flash cache %v", srs)
+	s.Lock()
+	defer s.Unlock()
+	caches, err := s.loadCache()
+	if err != nil {
+		return err
+	}
+	entries := []CacheEntry{}
+	for _, sr := range srs {
+		e := CacheEntry{SimpleRange: sr, LeaseTime: time.Now()}
+		for _, c := range caches {
+			if c.Match(&sr) {
+				e = c
+				break
+			}
+		}
+		entries = append(entries, e)
+	}
+	return s.flashCache(entries)
+}
+
+// AppendCacheEntry caches a new block leased to this node
+func (s *Store) AppendCacheEntry(e *CacheEntry) error {
+	logging.Debugf("Going to append cache %v", *e)
+	s.Lock()
+	defer s.Unlock()
+	caches, err := s.loadCache()
+	if err != nil {
+		return err
+	}
+	for _, csr := range caches {
+		if csr.Overlaps(&e.SimpleRange) {
+			return logging.Errorf("%v over laps cache %v", e.SimpleRange, csr.SimpleRange)
+		}
+	}
+	caches = append(caches, *e)
+	return s.flashCache(caches)
+}
+
+// UpdateCacheRevisions sets the revision of the cached blocks to the one of
+// the block of leases they match. The cache is read and written under the
+// lock, the blocks cached meanwhile are kept.
+func (s *Store) UpdateCacheRevisions(leases []CacheEntry) error {
+	s.Lock()
+	defer s.Unlock()
+	caches, err := s.loadCache()
+	if err != nil {
+		return err
+	}
+	changed := false
+	for i := range caches {
+		for _, l := range leases {
+			if caches[i].Match(&l.SimpleRange) && caches[i].Revision != l.Revision {
+				caches[i].Revision = l.Revision
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return s.flashCache(caches)
+}
+
+func (s *Store) AppendCache(sr *allocator.SimpleRange) error {
+	return s.AppendCacheEntry(&CacheEntry{SimpleRange: *sr, LeaseTime: time.Now()})
+}
+
+func (s *Store) DeleteCache(sr *allocator.SimpleRange) error {
+	s.Lock()
+	defer s.Unlock()
+	caches, err := s.loadCache()
+	if err != nil {
+		return err
+	}
+	for idx, cache := range caches {
+		if cache.Overlaps(sr) {
+			caches = append(caches[:idx], caches[idx+1:]...)
+			break
+		}
+	}
+	return s.flashCache(caches)
+}
@@ -0,0 +1,104 @@
+package disk
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/intel/multus-cni/logging"
+	"github.com/intel/multus-cni/multus-ipam/backend/allocator"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Cache", func() {
+	var (
+		dataDir = "/tmp"
+		network = "testnetcache"
+		dir     = filepath.Join(dataDir, network)
+		sr1     = allocator.SimpleRange{RangeStart: net.ParseIP("10.0.0.16"), RangeEnd: net.ParseIP("10.0.0.31")}
+		sr2     = allocator.SimpleRange{RangeStart: net.ParseIP("10.0.0.32"), RangeEnd: net.ParseIP("10.0.0.47")}
+	)
+
+	BeforeEach(func() {
+		os.RemoveAll(dir)
+		logging.SetLogFile("/tmp/multus-test.log")
+		logging.SetLogLevel("debug")
+	})
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("keeps the revision and lease time of the entries", func() {
+		store, _ := New(network, dataDir)
+		defer store.Close()
+		leased := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+		Expect(store.AppendCacheEntry(&CacheEntry{SimpleRange: sr1, Revision: 7, LeaseTime: leased})).To(Succeed())
+		Expect(store.AppendCache(&sr2)).To(Succeed())
+
+		entries, err := store.LoadCacheEntries()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(len(entries)).To(Equal(2))
+		Expect(entries[0].Revision).To(Equal(int64(7)))
+		Expect(entries[0].LeaseTime.Equal(leased)).To(BeTrue())
+
+		// flashing the same blocks keeps them
+		Expect(store.FlashCache([]allocator.SimpleRange{sr2, sr1})).To(Succeed())
+		entries, _ = store.LoadCacheEntries()
+		Expect(entries[1].Revision).To(Equal(int64(7)))
+		Expect(entries[1].LeaseTime.Equal(leased)).To(BeTrue())
+
+		Expect(store.DeleteCache(&sr1)).To(Succeed())
+		caches, _ := store.LoadCache()
+		Expect(len(caches)).To(Equal(1))
+		Expect(caches[0].Match(&sr2)).To(BeTrue())
+	})
+
+	It("updates the revisions of the cached blocks only", func() {
+		store, _ := New(network, dataDir)
+		defer store.Close()
+		Expect(store.AppendCacheEntry(&CacheEntry{SimpleRange: sr1, Revision: 7})).To(Succeed())
+		Expect(store.AppendCacheEntry(&CacheEntry{SimpleRange: sr2, Revision: 8})).To(Succeed())
+
+		sr3 := allocator.SimpleRange{RangeStart: net.ParseIP("10.0.0.48"), RangeEnd: net.ParseIP("10.0.0.63")}
+		Expect(store.UpdateCacheRevisions([]CacheEntry{{SimpleRange: sr1, Revision: 9}, {SimpleRange: sr3, Revision: 10}})).To(Succeed())
+		entries, err := store.LoadCacheEntries()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(len(entries)).To(Equal(2))
+		Expect(entries[0].Revision).To(Equal(int64(9)))
+		Expect(entries[1].Revision).To(Equal(int64(8)))
+	})
+
+	It("loads the previous format", func() {
+		os.MkdirAll(dir, 0755)
+		ioutil.WriteFile(filepath.Join(dir, cacheName), []byte("10.0.0.16-10.0.0.31\nbroken\n10.0.0.32-10.0.0.47\n"), 0644)
+		store, _ := New(network, dataDir)
+		defer store.Close()
+		caches, err := store.LoadCache()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(len(caches)).To(Equal(2))
+		Expect(caches[1].Match(&sr2)).To(BeTrue())
+	})
+
+	It("puts a corrupted cache aside", func() {
+		store, _ := New(network, dataDir)
+		defer store.Close()
+		store.AppendCache(&sr1)
+		fname := filepath.Join(dir, cacheName)
+		data, _ := ioutil.ReadFile(fname)
+		ioutil.WriteFile(fname, []byte(strings.Replace(string(data), "10.0.0.16", "10.0.0.17", 1)), 0644)
+
+		caches, err := store.LoadCache()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(caches).To(BeEmpty())
+		_, err = os.Stat(fname + ".corrupted")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(store.AppendCache(&sr2)).To(Succeed())
+		caches, _ = store.LoadCache()
+		Expect(len(caches)).To(Equal(1))
+	})
+})
@@ -117,4 +117,29 @@ var _ = Describe("Disk", func() {
 		ips = store.GetByID(id, "eth1")
 		Expect(len(ips)).To(Equal(0))
 	})
+	It("does not match the addresses of a delegate named like a sub interface", func() {
+		store, _ := New(network, dataDir)
+		id := "dlkfangmafodfadfdjgamds1223fef"
+		store.SetOwner(id, "eth1", "default", "pod1")
+		store.Reserve(id, "eth1.0", net.IPv4(192, 168, 200, 100), "0")
+		store.Reserve(id, "eth1.1", net.IPv4(192, 168, 200, 101), "0")
+		store.SetOwner(id, "eth1.100", "default", "pod1")
+		store.Reserve(id, "eth1.100.0", net.IPv4(192, 168, 200, 102), "0")
+		Expect(len(store.GetByID(id, "eth1"))).To(Equal(2))
+		Expect(len(store.GetByID(id, "eth1.100"))).To(Equal(1))
+
+		Expect(store.ReleaseByID(id, "eth1")).To(Succeed())
+		Expect(store.GetByID(id, "eth1")).To(BeEmpty())
+		Expect(len(store.GetByID(id, "eth1.100"))).To(Equal(1))
+	})
+	It("does not match interfaces sharing a name prefix", func() {
+		store, _ := New(network, dataDir)
+		store.Reserve("gateway", "gateway.1", net.IPv4(192, 168, 200, 1), "0")
+		store.Reserve("gateway", "gateway.10", net.IPv4(192, 168, 200, 2), "0")
+		Expect(len(store.GetByID("gateway", "gateway.1"))).To(Equal(1))
+		Expect(len(store.GetByID("gateway", "gateway"))).To(Equal(2))
+		store.ReleaseByID("gateway", "gateway.1")
+		Expect(len(store.GetByID("gateway", "gateway.10"))).To(Equal(1))
+		Expect(store.FindByID("gateway", "gateway.1")).To(BeFalse())
+	})
 })
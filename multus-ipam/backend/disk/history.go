@@ -0,0 +1,148 @@
+package disk
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/intel/multus-cni/logging"
+)
+
+const (
+	historyName = "history.log"
+	// the history is rotated once it is larger, one rotated file is kept
+	maxHistorySize = 4 << 20
+)
+
+// HistoryEvent is a reservation or release of an ip
+type HistoryEvent struct {
+	Time      time.Time `json:"time"`
+	Op        string    `json:"op"` // "reserve" or "release"
+	IP        string    `json:"ip"`
+	ID        string    `json:"id"`
+	IfName    string    `json:"ifname,omitempty"`
+	Namespace string    `json:"namespace,omitempty"`
+	Pod       string    `json:"pod,omitempty"`
+}
+
+// owner is the pod of the container the store works for, and the interface
+// of the CNI command
+type owner struct {
+	id        string
+	ifName    string
+	namespace string
+	pod       string
+}
+
+// SetOwner records namespace and pod of id in the history of its ips, and
+// ifName as the parent of the interfaces the ips of id are reserved for
+func (s *Store) SetOwner(id, ifName, namespace, pod string) {
+	s.owner = owner{id: id, ifName: ifName, namespace: namespace, pod: pod}
+}
+
+func historyPath(dir string) string {
+	return filepath.Join(dir, historyName)
+}
+
+// record appends an event to the history, failures are only logged since the
+// history is for troubleshooting
+func (s *Store) record(op string, ip string, e indexEntry) {
+	ev := HistoryEvent{Time: time.Now(), Op: op, IP: ip, ID: e.ID, IfName: e.IfName, Namespace: e.Namespace, Pod: e.Pod}
+	if ev.Pod == "" && e.ID == s.owner.id {
+		ev.Namespace, ev.Pod = s.owner.namespace, s.owner.pod
+	}
+	data, err := json.Marshal(ev)
+	if err != nil {
+		logging.Errorf("marshal history event %v failed, %v", ev, err)
+		return
+	}
+	f, err := os.OpenFile(historyPath(s.dataDir), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		logging.Errorf("open history of %v failed, %v", s.dataDir, err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		logging.Errorf("write history of %v failed, %v", s.dataDir, err)
+	}
+}
+
+// rotateHistory keeps the history bounded, it must be called with the lock held
+func (s *Store) rotateHistory() error {
+	fname := historyPath(s.dataDir)
+	st, err := os.Stat(fname)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if st.Size() < maxHistorySize {
+		return nil
+	}
+	return os.Rename(fname, fname+".1")
+}
+
+// LoadHistory returns the events of ip in network, of all ips if ip is nil,
+// oldest first
+func LoadHistory(network string, d string, ip net.IP) ([]HistoryEvent, error) {
+	dataDir := d
+	if dataDir == "" {
+		dataDir = defaultDataDir
+	}
+	fname := historyPath(filepath.Join(dataDir, network))
+
+	events := []HistoryEvent{}
+	for _, f := range []string{fname + ".1", fname} {
+		evs, err := loadHistoryFile(f, ip)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, evs...)
+	}
+	return events, nil
+}
+
+func loadHistoryFile(fname string, ip net.IP) ([]HistoryEvent, error) {
+	events := []HistoryEvent{}
+	f, err := os.Open(fname)
+	if os.IsNotExist(err) {
+		return events, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		ev := HistoryEvent{}
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			// torn by a crash
+			continue
+		}
+		if ip == nil || net.ParseIP(ev.IP).Equal(ip) {
+			events = append(events, ev)
+		}
+	}
+	return events, scanner.Err()
+}
+
+// WhoHad returns the reservation ip was held by at time t, nil if it was free
+func WhoHad(events []HistoryEvent, t time.Time) *HistoryEvent {
+	var holder *HistoryEvent
+	for i := range events {
+		if events[i].Time.After(t) {
+			break
+		}
+		if events[i].Op == "reserve" {
+			holder = &events[i]
+		} else {
+			holder = nil
+		}
+	}
+	return holder
+}
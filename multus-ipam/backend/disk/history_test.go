@@ -0,0 +1,106 @@
+package disk
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/intel/multus-cni/logging"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("History", func() {
+	var (
+		dataDir = "/tmp"
+		network = "testnethistory"
+		dir     = filepath.Join(dataDir, network)
+		ip      = net.ParseIP("10.0.0.2")
+	)
+
+	BeforeEach(func() {
+		os.RemoveAll(dir)
+		logging.SetLogFile("/tmp/multus-test.log")
+		logging.SetLogLevel("debug")
+	})
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("tells who had an ip at a time", func() {
+		store, err := New(network, dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		defer store.Close()
+		before := time.Now().Add(-time.Second)
+
+		store.SetOwner("container1", "eth1", "default", "pod1")
+		store.Reserve("container1", "eth1", ip, "0")
+		held := time.Now()
+		Expect(store.ReleaseByID("container1", "eth1")).To(Succeed())
+		store.SetOwner("container2", "eth1", "kube-system", "pod2")
+		store.Reserve("container2", "eth1", ip, "0")
+		store.Reserve("container2", "eth1.1", net.ParseIP("10.0.0.3"), "0")
+
+		events, err := LoadHistory(network, dataDir, ip)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(len(events)).To(Equal(3))
+		Expect(events[1].Op).To(Equal("release"))
+		Expect(events[1].Pod).To(Equal("pod1"))
+
+		Expect(WhoHad(events, before)).To(BeNil())
+		ev := WhoHad(events, held)
+		Expect(ev).NotTo(BeNil())
+		Expect(ev.ID).To(Equal("container1"))
+		Expect(ev.Namespace).To(Equal("default"))
+		ev = WhoHad(events, time.Now())
+		Expect(ev.Pod).To(Equal("pod2"))
+	})
+
+	It("keeps one rotated history", func() {
+		Expect(os.MkdirAll(dir, 0755)).To(Succeed())
+		old := `{"time":"2020-01-01T00:00:00Z","op":"reserve","ip":"10.0.0.2","id":"old"}` + "\n"
+		big := make([]byte, maxHistorySize)
+		for i := range big {
+			big[i] = '\n'
+		}
+		ioutil.WriteFile(filepath.Join(dir, historyName), append([]byte(old), big...), 0644)
+
+		store, err := New(network, dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		defer store.Close()
+		_, err = os.Stat(filepath.Join(dir, historyName+".1"))
+		Expect(err).NotTo(HaveOccurred())
+		store.Release(ip)
+		store.Reserve("container1", "eth1", ip, "0")
+
+		events, err := LoadHistory(network, dataDir, ip)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(len(events)).To(Equal(2))
+		Expect(events[0].ID).To(Equal("old"))
+		Expect(WhoHad(events, time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)).ID).To(Equal("old"))
+	})
+
+	It("keeps the pods the ips are reserved for", func() {
+		store, err := New(network, dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		defer store.Close()
+		store.SetOwner("container1", "eth1", "default", "pod1")
+		store.Reserve("container1", "eth1", ip, "0")
+
+		// reserved before the pod was kept in the index
+		old := net.ParseIP("10.0.0.9")
+		Expect(store.index.append(&journalRecord{Op: "add", IP: old.String(), ID: "container0"})).To(Succeed())
+		ev := `{"time":"2020-01-01T00:00:00Z","op":"reserve","ip":"10.0.0.9","id":"container0","namespace":"ns0","pod":"pod0"}` + "\n"
+		f, err := os.OpenFile(filepath.Join(dir, historyName), os.O_WRONLY|os.O_APPEND, 0644)
+		Expect(err).NotTo(HaveOccurred())
+		f.WriteString(ev)
+		f.Close()
+
+		owners := LoadAllOwners(network, dataDir)
+		Expect(owners).To(HaveLen(2))
+		Expect(owners[filepath.Join(dir, ip.String())]).To(Equal(Owner{ID: "container1", Namespace: "default", Pod: "pod1"}))
+		Expect(owners[filepath.Join(dir, old.String())]).To(Equal(Owner{ID: "container0", Namespace: "ns0", Pod: "pod0"}))
+	})
+})
@@ -0,0 +1,353 @@
+package disk
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/intel/multus-cni/logging"
+	"github.com/intel/multus-cni/multus-ipam/backend/allocator"
+)
+
+const (
+	indexName    = "index.json"
+	journalName  = "index.journal"
+	indexVersion = 1
+	// the journal is folded into the snapshot when it has more records
+	maxJournalRecords = 512
+)
+
+type indexEntry struct {
+	ID     string `json:"id"`
+	IfName string `json:"ifname,omitempty"`
+	// Parent is the interface of the CNI command IfName is a sub interface
+	// of, empty for the entries recorded before it was
+	Parent    string `json:"parent,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Pod       string `json:"pod,omitempty"`
+}
+
+// releaseEntry is the last release of an ip
+type releaseEntry struct {
+	ID   string `json:"id"`
+	Time int64  `json:"time"` // unix seconds
+}
+
+type indexSnapshot struct {
+	Version  int                     `json:"version"`
+	Entries  map[string]indexEntry   `json:"entries"`
+	Released map[string]releaseEntry `json:"released,omitempty"`
+}
+
+type journalRecord struct {
+	Op        string `json:"op"` // "add" or "del"
+	IP        string `json:"ip"`
+	ID        string `json:"id,omitempty"`
+	IfName    string `json:"ifname,omitempty"`
+	Parent    string `json:"parent,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Pod       string `json:"pod,omitempty"`
+	Time      int64  `json:"time,omitempty"` // unix seconds of a "del"
+}
+
+// index keeps the reservations of a network by ip and by container id. It is
+// persisted as a snapshot plus an append-only journal of the changes made
+// since the snapshot, a torn record at the end of the journal is ignored.
+type index struct {
+	dir      string
+	entries  map[string]indexEntry
+	byID     map[string]map[string]bool
+	released map[string]releaseEntry
+	snapshot os.FileInfo
+	offset   int64 // bytes of the journal applied to entries
+	records  int   // records of the journal applied to entries
+	torn     bool  // the journal does not end with a line break
+}
+
+func newIndex(dir string) *index {
+	return &index{dir: dir}
+}
+
+func (x *index) snapshotPath() string {
+	return filepath.Join(x.dir, indexName)
+}
+
+func (x *index) journalPath() string {
+	return filepath.Join(x.dir, journalName)
+}
+
+// load brings the index up to date with the files, only the records appended
+// since the last load are read unless the snapshot has been replaced
+func (x *index) load() error {
+	fi, err := os.Stat(x.snapshotPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	replaced := (fi == nil) != (x.snapshot == nil) || (fi != nil && !os.SameFile(fi, x.snapshot))
+	if x.entries == nil || replaced {
+		if err := x.loadSnapshot(fi); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Open(x.journalPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if st.Size() < x.offset {
+		// compacted by someone else
+		if err := x.loadSnapshot(fi); err != nil {
+			return err
+		}
+	}
+	if _, err := f.Seek(x.offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			x.torn = len(line) > 0
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		x.offset += int64(len(line))
+		x.records++
+		rec := journalRecord{}
+		if err := json.Unmarshal(line, &rec); err != nil {
+			logging.Errorf("skip broken journal record %q in %v, %v", strings.TrimSpace(string(line)), x.dir, err)
+			continue
+		}
+		x.apply(&rec)
+	}
+}
+
+func (x *index) loadSnapshot(fi os.FileInfo) error {
+	snap := indexSnapshot{}
+	if fi != nil {
+		data, err := ioutil.ReadFile(x.snapshotPath())
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &snap); err != nil {
+			return fmt.Errorf("corrupted index %v, %v", x.snapshotPath(), err)
+		}
+		if snap.Version != indexVersion {
+			return fmt.Errorf("unsupported index version %d of %v", snap.Version, x.snapshotPath())
+		}
+	}
+	x.entries = map[string]indexEntry{}
+	x.byID = map[string]map[string]bool{}
+	x.released = map[string]releaseEntry{}
+	for ip, e := range snap.Entries {
+		x.set(ip, e)
+	}
+	for ip, r := range snap.Released {
+		x.released[ip] = r
+	}
+	x.snapshot, x.offset, x.records, x.torn = fi, 0, 0, false
+	return nil
+}
+
+func (x *index) set(ip string, e indexEntry) {
+	x.unset(ip)
+	x.entries[ip] = e
+	if x.byID[e.ID] == nil {
+		x.byID[e.ID] = map[string]bool{}
+	}
+	x.byID[e.ID][ip] = true
+}
+
+func (x *index) unset(ip string) {
+	e, ok := x.entries[ip]
+	if !ok {
+		return
+	}
+	delete(x.entries, ip)
+	delete(x.byID[e.ID], ip)
+	if len(x.byID[e.ID]) == 0 {
+		delete(x.byID, e.ID)
+	}
+}
+
+func (x *index) apply(rec *journalRecord) {
+	switch rec.Op {
+	case "add":
+		x.set(rec.IP, indexEntry{ID: rec.ID, IfName: rec.IfName, Parent: rec.Parent, Namespace: rec.Namespace, Pod: rec.Pod})
+		delete(x.released, rec.IP)
+	case "del":
+		if e, ok := x.entries[rec.IP]; ok && rec.Time != 0 {
+			x.released[rec.IP] = releaseEntry{ID: e.ID, Time: rec.Time}
+		}
+		x.unset(rec.IP)
+	}
+}
+
+// append persists rec in the journal before applying it
+func (x *index) append(rec *journalRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if x.torn {
+		data = append([]byte("\n"), data...)
+	}
+	data = append(data, '\n')
+
+	f, err := os.OpenFile(x.journalPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	x.apply(rec)
+	x.offset, x.torn = st.Size(), false
+	x.records++
+	return nil
+}
+
+// compact folds the journal into a new snapshot. A crash before the journal
+// is truncated is harmless, replaying it on the new snapshot is idempotent.
+func (x *index) compact() error {
+	expired := time.Now().Add(-allocator.MaxQuarantine).Unix()
+	for ip, r := range x.released {
+		if r.Time < expired {
+			delete(x.released, ip)
+		}
+	}
+	data, err := json.Marshal(indexSnapshot{Version: indexVersion, Entries: x.entries, Released: x.released})
+	if err != nil {
+		return err
+	}
+	if err := writeFileSync(x.snapshotPath(), data); err != nil {
+		return err
+	}
+	if err := os.Truncate(x.journalPath(), 0); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	fi, err := os.Stat(x.snapshotPath())
+	if err != nil {
+		return err
+	}
+	x.snapshot, x.offset, x.records, x.torn = fi, 0, 0, false
+	return nil
+}
+
+// writeFileSync replaces fname with data through a synced temp file
+func writeFileSync(fname string, data []byte) error {
+	tmp := fname + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, fname)
+}
+
+// migrate moves the reservations of the one file per ip layout into the index
+func (x *index) migrate() error {
+	files, err := ioutil.ReadDir(x.dir)
+	if err != nil {
+		return err
+	}
+	migrated := []string{}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		ip := parseIPFileName(file.Name())
+		if ip == "" {
+			continue
+		}
+		fname := filepath.Join(x.dir, file.Name())
+		data, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return err
+		}
+		if _, ok := x.entries[ip]; !ok {
+			lines := strings.SplitN(strings.TrimSpace(string(data)), "\n", 2)
+			rec := &journalRecord{Op: "add", IP: ip, ID: strings.TrimSpace(lines[0])}
+			if len(lines) > 1 {
+				rec.IfName = strings.TrimSpace(lines[1])
+			}
+			if err := x.append(rec); err != nil {
+				return err
+			}
+		}
+		migrated = append(migrated, fname)
+	}
+	if len(migrated) == 0 {
+		return nil
+	}
+
+	logging.Verbosef("migrated %d reservations of %v to the index", len(migrated), x.dir)
+	if err := x.compact(); err != nil {
+		return err
+	}
+	for _, fname := range migrated {
+		if err := os.Remove(fname); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inQuarantine tells whether ip was released by another id less than d ago
+func (x *index) inQuarantine(ip string, id string, d time.Duration) bool {
+	r, ok := x.released[ip]
+	if !ok || d <= 0 || r.ID == id {
+		return false
+	}
+	return time.Since(time.Unix(r.Time, 0)) < d
+}
+
+// parseIPFileName returns the ip a file of the one file per ip layout is named after
+func parseIPFileName(name string) string {
+	ip := net.ParseIP(strings.Replace(name, "_", ":", -1))
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
@@ -0,0 +1,150 @@
+package disk
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/intel/multus-cni/logging"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Index", func() {
+	var (
+		dataDir = "/tmp"
+		network = "testnetindex"
+		dir     = filepath.Join(dataDir, network)
+	)
+
+	BeforeEach(func() {
+		os.RemoveAll(dir)
+		logging.SetLogFile("/tmp/multus-test.log")
+		logging.SetLogLevel("debug")
+	})
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("migrates the one file per ip layout", func() {
+		Expect(os.MkdirAll(dir, 0755)).To(Succeed())
+		ioutil.WriteFile(filepath.Join(dir, "10.0.0.2"), []byte("container1"+LineBreak+"eth1.0"), 0644)
+		ioutil.WriteFile(filepath.Join(dir, "10.0.0.3"), []byte("container1"+LineBreak+"eth1.1"), 0644)
+		ioutil.WriteFile(filepath.Join(dir, "10.0.0.4"), []byte("container2"), 0644)
+		ioutil.WriteFile(filepath.Join(dir, lastIPFilePrefix+"0"), []byte("10.0.0.4"), 0644)
+
+		store, err := New(network, dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		defer store.Close()
+		Expect(len(store.GetByID("container1", "eth1"))).To(Equal(2))
+		Expect(store.GetByID("container2", "eth0")).To(Equal([]net.IP{net.ParseIP("10.0.0.4")}))
+
+		for _, f := range []string{"10.0.0.2", "10.0.0.3", "10.0.0.4"} {
+			_, err := os.Stat(filepath.Join(dir, f))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		}
+		last, err := store.LastReservedIP("0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(last.String()).To(Equal("10.0.0.4"))
+	})
+
+	It("shares the reservations between stores", func() {
+		s1, err := New(network, dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		defer s1.Close()
+		s2, err := New(network, dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		defer s2.Close()
+
+		reserved, err := s1.Reserve("container1", "eth1", net.ParseIP("10.0.0.2"), "0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reserved).To(BeTrue())
+		reserved, err = s2.Reserve("container2", "eth1", net.ParseIP("10.0.0.2"), "0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reserved).To(BeFalse())
+
+		Expect(s2.ReleaseByID("container1", "eth1")).To(Succeed())
+		Expect(s1.GetByID("container1", "eth1")).To(BeNil())
+	})
+
+	It("ignores a torn record at the end of the journal", func() {
+		store, err := New(network, dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		store.Reserve("container1", "eth1", net.ParseIP("10.0.0.2"), "0")
+		store.Close()
+
+		f, err := os.OpenFile(filepath.Join(dir, journalName), os.O_WRONLY|os.O_APPEND, 0644)
+		Expect(err).NotTo(HaveOccurred())
+		f.WriteString(`{"op":"add","ip":"10.0.0.3","id":"contai`)
+		f.Close()
+
+		store, err = New(network, dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		defer store.Close()
+		Expect(len(store.GetByID("container1", "eth1"))).To(Equal(1))
+		reserved, err := store.Reserve("container2", "eth1", net.ParseIP("10.0.0.3"), "0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reserved).To(BeTrue())
+
+		reopened, err := New(network, dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		defer reopened.Close()
+		Expect(reopened.GetByID("container2", "eth1")).To(Equal([]net.IP{net.ParseIP("10.0.0.3")}))
+	})
+
+	It("folds a long journal into the snapshot", func() {
+		store, err := New(network, dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		ip := net.ParseIP("10.0.0.2")
+		for i := 0; i < maxJournalRecords+1; i++ {
+			store.Reserve(fmt.Sprintf("container%d", i), "eth1", ip, "0")
+			store.Release(ip)
+		}
+		store.Reserve("container", "eth1", ip, "0")
+		store.Close()
+
+		store, err = New(network, dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		defer store.Close()
+		st, err := os.Stat(filepath.Join(dir, journalName))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(st.Size()).To(BeZero())
+		Expect(store.GetByID("container", "eth1")).To(Equal([]net.IP{ip}))
+	})
+
+	It("keeps a released ip in quarantine", func() {
+		store, err := New(network, dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		store.SetQuarantine(time.Hour)
+		ip := net.ParseIP("10.0.0.2")
+		store.Reserve("container1", "eth1", ip, "0")
+		Expect(store.Release(ip)).To(Succeed())
+
+		reserved, err := store.Reserve("container2", "eth1", ip, "0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reserved).To(BeFalse())
+		// the previous owner may have it back
+		reserved, _ = store.Reserve("container1", "eth1", ip, "0")
+		Expect(reserved).To(BeTrue())
+		Expect(store.ReleaseByID("container1", "eth1")).To(Succeed())
+		store.Close()
+
+		// the release survives the journal being folded
+		store, err = New(network, dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(store.index.compact()).To(Succeed())
+		store.Close()
+		store, err = New(network, dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		defer store.Close()
+		store.SetQuarantine(time.Hour)
+		reserved, _ = store.Reserve("container2", "eth1", ip, "0")
+		Expect(reserved).To(BeFalse())
+		store.SetQuarantine(0)
+		reserved, _ = store.Reserve("container2", "eth1", ip, "0")
+		Expect(reserved).To(BeTrue())
+	})
+})
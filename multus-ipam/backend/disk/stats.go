@@ -0,0 +1,85 @@
+package disk
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/archichris/netools/ipaddr"
+	"github.com/containernetworking/plugins/pkg/ip"
+)
+
+const applyFailuresName = "apply_failures"
+
+// Usage is the address usage of a network on this node
+type Usage struct {
+	Blocks        int    // blocks leased to this node
+	Size          uint64 // addresses in the blocks
+	Allocated     int    // addresses reserved in the blocks
+	ApplyFailures int64  // blocks that could not be leased from etcd
+}
+
+// Free returns the addresses of the blocks not reserved yet
+func (u *Usage) Free() uint64 {
+	if uint64(u.Allocated) > u.Size {
+		return 0
+	}
+	return u.Size - uint64(u.Allocated)
+}
+
+// CountApplyFailure counts a failed attempt to lease a block from etcd
+func (s *Store) CountApplyFailure() error {
+	s.Lock()
+	defer s.Unlock()
+	fname := filepath.Join(s.dataDir, applyFailuresName)
+	n, err := readCounter(fname)
+	if err != nil {
+		return err
+	}
+	return writeFileSync(fname, []byte(strconv.FormatInt(n+1, 10)))
+}
+
+func readCounter(fname string) (int64, error) {
+	data, err := ioutil.ReadFile(fname)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		// start over rather than failing the allocation
+		return 0, nil
+	}
+	return n, nil
+}
+
+// LoadUsage returns the address usage of network on this node, it is read
+// from a View of the store
+func LoadUsage(network string, d string) (*Usage, error) {
+	v, err := LoadView(network, d)
+	if err != nil {
+		return nil, err
+	}
+	u := &Usage{Blocks: len(v.Caches)}
+	for _, c := range v.Caches {
+		u.Size += uint64(ipaddr.IP4ToUint32(c.RangeEnd)-ipaddr.IP4ToUint32(c.RangeStart)) + 1
+	}
+	for addr := range v.Reservations {
+		a := net.ParseIP(addr)
+		for _, c := range v.Caches {
+			if ip.Cmp(a, c.RangeStart) >= 0 && ip.Cmp(a, c.RangeEnd) <= 0 {
+				u.Allocated++
+				break
+			}
+		}
+	}
+	if u.ApplyFailures, err = v.ApplyFailures(); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
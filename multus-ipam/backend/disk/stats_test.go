@@ -0,0 +1,73 @@
+package disk
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/intel/multus-cni/logging"
+	"github.com/intel/multus-cni/multus-ipam/backend/allocator"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Stats", func() {
+	var (
+		dataDir = "/tmp"
+		network = "testnetstats"
+		dir     = filepath.Join(dataDir, network)
+	)
+
+	BeforeEach(func() {
+		os.RemoveAll(dir)
+		logging.SetLogFile("/tmp/multus-test.log")
+		logging.SetLogLevel("debug")
+	})
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("reports the usage of the leased blocks", func() {
+		store, err := New(network, dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		store.AppendCache(&allocator.SimpleRange{RangeStart: net.ParseIP("10.0.0.16"), RangeEnd: net.ParseIP("10.0.0.31")})
+		store.Reserve("container1", "eth1", net.ParseIP("10.0.0.16"), "0")
+		store.Reserve("container1", "eth1.1", net.ParseIP("10.0.0.17"), "0")
+		// the gateway is out of the blocks
+		store.Reserve("gateway", "gateway.0", net.ParseIP("10.0.0.1"), "0")
+		Expect(store.CountApplyFailure()).To(Succeed())
+		Expect(store.CountApplyFailure()).To(Succeed())
+		store.Close()
+
+		u, err := LoadUsage(network, dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(u.Blocks).To(Equal(1))
+		Expect(u.Size).To(Equal(uint64(16)))
+		Expect(u.Allocated).To(Equal(2))
+		Expect(u.Free()).To(Equal(uint64(14)))
+		Expect(u.ApplyFailures).To(Equal(int64(2)))
+	})
+	It("reads the store without changing it", func() {
+		u, err := LoadUsage(network, dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(u.Blocks).To(Equal(0))
+		_, err = os.Stat(dir)
+		Expect(os.IsNotExist(err)).To(BeTrue())
+
+		store, err := New(network, dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		store.AppendCache(&allocator.SimpleRange{RangeStart: net.ParseIP("10.0.0.16"), RangeEnd: net.ParseIP("10.0.0.31")})
+		store.Reserve("container1", "eth1", net.ParseIP("10.0.0.16"), "0")
+		store.Close()
+		// reserved by a previous version, it is migrated by the next store
+		Expect(ioutil.WriteFile(filepath.Join(dir, "10.0.0.20"), []byte("container2"+LineBreak+"eth1"), 0644)).To(Succeed())
+
+		v, err := LoadView(network, dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(v.Reservations).To(Equal(map[string]string{"10.0.0.16": "container1", "10.0.0.20": "container2"}))
+		Expect(len(v.Caches)).To(Equal(1))
+		_, err = os.Stat(filepath.Join(dir, "10.0.0.20"))
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
@@ -0,0 +1,110 @@
+package disk
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/intel/multus-cni/logging"
+)
+
+// maxViewReloads bounds the reloads of a view racing with compactions
+const maxViewReloads = 3
+
+// View is a read-only copy of the store of a network. Unlike New it takes
+// neither the lock nor any maintenance, nothing is created, migrated,
+// compacted or rotated, so it is cheap enough for the metrics and the reports.
+type View struct {
+	dataDir string
+	// Caches are the blocks leased to this node
+	Caches []CacheEntry
+	// Reservations are the ids of the reserved ips, by ip. The ips of the one
+	// file per ip layout not migrated to the index yet are included.
+	Reservations map[string]string
+}
+
+// LoadView reads the store of network in dataDir, it is empty if the network
+// has no store on this node
+func LoadView(network, dataDir string) (*View, error) {
+	if dataDir == "" {
+		dataDir = defaultDataDir
+	}
+	v := &View{
+		dataDir:      filepath.Join(dataDir, network),
+		Caches:       []CacheEntry{},
+		Reservations: map[string]string{},
+	}
+	if _, err := os.Stat(v.dataDir); os.IsNotExist(err) {
+		return v, nil
+	}
+
+	x, err := loadIndexView(v.dataDir)
+	if err != nil {
+		return nil, err
+	}
+	for ip, e := range x.entries {
+		v.Reservations[ip] = e.ID
+	}
+	files, err := ioutil.ReadDir(v.dataDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		ip := parseIPFileName(file.Name())
+		if file.IsDir() || ip == "" {
+			continue
+		}
+		if _, ok := v.Reservations[ip]; ok {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(v.dataDir, file.Name()))
+		if err != nil {
+			// migrated meanwhile
+			continue
+		}
+		v.Reservations[ip] = strings.TrimSpace(strings.SplitN(strings.TrimSpace(string(data)), "\n", 2)[0])
+	}
+
+	data, err := ioutil.ReadFile(GetEscapedPath(v.dataDir, cacheName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if v.Caches, err = parseCache(data); err != nil {
+			// put aside by the next store opened
+			logging.Errorf("cache of %v is corrupted, %v", network, err)
+			v.Caches = []CacheEntry{}
+		}
+	}
+	return v, nil
+}
+
+// loadIndexView loads the index of dir without the lock. The snapshot may be
+// replaced and the journal truncated by a compaction while they are read, the
+// index is loaded again then.
+func loadIndexView(dir string) (*index, error) {
+	x := newIndex(dir)
+	for i := 0; ; i++ {
+		if err := x.load(); err != nil {
+			return nil, err
+		}
+		fi, err := os.Stat(x.snapshotPath())
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if (fi == nil) == (x.snapshot == nil) && (fi == nil || os.SameFile(fi, x.snapshot)) {
+			return x, nil
+		}
+		if i == maxViewReloads {
+			return nil, logging.Errorf("index of %v is being compacted", dir)
+		}
+		x = newIndex(dir)
+	}
+}
+
+// ApplyFailures returns the blocks that could not be leased from etcd, see
+// Store.CountApplyFailure
+func (v *View) ApplyFailures() (int64, error) {
+	return readCounter(filepath.Join(v.dataDir, applyFailuresName))
+}
@@ -1,7 +1,7 @@
 package dockercli
 
 import (
-	"os"
+	"net"
 	"path/filepath"
 
 	"github.com/docker/docker/api/types"
@@ -12,6 +12,11 @@ import (
 	"golang.org/x/net/context"
 )
 
+// IPAMCheckLocalIPs releases the ips reserved for containers docker does not
+// run.
+//
+// Deprecated: use a runtimecli.Checker, it works with CRI runtimes too and
+// refuses to release the ips in bulk when the runtime looks unhealthy.
 func IPAMCheckLocalIPs(dir string) error {
 	cli, err := client.NewClientWithOpts(client.FromEnv)
 	if err != nil {
@@ -19,7 +24,7 @@ func IPAMCheckLocalIPs(dir string) error {
 	}
 	leases := disk.LoadAllLeases("", dir)
 	for f, id := range leases {
-		if id == "gateway" {
+		if id == disk.GatewayID {
 			continue
 		}
 		containers, err := cli.ContainerList(context.Background(),
@@ -38,9 +43,10 @@ func IPAMCheckLocalIPs(dir string) error {
 			s.Lock()
 			curID := disk.GetID(f)
 			if curID == id {
-				os.Remove(f)
+				s.Release(net.ParseIP(filepath.Base(f)))
 			}
 			s.Unlock()
+			s.Close()
 		}
 	}
 	return nil
@@ -0,0 +1,163 @@
+package etcdv3cli
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/archichris/netools/ipaddr"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/intel/multus-cni/etcdv3"
+	"github.com/intel/multus-cni/logging"
+	"github.com/intel/multus-cni/multus-ipam/backend/allocator"
+)
+
+// Lease is a block of a network leased to a node
+type Lease struct {
+	Network  string
+	Node     string
+	Range    allocator.SimpleRange
+	Revision int64
+	key      string
+}
+
+// FixBinding is a fixed ip bound to an interface of a pod
+type FixBinding struct {
+	Network   string
+	IP        net.IP
+	Namespace string
+	Pod       string
+	Index     int
+	key       string
+}
+
+// IPAMListLeases returns the blocks leased to any node, of all networks if
+// network is empty
+func IPAMListLeases(em *etcdv3.EtcdMultus, network string) ([]Lease, error) {
+	keyDir := filepath.Join(em.RootKeyDir, leaseDir) + "/"
+	if network != "" {
+		keyDir = filepath.Join(keyDir, network) + "/"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+	resp, err := em.Cli.Get(ctx, keyDir, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	cancel()
+	if err != nil {
+		return nil, logging.Errorf("get %v failed, %v", keyDir, err)
+	}
+	leases := []Lease{}
+	for _, ev := range resp.Kvs {
+		k := string(ev.Key)
+		leases = append(leases, Lease{
+			Network:  filepath.Base(filepath.Dir(k)),
+			Node:     strings.Trim(string(ev.Value), " \r\n\t"),
+			Range:    *ipamLeaseToSimleRange(k),
+			Revision: ev.ModRevision,
+			key:      k,
+		})
+	}
+	return leases, nil
+}
+
+// ipamFindLease returns the lease of network starting at start
+func ipamFindLease(em *etcdv3.EtcdMultus, network string, start net.IP) (*Lease, error) {
+	leases, err := IPAMListLeases(em, network)
+	if err != nil {
+		return nil, err
+	}
+	for i := range leases {
+		if leases[i].Range.RangeStart.Equal(start) {
+			return &leases[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no block of %v starts at %v", network, start)
+}
+
+// IPAMReleaseLease gives a block back to the pool. A node still caching the
+// block leases it again on its next check, so release the blocks of nodes
+// that are gone or move them instead.
+func IPAMReleaseLease(em *etcdv3.EtcdMultus, network string, start net.IP) (*Lease, error) {
+	l, err := ipamFindLease(em, network, start)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+	resp, err := em.Cli.Txn(ctx).If(clientv3.Compare(clientv3.ModRevision(l.key), "=", l.Revision)).Then(clientv3.OpDelete(l.key)).Commit()
+	cancel()
+	if err != nil {
+		return nil, logging.Errorf("delete %v failed, %v", l.key, err)
+	}
+	if !resp.Succeeded {
+		return nil, fmt.Errorf("block %v of %v changed meanwhile", start, network)
+	}
+	return l, nil
+}
+
+// IPAMMoveLease leases a block to another node. The new node caches the block
+// on its next check and the old one drops it from its cache. The ips the old
+// node reserved in the block stay with its pods, the new node hands them out
+// again, so the old node must not have any, see IPAMBlockReservations.
+func IPAMMoveLease(em *etcdv3.EtcdMultus, network string, start net.IP, node string) (*Lease, error) {
+	l, err := ipamFindLease(em, network, start)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+	resp, err := em.Cli.Txn(ctx).If(clientv3.Compare(clientv3.ModRevision(l.key), "=", l.Revision)).Then(clientv3.OpPut(l.key, node)).Commit()
+	cancel()
+	if err != nil {
+		return nil, logging.Errorf("put %v failed, %v", l.key, err)
+	}
+	if !resp.Succeeded {
+		return nil, fmt.Errorf("block %v of %v changed meanwhile", start, network)
+	}
+	return l, nil
+}
+
+// IPAMListFixBindings returns the fixed ips bound, of all networks if network
+// is empty
+func IPAMListFixBindings(em *etcdv3.EtcdMultus, network string) ([]FixBinding, error) {
+	keyDir := filepath.Join(em.RootKeyDir, fixDir) + "/"
+	if network != "" {
+		keyDir = filepath.Join(keyDir, network) + "/"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+	resp, err := em.Cli.Get(ctx, keyDir, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	cancel()
+	if err != nil {
+		return nil, logging.Errorf("get %v failed, %v", keyDir, err)
+	}
+	bindings := []FixBinding{}
+	for _, ev := range resp.Kvs {
+		k := string(ev.Key)
+		v := strings.Split(strings.Trim(string(ev.Value), " \r\n\t"), fixGap)
+		b := FixBinding{
+			Network: filepath.Base(filepath.Dir(k)),
+			IP:      ipaddr.Uint32ToIP4(ipaddr.StrToUint32(filepath.Base(k))),
+			key:     k,
+		}
+		if len(v) > 0 {
+			b.Namespace = v[0]
+		}
+		if len(v) > 1 {
+			b.Pod = v[1]
+		}
+		if len(v) > 2 {
+			b.Index, _ = strconv.Atoi(v[2])
+		}
+		bindings = append(bindings, b)
+	}
+	return bindings, nil
+}
+
+// IPAMReleaseFixBindings releases fixed ips returned by IPAMListFixBindings,
+// see IPAMReleaseFixIPs
+func IPAMReleaseFixBindings(em *etcdv3.EtcdMultus, bindings []FixBinding) error {
+	keys := []string{}
+	for _, b := range bindings {
+		keys = append(keys, b.key)
+	}
+	return IPAMReleaseFixIPs(em, keys)
+}
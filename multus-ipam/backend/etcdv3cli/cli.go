@@ -3,7 +3,6 @@ package etcdv3cli
 import (
 	"context"
 	"math"
-	"os"
 	"path/filepath"
 
 	"fmt"
@@ -12,10 +11,10 @@ import (
 
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/coreos/etcd/clientv3"
 
-	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/intel/multus-cni/etcdv3"
 	"github.com/archichris/netools/ipaddr"
 	"github.com/intel/multus-cni/logging"
@@ -26,6 +25,7 @@ import (
 var (
 	leaseDir      = "lease" //multus/netowrkname/key(ipsegment):value(node)
 	fixDir        = "fix"
+	quarantineDir = "quarantine" // quarantine/networkname/key(ip):value(release time fixInfo)
 	staticDir     = "static"
 	rangeTemplate = "%010d-%d"
 	fixGap        = "/" // ns/name
@@ -53,6 +53,16 @@ func ipamSimpleRangeToLease(keyDir string, rs *allocator.SimpleRange) string {
 
 // IpamApplyIPRange is used to apply IP range from ectd
 func IPAMApplyIPRange(network string, r *allocator.Range, unit uint32) (*allocator.SimpleRange, error) {
+	e, err := IPAMApplyLease(network, r, unit)
+	if err != nil {
+		return nil, err
+	}
+	return &e.SimpleRange, nil
+}
+
+// IPAMApplyLease leases a free block of r to this node, the block is returned
+// with the etcd revision of the lease
+func IPAMApplyLease(network string, r *allocator.Range, unit uint32) (*disk.CacheEntry, error) {
 	logging.Debugf("Going to do apply IP range from %v", *r)
 	etcdMultus, err := etcdv3.New()
 	if err != nil {
@@ -76,12 +86,12 @@ func IPAMApplyIPRange(network string, r *allocator.Range, unit uint32) (*allocat
 
 	logging.Debugf("Going to put %v:%v", ipamSimpleRangeToLease(keyDir, rs), id)
 
-	_, err = cli.Put(context.TODO(), ipamSimpleRangeToLease(keyDir, rs), id)
+	resp, err := cli.Put(context.TODO(), ipamSimpleRangeToLease(keyDir, rs), id)
 	if err != nil {
 		return nil, logging.Errorf("write key %v to %v failed", ipamSimpleRangeToLease(keyDir, rs), id)
 	}
 
-	return rs, nil
+	return &disk.CacheEntry{SimpleRange: *rs, Revision: resp.Header.Revision, LeaseTime: time.Now()}, nil
 }
 
 // GetFreeIPRange is used to find a free IP range
@@ -129,6 +139,21 @@ func ipamGetFreeIPRange(cli *clientv3.Client, keyDir string, r *allocator.Range,
 }
 
 func IPAMGetAllLease(cli *clientv3.Client, keyDir, id string) (map[string][]allocator.SimpleRange, error) {
+	entries, err := ipamGetAllLeaseEntries(cli, keyDir, id)
+	if err != nil {
+		return nil, err
+	}
+	leases := make(map[string][]allocator.SimpleRange)
+	for network, es := range entries {
+		for _, e := range es {
+			leases[network] = append(leases[network], e.SimpleRange)
+		}
+	}
+	return leases, nil
+}
+
+// ipamGetAllLeaseEntries returns the blocks leased to id with their revisions
+func ipamGetAllLeaseEntries(cli *clientv3.Client, keyDir, id string) (map[string][]disk.CacheEntry, error) {
 	logging.Debugf("Going to get all IP lease belong to %v from %v", id, keyDir)
 	ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
 	resp, err := cli.Get(ctx, keyDir, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
@@ -136,7 +161,7 @@ func IPAMGetAllLease(cli *clientv3.Client, keyDir, id string) (map[string][]allo
 	if err != nil {
 		return nil, logging.Errorf("Get %v failed, %v", keyDir, err)
 	}
-	leases := make(map[string][]allocator.SimpleRange)
+	leases := make(map[string][]disk.CacheEntry)
 	for _, ev := range resp.Kvs {
 		v := strings.Trim(string(ev.Value), " \r\n\t")
 		logging.Debugf("Key:%v, Value:%v, id:%v, match:%v ", string(ev.Key), v, id, v == id)
@@ -144,124 +169,64 @@ func IPAMGetAllLease(cli *clientv3.Client, keyDir, id string) (map[string][]allo
 			k := strings.Trim(string(ev.Key), " \r\n\t")
 			network := filepath.Base(filepath.Dir(k))
 			sr := ipamLeaseToSimleRange(k)
-			if _, ok := leases[network]; ok {
-				leases[network] = append(leases[network], *sr)
-			} else {
-				leases[network] = []allocator.SimpleRange{*sr}
-			}
+			leases[network] = append(leases[network], disk.CacheEntry{SimpleRange: *sr, Revision: ev.ModRevision, LeaseTime: time.Now()})
 		}
 	}
 	return leases, nil
 }
 
-func ipamCheckNet(em *etcdv3.EtcdMultus, network string, leases []allocator.SimpleRange) {
-
-	s, err := disk.New(network, "")
-	if err != nil {
-		logging.Errorf("create disk manager failed, %v", err)
-		return
-	}
-	caches, err := s.LoadCache()
+// IPAMGetNodeLeases returns the blocks of network leased to this node
+func IPAMGetNodeLeases(network string) ([]allocator.SimpleRange, error) {
+	em, err := etcdv3.New()
 	if err != nil {
-		logging.Errorf("get cache failed, %v", err)
-		return
-	}
-	logging.Debugf("check net:%v\nleases:%v\ncaches:%v\n", network, leases, caches)
-	keyDir := filepath.Join(em.RootKeyDir, leaseDir, network)
-	cli, id := em.Cli, em.Id
-	var last *allocator.SimpleRange
-	for _, lsr := range leases {
-		last = nil
-		for _, csr := range caches {
-			if csr.Overlaps(&lsr) {
-				if csr.Match(&lsr) {
-					last = &csr
-					break
-				} else {
-					// caches = delete(caches, csr)
-					s.DeleteCache(&csr)
-				}
-			}
-		}
-		if last == nil {
-			err := s.AppendCache(&lsr)
-			if err != nil {
-				etcdv3.TransDelKey(cli, ipamSimpleRangeToLease(keyDir, &lsr))
-			}
-		}
+		return nil, err
 	}
+	defer em.Close()
 
-	caches, err = s.LoadCache()
+	keyDir := filepath.Join(em.RootKeyDir, leaseDir, network) + "/"
+	leases, err := IPAMGetAllLease(em.Cli, keyDir, em.Id)
 	if err != nil {
-		logging.Errorf("get cache failed, %v", err)
-		return
-	}
-	for _, csr := range caches {
-		last = nil
-		var lsr allocator.SimpleRange
-		for _, lsr = range leases {
-			if csr.Match(&lsr) {
-				last = &csr
-				break
-			}
-		}
-		logging.Debugf("cache:%v, lease:%v, result:%v", csr, lsr, last)
-		if last == nil {
-			err = etcdv3.TransPutKey(cli, ipamSimpleRangeToLease(keyDir, &csr), id, true)
-			if err != nil {
-				logging.Debugf("going to delete error cache:%v", csr)
-				s.DeleteCache(&csr)
-			}
-		}
+		return nil, err
 	}
+	return leases[network], nil
 }
 
+// IPAMCheckEtcd makes the blocks cached on this node and the blocks leased to
+// it in etcd agree, see IPAMDiffEtcd and IPAMRepairEtcd
 func IPAMCheckEtcd() error {
-	// logging.Debugf("Going to check IPAM")
-	etcdMultus, err := etcdv3.New()
-	cli, rKeyDir, id := etcdMultus.Cli, etcdMultus.RootKeyDir, etcdMultus.Id
+	em, err := etcdv3.New()
 	if err != nil {
 		return err
 	}
-	defer cli.Close() // make sure to close the client
-
-	lDir := filepath.Join(rKeyDir, leaseDir)
+	defer em.Close()
 
-	leases, err := IPAMGetAllLease(cli, lDir, id)
+	diffs, err := IPAMDiffEtcd(em, "")
 	if err != nil {
 		return err
 	}
-
-	localNets := disk.GetAllNet(os.Getenv("NET_DATA_DIR"))
-	logging.Debugf("local net: %v", localNets)
-
-	for network, lease := range leases {
-		ipamCheckNet(etcdMultus, network, lease)
-		for idx, n := range localNets {
-			if network == n {
-				if idx == 0 {
-					localNets = localNets[1:]
-				} else if idx == len(localNets)-1 {
-					localNets = localNets[:len(localNets)-1]
-				} else {
-					localNets = append(localNets[:idx], localNets[idx+1:]...)
-				}
-				break
-			}
+	for _, d := range diffs {
+		if !d.Empty() {
+			logging.Verbosef("ipam check, %v", d)
 		}
 	}
-
-	for _, network := range localNets {
-		ipamCheckNet(etcdMultus, network, nil)
-	}
-
-	return nil
+	return IPAMRepairEtcd(em, diffs)
 }
 
 // GetFreeIPRange is used to find a free IP range
 func IPAMApplyFixIP(network string, r *allocator.Range, fixInfo string) (*net.IPNet, error) {
+	ns, err := IPAMApplyFixIPs(network, r, []string{fixInfo}, 0)
+	if err != nil {
+		return nil, err
+	}
+	return ns[0], nil
+}
+
+// IPAMApplyFixIPs binds a fixed ip to every fixInfo in one transaction, so
+// either all of them are bound or none is. Existing bindings are kept, ips
+// released less than quarantine ago are only bound to their previous owner.
+func IPAMApplyFixIPs(network string, r *allocator.Range, fixInfos []string, quarantine time.Duration) ([]*net.IPNet, error) {
 	// netConf *allocator.Net
-	logging.Debugf("Going to do apply fix IP from %v for %v", r, network)
+	logging.Debugf("Going to do apply fix IPs from %v for %v: %v", r, network, fixInfos)
 	em, err := etcdv3.New()
 	if err != nil {
 		return nil, err
@@ -280,63 +245,247 @@ func IPAMApplyFixIP(network string, r *allocator.Range, fixInfo string) (*net.IP
 	ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
 	resp, err := em.Cli.Get(ctx, keyDir, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
 	cancel()
-	freeIPs := []uint32{}
-	fixIP := uint32(0)
+	if err != nil {
+		return nil, logging.Errorf("get fixed ips of %v failed, %v", network, err)
+	}
+
 	rips, ripe := ipaddr.IP4ToUint32(r.RangeStart), ipaddr.IP4ToUint32(r.RangeEnd)
 	tmp := ipaddr.IP4ToUint32(r.Subnet.IP) + 2
 	if rips < tmp {
 		rips = tmp
 	}
-	last := rips
+	// the gateway may be shared by all nodes, never hand it out as fixed ip
+	gw := ipaddr.IP4ToUint32(r.Gateway)
+
+	ops := []clientv3.Op{}
+	used := map[uint32]bool{gw: true}
+	bound := map[string]uint32{}
 	for _, ev := range resp.Kvs {
-		logging.Debugf("Key:%v, Value:%v, fixInfo:%v", string(ev.Key), string(ev.Value), fixInfo)
+		logging.Debugf("Key:%v, Value:%v", string(ev.Key), string(ev.Value))
 		fix := ipaddr.StrToUint32(filepath.Base(string(ev.Key)))
-		addr := ipaddr.Uint32ToIP4(fix)
 		v := string(ev.Value)
-
-		if (ip.Cmp(r.RangeStart, addr) > 0) || (ip.Cmp(r.RangeEnd, addr) < 0) {
-			if v == fixInfo {
-				em.Cli.Delete(context.TODO(), string(ev.Key))
+		if fix < rips || fix > ripe {
+			// the binding is out of the range now, apply a new one
+			for _, fixInfo := range fixInfos {
+				if v == fixInfo {
+					ops = append(ops, clientv3.OpDelete(string(ev.Key)))
+				}
 			}
 			continue
 		}
-		if v == fixInfo {
-			fixIP = fix
-			break
+		used[fix] = true
+		bound[v] = fix
+	}
+
+	qKeyDir := filepath.Join(em.RootKeyDir, quarantineDir, network) + "/"
+	ctx, cancel = context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+	qResp, err := em.Cli.Get(ctx, qKeyDir, clientv3.WithPrefix())
+	cancel()
+	if err != nil {
+		return nil, logging.Errorf("get quarantined ips of %v failed, %v", network, err)
+	}
+	released := map[string]uint32{}
+	for _, ev := range qResp.Kvs {
+		fix := ipaddr.StrToUint32(filepath.Base(string(ev.Key)))
+		t, fixInfo := ipamParseQuarantine(string(ev.Value))
+		if used[fix] {
+			continue
 		}
+		if fixInfo != "" {
+			// the previous owner comes back, give it the same ip again
+			released[fixInfo] = fix
+		}
+		if time.Since(t) < quarantine {
+			used[fix] = true
+		}
+	}
 
-		if fix-last > 0 {
-			for i := last; i < fix; i++ {
+	fixIPs := []uint32{}
+	for _, fixInfo := range fixInfos {
+		if fix, ok := bound[fixInfo]; ok {
+			fixIPs = append(fixIPs, fix)
+			continue
+		}
+		if fix, ok := released[fixInfo]; ok && fix >= rips && fix <= ripe && fix != gw {
+			key := filepath.Join(keyDir, fmt.Sprintf("%010d", fix))
+			logging.Debugf("Going to put %v:%v again", key, fixInfo)
+			ops = append(ops, clientv3.OpPut(key, fixInfo), clientv3.OpDelete(qKeyDir+fmt.Sprintf("%010d", fix)))
+			used[fix] = true
+			fixIPs = append(fixIPs, fix)
+			continue
+		}
+		freeIPs := []uint32{}
+		for i := rips; i < ripe+1; i++ {
+			if !used[i] {
 				freeIPs = append(freeIPs, i)
 			}
 		}
-
-		last = fix + 1
+		if len(freeIPs) == 0 {
+			return nil, logging.Errorf("no availble fixed ip")
+		}
+		fix := freeIPs[rand.Intn(len(freeIPs))]
+		used[fix] = true
+		key := filepath.Join(keyDir, fmt.Sprintf("%010d", fix))
+		logging.Debugf("Going to put %v:%v", key, fixInfo)
+		ops = append(ops, clientv3.OpPut(key, fixInfo))
+		fixIPs = append(fixIPs, fix)
 	}
 
-	if fixIP == 0 {
-		for i := last; i < ripe+1; i++ {
-			freeIPs = append(freeIPs, i)
+	if len(ops) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+		_, err = em.Cli.Txn(ctx).Then(ops...).Commit()
+		cancel()
+		if err != nil {
+			return nil, logging.Errorf("bind fixed ips %v of %v failed, %v", fixInfos, network, err)
 		}
-		if len(freeIPs) > 0 {
-			fixIP = freeIPs[rand.Intn(len(freeIPs))]
-		} else {
-			return nil, logging.Errorf("no availble fixed ip")
+	}
+
+	ns := []*net.IPNet{}
+	for _, fix := range fixIPs {
+		ns = append(ns, &net.IPNet{IP: ipaddr.Uint32ToIP4(fix), Mask: r.Subnet.Mask})
+	}
+	return ns, nil
+}
+// IPAMGetFixIPs returns the fixed ips bound to fixInfos, fixInfos without a
+// binding are left out
+func IPAMGetFixIPs(network string, fixInfos []string) (map[string]net.IP, error) {
+	em, err := etcdv3.New()
+	if err != nil {
+		return nil, err
+	}
+	defer em.Close()
+
+	keyDir := filepath.Join(em.RootKeyDir, fixDir, network) + "/"
+	ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+	resp, err := em.Cli.Get(ctx, keyDir, clientv3.WithPrefix())
+	cancel()
+	if err != nil {
+		return nil, logging.Errorf("get fixed ips of %v failed, %v", network, err)
+	}
+
+	fixIPs := map[string]net.IP{}
+	for _, ev := range resp.Kvs {
+		v := strings.Trim(string(ev.Value), " \r\n\t")
+		for _, fixInfo := range fixInfos {
+			if v == fixInfo {
+				fixIPs[fixInfo] = ipaddr.Uint32ToIP4(ipaddr.StrToUint32(filepath.Base(string(ev.Key))))
+			}
 		}
 	}
+	return fixIPs, nil
+}
 
-	key := filepath.Join(keyDir, fmt.Sprintf("%010d", fixIP))
+// IPAMCountFixIPs returns the number of fixed ips bound in every network
+func IPAMCountFixIPs(em *etcdv3.EtcdMultus) (map[string]int, error) {
+	fixKeyDir := filepath.Join(em.RootKeyDir, fixDir) + "/"
+	ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+	resp, err := em.Cli.Get(ctx, fixKeyDir, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	cancel()
+	if err != nil {
+		return nil, logging.Errorf("get %v failed, %v", fixKeyDir, err)
+	}
+	counts := map[string]int{}
+	for _, ev := range resp.Kvs {
+		network := filepath.Dir(strings.TrimPrefix(string(ev.Key), fixKeyDir))
+		counts[network]++
+	}
+	return counts, nil
+}
 
-	logging.Debugf("Going to put %v:%v", key, fixInfo)
+// IPAMGetUsage returns the addresses of the blocks of network leased to the
+// nodes and the number of its fixed ips
+func IPAMGetUsage(em *etcdv3.EtcdMultus, network string) (uint64, int, error) {
+	leaseKeyDir := filepath.Join(em.RootKeyDir, leaseDir, network) + "/"
+	ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+	resp, err := em.Cli.Get(ctx, leaseKeyDir, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	cancel()
+	if err != nil {
+		return 0, 0, logging.Errorf("get %v failed, %v", leaseKeyDir, err)
+	}
+	leased := uint64(0)
+	for _, ev := range resp.Kvs {
+		ips, ipe := ipamLeaseToUint32Range(string(ev.Key))
+		leased += uint64(ipe-ips) + 1
+	}
 
-	_, err = em.Cli.Put(context.TODO(), key, fixInfo)
+	fixKeyDir := filepath.Join(em.RootKeyDir, fixDir, network) + "/"
+	ctx, cancel = context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+	resp, err = em.Cli.Get(ctx, fixKeyDir, clientv3.WithPrefix(), clientv3.WithCountOnly())
+	cancel()
 	if err != nil {
-		return nil, logging.Errorf("write key %v to %v failed", key, fixInfo)
+		return 0, 0, logging.Errorf("get %v failed, %v", fixKeyDir, err)
 	}
-	return &net.IPNet{IP: ipaddr.Uint32ToIP4(fixIP), Mask: r.Subnet.Mask}, nil
+	return leased, int(resp.Count), nil
+}
+
+// IPAMReleaseFixIPs deletes the fixed ip keys and puts their ips in
+// quarantine, the time they are kept there is up to the network config.
+// A key changed since it was read is left alone.
+func IPAMReleaseFixIPs(em *etcdv3.EtcdMultus, keys []string) error {
+	fixKeyDir := filepath.Join(em.RootKeyDir, fixDir) + "/"
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	for _, key := range keys {
+		ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+		resp, err := em.Cli.Get(ctx, key)
+		cancel()
+		if err != nil {
+			return logging.Errorf("get %v failed, %v", key, err)
+		}
+		if len(resp.Kvs) == 0 {
+			continue
+		}
+		kv := resp.Kvs[0]
+		ops := []clientv3.Op{clientv3.OpDelete(key)}
+		if strings.HasPrefix(key, fixKeyDir) {
+			qKey := filepath.Join(em.RootKeyDir, quarantineDir, strings.TrimPrefix(key, fixKeyDir))
+			ops = append(ops, clientv3.OpPut(qKey, now+" "+strings.Trim(string(kv.Value), " \r\n\t")))
+		}
+		ctx, cancel = context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+		_, err = em.Cli.Txn(ctx).If(clientv3.Compare(clientv3.ModRevision(key), "=", kv.ModRevision)).Then(ops...).Commit()
+		cancel()
+		if err != nil {
+			return logging.Errorf("release fixed ip %v failed, %v", key, err)
+		}
+	}
+	return nil
+}
+
+// IPAMPurgeQuarantine deletes the quarantined ips released before maxAge
+func IPAMPurgeQuarantine(em *etcdv3.EtcdMultus, maxAge time.Duration) error {
+	qKeyDir := filepath.Join(em.RootKeyDir, quarantineDir) + "/"
+	ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+	resp, err := em.Cli.Get(ctx, qKeyDir, clientv3.WithPrefix())
+	cancel()
+	if err != nil {
+		return logging.Errorf("get %v failed, %v", qKeyDir, err)
+	}
+	delList := []string{}
+	for _, ev := range resp.Kvs {
+		if t, _ := ipamParseQuarantine(string(ev.Value)); time.Since(t) > maxAge {
+			delList = append(delList, string(ev.Key))
+		}
+	}
+	if len(delList) > 0 {
+		logging.Debugf("Going to del %v", delList)
+		etcdv3.TransDelKeys(em.Cli, delList)
+	}
+	return nil
+}
+
+// ipamParseQuarantine returns the release time and the previous fixInfo of a
+// quarantined ip, a malformed value is treated as released long ago
+func ipamParseQuarantine(v string) (time.Time, string) {
+	fields := strings.SplitN(strings.Trim(v, " \r\n\t"), " ", 2)
+	sec, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return time.Unix(0, 0), ""
+	}
+	if len(fields) < 2 {
+		return time.Unix(sec, 0), ""
+	}
+	return time.Unix(sec, 0), fields[1]
 }
 
-// GetFreeIPRange is used to find a free IP range
 func IPAMGenFixInfo(ns, name string, n int) string {
 	return strings.Trim(ns+fixGap+name+fixGap+strconv.Itoa(n), "\r\n\t ")
 
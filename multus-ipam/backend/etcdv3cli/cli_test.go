@@ -8,6 +8,7 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"time"
 	// "strings"
 
 	"github.com/containernetworking/cni/pkg/types"
@@ -516,6 +517,69 @@ var _ = Describe("Cli", func() {
 				Expect(match).To(BeTrue())
 			}
 		})
+
+		It("keeps a released fix ip in quarantine", func() {
+			em, _ := etcdv3.New()
+			defer em.Close()
+			r := netConf.IPAM.FixRange
+			fixInfo := IPAMGenFixInfo(namespace, podName, 0)
+			ns, err := IPAMApplyFixIPs(netConf.Name, r, []string{fixInfo}, time.Hour)
+			Expect(err).To(BeNil())
+			key := filepath.Join(em.RootKeyDir, fixDir, netConf.Name, fmt.Sprintf("%010d", ipaddr.IP4ToUint32(ns[0].IP)))
+			Expect(IPAMReleaseFixIPs(em, []string{key})).To(Succeed())
+
+			// no one else gets the released ip
+			n := int(ipaddr.IP4ToUint32(r.RangeEnd) - ipaddr.IP4ToUint32(r.RangeStart))
+			for i := 1; i < n; i++ {
+				other, err := IPAMApplyFixIPs(netConf.Name, r, []string{IPAMGenFixInfo(namespace, podName, i)}, time.Hour)
+				if err != nil {
+					break
+				}
+				Expect(other[0].IP.Equal(ns[0].IP)).To(BeFalse())
+			}
+			// but its previous owner does
+			again, err := IPAMApplyFixIPs(netConf.Name, r, []string{fixInfo}, time.Hour)
+			Expect(err).To(BeNil())
+			Expect(again[0].String()).To(Equal(ns[0].String()))
+
+			Expect(IPAMPurgeQuarantine(em, 0)).To(Succeed())
+			ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+			resp, _ := em.Cli.Get(ctx, filepath.Join(em.RootKeyDir, quarantineDir), clientv3.WithPrefix())
+			cancel()
+			Expect(resp.Kvs).To(BeEmpty())
+		})
 	})
 
 })
+
+var _ = Describe("Block reservations", func() {
+	var (
+		dataDir = "/tmp/multus-ipam-blockres"
+		network = "testnetblockres"
+	)
+
+	BeforeEach(func() {
+		os.RemoveAll(dataDir)
+	})
+	AfterEach(func() {
+		os.RemoveAll(dataDir)
+	})
+
+	It("returns the ips reserved on this node in a block", func() {
+		block := &allocator.SimpleRange{RangeStart: net.ParseIP("10.1.0.16").To4(), RangeEnd: net.ParseIP("10.1.0.31").To4()}
+		rs, err := IPAMBlockReservations(network, dataDir, block)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rs).To(BeEmpty())
+
+		s, err := disk.New(network, dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		s.Reserve("container2", "eth1", net.ParseIP("10.1.0.20"), "0")
+		s.Reserve("container1", "eth1", net.ParseIP("10.1.0.17"), "0")
+		s.Reserve("container3", "eth1", net.ParseIP("10.1.0.32"), "0")
+		s.Close()
+
+		rs, err = IPAMBlockReservations(network, dataDir, block)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fmt.Sprint(rs)).To(Equal("[{10.1.0.17 container1} {10.1.0.20 container2}]"))
+	})
+})
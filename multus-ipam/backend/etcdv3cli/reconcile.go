@@ -0,0 +1,261 @@
+package etcdv3cli
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/intel/multus-cni/etcdv3"
+	"github.com/intel/multus-cni/logging"
+	"github.com/intel/multus-cni/multus-ipam/backend/allocator"
+	"github.com/intel/multus-cni/multus-ipam/backend/disk"
+)
+
+// Reservation is an ip reserved on this node
+type Reservation struct {
+	IP net.IP
+	ID string
+}
+
+// NetDiff is the difference between the blocks of a network cached on this
+// node and the blocks leased to it in etcd
+type NetDiff struct {
+	Network   string
+	LocalOnly []allocator.SimpleRange // cached but not leased
+	EtcdOnly  []allocator.SimpleRange // leased but not cached
+	Conflicts []allocator.SimpleRange // cached, overlapping a different leased block
+	Orphans   []Reservation           // reserved out of the leased blocks
+	leases    []disk.CacheEntry
+	dataDir   string
+}
+
+// Empty tells whether the cache and etcd agree
+func (d *NetDiff) Empty() bool {
+	return len(d.LocalOnly) == 0 && len(d.EtcdOnly) == 0 && len(d.Conflicts) == 0 && len(d.Orphans) == 0
+}
+
+func (d *NetDiff) String() string {
+	if d.Empty() {
+		return fmt.Sprintf("%s: in sync", d.Network)
+	}
+	orphans := []string{}
+	for _, o := range d.Orphans {
+		orphans = append(orphans, fmt.Sprintf("%v(%s)", o.IP, o.ID))
+	}
+	return fmt.Sprintf("%s: cached only %v, leased only %v, conflicting %v, orphans [%s]",
+		d.Network, d.LocalOnly, d.EtcdOnly, d.Conflicts, strings.Join(orphans, " "))
+}
+
+// ipamDiffNet compares the blocks cached for network in dataDir with leases
+// without changing either, the store is read from a disk.View
+func ipamDiffNet(network, dataDir string, leases []disk.CacheEntry) (*NetDiff, error) {
+	v, err := disk.LoadView(network, dataDir)
+	if err != nil {
+		return nil, err
+	}
+	caches := []allocator.SimpleRange{}
+	for _, c := range v.Caches {
+		caches = append(caches, c.SimpleRange)
+	}
+	reserved := v.Reservations
+
+	d := &NetDiff{Network: network, leases: leases, dataDir: dataDir}
+	for _, lsr := range leases {
+		matched := false
+		for _, csr := range caches {
+			if csr.Match(&lsr.SimpleRange) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			d.EtcdOnly = append(d.EtcdOnly, lsr.SimpleRange)
+		}
+	}
+	for _, csr := range caches {
+		matched, overlapped := false, false
+		for _, lsr := range leases {
+			if csr.Match(&lsr.SimpleRange) {
+				matched = true
+				break
+			}
+			if csr.Overlaps(&lsr.SimpleRange) || lsr.Overlaps(&csr) {
+				overlapped = true
+			}
+		}
+		switch {
+		case matched:
+		case overlapped:
+			d.Conflicts = append(d.Conflicts, csr)
+		default:
+			d.LocalOnly = append(d.LocalOnly, csr)
+		}
+	}
+	for addr, id := range reserved {
+		a := net.ParseIP(addr)
+		if a == nil || id == disk.GatewayID {
+			continue
+		}
+		leased := false
+		for _, lsr := range leases {
+			if lsr.Contains(&allocator.SimpleRange{RangeStart: a, RangeEnd: a}) {
+				leased = true
+				break
+			}
+		}
+		if !leased {
+			d.Orphans = append(d.Orphans, Reservation{IP: a, ID: id})
+		}
+	}
+	sort.Slice(d.Orphans, func(i, j int) bool {
+		return bytes.Compare(d.Orphans[i].IP.To16(), d.Orphans[j].IP.To16()) < 0
+	})
+	return d, nil
+}
+
+// IPAMDiffEtcd returns the differences between the blocks cached on this node
+// in NET_DATA_DIR and the blocks leased to it, of all networks if network is
+// empty. Nothing is changed, see IPAMRepairEtcd.
+func IPAMDiffEtcd(em *etcdv3.EtcdMultus, network string) ([]*NetDiff, error) {
+	dataDir := os.Getenv("NET_DATA_DIR")
+	leases, err := ipamGetAllLeaseEntries(em.Cli, filepath.Join(em.RootKeyDir, leaseDir), em.Id)
+	if err != nil {
+		return nil, err
+	}
+	networks := []string{}
+	if network != "" {
+		networks = append(networks, network)
+	} else {
+		seen := map[string]bool{}
+		for n := range leases {
+			seen[n] = true
+		}
+		for _, n := range disk.GetAllNet(dataDir) {
+			seen[n] = true
+		}
+		for n := range seen {
+			networks = append(networks, n)
+		}
+		sort.Strings(networks)
+	}
+
+	diffs := []*NetDiff{}
+	for _, n := range networks {
+		d, err := ipamDiffNet(n, dataDir, leases[n])
+		if err != nil {
+			return nil, logging.Errorf("diff %v failed, %v", n, err)
+		}
+		diffs = append(diffs, d)
+	}
+	return diffs, nil
+}
+
+// IPAMBlockReservations returns the ips reserved on this node in block r of
+// network, the gateways included. They are read from a disk.View of the store
+// in dataDir.
+func IPAMBlockReservations(network, dataDir string, r *allocator.SimpleRange) ([]Reservation, error) {
+	v, err := disk.LoadView(network, dataDir)
+	if err != nil {
+		return nil, err
+	}
+	rs := []Reservation{}
+	for addr, id := range v.Reservations {
+		a := net.ParseIP(addr)
+		if a != nil && r.Contains(&allocator.SimpleRange{RangeStart: a, RangeEnd: a}) {
+			rs = append(rs, Reservation{IP: a, ID: id})
+		}
+	}
+	sort.Slice(rs, func(i, j int) bool {
+		return bytes.Compare(rs[i].IP.To16(), rs[j].IP.To16()) < 0
+	})
+	return rs, nil
+}
+
+// ipamRepairNet makes the cache of a network and etcd agree again:
+// conflicting blocks are dropped from the cache, leased blocks are cached,
+// and cached blocks are leased, or dropped if another node holds them.
+// Orphan reservations are left alone, IPAMCheckLocalIPs releases them once
+// their containers are gone.
+func ipamRepairNet(em *etcdv3.EtcdMultus, d *NetDiff) error {
+	s, err := disk.New(d.Network, d.dataDir)
+	if err != nil {
+		return logging.Errorf("create disk manager failed, %v", err)
+	}
+	defer s.Close()
+	keyDir := filepath.Join(em.RootKeyDir, leaseDir, d.Network)
+
+	for i := range d.Conflicts {
+		logging.Verbosef("drop conflicting block %v of %v from cache", d.Conflicts[i], d.Network)
+		s.DeleteCache(&d.Conflicts[i])
+	}
+
+	for i := range d.EtcdOnly {
+		for j := range d.leases {
+			if !d.leases[j].Match(&d.EtcdOnly[i]) {
+				continue
+			}
+			logging.Verbosef("cache leased block %v of %v", d.EtcdOnly[i], d.Network)
+			if err := s.AppendCacheEntry(&d.leases[j]); err != nil {
+				etcdv3.TransDelKey(em.Cli, ipamSimpleRangeToLease(keyDir, &d.EtcdOnly[i]))
+			}
+			break
+		}
+	}
+
+	// keep the revisions of the cached blocks up to date
+	if err := s.UpdateCacheRevisions(d.leases); err != nil {
+		return logging.Errorf("update cache failed, %v", err)
+	}
+
+	for i := range d.LocalOnly {
+		logging.Verbosef("lease cached block %v of %v", d.LocalOnly[i], d.Network)
+		key := ipamSimpleRangeToLease(keyDir, &d.LocalOnly[i])
+		if err := etcdv3.TransPutKey(em.Cli, key, em.Id, true); err == nil {
+			continue
+		}
+		// the block may have been leased to this node by an ADD since the
+		// diff, or etcd failed, it is only dropped if another node holds it
+		owner, err := ipamLeaseOwner(em, key)
+		if err != nil {
+			logging.Errorf("read lease of block %v of %v failed, keep it, %v", d.LocalOnly[i], d.Network, err)
+			continue
+		}
+		if owner == "" || owner == em.Id {
+			continue
+		}
+		logging.Verbosef("drop block %v of %v leased by node %v from cache", d.LocalOnly[i], d.Network, owner)
+		s.DeleteCache(&d.LocalOnly[i])
+	}
+	return nil
+}
+
+// ipamLeaseOwner returns the node holding the lease key, empty if the key
+// does not exist
+func ipamLeaseOwner(em *etcdv3.EtcdMultus, key string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+	resp, err := em.Cli.Get(ctx, key)
+	cancel()
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Kvs) == 0 {
+		return "", nil
+	}
+	return string(resp.Kvs[0].Value), nil
+}
+
+// IPAMRepairEtcd applies diffs returned by IPAMDiffEtcd
+func IPAMRepairEtcd(em *etcdv3.EtcdMultus, diffs []*NetDiff) error {
+	var lastErr error
+	for _, d := range diffs {
+		if err := ipamRepairNet(em, d); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
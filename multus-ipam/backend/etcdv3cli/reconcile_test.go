@@ -0,0 +1,68 @@
+package etcdv3cli
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/intel/multus-cni/logging"
+	"github.com/intel/multus-cni/multus-ipam/backend/allocator"
+	"github.com/intel/multus-cni/multus-ipam/backend/disk"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Reconcile", func() {
+	var (
+		dataDir = "/tmp"
+		network = "testnetdiff"
+		block   = func(start, end string) allocator.SimpleRange {
+			return allocator.SimpleRange{RangeStart: net.ParseIP(start), RangeEnd: net.ParseIP(end)}
+		}
+	)
+
+	BeforeEach(func() {
+		os.RemoveAll(filepath.Join(dataDir, network))
+		logging.SetLogFile("/tmp/multus-test.log")
+		logging.SetLogLevel("debug")
+	})
+	AfterEach(func() {
+		os.RemoveAll(filepath.Join(dataDir, network))
+	})
+
+	It("compares the cached blocks with the leased ones", func() {
+		s, err := disk.New(network, dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		synced := block("10.0.0.16", "10.0.0.31")
+		local := block("10.0.0.32", "10.0.0.47")
+		conflict := block("10.0.0.64", "10.0.0.79")
+		s.FlashCache([]allocator.SimpleRange{synced, local, conflict})
+		for _, r := range []struct{ id, ip string }{{"c1", "10.0.0.20"}, {"c2", "10.0.0.33"}, {disk.GatewayID, "10.0.0.1"}} {
+			_, err = s.Reserve(r.id, "eth0", net.ParseIP(r.ip), "0")
+			Expect(err).NotTo(HaveOccurred())
+		}
+		s.Close()
+
+		leases := []disk.CacheEntry{
+			{SimpleRange: synced},
+			{SimpleRange: block("10.0.0.64", "10.0.0.71")},
+			{SimpleRange: block("10.0.0.128", "10.0.0.143")},
+		}
+		d, err := ipamDiffNet(network, dataDir, leases)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(d.Empty()).To(BeFalse())
+		Expect(len(d.LocalOnly)).To(Equal(1))
+		Expect(d.LocalOnly[0].Match(&local)).To(BeTrue())
+		Expect(len(d.Conflicts)).To(Equal(1))
+		Expect(d.Conflicts[0].Match(&conflict)).To(BeTrue())
+		Expect(len(d.EtcdOnly)).To(Equal(2))
+		Expect(len(d.Orphans)).To(Equal(1))
+		Expect(d.Orphans[0].IP.String()).To(Equal("10.0.0.33"))
+		Expect(d.Orphans[0].ID).To(Equal("c2"))
+
+		d, err = ipamDiffNet(network, dataDir, []disk.CacheEntry{{SimpleRange: conflict}, {SimpleRange: local}, {SimpleRange: synced}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(d.Empty()).To(BeTrue())
+		Expect(d.String()).To(Equal(network + ": in sync"))
+	})
+})
@@ -0,0 +1,83 @@
+package runtimecli
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/intel/multus-cni/logging"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	runtimeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+	"k8s.io/kubernetes/pkg/kubelet/util"
+)
+
+const (
+	criConnectionTimeout = 10 * time.Second
+	criMaxMsgSize        = 1024 * 1024 * 16 // 16 Mb
+)
+
+// criRuntime lists the sandboxes with ListPodSandbox of the CRI runtime
+// service, it works with containerd, CRI-O and any other CRI runtime
+type criRuntime struct {
+	name   string
+	conn   *grpc.ClientConn
+	client runtimeapi.RuntimeServiceClient
+}
+
+func newCRIRuntime(name, endpoint string) (*criRuntime, error) {
+	addr, dialer, err := util.GetAddressAndDialer(endpoint)
+	if err != nil {
+		return nil, logging.Errorf("parse runtime endpoint %v failed, %v", endpoint, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), criConnectionTimeout)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, addr, grpc.WithInsecure(), grpc.WithDialer(dialer),
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(criMaxMsgSize)))
+	if err != nil {
+		return nil, logging.Errorf("dial runtime %v failed, %v", endpoint, err)
+	}
+	return &criRuntime{name: name, conn: conn, client: runtimeapi.NewRuntimeServiceClient(conn)}, nil
+}
+
+func (r *criRuntime) Name() string {
+	return r.name
+}
+
+// Ready checks the RuntimeReady condition, the sandboxes the runtime lists
+// before it is ready may be incomplete
+func (r *criRuntime) Ready(ctx context.Context) error {
+	resp, err := r.client.Status(ctx, &runtimeapi.StatusRequest{})
+	if err != nil {
+		return err
+	}
+	if resp.Status == nil {
+		return fmt.Errorf("runtime %v returned no status", r.name)
+	}
+	for _, c := range resp.Status.Conditions {
+		if c.Type == runtimeapi.RuntimeReady {
+			if !c.Status {
+				return fmt.Errorf("runtime %v is not ready, %v: %v", r.name, c.Reason, c.Message)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("runtime %v did not report %v", r.name, runtimeapi.RuntimeReady)
+}
+
+// Sandboxes returns the ready and not ready sandboxes, a sandbox which is not
+// ready may not have released its addresses yet
+func (r *criRuntime) Sandboxes(ctx context.Context) (map[string]bool, error) {
+	resp, err := r.client.ListPodSandbox(ctx, &runtimeapi.ListPodSandboxRequest{})
+	if err != nil {
+		return nil, err
+	}
+	ids := map[string]bool{}
+	for _, s := range resp.Items {
+		ids[s.Id] = true
+	}
+	return ids, nil
+}
+
+func (r *criRuntime) Close() error {
+	return r.conn.Close()
+}
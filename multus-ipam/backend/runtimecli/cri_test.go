@@ -0,0 +1,80 @@
+package runtimecli
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	runtimeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/runtime/v1alpha2"
+	"k8s.io/kubernetes/pkg/kubelet/util"
+)
+
+// fakeRuntimeServer implements the calls of the CRI runtime service the
+// checker makes, the others panic
+type fakeRuntimeServer struct {
+	runtimeapi.RuntimeServiceServer
+	ready bool
+}
+
+func (s *fakeRuntimeServer) Status(ctx context.Context, req *runtimeapi.StatusRequest) (*runtimeapi.StatusResponse, error) {
+	return &runtimeapi.StatusResponse{Status: &runtimeapi.RuntimeStatus{Conditions: []*runtimeapi.RuntimeCondition{
+		{Type: runtimeapi.RuntimeReady, Status: s.ready, Reason: "Starting"},
+		{Type: runtimeapi.NetworkReady, Status: true},
+	}}}, nil
+}
+
+func (s *fakeRuntimeServer) ListPodSandbox(ctx context.Context, req *runtimeapi.ListPodSandboxRequest) (*runtimeapi.ListPodSandboxResponse, error) {
+	return &runtimeapi.ListPodSandboxResponse{Items: []*runtimeapi.PodSandbox{
+		{Id: "sandbox0", State: runtimeapi.PodSandboxState_SANDBOX_READY},
+		{Id: "sandbox1", State: runtimeapi.PodSandboxState_SANDBOX_NOTREADY},
+	}}, nil
+}
+
+var _ = Describe("CRI", func() {
+	var (
+		socketDir string
+		server    *grpc.Server
+		fake      *fakeRuntimeServer
+	)
+
+	BeforeEach(func() {
+		var err error
+		socketDir, err = ioutil.TempDir("", "multus-cri")
+		Expect(err).NotTo(HaveOccurred())
+		lis, err := util.CreateListener(util.LocalEndpoint(socketDir, "cri"))
+		Expect(err).NotTo(HaveOccurred())
+		fake = &fakeRuntimeServer{ready: true}
+		server = grpc.NewServer()
+		runtimeapi.RegisterRuntimeServiceServer(server, fake)
+		go server.Serve(lis)
+	})
+	AfterEach(func() {
+		server.Stop()
+		os.RemoveAll(socketDir)
+	})
+
+	It("lists the sandboxes of the runtime", func() {
+		rt, err := New(RuntimeCRI, "unix://"+filepath.Join(socketDir, "cri.sock"))
+		Expect(err).NotTo(HaveOccurred())
+		defer rt.Close()
+		Expect(rt.Name()).To(Equal(RuntimeCRI))
+		Expect(rt.Ready(context.Background())).To(Succeed())
+		sandboxes, err := rt.Sandboxes(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sandboxes).To(Equal(map[string]bool{"sandbox0": true, "sandbox1": true}))
+
+		fake.ready = false
+		Expect(rt.Ready(context.Background())).NotTo(Succeed())
+	})
+
+	It("selects the runtime by name", func() {
+		_, err := New("rkt", "")
+		Expect(err).To(HaveOccurred())
+		_, err = New(RuntimeCRI, "")
+		Expect(err).To(HaveOccurred())
+	})
+})
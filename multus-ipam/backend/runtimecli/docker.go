@@ -0,0 +1,51 @@
+package runtimecli
+
+import (
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/intel/multus-cni/logging"
+	"golang.org/x/net/context"
+)
+
+// dockerRuntime finds the sandboxes among the running containers, the
+// sandbox of a pod is its infra container
+type dockerRuntime struct {
+	cli *client.Client
+}
+
+func newDockerRuntime(endpoint string) (*dockerRuntime, error) {
+	opts := []func(*client.Client) error{client.FromEnv}
+	if endpoint != "" {
+		opts = append(opts, client.WithHost(endpoint))
+	}
+	cli, err := client.NewClientWithOpts(opts...)
+	if err != nil {
+		return nil, logging.Errorf("create docker cli failed, %v", err)
+	}
+	return &dockerRuntime{cli: cli}, nil
+}
+
+func (r *dockerRuntime) Name() string {
+	return RuntimeDocker
+}
+
+func (r *dockerRuntime) Ready(ctx context.Context) error {
+	_, err := r.cli.Ping(ctx)
+	return err
+}
+
+func (r *dockerRuntime) Sandboxes(ctx context.Context) (map[string]bool, error) {
+	containers, err := r.cli.ContainerList(ctx, types.ContainerListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	ids := map[string]bool{}
+	for _, c := range containers {
+		ids[c.ID] = true
+	}
+	return ids, nil
+}
+
+func (r *dockerRuntime) Close() error {
+	return r.cli.Close()
+}
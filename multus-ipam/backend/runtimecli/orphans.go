@@ -0,0 +1,153 @@
+package runtimecli
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/intel/multus-cni/logging"
+	"github.com/intel/multus-cni/multus-ipam/backend/disk"
+	"golang.org/x/net/context"
+)
+
+const (
+	// DefaultGracePeriod is how long a sandbox must be missing from the
+	// runtime before its addresses are released. A sandbox is reserved its
+	// addresses before some runtimes list it.
+	DefaultGracePeriod = 2 * time.Minute
+	// DefaultMaxReleasePercent is the share of the reserved addresses above
+	// which the runtime is assumed unhealthy and nothing is released
+	DefaultMaxReleasePercent = 50
+	// releasing fewer addresses than bulkReleaseMin is never refused
+	bulkReleaseMin = 3
+	runtimeTimeout = 30 * time.Second
+)
+
+// Checker releases the addresses reserved for sandboxes the runtime no longer
+// has. It remembers since when a sandbox is missing, so the same Checker has
+// to be used from one check to the next.
+type Checker struct {
+	Runtime           ContainerRuntime
+	DataDir           string
+	GracePeriod       time.Duration
+	MaxReleasePercent int
+	missing           map[string]time.Time
+}
+
+// NewChecker returns a Checker of runtime with the default safety settings
+func NewChecker(runtime ContainerRuntime, dataDir string) *Checker {
+	return &Checker{
+		Runtime:           runtime,
+		DataDir:           dataDir,
+		GracePeriod:       DefaultGracePeriod,
+		MaxReleasePercent: DefaultMaxReleasePercent,
+		missing:           map[string]time.Time{},
+	}
+}
+
+// NewCheckerFromEnv returns a Checker of the runtime of NewFromEnv, with the
+// grace period in seconds of ORPHAN_GRACE_PERIOD and the limit of
+// ORPHAN_MAX_RELEASE_PERCENT
+func NewCheckerFromEnv(dataDir string) (*Checker, error) {
+	runtime, err := NewFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	c := NewChecker(runtime, dataDir)
+	if v := os.Getenv("ORPHAN_GRACE_PERIOD"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			runtime.Close()
+			return nil, fmt.Errorf("invalid ORPHAN_GRACE_PERIOD %q", v)
+		}
+		c.GracePeriod = time.Duration(n) * time.Second
+	}
+	if v := os.Getenv("ORPHAN_MAX_RELEASE_PERCENT"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 100 {
+			runtime.Close()
+			return nil, fmt.Errorf("invalid ORPHAN_MAX_RELEASE_PERCENT %q, must be between 0 and 100", v)
+		}
+		c.MaxReleasePercent = n
+	}
+	return c, nil
+}
+
+// Check releases the addresses of the sandboxes missing from the runtime for
+// longer than the grace period and returns the released address files.
+// Nothing is released if the runtime is not ready, lists no sandbox while
+// addresses are reserved, or if more than MaxReleasePercent of the reserved
+// addresses would be released at once.
+func (c *Checker) Check() ([]string, error) {
+	if c.missing == nil {
+		c.missing = map[string]time.Time{}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), runtimeTimeout)
+	defer cancel()
+	if err := c.Runtime.Ready(ctx); err != nil {
+		return nil, logging.Errorf("%v is not ready, skip releasing orphan ips, %v", c.Runtime.Name(), err)
+	}
+
+	// load the reservations first, those made after the sandboxes are
+	// listed would look orphan
+	leases := disk.LoadAllLeases("", c.DataDir)
+	for f, id := range leases {
+		if id == disk.GatewayID {
+			delete(leases, f)
+		}
+	}
+	sandboxes, err := c.Runtime.Sandboxes(ctx)
+	if err != nil {
+		return nil, logging.Errorf("list sandboxes of %v failed, %v", c.Runtime.Name(), err)
+	}
+	if len(sandboxes) == 0 && len(leases) > 0 {
+		return nil, logging.Errorf("%v lists no sandbox while %d ips are reserved, skip releasing orphan ips",
+			c.Runtime.Name(), len(leases))
+	}
+
+	now := time.Now()
+	orphans := map[string]bool{}
+	for _, id := range leases {
+		if sandboxes[id] {
+			continue
+		}
+		orphans[id] = true
+		if _, ok := c.missing[id]; !ok {
+			logging.Verbosef("sandbox %v is missing from %v", id, c.Runtime.Name())
+			c.missing[id] = now
+		}
+	}
+	for id := range c.missing {
+		if !orphans[id] {
+			delete(c.missing, id)
+		}
+	}
+
+	due := []string{}
+	for f, id := range leases {
+		if orphans[id] && now.Sub(c.missing[id]) >= c.GracePeriod {
+			due = append(due, f)
+		}
+	}
+	sort.Strings(due)
+	if len(due) >= bulkReleaseMin && len(due)*100 > c.MaxReleasePercent*len(leases) {
+		return nil, logging.Errorf("%d of %d reserved ips look orphan, above %d%%, %v may be unhealthy, skip releasing them",
+			len(due), len(leases), c.MaxReleasePercent, c.Runtime.Name())
+	}
+
+	released := []string{}
+	for _, f := range due {
+		ok, err := disk.ReleaseIfOwned(f, leases[f])
+		if err != nil {
+			logging.Errorf("release %v of %v failed, %v", f, leases[f], err)
+			continue
+		}
+		if ok {
+			logging.Verbosef("released orphan ip %v of %v", f, leases[f])
+			released = append(released, f)
+		}
+	}
+	return released, nil
+}
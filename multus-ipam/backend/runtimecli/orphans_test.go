@@ -0,0 +1,122 @@
+package runtimecli
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/intel/multus-cni/logging"
+	"github.com/intel/multus-cni/multus-ipam/backend/allocator"
+	"github.com/intel/multus-cni/multus-ipam/backend/disk"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+type fakeRuntime struct {
+	ready     error
+	sandboxes map[string]bool
+}
+
+func (r *fakeRuntime) Name() string                    { return "fake" }
+func (r *fakeRuntime) Ready(ctx context.Context) error { return r.ready }
+func (r *fakeRuntime) Close() error                    { return nil }
+func (r *fakeRuntime) Sandboxes(ctx context.Context) (map[string]bool, error) {
+	return r.sandboxes, nil
+}
+
+var _ = Describe("Checker", func() {
+	var (
+		dataDir string
+		network = "testnetorphans"
+		rt      *fakeRuntime
+		c       *Checker
+	)
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "multus-orphans")
+		Expect(err).NotTo(HaveOccurred())
+		logging.SetLogFile("/tmp/multus-test.log")
+		logging.SetLogLevel("debug")
+
+		store, err := disk.New(network, dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		startIP := net.IPv4(192, 168, 200, 100)
+		curIP := startIP
+		store.Reserve(disk.GatewayID, disk.GatewayID, curIP, "0")
+		for i := 0; i < 10; i++ {
+			curIP = ip.NextIP(curIP)
+			store.Reserve(fmt.Sprintf("sandbox%d", i), "eth1", curIP, "0")
+		}
+		store.AppendCache(&allocator.SimpleRange{RangeStart: startIP, RangeEnd: curIP})
+		store.Close()
+
+		rt = &fakeRuntime{sandboxes: map[string]bool{}}
+		for i := 0; i < 10; i++ {
+			rt.sandboxes[fmt.Sprintf("sandbox%d", i)] = true
+		}
+		c = NewChecker(rt, dataDir)
+		c.GracePeriod = 0
+	})
+	AfterEach(func() {
+		os.RemoveAll(dataDir)
+	})
+
+	It("releases the ips of the missing sandboxes", func() {
+		delete(rt.sandboxes, "sandbox3")
+		delete(rt.sandboxes, "sandbox7")
+		released, err := c.Check()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(len(released)).To(Equal(2))
+		leases := disk.LoadAllLeases(network, dataDir)
+		Expect(len(leases)).To(Equal(9))
+		for _, id := range leases {
+			Expect(id).NotTo(Equal("sandbox3"))
+			Expect(id).NotTo(Equal("sandbox7"))
+		}
+	})
+
+	It("waits for the grace period", func() {
+		c.GracePeriod = DefaultGracePeriod
+		delete(rt.sandboxes, "sandbox3")
+		released, err := c.Check()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(released).To(BeEmpty())
+		Expect(c.missing).To(HaveKey("sandbox3"))
+
+		// back before the grace period is over
+		rt.sandboxes["sandbox3"] = true
+		_, err = c.Check()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.missing).To(BeEmpty())
+	})
+
+	It("refuses to release in bulk", func() {
+		for i := 0; i < 6; i++ {
+			delete(rt.sandboxes, fmt.Sprintf("sandbox%d", i))
+		}
+		_, err := c.Check()
+		Expect(err).To(HaveOccurred())
+		Expect(len(disk.LoadAllLeases(network, dataDir))).To(Equal(11))
+
+		c.MaxReleasePercent = 60
+		released, err := c.Check()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(len(released)).To(Equal(6))
+	})
+
+	It("does nothing when the runtime looks unhealthy", func() {
+		rt.sandboxes = map[string]bool{}
+		c.MaxReleasePercent = 100
+		_, err := c.Check()
+		Expect(err).To(HaveOccurred())
+
+		rt.ready = fmt.Errorf("not ready")
+		_, err = c.Check()
+		Expect(err).To(HaveOccurred())
+		Expect(len(disk.LoadAllLeases(network, dataDir))).To(Equal(11))
+	})
+})
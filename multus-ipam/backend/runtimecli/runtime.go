@@ -0,0 +1,66 @@
+// Package runtimecli asks the container runtime of the node which pods still
+// exist, to release the addresses reserved for the pods that are gone.
+package runtimecli
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// RuntimeDocker talks to the docker daemon, DOCKER_HOST by default
+	RuntimeDocker = "docker"
+	// RuntimeContainerd talks CRI to containerd
+	RuntimeContainerd = "containerd"
+	// RuntimeCRIO talks CRI to CRI-O
+	RuntimeCRIO = "crio"
+	// RuntimeCRI talks CRI to the runtime at RUNTIME_ENDPOINT
+	RuntimeCRI = "cri"
+)
+
+var defaultCRIEndpoints = map[string]string{
+	RuntimeContainerd: "unix:///run/containerd/containerd.sock",
+	RuntimeCRIO:       "unix:///var/run/crio/crio.sock",
+}
+
+// ContainerRuntime is the container runtime of the node
+type ContainerRuntime interface {
+	// Name returns the name of the runtime
+	Name() string
+	// Ready returns an error if the runtime is not ready to tell which
+	// sandboxes exist
+	Ready(ctx context.Context) error
+	// Sandboxes returns the ids of the pod sandboxes, the ids the addresses
+	// are reserved for
+	Sandboxes(ctx context.Context) (map[string]bool, error)
+	// Close releases the connection to the runtime
+	Close() error
+}
+
+// New returns the runtime named name, listening on endpoint. The default
+// endpoint of the runtime is used if endpoint is empty.
+func New(name, endpoint string) (ContainerRuntime, error) {
+	switch strings.ToLower(name) {
+	case "", RuntimeDocker:
+		return newDockerRuntime(endpoint)
+	case RuntimeContainerd, RuntimeCRIO, RuntimeCRI:
+		if endpoint == "" {
+			endpoint = defaultCRIEndpoints[strings.ToLower(name)]
+		}
+		if endpoint == "" {
+			return nil, fmt.Errorf("no endpoint given for runtime %v", name)
+		}
+		return newCRIRuntime(name, endpoint)
+	default:
+		return nil, fmt.Errorf("unknown container runtime %v", name)
+	}
+}
+
+// NewFromEnv returns the runtime named by CONTAINER_RUNTIME, listening on
+// RUNTIME_ENDPOINT
+func NewFromEnv() (ContainerRuntime, error) {
+	return New(os.Getenv("CONTAINER_RUNTIME"), os.Getenv("RUNTIME_ENDPOINT"))
+}
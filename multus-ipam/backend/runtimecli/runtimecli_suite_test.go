@@ -0,0 +1,13 @@
+package runtimecli
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestRuntimecli(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Runtimecli Suite")
+}
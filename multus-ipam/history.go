@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/intel/multus-cni/multus-ipam/backend/disk"
+)
+
+// cmdHistory answers who had an ip of a network at a given time, e.g.
+//   multus-ipam history -at 2020-01-02T15:04:05Z mynet 10.1.2.3
+func cmdHistory(args []string) int {
+	fs := flag.NewFlagSet("history", flag.ContinueOnError)
+	dataDir := fs.String("data-dir", "", "data dir of the ipam, the default one if empty")
+	at := fs.String("at", "", "RFC3339 time to look up, now if empty")
+	all := fs.Bool("all", false, "print all the events of the ip")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: multus-ipam history [options] NETWORK IP\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+	network := fs.Arg(0)
+	ip := net.ParseIP(fs.Arg(1))
+	if ip == nil {
+		fmt.Fprintf(os.Stderr, "invalid ip %q\n", fs.Arg(1))
+		return 2
+	}
+	t := time.Now()
+	if *at != "" {
+		var err error
+		if t, err = time.Parse(time.RFC3339, *at); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid time %q, %v\n", *at, err)
+			return 2
+		}
+	}
+
+	events, err := disk.LoadHistory(network, *dataDir, ip)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "load history of %v failed, %v\n", network, err)
+		return 1
+	}
+	if *all {
+		for _, ev := range events {
+			fmt.Println(formatEvent(&ev))
+		}
+		return 0
+	}
+	ev := disk.WhoHad(events, t)
+	if ev == nil {
+		fmt.Printf("%v was free at %v\n", ip, t.Format(time.RFC3339))
+		return 0
+	}
+	fmt.Println(formatEvent(ev))
+	return 0
+}
+
+func formatEvent(ev *disk.HistoryEvent) string {
+	pod := "-"
+	if ev.Pod != "" {
+		pod = ev.Namespace + "/" + ev.Pod
+	}
+	return fmt.Sprintf("%v %-7s %v container=%v ifname=%v pod=%v",
+		ev.Time.Format(time.RFC3339), ev.Op, ev.IP, ev.ID, ev.IfName, pod)
+}
@@ -15,10 +15,11 @@
 package main
 
 import (
-	// "encoding/json"
+	"encoding/json"
 	// "flag"
 	"fmt"
 	"net"
+	"os"
 	"strconv"
 	"strings"
 
@@ -41,6 +42,9 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "history" {
+		os.Exit(cmdHistory(os.Args[2:]))
+	}
 	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString("multus-ipam"))
 }
 
@@ -53,19 +57,142 @@ func cmdCheck(args *skel.CmdArgs) error {
 
 	ipamConf := netConf.IPAM
 
-	// Look to see if there is at least one IP address allocated to the container
-	// in the data dir, irrespective of what that address actually is
-	store, err := disk.New(ipamConf.Name, ipamConf.DataDir)
+	var ips []net.IP
+	if ipamConf.IsFixIP == false {
+		ips, err = checkLeasedIP(netConf, args.ContainerID, args.IfName)
+	} else {
+		ips, err = checkFixIP(netConf)
+	}
 	if err != nil {
 		return err
 	}
+
+	return checkPrevResult(args.StdinData, ips)
+}
+
+// checkLeasedIP verifies the addresses reserved for the container locally are
+// inside the blocks leased to this node, and returns them
+func checkLeasedIP(netConf *allocator.Net, containerID string, ifName string) ([]net.IP, error) {
+	ipamConf := netConf.IPAM
+
+	store, err := disk.New(ipamConf.Name, ipamConf.DataDir)
+	if err != nil {
+		return nil, err
+	}
 	defer store.Close()
 
-	containerIPFound := store.FindByID(args.ContainerID, args.IfName)
-	if containerIPFound == false {
-		return fmt.Errorf("host-local: Failed to find address added by container %v", args.ContainerID)
+	ips := store.GetByID(containerID, ifName)
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("multus-ipam: failed to find address added by container %v", containerID)
 	}
 
+	// only the range sets of the pool are allocated from, see allocateIP
+	num := 0
+	for _, rs := range ipamConf.Ranges {
+		if ipamConf.InPool(rs) {
+			num += ipamConf.Count(rs[0].RangeStart)
+		}
+	}
+	if len(ips) != num {
+		return nil, fmt.Errorf("multus-ipam: container %v has %d addresses, %d expected", containerID, len(ips), num)
+	}
+
+	caches, err := store.LoadCache()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range ips {
+		if !containedIn(caches, &allocator.SimpleRange{RangeStart: addr, RangeEnd: addr}) {
+			return nil, fmt.Errorf("multus-ipam: %v of container %v is out of the local blocks", addr, containerID)
+		}
+	}
+
+	leases, err := etcdv3cli.IPAMGetNodeLeases(netConf.Name)
+	if err != nil {
+		return nil, fmt.Errorf("multus-ipam: get leases of %v failed, %v", netConf.Name, err)
+	}
+	for _, addr := range ips {
+		if !containedIn(leases, &allocator.SimpleRange{RangeStart: addr, RangeEnd: addr}) {
+			return nil, fmt.Errorf("multus-ipam: %v of container %v is not leased to this node", addr, containerID)
+		}
+	}
+	return ips, nil
+}
+
+func containedIn(srs []allocator.SimpleRange, sr *allocator.SimpleRange) bool {
+	for _, r := range srs {
+		if r.Contains(sr) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkFixIP verifies every fixed address of the pod is still bound to it
+func checkFixIP(netConf *allocator.Net) ([]net.IP, error) {
+	ipamConf := netConf.IPAM
+	if (ipamConf.PodName == "") || (ipamConf.K8sNs == "") {
+		return nil, fmt.Errorf("multus-ipam: missing fix infor PodName(%v), K8sNs(%v)", ipamConf.PodName, ipamConf.K8sNs)
+	}
+	if ipamConf.FixRange == nil {
+		return nil, fmt.Errorf("multus-ipam: fixRange of %v is not configured", netConf.Name)
+	}
+
+	fixInfos := []string{}
+	for i := 0; i < ipamConf.Count(ipamConf.FixRange.RangeStart); i++ {
+		fixInfos = append(fixInfos, etcdv3cli.IPAMGenFixInfo(ipamConf.K8sNs, ipamConf.PodName, i))
+	}
+	bound, err := etcdv3cli.IPAMGetFixIPs(netConf.Name, fixInfos)
+	if err != nil {
+		return nil, fmt.Errorf("multus-ipam: get fixed ips of %v failed, %v", netConf.Name, err)
+	}
+
+	ips := []net.IP{}
+	for _, fixInfo := range fixInfos {
+		addr, ok := bound[fixInfo]
+		if !ok {
+			return nil, fmt.Errorf("multus-ipam: no fixed ip is bound to %v", fixInfo)
+		}
+		if !ipamConf.FixRange.Contains(addr) {
+			return nil, fmt.Errorf("multus-ipam: fixed ip %v of %v is out of %v", addr, fixInfo, ipamConf.FixRange)
+		}
+		ips = append(ips, addr)
+	}
+	return ips, nil
+}
+
+// checkPrevResult verifies the addresses of prevResult are the allocated ones
+func checkPrevResult(stdinData []byte, ips []net.IP) error {
+	conf := types.NetConf{}
+	if err := json.Unmarshal(stdinData, &conf); err != nil {
+		return fmt.Errorf("multus-ipam: failed to load netconf, %v", err)
+	}
+	if conf.RawPrevResult == nil {
+		return nil
+	}
+	if err := version.ParsePrevResult(&conf); err != nil {
+		return fmt.Errorf("multus-ipam: failed to parse prevResult, %v", err)
+	}
+	result, err := current.NewResultFromResult(conf.PrevResult)
+	if err != nil {
+		return fmt.Errorf("multus-ipam: failed to convert prevResult, %v", err)
+	}
+
+	if len(result.IPs) != len(ips) {
+		return fmt.Errorf("multus-ipam: prevResult has %d addresses, %d allocated", len(result.IPs), len(ips))
+	}
+	for _, ipc := range result.IPs {
+		found := false
+		for _, addr := range ips {
+			if ipc.Address.IP.Equal(addr) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("multus-ipam: %v of prevResult is not allocated", ipc.Address.IP)
+		}
+	}
 	return nil
 }
 
@@ -96,6 +223,8 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return logging.Errorf("disk.New(%v, %v) failed, %v", ipamConf.Name, ipamConf.DataDir, err)
 	}
 	defer store.Close()
+	store.SetOwner(args.ContainerID, args.IfName, ipamConf.K8sNs, ipamConf.PodName)
+	store.SetQuarantine(ipamConf.QuarantinePeriod())
 
 	if ipamConf.IsFixIP == false {
 		result.IPs, err = allocateIP(netConf, store, args.ContainerID, args.IfName)
@@ -113,39 +242,14 @@ func cmdAdd(args *skel.CmdArgs) error {
 
 	// logging.Debugf("AllocGW is %v", ipamConf.AllocGW)
 
-	if ipamConf.AllocGW == true {
-		gwsLocal := store.GetByID("gateway", "gateway")
-		var gw net.IP
-		// logging.Debugf("choose gw form %v", gwsLocal)
-		for _, g := range gwsLocal {
-			if ip.Cmp(g, net.IPv4zero) != 0 {
-				if gw != nil {
-					store.Release(g)
-					logging.Verbosef("release redundant gw ip %v", g)
-				} else {
-					if !result.IPs[0].Address.Contains(g) {
-						store.Release(g)
-						logging.Verbosef("release invalid gw ip %v", g)
-					} else {
-						logging.Debugf("get gw  %v", g)
-						gw = g
-					}
-				}
-			}
-		}
-
-		if gw == nil {
-			r, err := allocateIP(netConf, store, "gateway", "gateway")
-			if err == nil {
-				gw = r[0].Address.IP
-			} else {
-				gw = net.IPv4zero
-			}
+	if ipamConf.DistGW == true {
+		for _, ipc := range result.IPs {
+			ipc.Gateway = distGateway(ipamConf, ipc.Address.IP)
 		}
-		for i := 0; i < len(result.IPs); i++ {
-			result.IPs[i].Gateway = gw
+	} else if ipamConf.AllocGW == true {
+		if err := allocateGateways(netConf, store, result.IPs); err != nil {
+			return logging.Errorf("allocate gateways failed, %v", err)
 		}
-
 	}
 	logging.Debugf("IPs: %v", result.IPs)
 	return types.PrintResult(result, confVersion)
@@ -165,8 +269,10 @@ func cmdDel(args *skel.CmdArgs) error {
 			return err
 		}
 		defer store.Close()
+		store.SetOwner(args.ContainerID, args.IfName, ipamConf.K8sNs, ipamConf.PodName)
 
-		// Loop through all ranges, releasing all IPs, even if an error occurs
+		// Loop through all ranges, releasing all IPs, even if an error occurs,
+		// the addresses of the sub interfaces "<ifName>.<n>" are released too
 		var errors []string
 		for idx, rangeset := range ipamConf.Ranges {
 			ipAllocator := allocator.NewIPAllocator(&rangeset, store, idx)
@@ -232,53 +338,25 @@ func allocateIP(netConf *allocator.Net, store *disk.Store, containerID string, i
 		return nil, err
 	}
 	logging.Debugf("allocate ip from %v", rss)
-	allocs := []*allocator.IPAllocator{}
 	IPs := []*current.IPConfig{}
-	for s := 0; s < ipamConf.Num; s++ {
-		subIfName := ifName + "." + strconv.Itoa(s)
-		for idx, rs := range rss {
-			var err error = nil
-			var ipConf *current.IPConfig = nil
-			var alloc *allocator.IPAllocator = nil
-			if len(rs) > 0 {
-				alloc = allocator.NewIPAllocator(&rs, store, idx)
-				logging.Debugf("allocator(%v, %v, %v) return %v", rs, store, idx, alloc)
-				ipConf, err = alloc.Get(containerID, subIfName, nil)
-			} else {
-				err = logging.Errorf("no IP addresses available in range set")
-			}
-			//try most 3 times
-			for i := 0; i < 3; i++ {
-				if err != nil && strings.Contains(err.Error(), "no IP addresses available in range set") {
-					var sr *allocator.SimpleRange
-					sr, err = etcdv3cli.IPAMApplyIPRange(netConf.Name, &ipamConf.Ranges[idx][0], ipamConf.ApplyUnit)
-					// logging.Debugf("apply new ip range(%v, %v, %v) return %v, %v, %v", ipamConf.Name, &ipamConf.Ranges[idx][0].Subnet, ipamConf.ApplyUnit, sIP, eIP, err)
-					if err == nil {
-						// store.AppendRangeToCache(fmt.Sprintf("%s-%s", sIP.String(), eIP.String()))
-						store.AppendCache(sr)
-						r := ipamConf.Ranges[idx][0]
-						r.RangeStart, r.RangeEnd = sr.RangeStart, sr.RangeEnd
-						alloc = allocator.NewIPAllocator(&(allocator.RangeSet{r}), store, idx)
-						logging.Debugf("NewIPAllocator(%v, %v, %v) return %v", allocator.RangeSet{r}, store, idx, alloc)
-						ipConf, err = alloc.Get(containerID, subIfName, nil)
-						if err != nil {
-							logging.Errorf("alloc ip from range %v failed, %v", r, err)
-							continue
-						}
-					}
-				}
-				break
-			}
+	for idx, rs := range rss {
+		if !ipamConf.InPool(ipamConf.Ranges[idx]) {
+			continue
+		}
+		origin := &ipamConf.Ranges[idx][0]
+		// every address gets a sub interface name "<ifName>.<n>"
+		for s := 0; s < ipamConf.Count(origin.RangeStart); s++ {
+			subIfName := ifName + "." + strconv.Itoa(s)
+			ipConf, err := allocateFromRangeSet(netConf, store, rs, origin, idx, containerID, subIfName)
 			if err != nil {
-				// Deallocate all already allocated IPs
-				for _, alloc := range allocs {
-					_ = alloc.Release(containerID, ifName)
+				// all or nothing, release the addresses of every sub interface
+				alloc := allocator.NewIPAllocator(&rs, store, idx)
+				if rerr := alloc.Release(containerID, ifName); rerr != nil {
+					logging.Errorf("release %v of %v failed, %v", ifName, containerID, rerr)
 				}
 				return nil, logging.Errorf("failed to allocate for range %d: %v", idx, err)
 			}
-			allocs = append(allocs, alloc)
 			IPs = append(IPs, ipConf)
-			break
 		}
 	}
 
@@ -286,19 +364,190 @@ func allocateIP(netConf *allocator.Net, store *disk.Store, containerID string, i
 	return IPs, nil
 }
 
+// allocateFromRangeSet allocates an ip from the blocks leased to this node,
+// a new block is applied from origin when they are exhausted
+func allocateFromRangeSet(netConf *allocator.Net, store *disk.Store, rs allocator.RangeSet, origin *allocator.Range, idx int, id string, ifName string) (*current.IPConfig, error) {
+	ipamConf := netConf.IPAM
+
+	var err error = nil
+	var ipConf *current.IPConfig = nil
+	if len(rs) > 0 {
+		alloc := allocator.NewIPAllocator(&rs, store, idx)
+		logging.Debugf("allocator(%v, %v, %v) return %v", rs, store, idx, alloc)
+		ipConf, err = alloc.Get(id, ifName, nil)
+	} else {
+		err = logging.Errorf("no IP addresses available in range set")
+	}
+	//try most 3 times
+	for i := 0; i < 3; i++ {
+		if err != nil && strings.Contains(err.Error(), "no IP addresses available in range set") {
+			var lease *disk.CacheEntry
+			lease, err = etcdv3cli.IPAMApplyLease(netConf.Name, origin, ipamConf.ApplyUnit)
+			if err != nil {
+				store.CountApplyFailure()
+			} else {
+				store.AppendCacheEntry(lease)
+				r := *origin
+				r.RangeStart, r.RangeEnd = lease.RangeStart, lease.RangeEnd
+				alloc := allocator.NewIPAllocator(&(allocator.RangeSet{r}), store, idx)
+				logging.Debugf("NewIPAllocator(%v, %v, %v) return %v", allocator.RangeSet{r}, store, idx, alloc)
+				ipConf, err = alloc.Get(id, ifName, nil)
+				if err != nil {
+					logging.Errorf("alloc ip from range %v failed, %v", r, err)
+					continue
+				}
+			}
+		}
+		break
+	}
+	return ipConf, err
+}
+
+// gatewayIfName is the key the gateways of a range set are recorded with
+func gatewayIfName(idx int) string {
+	return disk.GatewayID + "." + strconv.Itoa(idx)
+}
+
+// rangeFor returns the range of rs whose subnet contains addr
+func rangeFor(rs allocator.RangeSet, addr net.IP) *allocator.Range {
+	for i := range rs {
+		if (*net.IPNet)(&rs[i].Subnet).Contains(addr) {
+			return &rs[i]
+		}
+	}
+	return nil
+}
+
+// allocateGateways sets the gateway of every ip. Gateways are allocated from
+// the blocks of this node, one per range set and subnet, so ips of different
+// range sets or address families never share a gateway.
+func allocateGateways(netConf *allocator.Net, store *disk.Store, ips []*current.IPConfig) error {
+	ipamConf := netConf.IPAM
+
+	rss, err := formRangeSets(ipamConf.Ranges, ipamConf.Name, ipamConf.ApplyUnit, store)
+	if err != nil {
+		return err
+	}
+	migrateGateways(ipamConf, store)
+
+	for idx, rso := range ipamConf.Ranges {
+		gwIfName := gatewayIfName(idx)
+
+		// keep one valid gateway per subnet
+		gws := []net.IP{}
+		for _, g := range store.GetByID(disk.GatewayID, gwIfName) {
+			r := rangeFor(rso, g)
+			if r == nil {
+				store.Lock()
+				store.Release(g)
+				store.Unlock()
+				logging.Verbosef("release invalid gw ip %v", g)
+				continue
+			}
+			if gatewayIn(gws, (*net.IPNet)(&r.Subnet)) != nil {
+				store.Lock()
+				store.Release(g)
+				store.Unlock()
+				logging.Verbosef("release redundant gw ip %v", g)
+				continue
+			}
+			logging.Debugf("get gw %v", g)
+			gws = append(gws, g)
+		}
+
+		for _, ipc := range ips {
+			origin := rangeFor(rso, ipc.Address.IP)
+			if origin == nil {
+				continue
+			}
+			gw := gatewayIn(gws, (*net.IPNet)(&origin.Subnet))
+			if gw == nil {
+				local := allocator.RangeSet{}
+				for _, r := range rss[idx] {
+					if (*net.IPNet)(&origin.Subnet).Contains(r.RangeStart) {
+						local = append(local, r)
+					}
+				}
+				gwConf, err := allocateFromRangeSet(netConf, store, local, origin, idx, disk.GatewayID, gwIfName)
+				if err == nil {
+					gw = gwConf.Address.IP
+					gws = append(gws, gw)
+				} else {
+					logging.Errorf("allocate gateway for %v failed, %v", ipc.Address.String(), err)
+					gw = net.IPv4zero
+					if ipc.Address.IP.To4() == nil {
+						gw = net.IPv6zero
+					}
+				}
+			}
+			ipc.Gateway = gw
+		}
+	}
+	return nil
+}
+
+// migrateGateways moves the gateways previous versions recorded for the whole
+// network, as "gateway" or without ifname, to the range set they belong to.
+// They are reused instead of leaking while another one is allocated.
+func migrateGateways(ipamConf *allocator.IPAMConfig, store *disk.Store) {
+	legacy := append(store.GetByIfName(disk.GatewayID, disk.GatewayID), store.GetByIfName(disk.GatewayID, "")...)
+	if len(legacy) == 0 {
+		return
+	}
+	store.Lock()
+	defer store.Unlock()
+	for _, g := range legacy {
+		gwIfName := ""
+		for idx, rso := range ipamConf.Ranges {
+			if rangeFor(rso, g) != nil {
+				gwIfName = gatewayIfName(idx)
+				break
+			}
+		}
+		if gwIfName == "" {
+			store.Release(g)
+			logging.Verbosef("release invalid gw ip %v", g)
+			continue
+		}
+		if err := store.SetIfName(g, gwIfName); err != nil {
+			logging.Errorf("migrate gw ip %v to %v failed, %v", g, gwIfName, err)
+			continue
+		}
+		logging.Verbosef("migrated gw ip %v to %v", g, gwIfName)
+	}
+}
+
+// gatewayIn returns the gateway of gws that belongs to subnet
+func gatewayIn(gws []net.IP, subnet *net.IPNet) net.IP {
+	for _, g := range gws {
+		if subnet.Contains(g) {
+			return g
+		}
+	}
+	return nil
+}
+
 func allocateFixIP(netConf *allocator.Net) ([]*current.IPConfig, error) {
 	ipamConf := netConf.IPAM
 	if (ipamConf.PodName == "") || (ipamConf.K8sNs == "") {
 		return nil, logging.Errorf("missing fix infor PodName(%v), K8sNs(%v)", ipamConf.PodName, ipamConf.K8sNs)
 	}
+	if ipamConf.FixRange == nil {
+		return nil, logging.Errorf("fixRange of %v is not configured", netConf.Name)
+	}
+
+	fixInfos := []string{}
+	for i := 0; i < ipamConf.Count(ipamConf.FixRange.RangeStart); i++ {
+		fixInfos = append(fixInfos, etcdv3cli.IPAMGenFixInfo(ipamConf.K8sNs, ipamConf.PodName, i))
+	}
+	// the existing bindings are returned when ADD is retried
+	ns, err := etcdv3cli.IPAMApplyFixIPs(netConf.Name, ipamConf.FixRange, fixInfos, ipamConf.QuarantinePeriod())
+	if err != nil {
+		return nil, err
+	}
 
 	IPs := []*current.IPConfig{}
-	for i := 0; i < ipamConf.Num; i++ {
-		fixInfo := etcdv3cli.IPAMGenFixInfo(ipamConf.K8sNs, ipamConf.PodName, i)
-		n, err := etcdv3cli.IPAMApplyFixIP(netConf.Name, ipamConf.FixRange, fixInfo)
-		if err != nil {
-			return nil, err
-		}
+	for _, n := range ns {
 		IPs = append(IPs, &current.IPConfig{
 			Version: "4",
 			Address: *n,
@@ -306,3 +555,20 @@ func allocateFixIP(netConf *allocator.Net) ([]*current.IPConfig, error) {
 	}
 	return IPs, nil
 }
+
+// distGateway returns the gateway configured for the subnet the ip belongs to.
+// In distributed gateway mode every node announces the same gateway, so it is
+// taken from the network config instead of being allocated from a local block.
+func distGateway(ipamConf *allocator.IPAMConfig, addr net.IP) net.IP {
+	for _, rs := range ipamConf.Ranges {
+		for _, r := range rs {
+			if (*net.IPNet)(&r.Subnet).Contains(addr) {
+				return r.Gateway
+			}
+		}
+	}
+	if ipamConf.FixRange != nil && (*net.IPNet)(&ipamConf.FixRange.Subnet).Contains(addr) {
+		return ipamConf.FixRange.Gateway
+	}
+	return nil
+}
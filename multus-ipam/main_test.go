@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
 	// "github.com/containernetworking/plugins/pkg/ns"
 	"github.com/containernetworking/plugins/pkg/testutils"
 	"github.com/coreos/etcd/clientv3"
@@ -14,7 +16,10 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
 var _ = Describe("Main", func() {
@@ -203,3 +208,306 @@ var _ = Describe("Main", func() {
 	})
 
 })
+
+var _ = Describe("Gateway", func() {
+	var cniCfg = []byte(`
+{
+	"name": "testnetgw",
+	"cniVersion": "0.3.0",
+	"type": "multus-vxlan",
+	"ipam": {
+		"type": "multus-ipam",
+		"dataDir": "/tmp/multus-ipam-gw",
+		"applyUnit": 4,
+		"allocGW": true,
+		"ranges": [
+			[
+				{ "subnet": "10.10.1.0/24" },
+				{ "subnet": "10.10.2.0/24" }
+			],
+			[
+				{ "subnet": "10.20.1.0/24" }
+			]
+		]
+	}
+}
+`)
+	var netConf *allocator.Net
+	var store *disk.Store
+
+	BeforeEach(func() {
+		logging.SetLogFile("/tmp/multus-test.log")
+		logging.SetLogLevel("debug")
+		os.RemoveAll("/tmp/multus-ipam-gw")
+		var err error
+		netConf, _, err = allocator.LoadIPAMConfig(cniCfg, "")
+		Expect(err).NotTo(HaveOccurred())
+		store, err = disk.New(netConf.Name, netConf.IPAM.DataDir)
+		Expect(err).NotTo(HaveOccurred())
+		// blocks already leased to this node, so no etcd is needed
+		for _, r := range []string{"10.10.1.16-10.10.1.31", "10.10.2.16-10.10.2.31", "10.20.1.16-10.20.1.31"} {
+			sr := strings.Split(r, "-")
+			store.AppendCache(&allocator.SimpleRange{RangeStart: net.ParseIP(sr[0]), RangeEnd: net.ParseIP(sr[1])})
+		}
+	})
+	AfterEach(func() {
+		store.Close()
+		os.RemoveAll("/tmp/multus-ipam-gw")
+	})
+
+	It("allocates a gateway per range set and subnet", func() {
+		ips := []*current.IPConfig{
+			{Version: "4", Address: net.IPNet{IP: net.ParseIP("10.10.1.20"), Mask: net.CIDRMask(24, 32)}},
+			{Version: "4", Address: net.IPNet{IP: net.ParseIP("10.10.2.20"), Mask: net.CIDRMask(24, 32)}},
+			{Version: "4", Address: net.IPNet{IP: net.ParseIP("10.20.1.20"), Mask: net.CIDRMask(24, 32)}},
+		}
+		Expect(allocateGateways(netConf, store, ips)).To(Succeed())
+		for _, ipc := range ips {
+			Expect(ipc.Gateway).NotTo(BeNil())
+			Expect(ipc.Address.Contains(ipc.Gateway)).To(BeTrue())
+			Expect(ipc.Gateway.Equal(ipc.Address.IP)).To(BeFalse())
+		}
+		Expect(len(store.GetByID(disk.GatewayID, gatewayIfName(0)))).To(Equal(2))
+		Expect(len(store.GetByID(disk.GatewayID, gatewayIfName(1)))).To(Equal(1))
+
+		// the recorded gateways are reused
+		again := []*current.IPConfig{
+			{Version: "4", Address: net.IPNet{IP: net.ParseIP("10.10.2.21"), Mask: net.CIDRMask(24, 32)}},
+		}
+		Expect(allocateGateways(netConf, store, again)).To(Succeed())
+		Expect(again[0].Gateway.Equal(ips[1].Gateway)).To(BeTrue())
+		Expect(len(store.GetByID(disk.GatewayID, disk.GatewayID))).To(Equal(3))
+	})
+
+	It("reuses the gateways of the baseline layout", func() {
+		dir := filepath.Join(netConf.IPAM.DataDir, netConf.Name)
+		for _, ip := range []string{"10.10.2.17", "10.20.1.17", "10.30.1.17"} {
+			Expect(ioutil.WriteFile(filepath.Join(dir, ip), []byte("gateway"+disk.LineBreak+"gateway"), 0644)).To(Succeed())
+		}
+		// the files are migrated to the index by the next store
+		store.Close()
+		var err error
+		store, err = disk.New(netConf.Name, netConf.IPAM.DataDir)
+		Expect(err).NotTo(HaveOccurred())
+
+		ips := []*current.IPConfig{
+			{Version: "4", Address: net.IPNet{IP: net.ParseIP("10.10.2.20"), Mask: net.CIDRMask(24, 32)}},
+			{Version: "4", Address: net.IPNet{IP: net.ParseIP("10.20.1.20"), Mask: net.CIDRMask(24, 32)}},
+		}
+		Expect(allocateGateways(netConf, store, ips)).To(Succeed())
+		Expect(ips[0].Gateway.String()).To(Equal("10.10.2.17"))
+		Expect(ips[1].Gateway.String()).To(Equal("10.20.1.17"))
+		Expect(store.GetByID(disk.GatewayID, gatewayIfName(0))).To(Equal([]net.IP{net.ParseIP("10.10.2.17")}))
+		Expect(store.GetByID(disk.GatewayID, gatewayIfName(1))).To(Equal([]net.IP{net.ParseIP("10.20.1.17")}))
+		Expect(len(store.GetByID(disk.GatewayID, disk.GatewayID))).To(Equal(2))
+	})
+
+	It("releases gateways outside the range set", func() {
+		store.Reserve(disk.GatewayID, gatewayIfName(1), net.ParseIP("10.10.1.17"), "1")
+		ips := []*current.IPConfig{
+			{Version: "4", Address: net.IPNet{IP: net.ParseIP("10.20.1.20"), Mask: net.CIDRMask(24, 32)}},
+		}
+		Expect(allocateGateways(netConf, store, ips)).To(Succeed())
+		gws := store.GetByID(disk.GatewayID, gatewayIfName(1))
+		Expect(len(gws)).To(Equal(1))
+		Expect(gws[0].Equal(ips[0].Gateway)).To(BeTrue())
+		Expect(ips[0].Address.Contains(ips[0].Gateway)).To(BeTrue())
+	})
+})
+
+var _ = Describe("Distributed gateway", func() {
+	var cniCfg = []byte(`
+{
+	"name": "testnetdistgw",
+	"cniVersion": "0.3.0",
+	"type": "multus-vxlan",
+	"ipam": {
+		"type": "multus-ipam",
+		"distGW": true,
+		"ranges": [
+			[
+				{ "subnet": "10.50.1.0/24", "gateway": "10.50.1.254" },
+				{ "subnet": "10.50.2.0/24", "gateway": "10.50.2.1" }
+			],
+			[
+				{ "subnet": "10.60.1.0/24", "gateway": "10.60.1.1" }
+			]
+		],
+		"fixRange": { "subnet": "10.70.1.0/24", "gateway": "10.70.1.1" }
+	}
+}
+`)
+
+	It("takes the gateway of the range the address belongs to", func() {
+		netConf, _, err := allocator.LoadIPAMConfig(cniCfg, "")
+		Expect(err).NotTo(HaveOccurred())
+		for addr, gw := range map[string]string{
+			"10.50.1.20": "10.50.1.254",
+			"10.50.2.20": "10.50.2.1",
+			"10.60.1.20": "10.60.1.1",
+			"10.70.1.20": "10.70.1.1",
+		} {
+			Expect(distGateway(netConf.IPAM, net.ParseIP(addr)).Equal(net.ParseIP(gw))).To(BeTrue(), addr)
+		}
+		Expect(distGateway(netConf.IPAM, net.ParseIP("10.80.1.20"))).To(BeNil())
+	})
+})
+
+var _ = Describe("Multiple addresses", func() {
+	var cniCfg = []byte(`
+{
+	"name": "testnetnum",
+	"cniVersion": "0.3.0",
+	"type": "multus-vxlan",
+	"ipam": {
+		"type": "multus-ipam",
+		"dataDir": "/tmp/multus-ipam-num",
+		"ipCount": {"ipv4": 3},
+		"ranges": [
+			[
+				{ "subnet": "10.30.1.0/24", "rangeStart": "10.30.1.16", "rangeEnd": "10.30.1.23" }
+			]
+		]
+	}
+}
+`)
+	var netConf *allocator.Net
+	var store *disk.Store
+	var etcdCfgDir string
+
+	BeforeEach(func() {
+		logging.SetLogFile("/tmp/multus-test.log")
+		logging.SetLogLevel("debug")
+		// no new block can be applied, allocation relies on the cached blocks
+		etcdCfgDir = os.Getenv("ETCD_CFG_DIR")
+		os.Setenv("ETCD_CFG_DIR", "/tmp/multus-ipam-num/etcd")
+		os.RemoveAll("/tmp/multus-ipam-num")
+		var err error
+		netConf, _, err = allocator.LoadIPAMConfig(cniCfg, "")
+		Expect(err).NotTo(HaveOccurred())
+		store, err = disk.New(netConf.Name, netConf.IPAM.DataDir)
+		Expect(err).NotTo(HaveOccurred())
+		store.AppendCache(&allocator.SimpleRange{RangeStart: net.ParseIP("10.30.1.16"), RangeEnd: net.ParseIP("10.30.1.19")})
+	})
+	AfterEach(func() {
+		store.Close()
+		os.RemoveAll("/tmp/multus-ipam-num")
+		os.Setenv("ETCD_CFG_DIR", etcdCfgDir)
+	})
+
+	It("allocates the count of every family and releases all of them on DEL", func() {
+		ips, err := allocateIP(netConf, store, "container1", "eth1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(len(ips)).To(Equal(3))
+		Expect(len(store.GetByID("container1", "eth1"))).To(Equal(3))
+
+		err = cmdDel(&skel.CmdArgs{ContainerID: "container1", IfName: "eth1", StdinData: cniCfg})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(store.GetByID("container1", "eth1")).To(BeEmpty())
+	})
+
+	It("returns the existing allocation when ADD is retried", func() {
+		ips, err := allocateIP(netConf, store, "container1", "eth1")
+		Expect(err).NotTo(HaveOccurred())
+		again, err := allocateIP(netConf, store, "container1", "eth1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(again).To(Equal(ips))
+		Expect(len(store.GetByID("container1", "eth1"))).To(Equal(3))
+	})
+
+	It("allocates all addresses or none", func() {
+		_, err := allocateIP(netConf, store, "container1", "eth1")
+		Expect(err).NotTo(HaveOccurred())
+		// only one address left in the block
+		_, err = allocateIP(netConf, store, "container2", "eth1")
+		Expect(err).To(HaveOccurred())
+		Expect(store.GetByID("container2", "eth1")).To(BeEmpty())
+		Expect(len(store.GetByID("container1", "eth1"))).To(Equal(3))
+	})
+})
+
+var _ = Describe("Check", func() {
+	var cniCfg = `
+{
+	"name": "testnetchk",
+	"cniVersion": "0.4.0",
+	"type": "multus-vxlan",
+	"ipam": {
+		"type": "multus-ipam",
+		"dataDir": "/tmp/multus-ipam-chk",
+		"ranges": [
+			[
+				{ "subnet": "10.40.1.0/24" }
+			]
+		]
+	}%s
+}
+`
+	var prevResult = `,
+	"prevResult": {
+		"cniVersion": "0.4.0",
+		"ips": [
+			{ "version": "4", "address": "%s/24" }
+		]
+	}`
+
+	BeforeEach(func() {
+		logging.SetLogFile("/tmp/multus-test.log")
+		logging.SetLogLevel("debug")
+		os.RemoveAll("/tmp/multus-ipam-chk")
+	})
+	AfterEach(func() {
+		os.RemoveAll("/tmp/multus-ipam-chk")
+	})
+
+	It("matches the allocation against prevResult", func() {
+		ips := []net.IP{net.ParseIP("10.40.1.20")}
+		Expect(checkPrevResult([]byte(fmt.Sprintf(cniCfg, "")), ips)).To(Succeed())
+		Expect(checkPrevResult([]byte(fmt.Sprintf(cniCfg, fmt.Sprintf(prevResult, "10.40.1.20"))), ips)).To(Succeed())
+		err := checkPrevResult([]byte(fmt.Sprintf(cniCfg, fmt.Sprintf(prevResult, "10.40.1.21"))), ips)
+		Expect(err).To(MatchError("multus-ipam: 10.40.1.21 of prevResult is not allocated"))
+		err = checkPrevResult([]byte(fmt.Sprintf(cniCfg, fmt.Sprintf(prevResult, "10.40.1.20"))), append(ips, net.ParseIP("10.40.1.22")))
+		Expect(err).To(MatchError("multus-ipam: prevResult has 1 addresses, 2 allocated"))
+	})
+
+	It("fails without a local reservation", func() {
+		netConf, _, err := allocator.LoadIPAMConfig([]byte(fmt.Sprintf(cniCfg, "")), "")
+		Expect(err).NotTo(HaveOccurred())
+		_, err = checkLeasedIP(netConf, "container1", "eth1")
+		Expect(err).To(MatchError("multus-ipam: failed to find address added by container container1"))
+	})
+
+	It("fails when the address is out of the local blocks", func() {
+		netConf, _, err := allocator.LoadIPAMConfig([]byte(fmt.Sprintf(cniCfg, "")), "")
+		Expect(err).NotTo(HaveOccurred())
+		store, err := disk.New(netConf.Name, netConf.IPAM.DataDir)
+		Expect(err).NotTo(HaveOccurred())
+		store.AppendCache(&allocator.SimpleRange{RangeStart: net.ParseIP("10.40.1.16"), RangeEnd: net.ParseIP("10.40.1.31")})
+		store.Reserve("container1", "eth1.0", net.ParseIP("10.40.1.40"), "0")
+		store.Close()
+		_, err = checkLeasedIP(netConf, "container1", "eth1")
+		Expect(err).To(MatchError(ContainSubstring("10.40.1.40 of container container1 is out of the local blocks")))
+	})
+	It("expects the addresses of the range sets of the pool only", func() {
+		cfg := strings.Replace(cniCfg, `{ "subnet": "10.40.1.0/24" }
+			]`, `{ "subnet": "10.40.1.0/24" }
+			],
+			[
+				{ "subnet": "10.40.2.0/24" }
+			]`, 1)
+		netConf, _, err := allocator.LoadIPAMConfig([]byte(fmt.Sprintf(cfg, "")), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(len(netConf.IPAM.Ranges)).To(Equal(2))
+		_, pool, _ := net.ParseCIDR("10.40.2.0/24")
+		netConf.IPAM.Pool = (*types.IPNet)(pool)
+
+		store, err := disk.New(netConf.Name, netConf.IPAM.DataDir)
+		Expect(err).NotTo(HaveOccurred())
+		store.AppendCache(&allocator.SimpleRange{RangeStart: net.ParseIP("10.40.1.16"), RangeEnd: net.ParseIP("10.40.1.31")})
+		store.Reserve("container1", "eth1.0", net.ParseIP("10.40.2.20"), "1")
+		store.Close()
+		// one address of the pool is expected, it is checked against the blocks
+		_, err = checkLeasedIP(netConf, "container1", "eth1")
+		Expect(err).To(MatchError(ContainSubstring("10.40.2.20 of container container1 is out of the local blocks")))
+	})
+})
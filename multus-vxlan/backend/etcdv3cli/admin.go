@@ -0,0 +1,69 @@
+package etcdv3cli
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/intel/multus-cni/etcdv3"
+	"github.com/intel/multus-cni/logging"
+)
+
+// Vtep is the endpoint of a vxlan on a node
+type Vtep struct {
+	Vxlan string
+	Src   string
+	Node  string
+	key   string
+}
+
+// ListVteps returns the endpoints of vxlan, of all vxlans if it is empty
+func ListVteps(em *etcdv3.EtcdMultus, vxlan string) ([]Vtep, error) {
+	keyDir := filepath.Join(em.RootKeyDir, vxlanKeyDir) + "/"
+	if vxlan != "" {
+		keyDir = filepath.Join(keyDir, vxlan) + "/"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), etcdv3.RequestTimeout)
+	resp, err := em.Cli.Get(ctx, keyDir, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	cancel()
+	if err != nil {
+		return nil, logging.Errorf("get %v failed, %v", keyDir, err)
+	}
+	vteps := []Vtep{}
+	for _, ev := range resp.Kvs {
+		name, src := ParseVxlan(ev.Key, ev.Value)
+		vteps = append(vteps, Vtep{
+			Vxlan: name,
+			Src:   src,
+			Node:  strings.Trim(string(ev.Value), " \r\n\t"),
+			key:   string(ev.Key),
+		})
+	}
+	return vteps, nil
+}
+
+// DelVteps deletes the endpoints of vxlan with source src, or all the
+// endpoints of node if src is empty. The watching daemons remove the fdb
+// entries of the deleted endpoints.
+func DelVteps(em *etcdv3.EtcdMultus, vxlan, src, node string) ([]Vtep, error) {
+	if src == "" && node == "" {
+		return nil, fmt.Errorf("either a source or a node is required")
+	}
+	vteps, err := ListVteps(em, vxlan)
+	if err != nil {
+		return nil, err
+	}
+	deleted := []Vtep{}
+	for _, v := range vteps {
+		if (src != "" && v.Src != src) || (node != "" && v.Node != node) {
+			continue
+		}
+		if err := etcdv3.TransDelKey(em.Cli, v.key); err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, v)
+	}
+	return deleted, nil
+}
@@ -1,7 +1,9 @@
 package etcdv3cli
 
 import (
+	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
 	"strings"
@@ -15,6 +17,7 @@ import (
 var (
 	vxlanKeyDir = "vxlan"
 	cacheDir    = "/var/lib/cni/mulvx"
+	gwDir       = "gateway"
 )
 
 func RecVxlan(network string, vxlan *netlink.Vxlan) error {
@@ -117,3 +120,118 @@ func CacheToEtcd() error {
 	}
 	return nil
 }
+
+// RecGateway records the distributed gateways served behind a vxlan, so that
+// multus-daemon can keep ARP for them from crossing the overlay. gws are the
+// gateways of network with the mask of their subnet, they replace the
+// gateways recorded for the same network and subnet, so that a gateway moved
+// in the network config is not suppressed any more.
+func RecGateway(vxlan string, network string, gws []net.IPNet) error {
+	dir := filepath.Join(cacheDir, gwDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return logging.Errorf("create dir %v failed, %v", dir, err)
+	}
+	lk, err := disk.NewFileLock(dir)
+	if err != nil {
+		return logging.Errorf("create dir mutex in %v failed, %v", dir, err)
+	}
+	lk.Lock()
+	defer lk.Close()
+
+	name := filepath.Join(dir, vxlan)
+	recs := loadGateway(name)
+	for _, gw := range gws {
+		subnet := &net.IPNet{IP: gw.IP.Mask(gw.Mask), Mask: gw.Mask}
+		kept := []gatewayRec{}
+		for _, r := range recs {
+			if r.network == network && r.subnet.String() == subnet.String() {
+				continue
+			}
+			// recorded before the network and subnet were
+			if r.network == "" && subnet.Contains(r.gw) {
+				continue
+			}
+			kept = append(kept, r)
+		}
+		recs = append(kept, gatewayRec{gw: gw.IP, network: network, subnet: subnet})
+	}
+	lines := []string{}
+	for _, r := range recs {
+		lines = append(lines, r.String())
+	}
+	err = ioutil.WriteFile(name, []byte(strings.Join(lines, "\n")), 0644)
+	if err != nil {
+		return logging.Errorf("write gateway file %v failed, %v", name, err)
+	}
+	return nil
+}
+
+// LoadGateways returns the distributed gateways recorded on this node by vxlan name
+func LoadGateways() map[string][]net.IP {
+	dir := filepath.Join(cacheDir, gwDir)
+	gws := map[string][]net.IP{}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return gws
+	}
+	for _, file := range files {
+		if file.IsDir() || file.Name() == "lock" {
+			continue
+		}
+		for _, r := range loadGateway(filepath.Join(dir, file.Name())) {
+			found := false
+			for _, gw := range gws[file.Name()] {
+				if gw.Equal(r.gw) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				gws[file.Name()] = append(gws[file.Name()], r.gw)
+			}
+		}
+	}
+	return gws
+}
+
+// gatewayRec is a line "<gateway> <network> <subnet>" of a gateway file, the
+// lines written before the network and subnet were recorded only hold the
+// gateway
+type gatewayRec struct {
+	gw      net.IP
+	network string
+	subnet  *net.IPNet
+}
+
+func (r gatewayRec) String() string {
+	if r.network == "" {
+		return r.gw.String()
+	}
+	return fmt.Sprintf("%v %v %v", r.gw, r.network, r.subnet)
+}
+
+func loadGateway(name string) []gatewayRec {
+	recs := []gatewayRec{}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return recs
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		gw := net.ParseIP(fields[0])
+		if gw == nil {
+			continue
+		}
+		r := gatewayRec{gw: gw}
+		if len(fields) == 3 {
+			if _, subnet, err := net.ParseCIDR(fields[2]); err == nil {
+				r.network, r.subnet = fields[1], subnet
+			}
+		}
+		recs = append(recs, r)
+	}
+	return recs
+}
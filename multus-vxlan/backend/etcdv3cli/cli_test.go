@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
 
@@ -124,3 +125,41 @@ var _ = Describe("Cli", func() {
 	})
 
 })
+
+var _ = Describe("Gateway", func() {
+	var origin string
+
+	BeforeEach(func() {
+		origin = cacheDir
+		cacheDir = "/tmp/multus-vxlan-gw"
+		os.RemoveAll(cacheDir)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(cacheDir)
+		cacheDir = origin
+	})
+
+	gateway := func(cidr string) net.IPNet {
+		ip, subnet, err := net.ParseCIDR(cidr)
+		Expect(err).NotTo(HaveOccurred())
+		return net.IPNet{IP: ip, Mask: subnet.Mask}
+	}
+
+	It("replaces the gateways of the network and subnet", func() {
+		// recorded before the network and subnet were
+		Expect(os.MkdirAll(filepath.Join(cacheDir, gwDir), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(cacheDir, gwDir, "vx100"), []byte("10.1.0.1\n10.3.0.1"), 0644)).To(Succeed())
+
+		Expect(RecGateway("vx100", "net1", []net.IPNet{gateway("10.1.0.254/24"), gateway("10.2.0.1/24")})).To(Succeed())
+		Expect(RecGateway("vx100", "net2", []net.IPNet{gateway("10.2.0.1/24")})).To(Succeed())
+		Expect(RecGateway("vx200", "net3", []net.IPNet{gateway("10.4.0.1/24")})).To(Succeed())
+		Expect(fmt.Sprint(LoadGateways())).To(Equal("map[vx100:[10.3.0.1 10.1.0.254 10.2.0.1] vx200:[10.4.0.1]]"))
+
+		// the gateway moved in the config of net1
+		Expect(RecGateway("vx100", "net1", []net.IPNet{gateway("10.2.0.254/24")})).To(Succeed())
+		Expect(fmt.Sprint(LoadGateways())).To(Equal("map[vx100:[10.3.0.1 10.1.0.254 10.2.0.1 10.2.0.254] vx200:[10.4.0.1]]"))
+		Expect(RecGateway("vx100", "net1", []net.IPNet{gateway("10.1.0.1/24")})).To(Succeed())
+		Expect(fmt.Sprint(LoadGateways())).To(Equal("map[vx100:[10.3.0.1 10.2.0.1 10.2.0.254 10.1.0.1] vx200:[10.4.0.1]]"))
+	})
+})
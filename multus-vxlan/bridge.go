@@ -21,6 +21,7 @@ import (
 	"syscall"
 
 	"github.com/intel/multus-cni/logging"
+	"github.com/intel/multus-cni/multus-vxlan/config"
 	"github.com/j-keck/arping"
 	"github.com/vishvananda/netlink"
 
@@ -38,18 +39,7 @@ import (
 var debugPostIPAMError error
 var brNameTmp = "mulbr.%s"
 
-type BridgeNetConf struct {
-	// BrName       string `json:"bridge"`
-	IsGW         bool   `json:"isGateway"`
-	IsDefaultGW  bool   `json:"isDefaultGateway"`
-	ForceAddress bool   `json:"forceAddress"`
-	IPMasq       bool   `json:"ipMasq"`
-	MTU          int    `json:"mtu"`
-	HairpinMode  bool   `json:"hairpinMode"`
-	PromiscMode  bool   `json:"promiscMode"`
-	Vlan         int    `json:"vlan"`
-	BrName       string `json:"brName"`
-}
+type BridgeNetConf = config.BridgeNetConf
 
 type gwInfo struct {
 	gws               []net.IPNet
@@ -349,6 +339,7 @@ func enableIPForward(family int) error {
 func bridgeAdd(args *skel.CmdArgs, n *NetConf) (*netlink.Bridge, *current.Result, error) {
 
 	var success bool = false
+	var err error
 
 	isLayer3 := n.IPAM.Type != ""
 
@@ -360,6 +351,14 @@ func bridgeAdd(args *skel.CmdArgs, n *NetConf) (*netlink.Bridge, *current.Result
 		return nil, nil, logging.Errorf("cannot set hairpin mode and promiscous mode at the same time.")
 	}
 
+	var gwMac net.HardwareAddr
+	if n.GatewayMac != "" {
+		gwMac, err = net.ParseMAC(n.GatewayMac)
+		if err != nil {
+			return nil, nil, logging.Errorf("failed to parse gateway mac %q: %v", n.GatewayMac, err)
+		}
+	}
+
 	br, brInterface, err := setupBridge(n)
 	if err != nil {
 		return nil, nil, logging.Errorf("setupBridge failed, %v", err)
@@ -455,6 +454,7 @@ func bridgeAdd(args *skel.CmdArgs, n *NetConf) (*netlink.Bridge, *current.Result
 		if n.IsGW {
 			var firstV4Addr net.IP
 			var vlanInterface *current.Interface
+			var gwLink netlink.Link = br
 			// Set the IP address(es) on the bridge and enable forwarding
 			for _, gws := range []*gwInfo{gwsV4, gwsV6} {
 				for _, gw := range gws.gws {
@@ -477,6 +477,7 @@ func bridgeAdd(args *skel.CmdArgs, n *NetConf) (*netlink.Bridge, *current.Result
 						if err != nil {
 							return nil, nil, logging.Errorf("failed to set vlan interface for bridge with addr: %v", err)
 						}
+						gwLink = vlanIface
 					} else {
 						logging.Debugf("ensureAddr %v, %v, %v, %v", br, gws.family, gw, n.ForceAddress)
 						err = ensureAddr(br, gws.family, &gw, n.ForceAddress)
@@ -492,6 +493,13 @@ func bridgeAdd(args *skel.CmdArgs, n *NetConf) (*netlink.Bridge, *current.Result
 					}
 				}
 			}
+
+			// Distributed gateway, every node answers for the gateway with the same mac
+			if gwMac != nil && gwLink.Attrs().HardwareAddr.String() != gwMac.String() {
+				if err = netlink.LinkSetHardwareAddr(gwLink, gwMac); err != nil {
+					return nil, nil, logging.Errorf("failed to set gateway mac %v on %q: %v", gwMac, gwLink.Attrs().Name, err)
+				}
+			}
 		}
 
 		if n.IPMasq {
@@ -0,0 +1,102 @@
+// Copyright 2014 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package config loads the network config of multus-vxlan, so that it is
+// checked by the other components as the plugin reads it
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// maxVxlanID is the largest VNI of the 24 bits of a vxlan header
+const maxVxlanID = 1<<24 - 1
+
+type NetConf struct {
+	types.NetConf
+	Master string `json:"master"`
+	BridgeNetConf
+	Vxlan    VxlanNetConf `json:"vxlan"`
+	LogFile  string       `json:"logFile"`
+	LogLevel string       `json:"logLevel"`
+}
+
+type BridgeNetConf struct {
+	// BrName       string `json:"bridge"`
+	IsGW         bool   `json:"isGateway"`
+	IsDefaultGW  bool   `json:"isDefaultGateway"`
+	ForceAddress bool   `json:"forceAddress"`
+	IPMasq       bool   `json:"ipMasq"`
+	MTU          int    `json:"mtu"`
+	HairpinMode  bool   `json:"hairpinMode"`
+	PromiscMode  bool   `json:"promiscMode"`
+	Vlan         int    `json:"vlan"`
+	BrName       string `json:"brName"`
+	// GatewayMac is the anycast mac shared by the gateway of every node
+	GatewayMac string `json:"gatewayMac"`
+}
+
+type VxlanNetConf struct {
+	Master   string
+	VxlanId  int  `json:"vxlanId"`
+	Port     int  `json:"port"`
+	Learning bool `json:"learning"`
+	GBP      bool `json:"gbp"`
+}
+
+// Load returns the config of bytes with the defaults set, the log settings
+// of the config are left to the caller
+func Load(bytes []byte) (*NetConf, string, error) {
+	n := &NetConf{}
+	if err := json.Unmarshal(bytes, n); err != nil {
+		return nil, "", fmt.Errorf("Unmarshal failed, %v", err)
+	}
+	n.Vxlan.Master = n.Master
+	if n.BrName == "" {
+		n.BrName = n.Master
+	}
+	return n, n.CNIVersion, nil
+}
+
+// Validate checks what the plugin only finds out when a pod is attached
+func (n *NetConf) Validate() error {
+	if n.Master == "" {
+		return fmt.Errorf("master is missing")
+	}
+	if n.Vxlan.VxlanId == 0 {
+		return fmt.Errorf("vxlan.vxlanId is missing")
+	}
+	if n.Vxlan.VxlanId < 0 || n.Vxlan.VxlanId > maxVxlanID {
+		return fmt.Errorf("invalid vxlan.vxlanId %d, must be between 1 and %d", n.Vxlan.VxlanId, maxVxlanID)
+	}
+	if n.Vxlan.Port < 0 || n.Vxlan.Port > 65535 {
+		return fmt.Errorf("invalid vxlan.port %d", n.Vxlan.Port)
+	}
+	if n.Vlan < 0 || n.Vlan > 4094 {
+		return fmt.Errorf("invalid vlan %d, must be between 0 and 4094", n.Vlan)
+	}
+	if n.MTU < 0 {
+		return fmt.Errorf("invalid mtu %d", n.MTU)
+	}
+	if n.GatewayMac != "" {
+		if _, err := net.ParseMAC(n.GatewayMac); err != nil {
+			return fmt.Errorf("invalid gatewayMac %q, %v", n.GatewayMac, err)
+		}
+	}
+	return nil
+}
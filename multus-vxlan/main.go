@@ -15,7 +15,7 @@
 package main
 
 import (
-	"encoding/json"
+	"net"
 	"os"
 	"runtime"
 
@@ -25,17 +25,11 @@ import (
 	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
 	"github.com/intel/multus-cni/logging"
 	"github.com/intel/multus-cni/multus-vxlan/backend/etcdv3cli"
+	"github.com/intel/multus-cni/multus-vxlan/config"
 	"github.com/vishvananda/netlink"
 )
 
-type NetConf struct {
-	types.NetConf
-	Master string `json:"master"`
-	BridgeNetConf
-	Vxlan    VxlanNetConf `json:"vxlan"`
-	LogFile  string       `json:"logFile"`
-	LogLevel string       `json:"logLevel"`
-}
+type NetConf = config.NetConf
 
 func init() {
 	// this ensures that main runs only on main thread (thread group leader).
@@ -47,9 +41,9 @@ func init() {
 }
 
 func loadNetConf(bytes []byte) (*NetConf, string, error) {
-	n := &NetConf{}
-	if err := json.Unmarshal(bytes, n); err != nil {
-		return nil, "", logging.Errorf("Unmarshal failed, %v", err)
+	n, cniVersion, err := config.Load(bytes)
+	if err != nil {
+		return nil, "", logging.Errorf("%v", err)
 	}
 	// Logging
 	if n.LogFile != "" {
@@ -58,11 +52,7 @@ func loadNetConf(bytes []byte) (*NetConf, string, error) {
 	if n.LogLevel != "" {
 		logging.SetLogLevel(n.LogLevel)
 	}
-	n.Vxlan.Master = n.Master
-	if n.BrName == "" {
-		n.BrName = n.Master
-	}
-	return n, n.CNIVersion, nil
+	return n, cniVersion, nil
 }
 
 func cmdAdd(args *skel.CmdArgs) error {
@@ -98,6 +88,18 @@ func cmdAdd(args *skel.CmdArgs) error {
 
 	etcdv3cli.RecVxlan(n.Name, vxlan)
 
+	if n.GatewayMac != "" {
+		gws := []net.IPNet{}
+		for _, ipc := range result.IPs {
+			if ipc.Gateway != nil {
+				gws = append(gws, net.IPNet{IP: ipc.Gateway, Mask: ipc.Address.Mask})
+			}
+		}
+		if err := etcdv3cli.RecGateway(vxlan.Attrs().Name, n.Name, gws); err != nil {
+			return logging.Errorf("record distributed gateway failed, %v", err)
+		}
+	}
+
 	result.CNIVersion = cniVersion
 
 	//Todo write neighbor to etcd /vxlan/<netname>/arp/<mainip>-<id>/<mac>:<ip>
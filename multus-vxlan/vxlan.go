@@ -7,16 +7,11 @@ import (
 
 	"github.com/archichris/netools/dev"
 	"github.com/intel/multus-cni/logging"
+	"github.com/intel/multus-cni/multus-vxlan/config"
 	"github.com/vishvananda/netlink"
 )
 
-type VxlanNetConf struct {
-	Master   string
-	VxlanId  int  `json:"vxlanId"`
-	Port     int  `json:"port"`
-	Learning bool `json:"learning"`
-	GBP      bool `json:"gbp"`
-}
+type VxlanNetConf = config.VxlanNetConf
 
 func ensureLink(vxlan *netlink.Vxlan) (*netlink.Vxlan, error) {
 	err := netlink.LinkAdd(vxlan)
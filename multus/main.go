@@ -0,0 +1,96 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This is a "Multi-plugin".The delegate concept refered from CNI project
+// It reads other plugin netconf, and then invoke them, e.g.
+// flannel or sriov plugin. The commands are sent to the server of
+// multus-daemon if it runs one, see package server.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	cniversion "github.com/containernetworking/cni/pkg/version"
+	"github.com/intel/multus-cni/cniplugin"
+	"github.com/intel/multus-cni/logging"
+	"github.com/intel/multus-cni/server"
+)
+
+var version = "master@git"
+var commit = "unknown commit"
+var date = "unknown date"
+
+func printVersionString() string {
+	return fmt.Sprintf("multus-cni version:%s, commit:%s, date:%s",
+		version, commit, date)
+}
+
+// forward sends the command to the server, ok is false if there is none
+func forward(command string, args *skel.CmdArgs) (out []byte, ok bool, err error) {
+	out, err = server.Do(server.SocketPath(args.StdinData), command, args)
+	if err == server.ErrUnavailable {
+		logging.Debugf("%s: %v, run it in process", command, err)
+		return nil, false, nil
+	}
+	return out, true, err
+}
+
+func main() {
+
+	// Init command line flags to clear vendored packages' one, especially in init()
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+
+	// add version flag
+	versionOpt := false
+	flag.BoolVar(&versionOpt, "version", false, "Show application version")
+	flag.BoolVar(&versionOpt, "v", false, "Show application version")
+	flag.Parse()
+	if versionOpt == true {
+		fmt.Printf("%s\n", printVersionString())
+		return
+	}
+
+	skel.PluginMain(
+		func(args *skel.CmdArgs) error {
+			if out, ok, err := forward("ADD", args); ok {
+				if err != nil {
+					return err
+				}
+				_, err = os.Stdout.Write(out)
+				return err
+			}
+			result, err := cniplugin.CmdAdd(args, nil, nil)
+			if err != nil {
+				return err
+			}
+			return result.Print()
+		},
+		func(args *skel.CmdArgs) error {
+			if _, ok, err := forward("CHECK", args); ok {
+				return err
+			}
+			return cniplugin.CmdCheck(args, nil, nil)
+		},
+		func(args *skel.CmdArgs) error {
+			if _, ok, err := forward("DEL", args); ok {
+				return err
+			}
+			return cniplugin.CmdDel(args, nil, nil)
+		},
+		cniversion.All, "meta-plugin that delegates to other CNI plugins")
+}
@@ -0,0 +1,311 @@
+// multusctl inspects and repairs the IPAM and VXLAN state multus keeps in
+// etcd. It uses the etcd config of the node, see ETCD_CFG_DIR, ETCD_ROOT_DIR
+// and HOSTNAME.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/intel/multus-cni/etcdv3"
+	"github.com/intel/multus-cni/multus-ipam/backend/allocator"
+	ipamEtcd "github.com/intel/multus-cni/multus-ipam/backend/etcdv3cli"
+	vxEtcd "github.com/intel/multus-cni/multus-vxlan/backend/etcdv3cli"
+)
+
+type command struct {
+	usage string
+	run   func(em *etcdv3.EtcdMultus, args []string) error
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"blocks":  {"blocks [-network NET] [-node NODE]: list the blocks leased to the nodes", cmdBlocks},
+		"release": {"release -network NET START: give the block starting at START back to the pool", cmdRelease},
+		"move":    {"move -network NET [-force] START NODE: lease the block starting at START to NODE", cmdMove},
+		"fixips":  {"fixips [-network NET] [-namespace NS] [-pod POD]: list the fixed ips bound to pods", cmdFixIPs},
+		"vteps":   {"vteps [-vxlan VXLAN] [-node NODE]: list the vxlan endpoints", cmdVteps},
+		"delvtep": {"delvtep -vxlan VXLAN (SRC | -node NODE): delete stale vxlan endpoints", cmdDelVtep},
+		"diff":    {"diff [-network NET]: compare the blocks cached on this node with etcd", cmdDiff},
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: multusctl COMMAND [options]\n\ncommands:\n")
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	em, err := etcdv3.New()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "connect to etcd failed, %v\n", err)
+		os.Exit(1)
+	}
+	defer em.Close()
+	if err := cmd.run(em, os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s failed, %v\n", os.Args[1], err)
+		em.Close()
+		os.Exit(1)
+	}
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: multusctl %s\n", commands[name].usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func newTabWriter() *tabwriter.Writer {
+	return tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+}
+
+func formatRange(r *allocator.SimpleRange) string {
+	return fmt.Sprintf("%v-%v", r.RangeStart, r.RangeEnd)
+}
+
+func parseStart(fs *flag.FlagSet, network string, n int) (net.IP, error) {
+	if network == "" || fs.NArg() != n {
+		fs.Usage()
+		return nil, fmt.Errorf("a network and %d arguments are required", n)
+	}
+	start := net.ParseIP(fs.Arg(0))
+	if start == nil {
+		return nil, fmt.Errorf("invalid start %q", fs.Arg(0))
+	}
+	return start, nil
+}
+
+func cmdBlocks(em *etcdv3.EtcdMultus, args []string) error {
+	fs := newFlagSet("blocks")
+	network := fs.String("network", "", "network, all if empty")
+	node := fs.String("node", "", "node, all if empty")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	leases, err := ipamEtcd.IPAMListLeases(em, *network)
+	if err != nil {
+		return err
+	}
+	w := newTabWriter()
+	fmt.Fprintln(w, "NETWORK\tNODE\tRANGE\tSIZE\tREVISION")
+	for _, l := range leases {
+		if *node != "" && l.Node != *node {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\n", l.Network, l.Node, formatRange(&l.Range), 1<<l.Range.HostSize(), l.Revision)
+	}
+	return w.Flush()
+}
+
+func cmdRelease(em *etcdv3.EtcdMultus, args []string) error {
+	fs := newFlagSet("release")
+	network := fs.String("network", "", "network of the block")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	start, err := parseStart(fs, *network, 1)
+	if err != nil {
+		return err
+	}
+	l, err := ipamEtcd.IPAMReleaseLease(em, *network, start)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("released %s of %s, leased to %s\n", formatRange(&l.Range), l.Network, l.Node)
+	return nil
+}
+
+func cmdMove(em *etcdv3.EtcdMultus, args []string) error {
+	fs := newFlagSet("move")
+	network := fs.String("network", "", "network of the block")
+	force := fs.Bool("force", false, "move a block leased to another node than this one, whose reservations can not be checked")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	start, err := parseStart(fs, *network, 2)
+	if err != nil {
+		return err
+	}
+	leases, err := ipamEtcd.IPAMListLeases(em, *network)
+	if err != nil {
+		return err
+	}
+	var l *ipamEtcd.Lease
+	for i := range leases {
+		if leases[i].Range.RangeStart.Equal(start) {
+			l = &leases[i]
+			break
+		}
+	}
+	if l == nil {
+		return fmt.Errorf("no block of %s starts at %v", *network, start)
+	}
+
+	// the ips the old node reserved in the block would be handed out twice
+	if l.Node == em.Id {
+		rs, err := ipamEtcd.IPAMBlockReservations(*network, os.Getenv("NET_DATA_DIR"), &l.Range)
+		if err != nil {
+			return err
+		}
+		if len(rs) > 0 {
+			ips := []string{}
+			for _, r := range rs {
+				ips = append(ips, fmt.Sprintf("%v(%s)", r.IP, r.ID))
+			}
+			return fmt.Errorf("%d ips of %s are reserved on this node: %s", len(rs), formatRange(&l.Range), strings.Join(ips, " "))
+		}
+	} else {
+		if !*force {
+			return fmt.Errorf("%s is leased to %s, run move on %s or make sure no ip of the block is reserved there and use -force",
+				formatRange(&l.Range), l.Node, l.Node)
+		}
+		fmt.Fprintf(os.Stderr, "warning: the ips %s still reserves in %s are handed out again by %s\n", l.Node, formatRange(&l.Range), fs.Arg(1))
+	}
+
+	l, err = ipamEtcd.IPAMMoveLease(em, *network, start, fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("moved %s of %s from %s to %s\n", formatRange(&l.Range), l.Network, l.Node, fs.Arg(1))
+	return nil
+}
+
+func cmdFixIPs(em *etcdv3.EtcdMultus, args []string) error {
+	fs := newFlagSet("fixips")
+	network := fs.String("network", "", "network, all if empty")
+	namespace := fs.String("namespace", "", "namespace of the pods, all if empty")
+	pod := fs.String("pod", "", "pod, all if empty")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	bindings, err := ipamEtcd.IPAMListFixBindings(em, *network)
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(bindings, func(i, j int) bool {
+		bi, bj := bindings[i], bindings[j]
+		if bi.Namespace+"/"+bi.Pod != bj.Namespace+"/"+bj.Pod {
+			return bi.Namespace+"/"+bi.Pod < bj.Namespace+"/"+bj.Pod
+		}
+		return bi.Index < bj.Index
+	})
+	w := newTabWriter()
+	fmt.Fprintln(w, "NAMESPACE\tPOD\tINDEX\tNETWORK\tIP")
+	for _, b := range bindings {
+		if (*namespace != "" && b.Namespace != *namespace) || (*pod != "" && b.Pod != *pod) {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%v\n", b.Namespace, b.Pod, b.Index, b.Network, b.IP)
+	}
+	return w.Flush()
+}
+
+func cmdVteps(em *etcdv3.EtcdMultus, args []string) error {
+	fs := newFlagSet("vteps")
+	vxlan := fs.String("vxlan", "", "vxlan device, all if empty")
+	node := fs.String("node", "", "node, all if empty")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	vteps, err := vxEtcd.ListVteps(em, *vxlan)
+	if err != nil {
+		return err
+	}
+	w := newTabWriter()
+	fmt.Fprintln(w, "VXLAN\tSOURCE\tNODE")
+	for _, v := range vteps {
+		if *node != "" && v.Node != *node {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", v.Vxlan, v.Src, v.Node)
+	}
+	return w.Flush()
+}
+
+func cmdDelVtep(em *etcdv3.EtcdMultus, args []string) error {
+	fs := newFlagSet("delvtep")
+	vxlan := fs.String("vxlan", "", "vxlan device")
+	node := fs.String("node", "", "delete all the endpoints of the node")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *vxlan == "" || (fs.NArg() == 0) == (*node == "") {
+		fs.Usage()
+		return fmt.Errorf("a vxlan and either a source or a node are required")
+	}
+	deleted, err := vxEtcd.DelVteps(em, *vxlan, fs.Arg(0), *node)
+	for _, v := range deleted {
+		fmt.Printf("deleted %s %s of %s\n", v.Vxlan, v.Src, v.Node)
+	}
+	if err == nil && len(deleted) == 0 {
+		return fmt.Errorf("no such endpoint")
+	}
+	return err
+}
+
+func formatRanges(srs []allocator.SimpleRange) string {
+	s := []string{}
+	for i := range srs {
+		s = append(s, formatRange(&srs[i]))
+	}
+	return strings.Join(s, " ")
+}
+
+func cmdDiff(em *etcdv3.EtcdMultus, args []string) error {
+	fs := newFlagSet("diff")
+	network := fs.String("network", "", "network, all if empty")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	diffs, err := ipamEtcd.IPAMDiffEtcd(em, *network)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("node %s\n", em.Id)
+	for _, d := range diffs {
+		if d.Empty() {
+			fmt.Printf("%s: in sync\n", d.Network)
+			continue
+		}
+		fmt.Printf("%s:\n", d.Network)
+		if len(d.LocalOnly) > 0 {
+			fmt.Printf("  cached only:  %s\n", formatRanges(d.LocalOnly))
+		}
+		if len(d.EtcdOnly) > 0 {
+			fmt.Printf("  leased only:  %s\n", formatRanges(d.EtcdOnly))
+		}
+		if len(d.Conflicts) > 0 {
+			fmt.Printf("  conflicting:  %s\n", formatRanges(d.Conflicts))
+		}
+		for _, o := range d.Orphans {
+			fmt.Printf("  orphan:       %v reserved by %s\n", o.IP, o.ID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+// Package sandbox keeps the sandbox multus set up for every pod of the node,
+// so that the networks of the pod can be changed while it runs
+package sandbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/intel/multus-cni/disk"
+	"github.com/intel/multus-cni/logging"
+)
+
+// podsDir is the directory of the sandboxes in the multus data directory,
+// next to the delegates cached by container ID
+const podsDir = "pods"
+
+// Sandbox is what multus is given on ADD for a pod, the delegates of the pod
+// are cached by ContainerID in the same data directory
+type Sandbox struct {
+	ContainerID string `json:"containerID"`
+	NetNS       string `json:"netns"`
+	IfName      string `json:"ifName"`
+	// Args are the CNI_ARGS of the pod
+	Args string `json:"args"`
+	// NetConf is the multus config the sandbox was set up with
+	NetConf json.RawMessage `json:"netconf"`
+}
+
+func path(dataDir, namespace, name string) string {
+	return filepath.Join(dataDir, podsDir, namespace+"_"+name)
+}
+
+// Save records s as the sandbox of the pod namespace/name
+func Save(dataDir, namespace, name string, s *Sandbox) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return logging.Errorf("failed to marshal the sandbox of %s/%s: %v", namespace, name, err)
+	}
+	p := path(dataDir, namespace, name)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return logging.Errorf("failed to create the sandbox directory(%q): %v", filepath.Dir(p), err)
+	}
+	// the sandbox may be read while it is written
+	tmp := p + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return logging.Errorf("failed to write the sandbox in the path(%q): %v", tmp, err)
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		os.Remove(tmp)
+		return logging.Errorf("failed to write the sandbox in the path(%q): %v", p, err)
+	}
+	return nil
+}
+
+// Load returns the sandbox of the pod namespace/name, nil if there is none
+func Load(dataDir, namespace, name string) (*Sandbox, error) {
+	data, err := ioutil.ReadFile(path(dataDir, namespace, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	s := &Sandbox{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("failed to load the sandbox of %s/%s: %v", namespace, name, err)
+	}
+	return s, nil
+}
+
+// Remove removes the sandbox of the pod namespace/name if it is the one of
+// containerID, the next sandbox of the pod may have been set up already
+func Remove(dataDir, namespace, name, containerID string) error {
+	s, err := Load(dataDir, namespace, name)
+	if err != nil || s == nil || s.ContainerID != containerID {
+		return err
+	}
+	if err := os.Remove(path(dataDir, namespace, name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Lock locks the sandboxes of dataDir, the delegates of a sandbox are not
+// changed by two processes at once
+func Lock(dataDir string) (*disk.FileLock, error) {
+	dir := filepath.Join(dataDir, podsDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	lk, err := disk.NewFileLock(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := lk.Lock(); err != nil {
+		lk.Close()
+		return nil, err
+	}
+	return lk, nil
+}
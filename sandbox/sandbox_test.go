@@ -0,0 +1,63 @@
+package sandbox
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Sandbox", func() {
+	var dataDir string
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "multus_sandbox")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dataDir)
+	})
+
+	It("saves and loads the sandbox of a pod", func() {
+		s, err := Load(dataDir, "test", "testpod")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s).To(BeNil())
+
+		saved := &Sandbox{
+			ContainerID: "123456789",
+			NetNS:       "/var/run/netns/test",
+			IfName:      "eth0",
+			Args:        "K8S_POD_NAMESPACE=test;K8S_POD_NAME=testpod",
+			NetConf:     json.RawMessage(`{"name":"node-cni-network","type":"multus"}`),
+		}
+		Expect(Save(dataDir, "test", "testpod", saved)).To(Succeed())
+		s, err = Load(dataDir, "test", "testpod")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s).To(Equal(saved))
+	})
+
+	It("removes the sandbox of a pod only for its container", func() {
+		Expect(Save(dataDir, "test", "testpod", &Sandbox{ContainerID: "new"})).To(Succeed())
+
+		Expect(Remove(dataDir, "test", "testpod", "old")).To(Succeed())
+		s, err := Load(dataDir, "test", "testpod")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s.ContainerID).To(Equal("new"))
+
+		Expect(Remove(dataDir, "test", "testpod", "new")).To(Succeed())
+		s, err = Load(dataDir, "test", "testpod")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s).To(BeNil())
+		Expect(Remove(dataDir, "test", "testpod", "new")).To(Succeed())
+	})
+
+	It("locks the sandboxes", func() {
+		lk, err := Lock(dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lk.Close()).To(Succeed())
+	})
+})
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	"golang.org/x/net/context"
+)
+
+// ErrUnavailable is returned when no server listens on the socket, the
+// command was not sent and is run by the multus binary
+var ErrUnavailable = errors.New("multus server is unavailable")
+
+// RequestTimeout is how long the multus binary waits for the answer of the
+// server, just under the 2 minutes kubelet gives a runtime request so that
+// the binary fails the command before the runtime gives up on it
+const RequestTimeout = 110 * time.Second
+
+// SocketPath returns the socket of the server for the multus config netconf
+func SocketPath(netconf []byte) string {
+	conf := struct {
+		SocketPath string `json:"socketPath"`
+	}{}
+	if err := json.Unmarshal(netconf, &conf); err != nil || conf.SocketPath == "" {
+		return DefaultSocketPath
+	}
+	return conf.SocketPath
+}
+
+// Do sends command with args to the server on socketPath and returns what
+// it prints. Once the command is sent, it is not run again by the multus
+// binary whatever happens to the server, the container runtime retries it.
+func Do(socketPath, command string, args *skel.CmdArgs) ([]byte, error) {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return nil, ErrUnavailable
+	}
+	if err := conn.SetDeadline(time.Now().Add(RequestTimeout)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("multus server: %v", err)
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			// the connection is used for this request only
+			DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+				return conn, nil
+			},
+			DisableKeepAlives: true,
+		},
+		Timeout: RequestTimeout,
+	}
+
+	body, err := json.Marshal(&Request{
+		Command:     command,
+		ContainerID: args.ContainerID,
+		Netns:       args.Netns,
+		IfName:      args.IfName,
+		Args:        args.Args,
+		Path:        args.Path,
+		StdinData:   args.StdinData,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp, err := client.Post("http://multus/cni", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("multus server: %v", err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("multus server: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		e := &cnitypes.Error{}
+		if err := json.Unmarshal(data, e); err != nil {
+			return nil, fmt.Errorf("multus server: %s: %s", resp.Status, string(bytes.TrimSpace(data)))
+		}
+		return nil, e
+	}
+	return data, nil
+}
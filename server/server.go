@@ -0,0 +1,162 @@
+// Package server runs the CNI commands of the multus binary in multus-daemon.
+// The multus binary sends them on a unix socket, so that they are run with
+// the clients the daemon keeps, and runs them itself if no server listens.
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/containernetworking/cni/pkg/skel"
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	"github.com/intel/multus-cni/cniplugin"
+	k8s "github.com/intel/multus-cni/k8sclient"
+	"github.com/intel/multus-cni/logging"
+	"golang.org/x/net/context"
+)
+
+// DefaultSocketPath is the socket of the server on the node, unless the
+// multus config sets socketPath. The daemon has to mount its directory of
+// the host at the same path, see daemonset.server of the chart.
+const DefaultSocketPath = "/run/multus/multus.sock"
+
+// Request is a CNI command of the multus binary, with what it was given by
+// the container runtime
+type Request struct {
+	Command     string `json:"command"`
+	ContainerID string `json:"containerID"`
+	Netns       string `json:"netns"`
+	IfName      string `json:"ifName"`
+	Args        string `json:"args"`
+	Path        string `json:"path"`
+	StdinData   []byte `json:"stdinData"`
+}
+
+func (r *Request) cmdArgs() *skel.CmdArgs {
+	return &skel.CmdArgs{
+		ContainerID: r.ContainerID,
+		Netns:       r.Netns,
+		IfName:      r.IfName,
+		Args:        r.Args,
+		Path:        r.Path,
+		StdinData:   r.StdinData,
+	}
+}
+
+// Server runs the requests of the multus binary
+type Server struct {
+	kubeClient k8s.KubeClient
+	exec       invoke.Exec
+}
+
+// NewServer returns a server running the requests with kubeClient, the
+// requests of the configs without kubeconfig are run without it
+func NewServer(kubeClient k8s.KubeClient) *Server {
+	return &Server{kubeClient: kubeClient}
+}
+
+// errorBody returns err as the CNI error the multus binary prints, with the
+// code of skel for the errors which are not
+func errorBody(err error) []byte {
+	e, ok := err.(*cnitypes.Error)
+	if !ok {
+		e = &cnitypes.Error{Code: 100, Msg: err.Error()}
+	}
+	data, _ := json.Marshal(e)
+	return data
+}
+
+// run runs the command of r and returns what the multus binary prints
+func (s *Server) run(r *Request) ([]byte, error) {
+	conf := struct {
+		Kubeconfig string `json:"kubeconfig"`
+	}{}
+	if err := json.Unmarshal(r.StdinData, &conf); err != nil {
+		return nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+	// the pods are not looked up without kubeconfig, as in the multus binary
+	var kubeClient k8s.KubeClient
+	if conf.Kubeconfig != "" {
+		kubeClient = s.kubeClient
+	}
+
+	args := r.cmdArgs()
+	switch r.Command {
+	case "ADD":
+		result, err := cniplugin.CmdAdd(args, s.exec, kubeClient)
+		if err != nil {
+			return nil, err
+		}
+		buf := &bytes.Buffer{}
+		if err := result.PrintTo(buf); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case "CHECK":
+		return nil, cniplugin.CmdCheck(args, s.exec, kubeClient)
+	case "DEL":
+		return nil, cniplugin.CmdDel(args, s.exec, kubeClient)
+	}
+	return nil, fmt.Errorf("unknown CNI_COMMAND: %v", r.Command)
+}
+
+// ServeHTTP runs the request posted and writes what the multus binary
+// prints, the CNI error with the status 500 if it failed
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r := &Request{}
+	if err := json.NewDecoder(req.Body).Decode(r); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	logging.Debugf("server: %s %s %s", r.Command, r.ContainerID, r.Args)
+	data, err := s.run(r)
+	if err != nil {
+		logging.Errorf("server: %s of %s failed: %v", r.Command, r.ContainerID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(errorBody(err))
+		return
+	}
+	w.Write(data)
+}
+
+// Serve serves the requests on socketPath until ctx is done
+func (s *Server) Serve(ctx context.Context, socketPath string) error {
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0700); err != nil {
+		return err
+	}
+	// the socket of the server which ran before
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		l.Close()
+		return err
+	}
+
+	srv := &http.Server{Handler: s}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	logging.Verbosef("server listens on %v", socketPath)
+	err = srv.Serve(l)
+	os.Remove(socketPath)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/version"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+// fakeExec records the plugins run as "COMMAND CNI_PATH network"
+type fakeExec struct {
+	version.PluginDecoder
+
+	calls []string
+}
+
+func getEnv(environ []string, key string) string {
+	for _, env := range environ {
+		if strings.HasPrefix(env, key+"=") {
+			return strings.TrimPrefix(env, key+"=")
+		}
+	}
+	return ""
+}
+
+func (e *fakeExec) ExecPlugin(ctx context.Context, pluginPath string, stdinData []byte, environ []string) ([]byte, error) {
+	conf := struct {
+		Name string `json:"name"`
+	}{}
+	Expect(json.Unmarshal(stdinData, &conf)).To(Succeed())
+	e.calls = append(e.calls, fmt.Sprintf("%s %s %s", getEnv(environ, "CNI_COMMAND"), getEnv(environ, "CNI_PATH"), conf.Name))
+	return nil, nil
+}
+
+func (e *fakeExec) FindInPath(plugin string, paths []string) (string, error) {
+	Expect(len(paths)).To(BeNumerically(">", 0))
+	return filepath.Join(paths[0], plugin), nil
+}
+
+var _ = Describe("Server", func() {
+	var (
+		tmpDir     string
+		socketPath string
+		exec       *fakeExec
+		cancel     context.CancelFunc
+		done       chan error
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "multus_server")
+		Expect(err).NotTo(HaveOccurred())
+		socketPath = filepath.Join(tmpDir, "run", "multus.sock")
+
+		exec = &fakeExec{}
+		s := NewServer(nil)
+		s.exec = exec
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		done = make(chan error, 1)
+		go func() {
+			done <- s.Serve(ctx, socketPath)
+		}()
+		Eventually(func() error {
+			_, err := os.Stat(socketPath)
+			return err
+		}).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		cancel()
+		Eventually(done).Should(Receive(BeNil()))
+		_, err := os.Stat(socketPath)
+		Expect(os.IsNotExist(err)).To(BeTrue())
+		Expect(os.RemoveAll(tmpDir)).To(Succeed())
+	})
+
+	It("runs the commands sent on the socket", func() {
+		args := &skel.CmdArgs{
+			ContainerID: "123456789",
+			Netns:       "/var/run/netns/multus-server-test",
+			IfName:      "eth0",
+			Path:        "/some/path",
+			StdinData: []byte(fmt.Sprintf(`{
+	    "name": "node-cni-network",
+	    "type": "multus",
+	    "cniDir": %q,
+	    "delegates": [{
+	        "name": "weave1",
+	        "cniVersion": "0.3.1",
+	        "type": "weave-net"
+	    }]
+	}`, tmpDir)),
+		}
+		out, err := Do(socketPath, "DEL", args)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(out).To(BeEmpty())
+		Expect(exec.calls).To(Equal([]string{"DEL /some/path weave1"}))
+	})
+
+	It("returns the CNI error of the commands", func() {
+		args := &skel.CmdArgs{
+			ContainerID: "123456789",
+			Netns:       "/var/run/netns/multus-server-test",
+			IfName:      "eth0",
+			StdinData:   []byte(`{"name": "node-cni-network", "type": "multus"}`),
+		}
+		_, err := Do(socketPath, "ADD", args)
+		Expect(err).To(HaveOccurred())
+		e, ok := err.(*cnitypes.Error)
+		Expect(ok).To(BeTrue())
+		Expect(e.Code).To(Equal(uint(100)))
+		Expect(e.Msg).To(ContainSubstring("at least one delegate"))
+		Expect(exec.calls).To(BeEmpty())
+	})
+
+	It("is unavailable without socket", func() {
+		_, err := Do(filepath.Join(tmpDir, "none.sock"), "ADD", &skel.CmdArgs{})
+		Expect(err).To(Equal(ErrUnavailable))
+	})
+
+	It("finds the socket in the multus config", func() {
+		Expect(SocketPath([]byte(`{"name": "node-cni-network"}`))).To(Equal(DefaultSocketPath))
+		Expect(SocketPath([]byte(`{"socketPath": "/run/test.sock"}`))).To(Equal("/run/test.sock"))
+	})
+})
@@ -17,6 +17,9 @@ package types
 
 import (
 	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
 
 	"github.com/containernetworking/cni/libcni"
 	"github.com/containernetworking/cni/pkg/skel"
@@ -32,6 +35,7 @@ const (
 	defaultBinDir                 = "/opt/cni/bin"
 	defaultReadinessIndicatorFile = ""
 	defaultMultusNamespace        = "kube-system"
+	defaultMaxParallelDelegates   = 4
 )
 
 // LoadDelegateNetConfList reads DelegateNetConf from bytes
@@ -83,7 +87,18 @@ func LoadDelegateNetConf(bytes []byte, net *NetworkSelectionElement, deviceID st
 		}
 	}
 
+	if net != nil && (net.FixedIP || net.IPCount > 0 || net.IPPool != "") {
+		bytes, err = addIPAMArgs(bytes, net)
+		if err != nil {
+			return nil, logging.Errorf("LoadDelegateNetConf(): failed to add ipam args of %v: %v", net.Name, err)
+		}
+		delegateConf.FixedIP = net.FixedIP
+		delegateConf.IPCount = net.IPCount
+		delegateConf.IPPool = net.IPPool
+	}
+
 	if net != nil {
+		delegateConf.Network = net
 		if net.InterfaceRequest != "" {
 			delegateConf.IfnameRequest = net.InterfaceRequest
 		}
@@ -100,9 +115,32 @@ func LoadDelegateNetConf(bytes []byte, net *NetworkSelectionElement, deviceID st
 	return delegateConf, nil
 }
 
-// CreateCNIRuntimeConf create CNI RuntimeConf
-func CreateCNIRuntimeConf(args *skel.CmdArgs, k8sArgs *K8sArgs, ifName string, rc *RuntimeConfig) *libcni.RuntimeConf {
-	logging.Debugf("LoadCNIRuntimeConf: %v, %v, %s, %v", args, k8sArgs, ifName, rc)
+// CheckRequests checks the MAC and the IP or CIDR requested for a network
+// attachment
+func CheckRequests(macRequest, ipRequest string) error {
+	if macRequest != "" {
+		if _, err := net.ParseMAC(macRequest); err != nil {
+			return fmt.Errorf("failed to parse mac address %q", macRequest)
+		}
+	}
+
+	if ipRequest != "" {
+		if strings.Contains(ipRequest, "/") {
+			if _, _, err := net.ParseCIDR(ipRequest); err != nil {
+				return fmt.Errorf("failed to parse CIDR %q", ipRequest)
+			}
+		} else if net.ParseIP(ipRequest) == nil {
+			return fmt.Errorf("failed to parse IP address %q", ipRequest)
+		}
+	}
+	return nil
+}
+
+// CreateCNIRuntimeConf create CNI RuntimeConf of delegate. Its args are the
+// CNI_ARGS of the pod, the MAC and IP requested for the delegate are added to
+// its args only.
+func CreateCNIRuntimeConf(args *skel.CmdArgs, k8sArgs *K8sArgs, ifName string, rc *RuntimeConfig, delegate *DelegateNetConf) *libcni.RuntimeConf {
+	logging.Debugf("LoadCNIRuntimeConf: %v, %v, %s, %v, %v", args, k8sArgs, ifName, rc, delegate)
 
 	// In part, adapted from K8s pkg/kubelet/dockershim/network/cni/cni.go#buildCNIRuntimeConf
 	// Todo
@@ -111,12 +149,16 @@ func CreateCNIRuntimeConf(args *skel.CmdArgs, k8sArgs *K8sArgs, ifName string, r
 		ContainerID: args.ContainerID,
 		NetNS:       args.Netns,
 		IfName:      ifName,
-		Args: [][2]string{
-			{"IgnoreUnknown", "1"},
-			{"K8S_POD_NAMESPACE", string(k8sArgs.K8S_POD_NAMESPACE)},
-			{"K8S_POD_NAME", string(k8sArgs.K8S_POD_NAME)},
-			{"K8S_POD_INFRA_CONTAINER_ID", string(k8sArgs.K8S_POD_INFRA_CONTAINER_ID)},
-		},
+		Args:        podArgs(args.Args, k8sArgs),
+	}
+
+	if delegate != nil {
+		if delegate.MacRequest != "" {
+			rt.Args = append(rt.Args, [2]string{"MAC", delegate.MacRequest})
+		}
+		if delegate.IPRequest != "" {
+			rt.Args = append(rt.Args, [2]string{"IP", delegate.IPRequest})
+		}
 	}
 
 	if rc != nil {
@@ -127,6 +169,30 @@ func CreateCNIRuntimeConf(args *skel.CmdArgs, k8sArgs *K8sArgs, ifName string, r
 	return rt
 }
 
+// podArgs returns the pairs of k8sArgs followed by the other pairs of
+// cniArgs, e.g. K8S_POD_UID. The MAC and IP are left out, they are requested
+// per delegate.
+func podArgs(cniArgs string, k8sArgs *K8sArgs) [][2]string {
+	pairs := [][2]string{
+		{"IgnoreUnknown", "1"},
+		{"K8S_POD_NAMESPACE", string(k8sArgs.K8S_POD_NAMESPACE)},
+		{"K8S_POD_NAME", string(k8sArgs.K8S_POD_NAME)},
+		{"K8S_POD_INFRA_CONTAINER_ID", string(k8sArgs.K8S_POD_INFRA_CONTAINER_ID)},
+	}
+	skip := map[string]bool{"MAC": true, "IP": true}
+	for _, kv := range pairs {
+		skip[kv[0]] = true
+	}
+	for _, item := range strings.Split(cniArgs, ";") {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || skip[kv[0]] {
+			continue
+		}
+		pairs = append(pairs, [2]string{kv[0], kv[1]})
+	}
+	return pairs
+}
+
 // LoadNetworkStatus create network status from CNI result
 func LoadNetworkStatus(r types.Result, netName string, defaultNet bool) (*NetworkStatus, error) {
 	logging.Debugf("LoadNetworkStatus: %v, %s, %t", r, netName, defaultNet)
@@ -156,14 +222,91 @@ func LoadNetworkStatus(r types.Result, netName string, defaultNet bool) (*Networ
 		if ipconfig.Version == "6" && ipconfig.Address.IP.To16() != nil {
 			netstatus.IPs = append(netstatus.IPs, ipconfig.Address.IP.String())
 		}
+
+		if ipconfig.Gateway != nil {
+			netstatus.Gateway = append(netstatus.Gateway, ipconfig.Gateway.String())
+		}
 	}
 
+	netstatus.Routes = result.Routes
 	netstatus.DNS = result.DNS
 
 	return netstatus, nil
 
 }
 
+// LoadCachedDelegates converts the delegates multus cached on ADD, the first
+// one is the master plugin
+func LoadCachedDelegates(bytes []byte) ([]*DelegateNetConf, error) {
+	var delegates []*DelegateNetConf
+	if err := json.Unmarshal(bytes, &delegates); err != nil {
+		return nil, logging.Errorf("failed to load netconf: %v", err)
+	}
+	if len(delegates) == 0 {
+		return nil, logging.Errorf("no delegate cached")
+	}
+	// check plugins field and enable ConfListPlugin if there is
+	for _, v := range delegates {
+		if len(v.ConfList.Plugins) != 0 {
+			v.ConfListPlugin = true
+		}
+	}
+	delegates[0].MasterPlugin = true
+	return delegates, nil
+}
+
+// LoadDelegateResult returns the result of delegate cached on ADD, in its own
+// version
+func LoadDelegateResult(delegate *DelegateNetConf) (types.Result, error) {
+	if len(delegate.Result) == 0 {
+		return nil, fmt.Errorf("no result cached on ADD")
+	}
+	decoder := version.ConfigDecoder{}
+	resultVersion, err := decoder.Decode(delegate.Result)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode the cached result: %v", err)
+	}
+	return version.NewResult(resultVersion, delegate.Result)
+}
+
+// pluginDeviceInfo is the device of a plugin config: the device ID injected
+// from the ResourceInfo of the pod and the VNI of multus-vxlan
+type pluginDeviceInfo struct {
+	DeviceID string `json:"deviceID"`
+	Vxlan    struct {
+		VxlanID int `json:"vxlanId"`
+	} `json:"vxlan"`
+}
+
+// LoadDelegateNetworkStatus create network status of delegate from its CNI
+// result, with the fixed IP, VNI and device ID of delegate
+func LoadDelegateNetworkStatus(r types.Result, delegate *DelegateNetConf) (*NetworkStatus, error) {
+	netstatus, err := LoadNetworkStatus(r, delegate.Conf.Name, delegate.MasterPlugin)
+	if err != nil {
+		return netstatus, err
+	}
+	netstatus.FixedIP = delegate.FixedIP
+
+	var conf struct {
+		pluginDeviceInfo
+		Plugins []pluginDeviceInfo `json:"plugins"`
+	}
+	if err := json.Unmarshal(delegate.Bytes, &conf); err != nil {
+		return netstatus, logging.Errorf("error in LoadDelegateNetworkStatus - unmarshalling delegate config: %v", err)
+	}
+	// the first plugin of a conflist has the device ID
+	for _, p := range append([]pluginDeviceInfo{conf.pluginDeviceInfo}, conf.Plugins...) {
+		if netstatus.DeviceID == "" {
+			netstatus.DeviceID = p.DeviceID
+		}
+		if netstatus.VNI == 0 {
+			netstatus.VNI = p.Vxlan.VxlanID
+		}
+	}
+
+	return netstatus, nil
+}
+
 // LoadNetConf converts inputs (i.e. stdin) to NetConf
 func LoadNetConf(bytes []byte) (*NetConf, error) {
 	netconf := &NetConf{}
@@ -206,7 +349,8 @@ func LoadNetConf(bytes []byte) (*NetConf, error) {
 	// delegates are executed in-order.  If a kubeconfig is present,
 	// at least one delegate must be present and the first delegate is
 	// the master plugin. Kubernetes CRD delegates are then appended to
-	// the existing delegate list and all delegates executed in-order.
+	// the existing delegate list. The master plugin is executed first, the
+	// other delegates are then executed in parallel.
 
 	if len(netconf.RawDelegates) == 0 && netconf.ClusterNetwork == "" {
 		return nil, logging.Errorf("at least one delegate/defaultNetwork must be specified")
@@ -236,6 +380,10 @@ func LoadNetConf(bytes []byte) (*NetConf, error) {
 		netconf.MultusNamespace = defaultMultusNamespace
 	}
 
+	if netconf.MaxParallelDelegates <= 0 {
+		netconf.MaxParallelDelegates = defaultMaxParallelDelegates
+	}
+
 	// get RawDelegates and put delegates field
 	if netconf.ClusterNetwork == "" {
 		// for Delegates
@@ -325,6 +473,69 @@ func addDeviceIDInConfList(inBytes []byte, deviceID string) ([]byte, error) {
 	return configBytes, nil
 }
 
+// addIPAMArgs injects the ipam requests of net in the "cni" args of the
+// delegate bytes, in every plugin with an ipam of a conflist
+func addIPAMArgs(inBytes []byte, net *NetworkSelectionElement) ([]byte, error) {
+	var rawConfig map[string]interface{}
+
+	if err := json.Unmarshal(inBytes, &rawConfig); err != nil {
+		return nil, logging.Errorf("addIPAMArgs(): failed to unmarshal inBytes: %v", err)
+	}
+
+	plugins := []map[string]interface{}{rawConfig}
+	if pList, ok := rawConfig["plugins"]; ok {
+		pMap, ok := pList.([]interface{})
+		if !ok {
+			return nil, logging.Errorf("addIPAMArgs(): unable to typecast plugin list")
+		}
+		plugins = nil
+		for _, p := range pMap {
+			plugin, ok := p.(map[string]interface{})
+			if !ok {
+				return nil, logging.Errorf("addIPAMArgs(): unable to typecast pMap")
+			}
+			plugins = append(plugins, plugin)
+		}
+	}
+
+	found := false
+	for _, plugin := range plugins {
+		if _, ok := plugin["ipam"]; !ok {
+			continue
+		}
+		found = true
+		args, ok := plugin["args"].(map[string]interface{})
+		if !ok {
+			args = map[string]interface{}{}
+			plugin["args"] = args
+		}
+		cniArgs, ok := args["cni"].(map[string]interface{})
+		if !ok {
+			cniArgs = map[string]interface{}{}
+			args["cni"] = cniArgs
+		}
+		if net.FixedIP {
+			cniArgs["fixedIP"] = true
+		}
+		if net.IPCount > 0 {
+			cniArgs["ipCount"] = net.IPCount
+		}
+		if net.IPPool != "" {
+			cniArgs["ipPool"] = net.IPPool
+		}
+	}
+	if !found {
+		return nil, logging.Errorf("addIPAMArgs(): no plugin with an ipam to take fixedIP, ipCount or ipPool")
+	}
+
+	configBytes, err := json.Marshal(rawConfig)
+	if err != nil {
+		return nil, logging.Errorf("addIPAMArgs(): failed to re-marshal: %v", err)
+	}
+	logging.Debugf("addIPAMArgs(): updated configBytes %s", string(configBytes))
+	return configBytes, nil
+}
+
 // CheckSystemNamespaces checks whether given namespace is in systemNamespaces or not.
 func CheckSystemNamespaces(namespace string, systemNamespaces []string) bool {
 	for _, nsname := range systemNamespaces {
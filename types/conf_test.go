@@ -20,10 +20,13 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/containernetworking/cni/pkg/skel"
+	cnitypes "github.com/containernetworking/cni/pkg/types"
 	types020 "github.com/containernetworking/cni/pkg/types/020"
+	"github.com/containernetworking/cni/pkg/types/current"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/containernetworking/plugins/pkg/testutils"
 	testhelpers "github.com/intel/multus-cni/testing"
@@ -261,6 +264,27 @@ var _ = Describe("config operations", func() {
 		Expect(netConf.ReadinessIndicatorFile).To(Equal("/etc/cni/net.d/foo"))
 	})
 
+	It("limits the delegates added in parallel", func() {
+		conf := `{
+    "name": "defaultnetwork",
+    "type": "multus",
+    "kubeconfig": "/etc/kubernetes/kubelet.conf",
+    "delegates": [{
+      "cniVersion": "0.3.0",
+      "name": "defaultnetwork",
+      "type": "flannel"
+    }]
+}`
+		netConf, err := LoadNetConf([]byte(conf))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(netConf.MaxParallelDelegates).To(Equal(4))
+
+		conf = strings.Replace(conf, `"type": "multus",`, `"type": "multus", "maxParallelDelegates": 1,`, 1)
+		netConf, err = LoadNetConf([]byte(conf))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(netConf.MaxParallelDelegates).To(Equal(1))
+	})
+
 	It("check CheckSystemNamespaces() works fine", func() {
 		b1 := CheckSystemNamespaces("foobar", []string{"barfoo", "bafoo", "foobar"})
 		Expect(b1).To(Equal(true))
@@ -313,6 +337,31 @@ var _ = Describe("config operations", func() {
 		Expect(sriovConfList.Plugins[0].DeviceID).To(Equal("0000:00:00.1"))
 	})
 
+	It("rejects ipam requests for a delegate without ipam", func() {
+		conf := `{
+    "name": "second-network",
+    "type": "sriov"
+}`
+		_, err := LoadDelegateNetConf([]byte(conf), &NetworkSelectionElement{Name: "second-network", IPCount: 2}, "")
+		Expect(err).To(HaveOccurred())
+
+		conf = `{
+    "name": "second-network",
+    "type": "sriov",
+    "args": {"cni": {"ips": ["10.1.2.3"]}},
+    "ipam": {"type": "multus-ipam"}
+}`
+		delegateNetConf, err := LoadDelegateNetConf([]byte(conf), &NetworkSelectionElement{Name: "second-network", IPCount: 2}, "")
+		Expect(err).NotTo(HaveOccurred())
+		args := &struct {
+			Args struct {
+				CNI map[string]interface{} `json:"cni"`
+			} `json:"args"`
+		}{}
+		Expect(json.Unmarshal(delegateNetConf.Bytes, args)).To(Succeed())
+		Expect(args.Args.CNI).To(Equal(map[string]interface{}{"ips": []interface{}{"10.1.2.3"}, "ipCount": float64(2)}))
+	})
+
 	It("assigns pciBusID in delegated conf", func() {
 		conf := `{
     "name": "second-network",
@@ -395,7 +444,7 @@ var _ = Describe("config operations", func() {
 		rc.PortMaps[1].Protocol = "anotherSampleProtocol"
 		rc.PortMaps[1].HostIP = "anotherSampleHostIP"
 
-		rt := CreateCNIRuntimeConf(args, k8sArgs, "", rc)
+		rt := CreateCNIRuntimeConf(args, k8sArgs, "", rc, nil)
 		fmt.Println("rt.ContainerID: ", rt.ContainerID)
 		Expect(rt.ContainerID).To(Equal("123456789"))
 		Expect(rt.NetNS).To(Equal(args.Netns))
@@ -403,6 +452,50 @@ var _ = Describe("config operations", func() {
 		Expect(rt.CapabilityArgs["portMappings"]).To(Equal(rc.PortMaps))
 	})
 
+	It("adds the MAC and IP requested for a delegate to its runtime conf only", func() {
+		args := &skel.CmdArgs{
+			ContainerID: "123456789",
+			Netns:       testNS.Path(),
+			IfName:      "eth0",
+		}
+		k8sArgs := &K8sArgs{K8S_POD_NAME: "dummy", K8S_POD_NAMESPACE: "namespacedummy", K8S_POD_INFRA_CONTAINER_ID: "123456789"}
+		podArgs := [][2]string{
+			{"IgnoreUnknown", "1"},
+			{"K8S_POD_NAMESPACE", "namespacedummy"},
+			{"K8S_POD_NAME", "dummy"},
+			{"K8S_POD_INFRA_CONTAINER_ID", "123456789"},
+		}
+
+		requested := &DelegateNetConf{MacRequest: "c2:11:22:33:44:66", IPRequest: "10.0.0.1/24"}
+		rt := CreateCNIRuntimeConf(args, k8sArgs, "net1", nil, requested)
+		Expect(rt.IfName).To(Equal("net1"))
+		Expect(rt.Args).To(Equal(append(podArgs, [2]string{"MAC", "c2:11:22:33:44:66"}, [2]string{"IP", "10.0.0.1/24"})))
+
+		rt = CreateCNIRuntimeConf(args, k8sArgs, "net2", nil, &DelegateNetConf{})
+		Expect(rt.IfName).To(Equal("net2"))
+		Expect(rt.Args).To(Equal(podArgs))
+	})
+
+	It("keeps the CNI_ARGS of the pod", func() {
+		args := &skel.CmdArgs{
+			ContainerID: "123456789",
+			Netns:       testNS.Path(),
+			IfName:      "eth0",
+			Args:        "K8S_POD_UID=uid1;IgnoreUnknown=1;K8S_POD_NAMESPACE=namespacedummy;K8S_POD_NAME=dummy;K8S_POD_INFRA_CONTAINER_ID=123456789;MAC=c2:11:22:33:44:55",
+		}
+		k8sArgs := &K8sArgs{K8S_POD_NAME: "dummy", K8S_POD_NAMESPACE: "namespacedummy", K8S_POD_INFRA_CONTAINER_ID: "123456789"}
+
+		rt := CreateCNIRuntimeConf(args, k8sArgs, "net1", nil, &DelegateNetConf{IPRequest: "10.0.0.1/24"})
+		Expect(rt.Args).To(Equal([][2]string{
+			{"IgnoreUnknown", "1"},
+			{"K8S_POD_NAMESPACE", "namespacedummy"},
+			{"K8S_POD_NAME", "dummy"},
+			{"K8S_POD_INFRA_CONTAINER_ID", "123456789"},
+			{"K8S_POD_UID", "uid1"},
+			{"IP", "10.0.0.1/24"},
+		}))
+	})
+
 	It("can loadnetworkstatus", func() {
 		result := &types020.Result{
 			CNIVersion: "0.2.0",
@@ -435,6 +528,84 @@ var _ = Describe("config operations", func() {
 		Expect(err).NotTo(HaveOccurred())
 	})
 
+	It("loads the gateway, routes, fixed IP, VNI and device ID into the network status", func() {
+		gw := testhelpers.EnsureCIDR("10.1.0.1/24").IP
+		result := &current.Result{
+			CNIVersion: "0.3.1",
+			Interfaces: []*current.Interface{{Name: "net1", Mac: "c2:11:22:33:44:66", Sandbox: "/var/run/netns/test"}},
+			IPs: []*current.IPConfig{{
+				Version:   "4",
+				Interface: current.Int(0),
+				Address:   *testhelpers.EnsureCIDR("10.1.0.5/24"),
+				Gateway:   gw,
+			}},
+			Routes: []*cnitypes.Route{{Dst: *testhelpers.EnsureCIDR("10.2.0.0/16"), GW: gw}},
+		}
+
+		conf := `{
+    "cniVersion": "0.3.1",
+    "name": "sriov-vxlan",
+    "plugins": [{
+        "type": "sriov"
+    },{
+        "type": "multus-vxlan",
+        "vxlan": {"vxlanId": 100}
+    }]
+}`
+		delegate, err := LoadDelegateNetConf([]byte(conf), &NetworkSelectionElement{Name: "sriov-vxlan"}, "0000:00:00.1")
+		Expect(err).NotTo(HaveOccurred())
+		delegate.FixedIP = true
+
+		netStatus, err := LoadDelegateNetworkStatus(result, delegate)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(netStatus.Name).To(Equal("sriov-vxlan"))
+		Expect(netStatus.Interface).To(Equal("net1"))
+		Expect(netStatus.IPs).To(Equal([]string{"10.1.0.5"}))
+		Expect(netStatus.Gateway).To(Equal([]string{"10.1.0.1"}))
+		Expect(netStatus.Routes).To(Equal(result.Routes))
+		Expect(netStatus.FixedIP).To(BeTrue())
+		Expect(netStatus.VNI).To(Equal(100))
+		Expect(netStatus.DeviceID).To(Equal("0000:00:00.1"))
+
+		data, err := json.Marshal(netStatus)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(MatchJSON(`{
+    "name": "sriov-vxlan",
+    "interface": "net1",
+    "ips": ["10.1.0.5"],
+    "mac": "c2:11:22:33:44:66",
+    "dns": {},
+    "gateway": ["10.1.0.1"],
+    "routes": [{"dst": "10.2.0.0/16", "gw": "10.1.0.1"}],
+    "fixedIP": true,
+    "vni": 100,
+    "deviceID": "0000:00:00.1"
+}`))
+	})
+
+	It("keeps the network status of the former format without gateway, routes nor device", func() {
+		result := &types020.Result{
+			CNIVersion: "0.2.0",
+			IP4: &types020.IPConfig{
+				IP: *testhelpers.EnsureCIDR("1.1.1.2/24"),
+			},
+		}
+		delegate, err := LoadDelegateNetConf([]byte(`{"name": "weave1", "type": "weave-net"}`), nil, "")
+		Expect(err).NotTo(HaveOccurred())
+		delegate.MasterPlugin = true
+
+		netStatus, err := LoadDelegateNetworkStatus(result, delegate)
+		Expect(err).NotTo(HaveOccurred())
+		data, err := json.Marshal(netStatus)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(MatchJSON(`{
+    "name": "weave1",
+    "ips": ["1.1.1.2"],
+    "default": true,
+    "dns": {}
+}`))
+	})
+
 	It("cannot loadnetworkstatus given incompatible CNIVersion", func() {
 
 		result := &testhelpers.Result{
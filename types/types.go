@@ -16,6 +16,7 @@
 package types
 
 import (
+	"encoding/json"
 	"net"
 
 	"github.com/containernetworking/cni/pkg/types"
@@ -54,6 +55,9 @@ type NetConf struct {
 	SystemNamespaces []string `json:"systemNamespaces"`
 	// Option to set the namespace that multus-cni uses (clusterNetwork/defaultNetworks)
 	MultusNamespace string `json:"multusNamespace"`
+	// Option to limit how many delegates are added at the same time after
+	// the master plugin, 1 adds them one by one
+	MaxParallelDelegates int `json:"maxParallelDelegates"`
 }
 
 // RuntimeConfig specifies CNI RuntimeConfig
@@ -77,6 +81,13 @@ type NetworkStatus struct {
 	Mac       string    `json:"mac,omitempty"`
 	Default   bool      `json:"default,omitempty"`
 	DNS       types.DNS `json:"dns,omitempty"`
+	// the fields below are omitted if empty, the readers of the status
+	// above are not affected
+	Gateway  []string       `json:"gateway,omitempty"`
+	Routes   []*types.Route `json:"routes,omitempty"`
+	FixedIP  bool           `json:"fixedIP,omitempty"`
+	VNI      int            `json:"vni,omitempty"`
+	DeviceID string         `json:"deviceID,omitempty"`
 }
 
 // DelegateNetConf for net-attach-def for pod
@@ -86,6 +97,14 @@ type DelegateNetConf struct {
 	IfnameRequest string `json:"ifnameRequest,omitempty"`
 	MacRequest    string `json:"macRequest,omitempty"`
 	IPRequest     string `json:"ipRequest,omitempty"`
+	FixedIP       bool   `json:"fixedIP,omitempty"`
+	IPCount       int    `json:"ipCount,omitempty"`
+	IPPool        string `json:"ipPool,omitempty"`
+	// Result of the delegate on ADD, cached to be its prevResult on CHECK
+	Result json.RawMessage `json:"result,omitempty"`
+	// Network is the element of the networks annotation of the pod the
+	// delegate is for, nil for the default networks
+	Network *NetworkSelectionElement `json:"network,omitempty"`
 	// MasterPlugin is only used internal housekeeping
 	MasterPlugin bool `json:"-"`
 	// Conflist plugin is only used internal housekeeping
@@ -143,6 +162,15 @@ type NetworkSelectionElement struct {
 	// ObsoateInterfaceRequest is obsolated parameter at pre 3.2.
 	// This will be removed in 4.0 release.
 	ObsolatedInterfaceRequest string `json:"interfaceRequest,omitempty"`
+	// FixedIP requests the fixed address of the pod, it is kept for the
+	// pod when it is recreated, instead of an address of the node
+	FixedIP bool `json:"fixedIP,omitempty"`
+	// IPCount contains an optional number of addresses allocated from
+	// every range set of the network
+	IPCount int `json:"ipCount,omitempty"`
+	// IPPool contains the optional subnet of the network the addresses are
+	// allocated from
+	IPPool string `json:"ipPool,omitempty"`
 }
 
 // K8sArgs is the valid CNI_ARGS used for Kubernetes